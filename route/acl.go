@@ -89,6 +89,10 @@ const (
 	SQLCAdviseAckedQuery
 	// SQLCFetchBlock is used by sqlchain to fetch block from adjacent nodes
 	SQLCFetchBlock
+	// SQLCFetchBlockRange is used by sqlchain to fetch a range of blocks from adjacent nodes
+	SQLCFetchBlockRange
+	// SQLCFetchBlockHeader is used by sqlchain to fetch the header of a block from adjacent nodes
+	SQLCFetchBlockHeader
 	// SQLCSignBilling is used by sqlchain to response billing signature for periodic billing request
 	SQLCSignBilling
 	// SQLCLaunchBilling is used by blockproducer to trigger the billing process in sqlchain
@@ -162,6 +166,10 @@ func (s RemoteFunc) String() string {
 		return "SQLC.AdviseAckedQuery"
 	case SQLCFetchBlock:
 		return "SQLC.FetchBlock"
+	case SQLCFetchBlockRange:
+		return "SQLC.FetchBlockRange"
+	case SQLCFetchBlockHeader:
+		return "SQLC.FetchBlockHeader"
 	case SQLCSignBilling:
 		return "SQLC.SignBilling"
 	case SQLCLaunchBilling:
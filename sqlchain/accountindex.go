@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+// QueryRef is a reference to a query committed in a block of the chain.
+type QueryRef struct {
+	Height      int32
+	RequestHash hash.Hash
+	QueryType   types.QueryType
+	// Cost is the billed cost of the query: the row count for read queries, the affected rows
+	// for write queries, or the query number for failed requests.
+	Cost   uint64
+	Failed bool
+}
+
+// accountIndexKey returns the account index key of a query:
+// ['A', 'C', 'C', 'T', account, height, request hash]
+func accountIndexKey(addr proto.AccountAddress, height int32, reqHash *hash.Hash) []byte {
+	return utils.ConcatAll(metaAccountIndex[:], addr[:], heightToKey(height), reqHash[:])
+}
+
+// putAccountIndex indexes the queries of block b at height by their signee accounts within
+// transaction t.
+func (c *Chain) putAccountIndex(t *leveldb.Transaction, height int32, b *types.Block) (err error) {
+	var put = func(signee *asymmetric.PublicKey, ref *QueryRef) (err error) {
+		var (
+			addr  proto.AccountAddress
+			enc   *bytes.Buffer
+			value []byte
+		)
+		if addr, err = crypto.PubKeyHash(signee); err != nil {
+			return
+		}
+		if enc, err = utils.EncodeMsgPack(ref); err != nil {
+			return
+		}
+		if value, err = c.vc.seal(enc.Bytes()); err != nil {
+			return
+		}
+		if err = t.Put(accountIndexKey(addr, height, &ref.RequestHash), value, nil); err != nil {
+			err = errors.Wrap(err, "put account index")
+		}
+		return
+	}
+	for _, v := range b.QueryTxs {
+		var ref = &QueryRef{
+			Height:      height,
+			RequestHash: v.Request.Header.Hash(),
+			QueryType:   v.Request.Header.QueryType,
+		}
+		if ref.QueryType == types.ReadQuery {
+			ref.Cost = v.Response.RowCount
+		} else {
+			ref.Cost = uint64(v.Response.AffectedRows)
+		}
+		if err = put(v.Request.Header.Signee, ref); err != nil {
+			return
+		}
+	}
+	for _, v := range b.FailedReqs {
+		if err = put(v.Header.Signee, &QueryRef{
+			Height:      height,
+			RequestHash: v.Header.Hash(),
+			QueryType:   v.Header.QueryType,
+			Cost:        uint64(len(v.Payload.Queries)),
+			Failed:      true,
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// delAccountIndex removes the account index of the queries of block b at height within
+// transaction t, e.g., when the block is reverted.
+func (c *Chain) delAccountIndex(t *leveldb.Transaction, height int32, b *types.Block) (err error) {
+	var del = func(signee *asymmetric.PublicKey, reqHash hash.Hash) (err error) {
+		var addr proto.AccountAddress
+		if addr, err = crypto.PubKeyHash(signee); err != nil {
+			return
+		}
+		if err = t.Delete(accountIndexKey(addr, height, &reqHash), nil); err != nil {
+			err = errors.Wrap(err, "delete account index")
+		}
+		return
+	}
+	for _, v := range b.QueryTxs {
+		if err = del(v.Request.Header.Signee, v.Request.Header.Hash()); err != nil {
+			return
+		}
+	}
+	for _, v := range b.FailedReqs {
+		if err = del(v.Header.Signee, v.Header.Hash()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// AccountQueryHistory returns at most limit references to the most recent queries submitted by
+// account addr, from the newer to the older ones. The history is paginated by the continuation
+// token: pass nil to begin from the head, or the returned next token to continue. The returned
+// next token is nil once the history is exhausted.
+func (c *Chain) AccountQueryHistory(addr proto.AccountAddress, limit int, token []byte) (
+	refs []QueryRef, next []byte, err error,
+) {
+	if limit <= 0 {
+		err = errors.Errorf("invalid limit %d", limit)
+		return
+	}
+	var prefix = utils.ConcatAll(metaAccountIndex[:], addr[:])
+	if token != nil && !bytes.HasPrefix(token, prefix) {
+		err = errors.New("invalid continuation token")
+		return
+	}
+
+	var (
+		iter = c.bdb.NewIterator(util.BytesPrefix(prefix), nil)
+		ok   bool
+	)
+	defer iter.Release()
+	if token == nil {
+		ok = iter.Last()
+	} else if iter.Seek(token) {
+		ok = iter.Prev()
+	} else {
+		ok = iter.Last()
+	}
+	for ; ok && len(refs) < limit; ok = iter.Prev() {
+		var (
+			value []byte
+			ref   QueryRef
+		)
+		if value, err = c.vc.open(iter.Value()); err != nil {
+			return
+		}
+		if err = utils.DecodeMsgPack(value, &ref); err != nil {
+			return
+		}
+		refs = append(refs, ref)
+		next = append([]byte(nil), iter.Key()...)
+	}
+	if err = iter.Error(); err != nil {
+		err = errors.Wrap(err, "iterate account index")
+		return
+	}
+	if !ok {
+		next = nil
+	}
+	return
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestAccountQueryHistory(t *testing.T) {
+	Convey("Given a chain with queries from different accounts", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		other, err := newRandomNode()
+		So(err, ShouldBeNil)
+		cliAddr, err := crypto.PubKeyHash(cli.PublicKey)
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var expected []QueryRef
+		err = pushTestBlocks(chain, 5, func(i int) []*types.QueryAsTx {
+			tx1, err := createTestQueryTx(cli, other, types.ReadQuery, 0)
+			So(err, ShouldBeNil)
+			tx2, err := createTestQueryTx(other, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			expected = append([]QueryRef{{
+				Height:      chain.rt.getHead().Height + 1,
+				RequestHash: tx1.Request.Header.Hash(),
+				QueryType:   types.ReadQuery,
+				Cost:        tx1.Response.RowCount,
+			}}, expected...)
+			return []*types.QueryAsTx{tx1, tx2}
+		})
+		So(err, ShouldBeNil)
+		Convey("The recent queries of the account should be returned from the newer ones", func() {
+			refs, next, err := chain.AccountQueryHistory(cliAddr, 10, nil)
+			So(err, ShouldBeNil)
+			So(refs, ShouldResemble, expected)
+			So(next, ShouldBeNil)
+		})
+		Convey("The history should be paginated by the continuation token", func() {
+			var (
+				all   []QueryRef
+				token []byte
+			)
+			for page := 0; ; page++ {
+				So(page, ShouldBeLessThan, 5)
+				refs, next, err := chain.AccountQueryHistory(cliAddr, 2, token)
+				So(err, ShouldBeNil)
+				So(len(refs), ShouldBeLessThanOrEqualTo, 2)
+				all = append(all, refs...)
+				if next == nil {
+					break
+				}
+				token = next
+			}
+			So(all, ShouldResemble, expected)
+		})
+		Convey("The failed requests should be indexed", func() {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			var (
+				head = chain.rt.getHead()
+				ts   = chain.rt.getTimeFromHeight(head.Height + 1)
+			)
+			b, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+			So(err, ShouldBeNil)
+			b.FailedReqs = []*types.Request{tx.Request}
+			So(b.PackAndSignBlock(testPrivKey), ShouldBeNil)
+			So(chain.pushBlock(b), ShouldBeNil)
+			refs, _, err := chain.AccountQueryHistory(cliAddr, 1, nil)
+			So(err, ShouldBeNil)
+			So(refs, ShouldResemble, []QueryRef{{
+				Height:      head.Height + 1,
+				RequestHash: tx.Request.Header.Hash(),
+				QueryType:   types.WriteQuery,
+				Cost:        uint64(len(tx.Request.Payload.Queries)),
+				Failed:      true,
+			}})
+		})
+		Convey("The invalid arguments should be rejected", func() {
+			_, _, err := chain.AccountQueryHistory(cliAddr, 0, nil)
+			So(err, ShouldNotBeNil)
+			_, _, err = chain.AccountQueryHistory(
+				cliAddr, 1, accountIndexKey(proto.AccountAddress{}, 0, &hash.Hash{}))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// defaultAckBatchWindow is the default max time to buffer an ack before flushing it.
+const defaultAckBatchWindow = 10 * time.Millisecond
+
+// bufferedAck is an ack buffered for a batched flush, with its encoded tdb key and value.
+type bufferedAck struct {
+	ack        *types.SignedAckHeader
+	key, value []byte
+}
+
+// ackBatcher buffers the pushed acks and flushes them together once the batch is full or the
+// first buffered ack has waited for the batch window.
+type ackBatcher struct {
+	sync.Mutex
+	size    int
+	window  time.Duration
+	pending []*bufferedAck
+	timer   *time.Timer
+
+	// flushMutex serializes the flushes.
+	flushMutex sync.Mutex
+}
+
+// newAckBatcher returns a new ack batcher of size, or nil if batching is disabled.
+func newAckBatcher(size int, window time.Duration) *ackBatcher {
+	if size <= 1 {
+		return nil
+	}
+	if window <= 0 {
+		window = defaultAckBatchWindow
+	}
+	return &ackBatcher{size: size, window: window}
+}
+
+// add buffers ba, and reports whether the batch is full and should be flushed right away. The
+// flush function is scheduled after the batch window for the first buffered ack.
+func (b *ackBatcher) add(ba *bufferedAck, flush func()) (full bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.pending = append(b.pending, ba)
+	if len(b.pending) >= b.size {
+		return true
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, flush)
+	}
+	return
+}
+
+// take takes all the buffered acks.
+func (b *ackBatcher) take() (pending []*bufferedAck) {
+	b.Lock()
+	defer b.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	pending, b.pending = b.pending, nil
+	return
+}
+
+// FlushAcks flushes the buffered acks, if ack batching is enabled by Config.AckBatchSize. The acks
+// are registered in the ack index and written to the chain database in a single batch. An ack
+// which fails to be registered is dropped, and the first such error is returned after writing the
+// others.
+func (c *Chain) FlushAcks() (err error) {
+	var b = c.ackBatch
+	if b == nil {
+		return
+	}
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+	var pending = b.take()
+	if len(pending) == 0 {
+		return
+	}
+	var batch = new(leveldb.Batch)
+	for _, v := range pending {
+		if ierr := c.register(v.ack); ierr != nil {
+			if err == nil {
+				err = errors.Wrapf(ierr, "register ack %v", v.ack.Hash())
+			}
+			continue
+		}
+		batch.Put(v.key, v.value)
+	}
+	if ierr := c.tdb.Write(batch, c.rt.writeOptions); ierr != nil {
+		err = errors.Wrapf(ierr, "write %d acks", batch.Len())
+	}
+	return
+}
+
+// flushAcksInBackground flushes the buffered acks on the expiry of the batch window.
+func (c *Chain) flushAcksInBackground() {
+	if err := c.FlushAcks(); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Error("failed to flush acks")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestAckBatch(t *testing.T) {
+	Convey("Given a chain batching acks", t, func() {
+		const batchSize = 3
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		chain.ackBatch = newAckBatcher(batchSize, time.Hour)
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var (
+			acks      []*types.SignedAckHeader
+			countAcks = func() (count int) {
+				var iter = chain.tdb.NewIterator(util.BytesPrefix(metaAckIndex[:]), nil)
+				defer iter.Release()
+				for iter.Next() {
+					count++
+				}
+				So(iter.Error(), ShouldBeNil)
+				return
+			}
+			countRegistered = func() (count int) {
+				for _, v := range acks {
+					var mi, err = chain.ai.load(chain.rt.getHeightFromTime(v.GetRequestTimestamp()))
+					So(err, ShouldBeNil)
+					for _, ack := range mi.acks() {
+						if ack == v {
+							count++
+						}
+					}
+				}
+				return
+			}
+		)
+		for i := 0; i < 2*batchSize+1; i++ {
+			resp, err := createRandomQueryResponse(cli, cli)
+			So(err, ShouldBeNil)
+			So(chain.AddResponse(resp), ShouldBeNil)
+			ack, err := createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+			acks = append(acks, ack)
+		}
+		Convey("The full batches should be flushed right away", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(countAcks(), ShouldEqual, 2*batchSize)
+			So(countRegistered(), ShouldEqual, 2*batchSize)
+			So(chain.FlushAcks(), ShouldBeNil)
+			So(countAcks(), ShouldEqual, 2*batchSize+1)
+			So(countRegistered(), ShouldEqual, 2*batchSize+1)
+		})
+		Convey("The buffered acks should be flushed on stopping", func() {
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(countAcks(), ShouldEqual, 2*batchSize+1)
+		})
+		Convey("The buffered acks should be flushed after the batch window", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			chain.ackBatch.window = 10 * time.Millisecond
+			chain.ackBatch.take()
+			resp, err := createRandomQueryResponse(cli, cli)
+			So(err, ShouldBeNil)
+			So(chain.AddResponse(resp), ShouldBeNil)
+			ack, err := createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+			for i := 0; i < 100 && countAcks() < 2*batchSize+1; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(countAcks(), ShouldEqual, 2*batchSize+1)
+		})
+	})
+}
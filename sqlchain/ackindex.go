@@ -41,7 +41,7 @@ type multiAckIndex struct {
 	ackIndex map[types.QueryKey]*types.SignedAckHeader
 }
 
-func (i *multiAckIndex) addResponse(resp *types.SignedResponseHeader) (err error) {
+func (i *multiAckIndex) addResponse(resp *types.SignedResponseHeader, j *ackJournal) (err error) {
 	var key = resp.ResponseHeader.Request.GetQueryKey()
 	log.Debugf("adding key %s <-- resp %s", &key, resp.Hash())
 	i.Lock()
@@ -55,6 +55,12 @@ func (i *multiAckIndex) addResponse(resp *types.SignedResponseHeader) (err error
 	}
 	i.respIndex[key] = resp
 	atomic.AddInt32(&responseCount, 1)
+	j.record(func() {
+		i.Lock()
+		defer i.Unlock()
+		delete(i.respIndex, key)
+		atomic.AddInt32(&responseCount, -1)
+	})
 	return
 }
 
@@ -82,14 +88,20 @@ func (i *multiAckIndex) register(ack *types.SignedAckHeader) (err error) {
 	return
 }
 
-func (i *multiAckIndex) remove(ack *types.SignedAckHeader) (err error) {
+func (i *multiAckIndex) remove(ack *types.SignedAckHeader, j *ackJournal) (err error) {
 	var key = ack.GetQueryKey()
 	log.Debugf("removing key %s -x- ack %s", &key, ack.Hash())
 	i.Lock()
 	defer i.Unlock()
-	if _, ok := i.respIndex[key]; ok {
+	if oresp, ok := i.respIndex[key]; ok {
 		delete(i.respIndex, key)
 		atomic.AddInt32(&responseCount, -1)
+		j.record(func() {
+			i.Lock()
+			defer i.Unlock()
+			i.respIndex[key] = oresp
+			atomic.AddInt32(&responseCount, 1)
+		})
 		return
 	}
 	if oack, ok := i.ackIndex[key]; ok {
@@ -100,6 +112,12 @@ func (i *multiAckIndex) remove(ack *types.SignedAckHeader) (err error) {
 		}
 		delete(i.ackIndex, key)
 		atomic.AddInt32(&ackCount, -1)
+		j.record(func() {
+			i.Lock()
+			defer i.Unlock()
+			i.ackIndex[key] = oack
+			atomic.AddInt32(&ackCount, 1)
+		})
 		return
 	}
 	err = errors.Wrapf(ErrQueryNotFound, "remove key %s -x- ack %s", &key, ack.Hash())
@@ -198,12 +216,37 @@ func (i *ackIndex) advance(h int32) {
 	atomic.AddInt32(&multiIndexCount, int32(-len(dl)))
 }
 
+// replace replaces the indexed queries with the ones of other, which must not be used afterwards.
+// The barrier is kept, and the queries of other below it are dropped.
+func (i *ackIndex) replace(other *ackIndex) {
+	var dl []*multiAckIndex
+	i.Lock()
+	for _, v := range i.hi {
+		dl = append(dl, v)
+	}
+	i.hi = other.hi
+	for h, v := range i.hi {
+		if h < i.barrier {
+			dl = append(dl, v)
+			delete(i.hi, h)
+		}
+	}
+	i.Unlock()
+	for _, v := range dl {
+		v.RLock()
+		atomic.AddInt32(&responseCount, int32(-len(v.respIndex)))
+		atomic.AddInt32(&ackCount, int32(-len(v.ackIndex)))
+		v.RUnlock()
+	}
+	atomic.AddInt32(&multiIndexCount, int32(-len(dl)))
+}
+
 func (i *ackIndex) addResponse(h int32, resp *types.SignedResponseHeader) (err error) {
 	var mi *multiAckIndex
 	if mi, err = i.load(h); err != nil {
 		return
 	}
-	return mi.addResponse(resp)
+	return mi.addResponse(resp, nil)
 }
 
 func (i *ackIndex) register(h int32, ack *types.SignedAckHeader) (err error) {
@@ -219,7 +262,7 @@ func (i *ackIndex) remove(h int32, ack *types.SignedAckHeader) (err error) {
 	if mi, err = i.load(h); err != nil {
 		return
 	}
-	return mi.remove(ack)
+	return mi.remove(ack, nil)
 }
 
 func (i *ackIndex) acks(h int32) (ret []*types.SignedAckHeader) {
@@ -235,3 +278,44 @@ func (i *ackIndex) acks(h int32) (ret []*types.SignedAckHeader) {
 	}
 	return
 }
+
+// ackJournal records the changes applied to an ackIndex through it, so that they can be rolled
+// back as a whole. A nil journal records nothing.
+type ackJournal struct {
+	ai   *ackIndex
+	undo []func()
+}
+
+func (i *ackIndex) journal() *ackJournal {
+	return &ackJournal{ai: i}
+}
+
+func (j *ackJournal) record(fn func()) {
+	if j != nil {
+		j.undo = append(j.undo, fn)
+	}
+}
+
+func (j *ackJournal) addResponse(h int32, resp *types.SignedResponseHeader) (err error) {
+	var mi *multiAckIndex
+	if mi, err = j.ai.load(h); err != nil {
+		return
+	}
+	return mi.addResponse(resp, j)
+}
+
+func (j *ackJournal) remove(h int32, ack *types.SignedAckHeader) (err error) {
+	var mi *multiAckIndex
+	if mi, err = j.ai.load(h); err != nil {
+		return
+	}
+	return mi.remove(ack, j)
+}
+
+// rollback reverts the recorded changes in the reverse order.
+func (j *ackJournal) rollback() {
+	for k := len(j.undo) - 1; k >= 0; k-- {
+		j.undo[k]()
+	}
+	j.undo = nil
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// ackWALWriteOptions syncs every journal append, regardless of Config.SyncWrites.
+var ackWALWriteOptions = &opt.WriteOptions{Sync: true}
+
+// ackWALEntry is an entry of ackWAL.
+type ackWALEntry struct {
+	Ack          *types.SignedAckHeader
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// ackWAL is the append-only journal of the acks accepted by the chain but not yet embedded in
+// any pushed block. An accepted ack may be buffered by the ack batching before it reaches the ack
+// index and tdb, so the journal is the durable record to reconstruct the pending acks after a
+// crash. The entries are keyed by an increasing sequence number in tdb.
+type ackWAL struct {
+	sync.Mutex
+	db  *leveldb.DB
+	vc  *valueCipher
+	seq uint64
+	// keys maps the ack hashes to the keys of their entries.
+	keys map[hash.Hash][]byte
+}
+
+func newAckWAL(db *leveldb.DB, vc *valueCipher) *ackWAL {
+	return &ackWAL{
+		db:   db,
+		vc:   vc,
+		keys: make(map[hash.Hash][]byte),
+	}
+}
+
+func ackWALKey(seq uint64) []byte {
+	var k = make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return utils.ConcatAll(metaAckJournal[:], k)
+}
+
+// append durably records ack at the tail of the journal.
+func (w *ackWAL) append(ack *types.SignedAckHeader) (err error) {
+	var (
+		entry = &ackWALEntry{
+			Ack:          ack,
+			RequestTime:  ack.GetRequestTimestamp(),
+			ResponseTime: ack.GetResponseTimestamp(),
+		}
+		enc   *bytes.Buffer
+		value []byte
+	)
+	if enc, err = utils.EncodeMsgPack(entry); err != nil {
+		return
+	}
+	if value, err = w.vc.seal(enc.Bytes()); err != nil {
+		return
+	}
+	w.Lock()
+	defer w.Unlock()
+	var k = ackWALKey(w.seq)
+	if err = w.db.Put(k, value, ackWALWriteOptions); err != nil {
+		return errors.Wrapf(err, "journal ack %s", ack.Hash().String())
+	}
+	w.seq++
+	w.keys[ack.Hash()] = k
+	return
+}
+
+// truncate removes the entries of acks from the journal, the acks not journaled are ignored.
+func (w *ackWAL) truncate(acks []*types.SignedAckHeader) (err error) {
+	var (
+		batch = new(leveldb.Batch)
+		hs    []hash.Hash
+	)
+	w.Lock()
+	defer w.Unlock()
+	for _, v := range acks {
+		var h = v.Hash()
+		if k, ok := w.keys[h]; ok {
+			batch.Delete(k)
+			hs = append(hs, h)
+		}
+	}
+	if batch.Len() == 0 {
+		return
+	}
+	if err = w.db.Write(batch, nil); err != nil {
+		return errors.Wrapf(err, "truncate %d journaled acks", len(hs))
+	}
+	for _, h := range hs {
+		delete(w.keys, h)
+	}
+	return
+}
+
+// replay reads all the entries of the journal in the appending order, and continues appending
+// after the last one.
+func (w *ackWAL) replay() (entries []*ackWALEntry, err error) {
+	w.Lock()
+	defer w.Unlock()
+	var iter = w.db.NewIterator(util.BytesPrefix(metaAckJournal[:]), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var (
+			k     = append([]byte{}, iter.Key()...)
+			v     []byte
+			entry = &ackWALEntry{}
+		)
+		if v, err = w.vc.open(iter.Value()); err != nil {
+			return nil, errors.Wrapf(err, "load journaled ack %x", k)
+		}
+		if err = utils.DecodeMsgPack(v, entry); err != nil {
+			return nil, errors.Wrapf(err, "load journaled ack %x", k)
+		}
+		if entry.Ack == nil {
+			return nil, errors.Errorf("load journaled ack %x: missing ack", k)
+		}
+		w.keys[entry.Ack.Hash()] = k
+		w.seq = binary.BigEndian.Uint64(k[len(metaAckJournal):]) + 1
+		entries = append(entries, entry)
+	}
+	if err = iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "load journaled ack")
+	}
+	return
+}
+
+// replayAckWAL reads the acks journaled before the last stop or crash to restore the ack index,
+// and truncates the expired ones.
+func (c *Chain) replayAckWAL() (acks []*types.SignedAckHeader, err error) {
+	var entries []*ackWALEntry
+	if entries, err = c.aw.replay(); err != nil {
+		return
+	}
+	var (
+		minHeight = c.rt.getCurrentHeight() - c.rt.queryTTL
+		expired   []*types.SignedAckHeader
+	)
+	for _, v := range entries {
+		if c.rt.getHeightFromTime(v.RequestTime) < minHeight {
+			expired = append(expired, v.Ack)
+			continue
+		}
+		acks = append(acks, v.Ack)
+	}
+	if err = c.aw.truncate(expired); err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"pending": len(acks),
+		"expired": len(expired),
+		"db":      c.databaseID,
+	}).Debug("replayed ack journal")
+	return
+}
+
+// truncateAckWAL removes the acks embedded in block b from the journal. The failure is only
+// logged, the entries left are dropped once they expire.
+func (c *Chain) truncateAckWAL(b *types.Block) {
+	if err := c.aw.truncate(b.Acks); err != nil {
+		log.WithFields(log.Fields{
+			"block": b.BlockHash().String(),
+			"db":    c.databaseID,
+		}).WithError(err).Warning("failed to truncate ack journal")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestAckWAL(t *testing.T) {
+	Convey("Given a chain batching acks with a pending ack", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		chain.ackBatch = newAckBatcher(16, time.Hour)
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var (
+			countJournaled = func() (count int) {
+				var iter = chain.tdb.NewIterator(util.BytesPrefix(metaAckJournal[:]), nil)
+				defer iter.Release()
+				for iter.Next() {
+					count++
+				}
+				So(iter.Error(), ShouldBeNil)
+				return
+			}
+			pending = func(ack *types.SignedAckHeader) *types.SignedAckHeader {
+				mi, err := chain.ai.load(chain.rt.getHeightFromTime(ack.GetRequestTimestamp()))
+				So(err, ShouldBeNil)
+				mi.RLock()
+				defer mi.RUnlock()
+				return mi.ackIndex[ack.GetQueryKey()]
+			}
+			reopen = func() {
+				So(chain.Stop(), ShouldBeNil)
+				chain, err = NewChain(config)
+				So(err, ShouldBeNil)
+			}
+		)
+		resp, err := createRandomQueryResponse(cli, cli)
+		So(err, ShouldBeNil)
+		So(chain.AddResponse(resp), ShouldBeNil)
+		ack, err := createRandomQueryAckWithResponse(resp, cli)
+		So(err, ShouldBeNil)
+		So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+		So(countJournaled(), ShouldEqual, 1)
+		So(pending(ack), ShouldBeNil)
+		Convey("The ack lost from the buffer by a crash should be recovered on reopening", func() {
+			So(chain.ackBatch.take(), ShouldHaveLength, 1)
+			reopen()
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(pending(ack), ShouldResemble, ack)
+			So(countJournaled(), ShouldEqual, 1)
+			Convey("The journal should keep appending after the replayed entries", func() {
+				resp, err := createRandomQueryResponse(cli, cli)
+				So(err, ShouldBeNil)
+				So(chain.AddResponse(resp), ShouldBeNil)
+				ack, err := createRandomQueryAckWithResponse(resp, cli)
+				So(err, ShouldBeNil)
+				So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+				So(countJournaled(), ShouldEqual, 2)
+			})
+		})
+		Convey("The ack should be truncated from the journal once embedded in a block", func() {
+			So(chain.FlushAcks(), ShouldBeNil)
+			So(pending(ack), ShouldResemble, ack)
+			var head = chain.rt.getHead()
+			block, err := createTestBlock(
+				&head.Head, chain.rt.getServer(), chain.rt.getTimeFromHeight(head.Height+1), nil)
+			So(err, ShouldBeNil)
+			block.Acks = []*types.SignedAckHeader{ack}
+			So(block.PackAndSignBlock(testPrivKey), ShouldBeNil)
+			So(chain.pushBlock(block), ShouldBeNil)
+			So(countJournaled(), ShouldEqual, 0)
+			So(pending(ack), ShouldBeNil)
+			reopen()
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(pending(ack), ShouldBeNil)
+		})
+		Convey("The ack failing to be pushed should be truncated from the journal", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			chain.ackBatch = nil
+			resp, err := createRandomQueryResponse(cli, cli)
+			So(err, ShouldBeNil)
+			ack, err := createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			err = chain.VerifyAndPushAckedQuery(ack)
+			So(errors.Cause(err), ShouldEqual, ErrQueryNotFound)
+			So(countJournaled(), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	// archiveBlockCacheCapacity is the leveldb block cache capacity of the block store of an
+	// archive node, which serves large historical block ranges to the bootstrapping peers.
+	archiveBlockCacheCapacity = 64 * opt.MiB
+)
+
+// StoreCompression is the compression of the chain databases.
+type StoreCompression int
+
+const (
+	// SnappyStoreCompression compresses the database tables with snappy, which is the default.
+	SnappyStoreCompression StoreCompression = iota
+	// NoStoreCompression stores the database tables uncompressed.
+	NoStoreCompression
+)
+
+// storeOptions returns the leveldb options to open the chain databases with the config c.
+func storeOptions(c *Config) *opt.Options {
+	if c.StoreCompression == SnappyStoreCompression &&
+		c.StoreBlockCacheCapacity <= 0 && c.StoreWriteBuffer <= 0 {
+		return &leveldbConf
+	}
+	var o = leveldbConf
+	if c.StoreCompression == NoStoreCompression {
+		o.Compression = opt.NoCompression
+	}
+	if c.StoreBlockCacheCapacity > 0 {
+		o.BlockCacheCapacity = c.StoreBlockCacheCapacity
+	}
+	if c.StoreWriteBuffer > 0 {
+		o.WriteBuffer = c.StoreWriteBuffer
+	}
+	return &o
+}
+
+// blockStoreOptions returns the leveldb options to open the block store with the config c.
+func blockStoreOptions(c *Config) *opt.Options {
+	if !c.ArchiveMode {
+		return storeOptions(c)
+	}
+	var o = *storeOptions(c)
+	if o.BlockCacheCapacity < archiveBlockCacheCapacity {
+		o.BlockCacheCapacity = archiveBlockCacheCapacity
+	}
+	return &o
+}
+
+// storeCompression returns the compression of the chain databases.
+func (r *runtime) storeCompression() StoreCompression {
+	if r.storeOptions.Compression == opt.NoCompression {
+		return NoStoreCompression
+	}
+	return SnappyStoreCompression
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestArchiveMode(t *testing.T) {
+	Convey("Given a chain in archive mode", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.archive = true
+		chain.rt.ackRetention = 1
+		err = pushTestBlocks(chain, int(chain.getBlockCacheTTL())+2, nil)
+		So(err, ShouldBeNil)
+		Convey("No block should be dropped from the block cache", func() {
+			chain.pruneBlockCache()
+			for n := chain.rt.getHead().node; n != nil; n = n.parent {
+				So(n.block, ShouldNotBeNil)
+			}
+		})
+		Convey("Acks should be retained forever", func() {
+			So(chain.ackRetentionHorizon(), ShouldEqual, -1)
+			So(chain.EffectiveConfig().ArchiveMode, ShouldBeTrue)
+		})
+		Convey("The block store should be tuned for historical reads", func() {
+			var o = blockStoreOptions(&Config{ArchiveMode: true})
+			So(o.BlockCacheCapacity, ShouldEqual, archiveBlockCacheCapacity)
+			So(blockStoreOptions(&Config{}), ShouldEqual, &leveldbConf)
+		})
+	})
+}
+
+func TestStoreOptions(t *testing.T) {
+	Convey("Given two chains reopened with different store options", t, func() {
+		var open = func(name string, apply func(c *Config)) *Chain {
+			chain, config, err := createTestChain(name, time.Now())
+			So(err, ShouldBeNil)
+			So(chain.Stop(), ShouldBeNil)
+			apply(config)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			return chain
+		}
+		var (
+			snappy = open(t.Name()+"-snappy", func(c *Config) {
+				c.StoreBlockCacheCapacity = 16 * opt.MiB
+			})
+			plain = open(t.Name()+"-plain", func(c *Config) {
+				c.StoreCompression = NoStoreCompression
+				c.StoreWriteBuffer = 8 * opt.MiB
+			})
+		)
+		defer func() { So(snappy.Stop(), ShouldBeNil) }()
+		defer func() { So(plain.Stop(), ShouldBeNil) }()
+		Convey("Each chain should report its own options", func() {
+			var sv, pv = snappy.EffectiveConfig(), plain.EffectiveConfig()
+			So(sv.StoreCompression, ShouldEqual, SnappyStoreCompression)
+			So(sv.StoreBlockCacheCapacity, ShouldEqual, 16*opt.MiB)
+			So(sv.StoreWriteBuffer, ShouldEqual, 0)
+			So(pv.StoreCompression, ShouldEqual, NoStoreCompression)
+			So(pv.StoreBlockCacheCapacity, ShouldEqual, 0)
+			So(pv.StoreWriteBuffer, ShouldEqual, 8*opt.MiB)
+			So(storeOptions(&Config{}), ShouldEqual, &leveldbConf)
+		})
+		Convey("Each database should be compressed by its own options", func() {
+			var (
+				value   = bytes.Repeat([]byte{'x'}, 4*opt.MiB)
+				measure = func(c *Chain) (size int64) {
+					So(c.tdb.Put([]byte("large"), value, nil), ShouldBeNil)
+					So(c.tdb.CompactRange(util.Range{}), ShouldBeNil)
+					var err error
+					size, err = leveldbSize(c.tdb)
+					So(err, ShouldBeNil)
+					return
+				}
+			)
+			So(measure(plain), ShouldBeGreaterThan, 4*measure(snappy))
+		})
+	})
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+const (
+	// backupBlockStateFile and backupAckReqRespFile are the names of the chain databases in a
+	// backup directory, and the suffixes of them to the chain file prefix.
+	backupBlockStateFile = "block-state.ldb"
+	backupAckReqRespFile = "ack-req-resp.ldb"
+	// backupSnapshotRetries is the max attempts to take the database snapshots consistent with
+	// the chain head, which may be pushed concurrently.
+	backupSnapshotRetries = 10
+	// backupBatchSize is the number of records per write batch when copying a database.
+	backupBatchSize = 1024
+)
+
+// iterable is a leveldb database or snapshot.
+type iterable interface {
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// copyStore copies all the records from src to a new leveldb database at file.
+func copyStore(file string, src iterable) (err error) {
+	var db *leveldb.DB
+	if db, err = leveldb.OpenFile(file, &leveldbConf); err != nil {
+		return errors.Wrapf(err, "open leveldb %s", file)
+	}
+	defer func() {
+		if ierr := db.Close(); ierr != nil && err == nil {
+			err = ierr
+		}
+	}()
+	var (
+		iter  = src.NewIterator(nil, nil)
+		batch = new(leveldb.Batch)
+	)
+	defer iter.Release()
+	for iter.Next() {
+		batch.Put(iter.Key(), iter.Value())
+		if batch.Len() >= backupBatchSize {
+			if err = db.Write(batch, nil); err != nil {
+				return errors.Wrapf(err, "write leveldb %s", file)
+			}
+			batch.Reset()
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return errors.Wrap(err, "iterate source records")
+	}
+	if err = db.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return errors.Wrapf(err, "write leveldb %s", file)
+	}
+	return
+}
+
+// snapshotStores takes the snapshots of bdb and tdb, where the persisted state of the bdb
+// snapshot matches the in-memory head at the time. The snapshots are retaken if a block is pushed
+// in the meantime.
+func (c *Chain) snapshotStores() (bsnap, tsnap *leveldb.Snapshot, st *state, err error) {
+	for i := 0; i < backupSnapshotRetries; i++ {
+		var head = c.rt.getHead()
+		if bsnap, err = c.bdb.GetSnapshot(); err != nil {
+			err = errors.Wrap(err, "snapshot bdb")
+			return
+		}
+		if tsnap, err = c.tdb.GetSnapshot(); err != nil {
+			bsnap.Release()
+			err = errors.Wrap(err, "snapshot tdb")
+			return
+		}
+		var enc []byte
+		if enc, err = bsnap.Get(metaState[:], nil); err == nil {
+			st = &state{}
+			err = utils.DecodeMsgPack(enc, st)
+		}
+		if err != nil {
+			bsnap.Release()
+			tsnap.Release()
+			err = errors.Wrapf(err, "get %s", string(metaState[:]))
+			return
+		}
+		if st.Head == head.Head && c.rt.getHead().Head == head.Head {
+			return
+		}
+		bsnap.Release()
+		tsnap.Release()
+	}
+	err = errors.Errorf("chain head keeps moving after %d snapshot attempts", backupSnapshotRetries)
+	return
+}
+
+// Backup writes a consistent backup of the block-state and ack-req-resp databases of the running
+// chain to dir, which must not exist yet. The databases are read from leveldb snapshots taken at
+// the same head, so the block producing is only blocked by the snapshotting, not the copying. The
+// backup is written aside and renamed to dir once completed.
+//
+// The state storage at Config.DataFile is not included. A state ahead of the restored chain is
+// continued from at load time, see Chain.recoverState.
+func (c *Chain) Backup(dir string) (err error) {
+	dir = filepath.Clean(dir)
+	if _, err = os.Stat(dir); err == nil {
+		return errors.Wrapf(os.ErrExist, "backup %s", dir)
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	var (
+		bsnap, tsnap *leveldb.Snapshot
+		st           *state
+		tmp          string
+	)
+	if bsnap, tsnap, st, err = c.snapshotStores(); err != nil {
+		return
+	}
+	defer bsnap.Release()
+	defer tsnap.Release()
+	if tmp, err = ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+".tmp-"); err != nil {
+		return errors.Wrap(err, "create backup dir")
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmp)
+		}
+	}()
+	if err = copyStore(filepath.Join(tmp, backupBlockStateFile), bsnap); err != nil {
+		return
+	}
+	if err = copyStore(filepath.Join(tmp, backupAckReqRespFile), tsnap); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		return errors.Wrapf(err, "rename backup dir to %s", dir)
+	}
+	log.WithFields(log.Fields{
+		"dir":    dir,
+		"head":   st.Head.String(),
+		"height": st.Height,
+		"db":     c.databaseID,
+	}).Info("chain backed up")
+	return
+}
+
+// RestoreChain restores the chain databases with prefix from the backup at backupDir, written by
+// Chain.Backup. It must be called before the chain is opened by NewChain or LoadChain. The
+// existing databases are replaced only after both of them are copied successfully.
+func RestoreChain(prefix, backupDir string) (err error) {
+	var names = []string{backupBlockStateFile, backupAckReqRespFile}
+	for _, name := range names {
+		var (
+			src = filepath.Join(backupDir, name)
+			tmp = prefix + "-" + name + ".restore"
+			db  *leveldb.DB
+			o   = leveldbConf
+		)
+		o.ReadOnly, o.ErrorIfMissing = true, true
+		if db, err = leveldb.OpenFile(src, &o); err != nil {
+			return errors.Wrapf(err, "open backup leveldb %s", src)
+		}
+		if err = os.RemoveAll(tmp); err == nil {
+			err = copyStore(tmp, db)
+		}
+		db.Close()
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range names {
+		var dst = prefix + "-" + name
+		if err = os.RemoveAll(dst); err != nil {
+			return
+		}
+		if err = os.Rename(dst+".restore", dst); err != nil {
+			return errors.Wrapf(err, "rename restored leveldb to %s", dst)
+		}
+	}
+	return
+}
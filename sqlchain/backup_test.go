@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+func TestBackup(t *testing.T) {
+	Convey("Given a running chain producing blocks", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		chain.rt.schedulingMode = CountDrivenScheduling
+		// Accept the billings of the running chain without a main chain
+		chain.currentBP = func() (proto.NodeID, error) { return "", nil }
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, req, resp interface{},
+		) error {
+			return nil
+		}}
+		So(chain.Start(), ShouldBeNil)
+		var (
+			dir      = config.ChainFilePrefix + "-backup"
+			deadline = time.Now().Add(10 * time.Second)
+			waitFor  = func(height int32) {
+				for chain.rt.getHead().Height < height && time.Now().Before(deadline) {
+					time.Sleep(testTick)
+				}
+				So(chain.rt.getHead().Height, ShouldBeGreaterThanOrEqualTo, height)
+			}
+		)
+		waitFor(3)
+		Convey("The chain should be restored to the head of the backup", func() {
+			So(chain.Backup(dir), ShouldBeNil)
+			So(errors.Cause(chain.Backup(dir)), ShouldEqual, os.ErrExist)
+			db, err := leveldb.OpenFile(filepath.Join(dir, backupBlockStateFile), nil)
+			So(err, ShouldBeNil)
+			enc, err := db.Get(metaState[:], nil)
+			So(err, ShouldBeNil)
+			So(db.Close(), ShouldBeNil)
+			var backup = &state{}
+			So(utils.DecodeMsgPack(enc, backup), ShouldBeNil)
+			So(backup.Height, ShouldBeGreaterThanOrEqualTo, 3)
+			waitFor(backup.Height + 3)
+			So(chain.Stop(), ShouldBeNil)
+			So(RestoreChain(config.ChainFilePrefix, dir), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.rt.getHead().Head, ShouldResemble, backup.Head)
+			So(chain.rt.getHead().Height, ShouldEqual, backup.Height)
+		})
+	})
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// billingEventBuffer is the number of pending billing events buffered for each subscriber.
+const billingEventBuffer = 16
+
+// BillingHandler handles a billing computed from the billing period ending at block count.
+type BillingHandler func(ub *types.UpdateBilling, count int32)
+
+type billingEvent struct {
+	ub    *types.UpdateBilling
+	count int32
+}
+
+// billingSubscriber delivers billing events to a handler in its own goroutine.
+type billingSubscriber struct {
+	fn     BillingHandler
+	events chan billingEvent
+}
+
+func (s *billingSubscriber) run(ctx context.Context, dbID proto.DatabaseID) {
+	for {
+		select {
+		case ev := <-s.events:
+			s.call(ev, dbID)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *billingSubscriber) call(ev billingEvent, dbID proto.DatabaseID) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"db":    dbID,
+				"count": ev.count,
+				"panic": r,
+			}).Error("billing handler panicked")
+		}
+	}()
+	s.fn(ev.ub, ev.count)
+}
+
+// billingSubscribers is the set of billing event subscribers of a chain.
+type billingSubscribers struct {
+	sync.Mutex
+	subs []*billingSubscriber
+}
+
+// OnBilling subscribes fn to the billings computed by the chain. fn is called with each
+// UpdateBilling transaction once it's computed and before it's submitted to the main chain, so it
+// may be called for a billing which fails to be submitted. The transaction is shared by all the
+// subscribers and must not be modified.
+//
+// Each subscriber is called in its own goroutine in the order of the billings, and a panicking
+// call is recovered and logged. The events are dropped with warnings if a subscriber falls behind
+// by more than a few billings, so that block processing is never stalled.
+func (c *Chain) OnBilling(fn BillingHandler) {
+	var sub = &billingSubscriber{
+		fn:     fn,
+		events: make(chan billingEvent, billingEventBuffer),
+	}
+	c.billingSubs.Lock()
+	c.billingSubs.subs = append(c.billingSubs.subs, sub)
+	c.billingSubs.Unlock()
+	go sub.run(c.rt.ctx, c.databaseID)
+}
+
+// publishBilling publishes a copy of ub computed from the billing period ending at count to the
+// subscribers without blocking.
+func (c *Chain) publishBilling(ub *types.UpdateBilling, count int32) {
+	c.billingSubs.Lock()
+	defer c.billingSubs.Unlock()
+	if len(c.billingSubs.subs) == 0 {
+		return
+	}
+	var cp = *ub
+	for i, sub := range c.billingSubs.subs {
+		select {
+		case sub.events <- billingEvent{ub: &cp, count: count}:
+		default:
+			log.WithFields(log.Fields{
+				"db":         c.databaseID,
+				"count":      count,
+				"subscriber": i,
+			}).Warning("billing event dropped: subscriber falls behind")
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestOnBilling(t *testing.T) {
+	Convey("Given a chain with billing subscribers", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, uint64(i))
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead().node
+		ub, err := chain.billing(head)
+		So(err, ShouldBeNil)
+		var (
+			received = make(chan billingEvent, 100)
+			panicked int32
+			blocked  = make(chan struct{})
+		)
+		defer close(blocked)
+		chain.OnBilling(func(ub *types.UpdateBilling, count int32) {
+			atomic.AddInt32(&panicked, 1)
+			panic("bad subscriber")
+		})
+		chain.OnBilling(func(ub *types.UpdateBilling, count int32) { <-blocked })
+		chain.OnBilling(func(ub *types.UpdateBilling, count int32) {
+			received <- billingEvent{ub: ub, count: count}
+		})
+		Convey("Every subscriber should receive the billings in order", func() {
+			for i := int32(0); i < 3; i++ {
+				chain.publishBilling(ub, head.count+i)
+			}
+			for i := int32(0); i < 3; i++ {
+				select {
+				case ev := <-received:
+					So(ev.count, ShouldEqual, head.count+i)
+					So(ev.ub.Users, ShouldResemble, ub.Users)
+				case <-time.After(time.Second):
+					So("billing event not received", ShouldBeEmpty)
+				}
+			}
+			for atomic.LoadInt32(&panicked) < 3 {
+				time.Sleep(time.Millisecond)
+			}
+		})
+		Convey("A stalled subscriber should not block publishing", func() {
+			var done = make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 2*billingEventBuffer; i++ {
+					chain.publishBilling(ub, head.count)
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				So("publishing blocked", ShouldBeEmpty)
+			}
+		})
+	})
+}
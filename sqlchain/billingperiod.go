@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// billingPeriod is a billing update period in effect since the block count base, i.e., the
+// billing periods end at the counts base+period, base+2*period, and so on.
+type billingPeriod struct {
+	base   int32
+	period uint64
+}
+
+// periodRecord is the persisted form of a billingPeriod.
+type periodRecord struct {
+	Base   int32
+	Period uint64
+}
+
+// periodSchedule is the persisted billing period schedule set by SetUpdatePeriod: the past
+// periods, the period in effect and the pending one if any.
+type periodSchedule struct {
+	Past    []periodRecord
+	Current periodRecord
+	Pending *periodRecord
+}
+
+// periodAt returns the billing period in effect for the block at count. The count ending the
+// last period of a billing period change belongs to the former period.
+func (c *Chain) periodAt(count int32) billingPeriod {
+	c.billingMutex.RLock()
+	defer c.billingMutex.RUnlock()
+	if count > c.billingBase || len(c.pastPeriods) == 0 {
+		return billingPeriod{base: c.billingBase, period: c.updatePeriod}
+	}
+	for i := len(c.pastPeriods) - 1; i > 0; i-- {
+		if count > c.pastPeriods[i].base {
+			return c.pastPeriods[i]
+		}
+	}
+	return c.pastPeriods[0]
+}
+
+// lastBillingBoundary returns the count ending the last billing period completed at count, the
+// blocks after it are not settled yet. It returns the base count if billing is disabled.
+func (c *Chain) lastBillingBoundary(count int32) int32 {
+	var p = c.periodAt(count)
+	if p.period == 0 || count <= p.base {
+		return p.base
+	}
+	return count - int32(uint64(count-p.base)%p.period)
+}
+
+// isBillingBoundary reports whether a billing period ends at count.
+func (c *Chain) isBillingBoundary(count int32) bool {
+	var p = c.periodAt(count)
+	return p.period > 0 && count > p.base && uint64(count-p.base)%p.period == 0
+}
+
+// getUpdatePeriod returns the billing update period in effect, and the one set by
+// SetUpdatePeriod to take effect later if any.
+func (c *Chain) getUpdatePeriod() (period uint64, pending *billingPeriod) {
+	c.billingMutex.RLock()
+	defer c.billingMutex.RUnlock()
+	return c.updatePeriod, c.pendingPeriod
+}
+
+// SetUpdatePeriod updates the billing update period in blocks at runtime, 0 to disable billing.
+// The new period takes effect from the next billing boundary, so that the current billing period
+// is completed with the former period and no block is billed twice or skipped. If billing is
+// disabled, it's enabled for the blocks after the current head. The period must be no greater
+// than the block cache ttl, or ErrInvalidUpdatePeriod will be returned.
+//
+// The change is persisted with the chain, and the billing periods are resumed with it after a
+// restart, in place of Config.UpdatePeriod.
+func (c *Chain) SetUpdatePeriod(period uint64) (err error) {
+	if ttl := c.getBlockCacheTTL(); period > uint64(ttl) {
+		return errors.Wrapf(ErrInvalidUpdatePeriod, "period %d, block cache ttl %d", period, ttl)
+	}
+	var (
+		count = c.rt.getHead().node.count
+		from  = c.lastBillingBoundary(count)
+	)
+	c.billingMutex.Lock()
+	defer c.billingMutex.Unlock()
+	if c.updatePeriod == 0 {
+		from = count
+	} else if from < count {
+		from += int32(c.updatePeriod)
+	}
+	var pending = &billingPeriod{base: from, period: period}
+	if err = c.putPeriodSchedule(pending); err != nil {
+		return
+	}
+	c.pendingPeriod = pending
+	log.WithFields(log.Fields{
+		"period":  c.updatePeriod,
+		"pending": period,
+		"from":    from,
+		"db":      c.databaseID,
+	}).Info("scheduled billing update period change")
+	return
+}
+
+// applyPendingPeriod switches to the billing period set by SetUpdatePeriod once the billings are
+// triggered up to its base count. It's only called by the block processing goroutine.
+func (c *Chain) applyPendingPeriod() {
+	c.billingMutex.Lock()
+	defer c.billingMutex.Unlock()
+	var p = c.pendingPeriod
+	if p == nil {
+		return
+	}
+	if c.updatePeriod == 0 && c.billedCount < p.base {
+		// Nothing to complete, start billing after the base count
+		c.billedCount = p.base
+	}
+	if c.billedCount < p.base {
+		return
+	}
+	c.pastPeriods = append(c.pastPeriods, billingPeriod{base: c.billingBase, period: c.updatePeriod})
+	c.billingBase, c.updatePeriod, c.pendingPeriod = c.billedCount, p.period, nil
+	log.WithFields(log.Fields{
+		"period": c.updatePeriod,
+		"base":   c.billingBase,
+		"db":     c.databaseID,
+	}).Info("changed billing update period")
+}
+
+// putPeriodSchedule persists the billing periods with pending as the pending one into bdb. The
+// caller must hold billingMutex.
+func (c *Chain) putPeriodSchedule(pending *billingPeriod) (err error) {
+	var (
+		ps = &periodSchedule{
+			Current: periodRecord{Base: c.billingBase, Period: c.updatePeriod},
+			Pending: &periodRecord{Base: pending.base, Period: pending.period},
+		}
+		enc *bytes.Buffer
+	)
+	for _, v := range c.pastPeriods {
+		ps.Past = append(ps.Past, periodRecord{Base: v.base, Period: v.period})
+	}
+	if enc, err = utils.EncodeMsgPack(ps); err != nil {
+		return
+	}
+	if err = c.bdb.Put(metaUpdatePeriod[:], enc.Bytes(), c.rt.writeOptions); err != nil {
+		err = errors.Wrapf(err, "put %s", string(metaUpdatePeriod[:]))
+	}
+	return
+}
+
+// loadPeriodSchedule restores the billing periods persisted by SetUpdatePeriod, if any, and
+// resumes the billings after the last billing boundary at the head count. The pending period is
+// applied from its base count if the head has reached it, as it's applied at runtime.
+func (c *Chain) loadPeriodSchedule(count int32) (err error) {
+	var enc []byte
+	if enc, err = c.bdb.Get(metaUpdatePeriod[:], nil); err == leveldb.ErrNotFound {
+		err = nil
+	} else if err != nil {
+		return errors.Wrapf(err, "get %s", string(metaUpdatePeriod[:]))
+	} else {
+		var ps = &periodSchedule{}
+		if err = utils.DecodeMsgPack(enc, ps); err != nil {
+			return errors.Wrapf(err, "decode %s", string(metaUpdatePeriod[:]))
+		}
+		c.billingMutex.Lock()
+		c.pastPeriods = nil
+		for _, v := range ps.Past {
+			c.pastPeriods = append(c.pastPeriods, billingPeriod{base: v.Base, period: v.Period})
+		}
+		c.billingBase, c.updatePeriod = ps.Current.Base, ps.Current.Period
+		c.pendingPeriod = nil
+		if p := ps.Pending; p != nil && count >= p.Base {
+			c.pastPeriods = append(c.pastPeriods,
+				billingPeriod{base: c.billingBase, period: c.updatePeriod})
+			c.billingBase, c.updatePeriod = p.Base, p.Period
+		} else if p != nil {
+			c.pendingPeriod = &billingPeriod{base: p.Base, period: p.Period}
+		}
+		c.billingMutex.Unlock()
+	}
+	if period, _ := c.getUpdatePeriod(); period > 0 {
+		// Resume the billing periods aligned to the loaded head
+		c.billedCount = c.lastBillingBoundary(count)
+	}
+	return
+}
+
+// SetGasPrice updates the gas price of the chain at runtime.
+func (c *Chain) SetGasPrice(price uint64) {
+	c.billingMutex.Lock()
+	defer c.billingMutex.Unlock()
+	c.gasPrice = price
+}
+
+func (c *Chain) getGasPrice() uint64 {
+	c.billingMutex.RLock()
+	defer c.billingMutex.RUnlock()
+	return c.gasPrice
+}
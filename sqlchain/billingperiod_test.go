@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestSetUpdatePeriod(t *testing.T) {
+	Convey("Given a chain billing every 4 blocks", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-time.Hour))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain.updatePeriod = 4
+		var push = func(n int) (counts []int32) {
+			err := pushTestBlocks(chain, n, func(i int) []*types.QueryAsTx {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+				So(err, ShouldBeNil)
+				return []*types.QueryAsTx{tx}
+			})
+			So(err, ShouldBeNil)
+			for _, v := range chain.dueBillings(chain.rt.getHead().node) {
+				counts = append(counts, v.count)
+			}
+			return
+		}
+		var checkBilling = func(count, from int32) {
+			var node = chain.rt.getHead().node.ancestorByCount(count)
+			ub, err := chain.billing(node)
+			So(err, ShouldBeNil)
+			preview, err := chain.PreviewBilling(from, count)
+			So(err, ShouldBeNil)
+			So(ub.Receiver, ShouldResemble, preview.Receiver)
+			So(ub.Users, ShouldResemble, preview.Users)
+		}
+		So(push(6), ShouldResemble, []int32{4})
+		Convey("The new period should take effect from the next billing boundary", func() {
+			So(chain.SetUpdatePeriod(3), ShouldBeNil)
+			So(push(1), ShouldBeEmpty)
+			So(chain.Stats().UpdatePeriod, ShouldEqual, 4)
+			So(push(1), ShouldResemble, []int32{8})
+			So(chain.Stats().UpdatePeriod, ShouldEqual, 3)
+			So(chain.EffectiveConfig().UpdatePeriod, ShouldEqual, 3)
+			So(push(6), ShouldResemble, []int32{11, 14})
+			Convey("Each block should be billed exactly once across the change", func() {
+				checkBilling(4, 1)
+				checkBilling(8, 5)
+				checkBilling(11, 9)
+				checkBilling(14, 12)
+				for _, v := range []int32{4, 8, 11, 14} {
+					So(chain.isBillingBoundary(v), ShouldBeTrue)
+				}
+				for _, v := range []int32{3, 6, 9, 12} {
+					So(chain.isBillingBoundary(v), ShouldBeFalse)
+				}
+				_, _, err = chain.VerifyBillingConservation(0, 14)
+				So(err, ShouldBeNil)
+			})
+			Convey("The blocks after the last boundary should be pending", func() {
+				So(push(2), ShouldBeEmpty)
+				pending, err := chain.PendingBilling()
+				So(err, ShouldBeNil)
+				preview, err := chain.PreviewBilling(15, 16)
+				So(err, ShouldBeNil)
+				So(preview.Users, ShouldHaveLength, 1)
+				So(pending[preview.Users[0].User], ShouldEqual, preview.Users[0].Cost)
+			})
+			Convey("The changed period should be resumed after a restart", func() {
+				So(chain.Stop(), ShouldBeNil)
+				chain, err = NewChain(config)
+				So(err, ShouldBeNil)
+				So(chain.Stats().UpdatePeriod, ShouldEqual, 3)
+				for _, v := range []int32{4, 8, 11, 14} {
+					So(chain.isBillingBoundary(v), ShouldBeTrue)
+				}
+				So(push(2), ShouldBeEmpty)
+				So(push(1), ShouldResemble, []int32{17})
+			})
+		})
+		Convey("The pending period should be applied from its base after a restart", func() {
+			So(chain.SetUpdatePeriod(3), ShouldBeNil)
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			So(chain.Stats().UpdatePeriod, ShouldEqual, 4)
+			So(push(2), ShouldResemble, []int32{8})
+			So(chain.Stats().UpdatePeriod, ShouldEqual, 3)
+			So(push(3), ShouldResemble, []int32{11})
+		})
+		Convey("The billing should restart after the head if it was disabled", func() {
+			So(chain.SetUpdatePeriod(0), ShouldBeNil)
+			So(push(2), ShouldResemble, []int32{8})
+			So(push(3), ShouldBeEmpty)
+			So(chain.Stats().UpdatePeriod, ShouldEqual, 0)
+			So(chain.SetUpdatePeriod(2), ShouldBeNil)
+			So(push(2), ShouldResemble, []int32{13})
+			checkBilling(13, 12)
+		})
+		Convey("The period exceeding the block cache ttl should be rejected", func() {
+			var ttl = chain.getBlockCacheTTL()
+			err = chain.SetUpdatePeriod(uint64(ttl) + 1)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidUpdatePeriod)
+			So(push(2), ShouldResemble, []int32{8})
+		})
+		Convey("The gas price should be updated at runtime", func() {
+			chain.SetGasPrice(7)
+			So(chain.Stats().GasPrice, ShouldEqual, 7)
+			So(chain.EffectiveConfig().GasPrice, ShouldEqual, 7)
+		})
+	})
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// queuedBilling is a computed UpdateBilling transaction waiting to be submitted to the main
+// chain. The transaction is stored unsigned, since it's signed with a fresh nonce on each attempt.
+type queuedBilling struct {
+	Count  int32
+	Chunk  int32
+	Chunks int32
+	Tx     *types.UpdateBilling
+}
+
+// billingQueueKey returns the key of the chunk of the billing period ending at count, the keys
+// are ordered by count first and then by chunk.
+func billingQueueKey(count, chunk int32) (key []byte) {
+	key = make([]byte, len(metaBillingQueue)+8)
+	copy(key, metaBillingQueue[:])
+	binary.BigEndian.PutUint32(key[4:], uint32(count))
+	binary.BigEndian.PutUint32(key[8:], uint32(chunk))
+	return
+}
+
+// enqueueBillings persists the UpdateBilling transactions of the billing period ending at count
+// into the billing queue.
+func (c *Chain) enqueueBillings(count int32, ubs []*types.UpdateBilling) (err error) {
+	var batch = &leveldb.Batch{}
+	for i, ub := range ubs {
+		var enc *bytes.Buffer
+		if enc, err = utils.EncodeMsgPack(&queuedBilling{
+			Count:  count,
+			Chunk:  int32(i),
+			Chunks: int32(len(ubs)),
+			Tx:     ub,
+		}); err != nil {
+			return
+		}
+		batch.Put(billingQueueKey(count, int32(i)), enc.Bytes())
+	}
+	if err = c.bdb.Write(batch, c.rt.writeOptions); err != nil {
+		err = errors.Wrapf(err, "put %s", string(metaBillingQueue[:]))
+	}
+	return
+}
+
+// drainBillingQueue submits the queued billings in order, and stops at the first failure so
+// that the rest are retried later. A billing period is recorded as the last billing once all of
+// its chunks are submitted.
+func (c *Chain) drainBillingQueue() (err error) {
+	var iter = c.bdb.NewIterator(util.BytesPrefix(metaBillingQueue[:]), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var qb = &queuedBilling{}
+		if err = utils.DecodeMsgPack(iter.Value(), qb); err != nil {
+			return errors.Wrapf(err, "decode queued billing")
+		}
+		if err = c.sendBilling(qb.Tx); err != nil {
+			return errors.Wrapf(err, "send billing of count %d chunk %d", qb.Count, qb.Chunk)
+		}
+		if err = c.bdb.Delete(iter.Key(), c.rt.writeOptions); err != nil {
+			return errors.Wrapf(err, "delete %s", string(metaBillingQueue[:]))
+		}
+		if qb.Chunk == qb.Chunks-1 {
+			if ierr := c.putLastBilling(&lastBilling{
+				Count:  qb.Count,
+				TxHash: qb.Tx.Hash(),
+				At:     time.Now().UTC(),
+			}); ierr != nil {
+				log.WithError(ierr).WithField("db", c.databaseID).Warning(
+					"record last billing failed")
+			}
+		}
+	}
+	return iter.Error()
+}
+
+// PendingBillingSubmissions returns the number of computed UpdateBilling transactions which are
+// not submitted to the main chain yet, e.g., during a main chain outage.
+func (c *Chain) PendingBillingSubmissions() (n int) {
+	var iter = c.bdb.NewIterator(util.BytesPrefix(metaBillingQueue[:]), nil)
+	defer iter.Release()
+	for iter.Next() {
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning(
+			"failed to count queued billings")
+	}
+	return
+}
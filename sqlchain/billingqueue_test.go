@@ -0,0 +1,92 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	pi "github.com/CovenantSQL/CovenantSQL/blockproducer/interfaces"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestBillingQueue(t *testing.T) {
+	Convey("Given a chain whose main chain is unreachable", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 2*int(testUpdatePeriod), nil), ShouldBeNil)
+		var (
+			down    = true
+			nonce   pi.AccountNonce
+			added   []*types.UpdateBilling
+			mockBPs = func(c *Chain) {
+				c.currentBP = func() (proto.NodeID, error) { return "", nil }
+				c.cl = &mockCaller{call: func(
+					ctx context.Context, node proto.NodeID, method string, req, resp interface{},
+				) error {
+					if down {
+						return errors.New("main chain unreachable")
+					}
+					switch method {
+					case route.MCCNextAccountNonce.String():
+						resp.(*types.NextAccountNonceResp).Nonce = nonce
+					case route.MCCAddTx.String():
+						var ub = req.(*types.AddTxReq).Tx.(*types.UpdateBilling)
+						So(ub.Verify(), ShouldBeNil)
+						So(ub.Nonce, ShouldEqual, nonce)
+						nonce++
+						added = append(added, ub)
+					}
+					return nil
+				}}
+			}
+			head  = chain.rt.getHead().node
+			first = head.ancestorByCount(int32(testUpdatePeriod))
+		)
+		mockBPs(chain)
+		chain.submitBilling(first)
+		So(chain.PendingBillingSubmissions(), ShouldEqual, 1)
+		_, _, _, err = chain.LastBilling()
+		So(err, ShouldEqual, ErrNoBillingRecord)
+		Convey("The queued billing should survive a restart", func() {
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.PendingBillingSubmissions(), ShouldEqual, 1)
+		})
+		Convey("The queued billing should be submitted in order after the recovery", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			down = false
+			chain.submitBilling(head)
+			So(chain.PendingBillingSubmissions(), ShouldEqual, 0)
+			So(added, ShouldHaveLength, 2)
+			So(added[0].Nonce, ShouldEqual, 0)
+			So(added[1].Nonce, ShouldEqual, 1)
+			count, txHash, _, err := chain.LastBilling()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, head.count)
+			So(txHash, ShouldResemble, added[1].Hash())
+		})
+	})
+}
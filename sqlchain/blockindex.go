@@ -116,6 +116,12 @@ func (i *blockIndex) addBlock(newBlock *blockNode) {
 	i.index[newBlock.hash] = newBlock
 }
 
+func (i *blockIndex) removeBlock(hash *hash.Hash) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.index, *hash)
+}
+
 func (i *blockIndex) hasBlock(hash *hash.Hash) (hasBlock bool) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
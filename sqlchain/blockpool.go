@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// blockPool reuses the block structures of transient decodes, such as the blocks walked through
+// by billing.
+//
+// Ownership rules: a block got from the pool is owned by the getter until it's released by
+// releasePooledBlock, and no reference to the block or any of its fields may be retained after
+// that. Blocks which are cached in block nodes or returned to callers must never be pooled.
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		return &types.Block{}
+	},
+}
+
+// getPooledBlock gets a clean block from the pool.
+func getPooledBlock() *types.Block {
+	return blockPool.Get().(*types.Block)
+}
+
+// releasePooledBlock cleans the block and puts it back to the pool. The slice fields keep their
+// backing arrays, including the element structures, so that the next decode can reuse them.
+func releasePooledBlock(b *types.Block) {
+	*b = types.Block{
+		FailedReqs: b.FailedReqs[:0],
+		QueryTxs:   b.QueryTxs[:0],
+		Acks:       b.Acks[:0],
+	}
+	blockPool.Put(b)
+}
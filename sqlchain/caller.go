@@ -0,0 +1,31 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// Caller defines the rpc caller of sql-chain, supports mocks for the default rpc.Caller.
+type Caller interface {
+	CallNode(node proto.NodeID, method string, args interface{}, reply interface{}) error
+	CallNodeWithContext(
+		ctx context.Context, node proto.NodeID, method string, args interface{}, reply interface{},
+	) error
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// hasMissedPeriods reports whether the head has missed the blocks before block at height, i.e.,
+// the parent of block is unknown and block runs more than Config.MaxSkippedPeriods ahead of head.
+func (c *Chain) hasMissedPeriods(block *types.Block, height int32, head *state) bool {
+	return height-head.Height > c.rt.maxSkippedPeriods && c.bi.lookupNode(block.ParentHash()) == nil
+}
+
+// fetchBlockRangeFromPeer fetches the blocks in height range [from, to] from the peer id, see
+// Chain.FetchBlockRange for the range limits.
+func (c *Chain) fetchBlockRangeFromPeer(
+	id proto.NodeID, from, to int32) (blocks []*types.Block, err error,
+) {
+	var (
+		req = &MuxFetchBlockRangeReq{
+			DatabaseID:         c.databaseID,
+			FetchBlockRangeReq: FetchBlockRangeReq{From: from, To: to},
+		}
+		resp = &MuxFetchBlockRangeResp{}
+		// Fetching should be done within a period as the other block fetches
+		ctx, cancel = context.WithTimeout(c.rt.ctx, c.rt.period)
+	)
+	defer cancel()
+	if _, err = retryWithBackoff(ctx, c.rt.fetchRetries, c.rt.retryBackoff, func() (err error) {
+		var sent = time.Now()
+		if err = c.cl.CallNodeWithContext(
+			ctx, id, route.SQLCFetchBlockRange.String(), req, resp,
+		); err == nil {
+			c.rt.reportPeerTime(id, sent, time.Now(), resp.Timestamp)
+		}
+		return
+	}); err != nil {
+		return
+	}
+	return resp.Blocks, nil
+}
+
+// catchUp fetches the blocks missed by the head before block at height from the producer of
+// block, and pushes them in order, so that block extends the head afterwards. ErrInvalidBlock is
+// returned if the fetched blocks don't lead to the parent of block.
+func (c *Chain) catchUp(block *types.Block, height int32) (err error) {
+	var (
+		peer  = block.Producer()
+		total = int32(len(c.rt.getPeers().Servers))
+		head  = c.rt.getHead()
+	)
+	if total == 0 {
+		return ErrUnknownProducer
+	}
+	log.WithFields(log.Fields{
+		"peer":        c.rt.getPeerInfoString(),
+		"remote":      peer,
+		"head_height": head.Height,
+		"height":      height,
+		"db":          c.databaseID,
+	}).Info("catching up with the missed blocks")
+	for ; !head.Head.IsEqual(block.ParentHash()); head = c.rt.getHead() {
+		var blocks []*types.Block
+		if blocks, err = c.fetchBlockRangeFromPeer(peer, head.Height+1, height-1); err != nil {
+			return errors.Wrapf(err, "catch up with %s", peer)
+		}
+		if len(blocks) == 0 {
+			return errors.Wrapf(ErrInvalidBlock, "no block from %s after height %d",
+				peer, head.Height)
+		}
+		for _, v := range blocks {
+			var h = c.rt.getHeightFromTime(v.Timestamp())
+			head = c.rt.getHead()
+			if h <= head.Height || h >= height || !v.ParentHash().IsEqual(&head.Head) {
+				c.rt.reportBadBlock(peer)
+				return errors.Wrapf(ErrInvalidBlock, "fetched block %s at height %d from %s",
+					v.BlockHash().String(), h, peer)
+			}
+			if err = c.checkAndPushNext(v, head, h%total); err != nil {
+				c.rt.reportBadBlock(peer)
+				return errors.Wrapf(err, "push fetched block %s at height %d from %s",
+					v.BlockHash().String(), h, peer)
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"peer":        c.rt.getPeerInfoString(),
+		"remote":      peer,
+		"head_height": head.Height,
+		"db":          c.databaseID,
+	}).Info("caught up with the missed blocks")
+	return
+}
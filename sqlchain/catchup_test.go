@@ -0,0 +1,108 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestCatchUp(t *testing.T) {
+	Convey("Given a chain which missed several turns of its peer", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var (
+			head   = chain.rt.getHead()
+			parent = head.Head
+			missed []*types.Block
+			calls  int
+		)
+		for h := head.Height + 1; h <= head.Height+6; h++ {
+			block, err := createTestBlock(
+				&parent, chain.rt.getServer(), chain.rt.getTimeFromHeight(h), nil)
+			So(err, ShouldBeNil)
+			missed = append(missed, block)
+			parent = *block.BlockHash()
+		}
+		var serve = func(blocks []*types.Block) {
+			chain.cl = &mockCaller{call: func(
+				ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+			) error {
+				So(method, ShouldEqual, route.SQLCFetchBlockRange.String())
+				calls++
+				var req = args.(*MuxFetchBlockRangeReq)
+				for _, v := range blocks {
+					if h := chain.rt.getHeightFromTime(v.Timestamp()); h >= req.From && h <= req.To {
+						reply.(*MuxFetchBlockRangeResp).Blocks = append(
+							reply.(*MuxFetchBlockRangeResp).Blocks, v)
+					}
+				}
+				return nil
+			}}
+		}
+		Convey("The chain should catch up with the missed blocks before the new block", func() {
+			serve(missed)
+			var last = missed[len(missed)-1]
+			So(chain.CheckAndPushNewBlock(last), ShouldBeNil)
+			So(calls, ShouldEqual, 1)
+			So(chain.rt.getHead().Head, ShouldResemble, *last.BlockHash())
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+6)
+			for i, v := range missed {
+				block, err := chain.FetchBlock(head.Height + 1 + int32(i))
+				So(err, ShouldBeNil)
+				So(block.BlockHash(), ShouldResemble, v.BlockHash())
+			}
+		})
+		Convey("The chain should catch up in several range fetches", func() {
+			var cur = chain.rt.getHead()
+			chain.cl = &mockCaller{call: func(
+				ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+			) error {
+				calls++
+				// Return one block at a time
+				var i = args.(*MuxFetchBlockRangeReq).From - cur.Height - 1
+				reply.(*MuxFetchBlockRangeResp).Blocks = missed[i : i+1]
+				return nil
+			}}
+			So(chain.CheckAndPushNewBlock(missed[len(missed)-1]), ShouldBeNil)
+			So(calls, ShouldEqual, len(missed)-1)
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+6)
+		})
+		Convey("The block with a small gap should not trigger the catch-up", func() {
+			serve(missed)
+			err = chain.CheckAndPushNewBlock(missed[1])
+			So(errors.Cause(err), ShouldEqual, ErrInvalidBlock)
+			So(calls, ShouldEqual, 0)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The blocks not leading to the new block should be refused", func() {
+			serve(missed[2:])
+			err = chain.CheckAndPushNewBlock(missed[len(missed)-1])
+			So(errors.Cause(err), ShouldEqual, ErrInvalidBlock)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+	})
+}
@@ -22,8 +22,11 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	rt "runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -33,8 +36,10 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 
+	"github.com/CovenantSQL/CovenantSQL/conf"
 	"github.com/CovenantSQL/CovenantSQL/crypto"
 	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/route"
@@ -49,13 +54,48 @@ import (
 
 const (
 	minBlockCacheTTL = int32(30)
+	// storeVersion is the current format version of the chain storage.
+	storeVersion = uint32(1)
+	// throughputStatPeriods is the window size in block periods of the throughput statistics.
+	throughputStatPeriods = 10
+	// defaultRPCRetryBackoff is the default initial backoff duration between the retries of block
+	// advising and fetching.
+	defaultRPCRetryBackoff = 50 * time.Millisecond
+	// produceDelayWarningRatio is the ratio to the period of the block producing delay to log
+	// warnings.
+	produceDelayWarningRatio = 0.5
+	// defaultMaxStashedHeights is the default number of turns ahead of the current turn to stash
+	// the future blocks.
+	defaultMaxStashedHeights = int32(10)
+	// defaultMaxStashedBlocks is the default max number of the stashed future blocks.
+	defaultMaxStashedBlocks = 256
+	// defaultMaxSyncStalls is the default number of initial sync attempts without head progress
+	// before leaving the sync to the main cycle.
+	defaultMaxSyncStalls = int32(10)
+	// defaultMaxHealthyLag is the default max lag in turns of a synced head.
+	defaultMaxHealthyLag = int32(1)
+	// defaultMaxSkippedPeriods is the default max periods a new block with an unknown parent may
+	// run ahead of the head before catching up.
+	defaultMaxSkippedPeriods = int32(2)
+	// maxFetchBlockRange caps the number of blocks returned by a single FetchBlockRange call.
+	maxFetchBlockRange = 64
 )
 
 var (
+	metaVersion       = [4]byte{'V', 'E', 'R', 'S'}
 	metaState         = [4]byte{'S', 'T', 'A', 'T'}
+	metaLastBilling   = [4]byte{'L', 'B', 'I', 'L'}
+	metaBillingQueue  = [4]byte{'B', 'Q', 'U', 'E'}
 	metaBlockIndex    = [4]byte{'B', 'L', 'C', 'K'}
 	metaResponseIndex = [4]byte{'R', 'E', 'S', 'P'}
 	metaAckIndex      = [4]byte{'Q', 'A', 'C', 'K'}
+	metaOrphanIndex   = [4]byte{'O', 'R', 'P', 'H'}
+	metaAccountIndex  = [4]byte{'A', 'C', 'C', 'T'}
+	metaIndexSnapshot = [4]byte{'I', 'S', 'N', 'P'}
+	metaSnapshotState = [4]byte{'I', 'S', 'S', 'T'}
+	metaAckJournal    = [4]byte{'A', 'W', 'A', 'L'}
+	metaHeightScheme  = [4]byte{'H', 'S', 'C', 'H'}
+	metaUpdatePeriod  = [4]byte{'B', 'P', 'E', 'R'}
 	leveldbConf       = opt.Options{}
 
 	// Atomic counters for stats
@@ -96,6 +136,71 @@ func keyWithSymbolToHeight(k []byte) int32 {
 	return int32(binary.BigEndian.Uint32(k[4:]))
 }
 
+// storageFactoryOf returns the StorageFactory of config c, which defaults to opening a sqlite
+// storage.
+func storageFactoryOf(c *Config) StorageFactory {
+	if c.StorageFactory != nil {
+		return c.StorageFactory
+	}
+	return func(dataFile string) (xi.Storage, error) {
+		return xs.NewSqlite(dataFile)
+	}
+}
+
+// putStoreVersion writes the current store version into bdb.
+func putStoreVersion(bdb *leveldb.DB) (err error) {
+	var buf = make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, storeVersion)
+	if err = bdb.Put(metaVersion[:], buf, nil); err != nil {
+		err = errors.Wrap(err, "put store version")
+	}
+	return
+}
+
+// checkStoreVersion validates the store version of bdb. A store without version marker is
+// written before the marker is introduced, and is compatible with store version 1.
+func checkStoreVersion(bdb *leveldb.DB) (err error) {
+	var enc []byte
+	if enc, err = bdb.Get(metaVersion[:], nil); err == leveldb.ErrNotFound {
+		return putStoreVersion(bdb)
+	} else if err != nil {
+		err = errors.Wrap(err, "get store version")
+		return
+	}
+	if len(enc) != 4 {
+		err = errors.Errorf("invalid store version marker %x", enc)
+		return
+	}
+	if ver := binary.BigEndian.Uint32(enc); ver != storeVersion {
+		err = &ErrIncompatibleStoreVersion{Found: ver, Expected: storeVersion}
+	}
+	return
+}
+
+// putHeightScheme writes the height scheme id of the chain into bdb.
+func putHeightScheme(bdb *leveldb.DB, id string) (err error) {
+	if err = bdb.Put(metaHeightScheme[:], []byte(id), nil); err != nil {
+		err = errors.Wrap(err, "put height scheme")
+	}
+	return
+}
+
+// checkHeightScheme validates the height scheme id of bdb. A store without height scheme marker
+// is written before the marker is introduced, and is marked with id.
+func checkHeightScheme(bdb *leveldb.DB, id string) (err error) {
+	var enc []byte
+	if enc, err = bdb.Get(metaHeightScheme[:], nil); err == leveldb.ErrNotFound {
+		return putHeightScheme(bdb, id)
+	} else if err != nil {
+		err = errors.Wrap(err, "get height scheme")
+		return
+	}
+	if found := string(enc); found != id {
+		err = errors.Wrapf(ErrHeightSchemeMismatch, "found %s, expected %s", found, id)
+	}
+	return
+}
+
 // Chain represents a sql-chain.
 type Chain struct {
 	// bdb stores state, profile and block
@@ -104,10 +209,20 @@ type Chain struct {
 	tdb *leveldb.DB
 	bi  *blockIndex
 	ai  *ackIndex
+	aw  *ackWAL
 	st  *x.State
-	cl  *rpc.Caller
+	cl  Caller
 	rt  *runtime
+	vc  *valueCipher    // vc is the at-rest cipher of database values, nil if disabled
 	ctx context.Context // ctx is the root context of Chain
+	// dataFile is the DSN of the sqlite storage of st.
+	dataFile string
+	// newStorage opens the state storage at a data file.
+	newStorage StorageFactory
+	// validator is the extra validation of the new blocks, nil if not configured.
+	validator BlockValidator
+	// currentBP returns the block producer to submit the main chain transactions to.
+	currentBP func() (proto.NodeID, error)
 
 	blocks    chan *types.Block
 	heights   chan int32
@@ -120,12 +235,148 @@ type Chain struct {
 	gasPrice     uint64
 	updatePeriod uint64
 
+	// billingMutex protects gasPrice, updatePeriod and the following billing period fields.
+	// billingBase is the block count since which updatePeriod is in effect, pastPeriods are the
+	// periods in effect before it, and pendingPeriod is the period set by SetUpdatePeriod to take
+	// effect from a later billing boundary.
+	billingMutex  sync.RWMutex
+	billingBase   int32
+	pastPeriods   []billingPeriod
+	pendingPeriod *billingPeriod
+
 	// Cached fileds, may need to renew some of this fields later.
 	//
 	// pk is the private key of the local miner.
 	pk *asymmetric.PrivateKey
 	// addr is the AccountAddress generate from public key.
 	addr *proto.AccountAddress
+
+	// statsMutex protects following statistic fields.
+	statsMutex sync.RWMutex
+	// queriesPerSec and blocksPerSec are the throughput of the most recent stat window.
+	queriesPerSec float64
+	blocksPerSec  float64
+
+	// Atomic counters for block propagation stats
+	adviseRetryCount   int64
+	adviseFailureCount int64
+	// lastProduceDelay is the delay in nanoseconds of the last block produced by this node.
+	lastProduceDelay int64
+	// Atomic counters for the turns without blocks
+	skippedTurns      int64
+	missedProductions int64
+
+	// waitersMutex protects following query commit waiters.
+	waitersMutex sync.Mutex
+	// waiters are the channels waiting for queries to be committed, indexed by request hash.
+	waiters map[hash.Hash][]chan int32
+
+	// orphanMutex serializes the orphan store updates.
+	orphanMutex sync.Mutex
+
+	// cacheMutex protects the following block cache ttl, which may be updated at runtime by
+	// SetBlockCacheTTL, and the cached block references from being read while pruning.
+	cacheMutex    sync.Mutex
+	blockCacheTTL int32
+
+	// fsMutex protects the finalized state replica, which is created on demand.
+	fsMutex sync.Mutex
+	fs      *finalizedState
+
+	// producedMutex protects the following in-flight produced block, whose channel is closed
+	// once the block is processed, and the stopping flag which rejects new produced blocks.
+	producedMutex sync.Mutex
+	producedHash  hash.Hash
+	produced      chan struct{}
+	stopping      bool
+
+	// started is set once the chain is started, it's accessed atomically.
+	started int32
+	// lastSynced is the last time in unix nanoseconds when the head is found caught up with the
+	// current turn, it's accessed atomically.
+	lastSynced int64
+
+	// billedCount is the block count ending the last triggered billing period, it's only
+	// accessed by the block processing goroutine.
+	billedCount int32
+	// billingSubs are the subscribers of the computed billings.
+	billingSubs billingSubscribers
+	// reorgSubs are the subscribers of the reorgs of the best chain.
+	reorgSubs reorgSubscribers
+	// chainSubs are the subscribers of the chain events.
+	chainSubs chainSubscribers
+
+	// ackBatch buffers the pushed acks for batched flushes, nil if ack batching is disabled.
+	ackBatch *ackBatcher
+
+	// gate admits client queries unless they are paused for maintenance.
+	gate queryGate
+
+	// snapMutex protects the following state of the persisted block index snapshot.
+	snapMutex sync.Mutex
+	snap      indexSnapshotState
+	// decodedOnLoad is the number of blocks decoded and verified while loading the chain.
+	decodedOnLoad int
+}
+
+// ChainStats represents the statistics of a sql-chain.
+type ChainStats struct {
+	// QueriesPerSec and BlocksPerSec are calculated in the most recent stat window.
+	QueriesPerSec float64
+	BlocksPerSec  float64
+	// AdviseRetryCount and AdviseFailureCount count the retried and finally failed block
+	// advising calls to peers.
+	AdviseRetryCount   int64
+	AdviseFailureCount int64
+	// LastProduceDelay is the delay between the ideal timestamp of the turn and the signing
+	// completion of the last block produced by this node.
+	LastProduceDelay time.Duration
+	// SkippedTurns counts the turns passed without a block in the chain, and MissedProductions
+	// counts the own turns of this node in which it failed to produce a block.
+	SkippedTurns      int64
+	MissedProductions int64
+	// QueryQueueDepths are the numbers of queries waiting for running slots of each priority.
+	QueryQueueDepths map[types.QueryPriority]int
+	// ForkCount is the number of side branches kept for a potential reorg.
+	ForkCount int
+	// BadBlockCounts are the numbers of fetched blocks which fail the verification by peer.
+	BadBlockCounts map[proto.NodeID]int64
+	// MultiIndexCount, ResponseHeaderCount, AckCount and CachedBlockCount are the process-wide
+	// counters of the indexed queries, the indexed responses and acks, and the cached blocks.
+	MultiIndexCount     int32
+	ResponseHeaderCount int32
+	AckCount            int32
+	CachedBlockCount    int32
+	// BlockCacheTTL is the number of the recent blocks kept in the block cache.
+	BlockCacheTTL int32
+	// HeadHeight and Head are the height and the hash of the current head block, and NextTurn is
+	// the next turn of the chain.
+	HeadHeight int32
+	Head       hash.Hash
+	NextTurn   int32
+	// PooledFailedRequests and PooledQueryTrackers are the numbers of the failed requests and the
+	// query trackers in the pool of the state, which are waiting to be packed into the next block.
+	PooledFailedRequests int32
+	PooledQueryTrackers  int32
+	// GasPrice and UpdatePeriod are the gas price and the billing update period in effect, see
+	// SetGasPrice and SetUpdatePeriod.
+	GasPrice     uint64
+	UpdatePeriod uint64
+}
+
+// ChainDiagnostics represents the internal states of a sql-chain for diagnostics.
+type ChainDiagnostics struct {
+	// AckRetentionHorizon is the height below which acks are pruned from the chain database,
+	// or -1 if acks are retained forever.
+	AckRetentionHorizon int32
+	// BlockStateSize, TransactionsSize and StateDataSize are the disk usages in bytes of the
+	// chain storages, see Chain.StorageBreakdown. They are all -1 if the measuring fails.
+	BlockStateSize   int64
+	TransactionsSize int64
+	StateDataSize    int64
+	// BlocksDecodedOnLoad is the number of blocks decoded and verified while loading the chain,
+	// the others are restored from the block index snapshot.
+	BlocksDecodedOnLoad int
 }
 
 // NewChain creates a new sql-chain struct.
@@ -149,7 +400,7 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 
 	// Open LevelDB for block and state
 	bdbFile := c.ChainFilePrefix + "-block-state.ldb"
-	bdb, err := leveldb.OpenFile(bdbFile, &leveldbConf)
+	bdb, err := leveldb.OpenFile(bdbFile, blockStoreOptions(c))
 	if err != nil {
 		err = errors.Wrapf(err, "open leveldb %s", bdbFile)
 		return
@@ -157,9 +408,13 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 
 	log.WithField("db", c.DatabaseID).Debugf("create new chain bdb %s", bdbFile)
 
+	if err = putStoreVersion(bdb); err != nil {
+		return
+	}
+
 	// Open LevelDB for ack/request/response
 	tdbFile := c.ChainFilePrefix + "-ack-req-resp.ldb"
-	tdb, err := leveldb.OpenFile(tdbFile, &leveldbConf)
+	tdb, err := leveldb.OpenFile(tdbFile, storeOptions(c))
 	if err != nil {
 		err = errors.Wrapf(err, "open leveldb %s", tdbFile)
 		return
@@ -168,8 +423,11 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 	log.WithField("db", c.DatabaseID).Debugf("create new chain tdb %s", tdbFile)
 
 	// Open storage
-	var strg xi.Storage
-	if strg, err = xs.NewSqlite(c.DataFile); err != nil {
+	var (
+		newStorage = storageFactoryOf(c)
+		strg       xi.Storage
+	)
+	if strg, err = newStorage(c.DataFile); err != nil {
 		return
 	}
 
@@ -197,6 +455,12 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 		st:           x.NewState(sql.IsolationLevel(c.IsolationLevel), c.Server, strg),
 		cl:           rpc.NewCaller(),
 		rt:           newRunTime(ctx, c),
+		vc:           newValueCipher(c.EncryptAtRest, pk, c.DatabaseID),
+		dataFile:     c.DataFile,
+		newStorage:   newStorage,
+		validator:    c.BlockValidator,
+		currentBP:    getCurrentBP,
+		ackBatch:     newAckBatcher(c.AckBatchSize, c.AckBatchWindow),
 		ctx:          ctx,
 		blocks:       make(chan *types.Block),
 		heights:      make(chan int32, 1),
@@ -209,11 +473,23 @@ func NewChainWithContext(ctx context.Context, c *Config) (chain *Chain, err erro
 
 		pk:   pk,
 		addr: &addr,
+
+		blockCacheTTL: blockCacheTTLRequired(c),
+
+		waiters: make(map[hash.Hash][]chan int32),
 	}
+	chain.aw = newAckWAL(tdb, chain.vc)
 
+	if _, _, err = chain.st.TrackAppliedSeq(); err != nil {
+		return nil, err
+	}
 	if err = chain.pushBlock(c.Genesis); err != nil {
 		return nil, err
 	}
+	if err = putHeightScheme(bdb, chain.rt.heights.ID()); err != nil {
+		return nil, err
+	}
+	chainMetrics.register(chain)
 
 	return
 }
@@ -228,23 +504,31 @@ func LoadChain(c *Config) (chain *Chain, err error) {
 func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err error) {
 	// Open LevelDB for block and state
 	bdbFile := c.ChainFilePrefix + "-block-state.ldb"
-	bdb, err := leveldb.OpenFile(bdbFile, &leveldbConf)
+	bdb, err := leveldb.OpenFile(bdbFile, blockStoreOptions(c))
 	if err != nil {
 		err = errors.Wrapf(err, "open leveldb %s", bdbFile)
 		return
 	}
 
+	if err = checkStoreVersion(bdb); err != nil {
+		bdb.Close()
+		return
+	}
+
 	// Open LevelDB for ack/request/response
 	tdbFile := c.ChainFilePrefix + "-ack-req-resp.ldb"
-	tdb, err := leveldb.OpenFile(tdbFile, &leveldbConf)
+	tdb, err := leveldb.OpenFile(tdbFile, storeOptions(c))
 	if err != nil {
 		err = errors.Wrapf(err, "open leveldb %s", tdbFile)
 		return
 	}
 
 	// Open x.State
-	var strg xi.Storage
-	if strg, err = xs.NewSqlite(c.DataFile); err != nil {
+	var (
+		newStorage = storageFactoryOf(c)
+		strg       xi.Storage
+	)
+	if strg, err = newStorage(c.DataFile); err != nil {
 		return
 	}
 
@@ -272,6 +556,12 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		st:           x.NewState(sql.IsolationLevel(c.IsolationLevel), c.Server, strg),
 		cl:           rpc.NewCaller(),
 		rt:           newRunTime(ctx, c),
+		vc:           newValueCipher(c.EncryptAtRest, pk, c.DatabaseID),
+		dataFile:     c.DataFile,
+		newStorage:   newStorage,
+		validator:    c.BlockValidator,
+		currentBP:    getCurrentBP,
+		ackBatch:     newAckBatcher(c.AckBatchSize, c.AckBatchWindow),
 		ctx:          ctx,
 		blocks:       make(chan *types.Block),
 		heights:      make(chan int32, 1),
@@ -284,16 +574,21 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 
 		pk:   pk,
 		addr: &addr,
+
+		blockCacheTTL: blockCacheTTLRequired(c),
+
+		waiters: make(map[hash.Hash][]chan int32),
 	}
+	chain.aw = newAckWAL(tdb, chain.vc)
 
 	// Read state struct
 	stateEnc, err := chain.bdb.Get(metaState[:], nil)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "load state")
 	}
 	st := &state{}
 	if err = utils.DecodeMsgPack(stateEnc, st); err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "load state")
 	}
 
 	log.WithFields(log.Fields{
@@ -302,13 +597,21 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		"db":    c.DatabaseID,
 	}).Debug("loading state from database")
 
-	// Read blocks and rebuild memory index
+	// Restore memory index from snapshot, and read the newer blocks to rebuild the rest
 	var (
-		id        uint64
-		index     int32
-		last      *blockNode
-		blockIter = chain.bdb.NewIterator(util.BytesPrefix(metaBlockIndex[:]), nil)
+		id         uint64
+		index      int32
+		last       *blockNode
+		blockRange = util.BytesPrefix(metaBlockIndex[:])
 	)
+	if last, id, err = chain.loadIndexSnapshot(); err != nil {
+		log.WithField("db", c.DatabaseID).WithError(err).Warning(
+			"failed to load block index snapshot, rebuild the whole index")
+		chain.bi, chain.snap, last, id, err = newBlockIndex(), indexSnapshotState{}, nil, 0, nil
+	} else if last != nil {
+		blockRange.Start = append(utils.ConcatAll(metaBlockIndex[:], chain.snap.LastKey), 0)
+	}
+	var blockIter = chain.bdb.NewIterator(blockRange, nil)
 	defer blockIter.Release()
 	for index = 0; blockIter.Next(); index++ {
 		var (
@@ -319,7 +622,7 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 			current, parent *blockNode
 		)
 
-		if err = utils.DecodeMsgPack(v, block); err != nil {
+		if err = chain.decodeBlock(k, v, block); err != nil {
 			err = errors.Wrapf(err, "decoding failed at height %d with key %s",
 				keyWithSymbolToHeight(k), string(k))
 			return
@@ -351,8 +654,13 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		}
 
 		// Update id
-		if nid, ok := block.CalcNextID(); ok && nid > id {
-			id = nid
+		if nid, ok := block.CalcNextID(); ok {
+			if nid > id {
+				id = nid
+			} else if err = chain.checkSequenceID(
+				block, keyWithSymbolToHeight(k), nid, id); err != nil {
+				return
+			}
 		}
 
 		current = &blockNode{}
@@ -364,21 +672,65 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		err = errors.Wrap(err, "load block")
 		return
 	}
+	chain.decodedOnLoad = int(index)
+	if chain.rt.heights != nil {
+		if err = checkHeightScheme(chain.bdb, chain.rt.heights.ID()); err != nil {
+			return
+		}
+	}
 
-	// Set chain state
-	st.node = last
+	// Set chain state, the persisted head may not be the last block if the chain is reorganized
+	if st.node = chain.bi.lookupNode(&st.Head); st.node == nil {
+		st.node = last
+	}
+	if err = chain.checkCheckpointsOfBranch(st.node); err != nil {
+		return
+	}
 	chain.rt.setHead(st)
-	chain.st.SetSeq(id)
+	if err = chain.loadPeriodSchedule(st.node.count); err != nil {
+		return
+	}
+	if err = chain.recoverState(id); err != nil {
+		return
+	}
 	chain.pruneBlockCache()
 
 	// Read queries and rebuild memory index
-	respIter := chain.tdb.NewIterator(util.BytesPrefix(metaResponseIndex[:]), nil)
+	var (
+		resps []*types.SignedResponseHeader
+		acks  []*types.SignedAckHeader
+	)
+	if resps, acks, err = chain.loadQueryHeaders(); err != nil {
+		return
+	}
+	// The journaled acks may never reach tdb before a crash
+	var journaled []*types.SignedAckHeader
+	if journaled, err = chain.replayAckWAL(); err != nil {
+		return
+	}
+	acks = append(acks, journaled...)
+	if err = chain.restoreAckIndex(chain.ai, st.node, resps, acks); err != nil {
+		return
+	}
+	chainMetrics.register(chain)
+	return
+}
+
+// loadQueryHeaders reads the persisted responses and acks from tdb.
+func (c *Chain) loadQueryHeaders() (
+	resps []*types.SignedResponseHeader, acks []*types.SignedAckHeader, err error,
+) {
+	respIter := c.tdb.NewIterator(util.BytesPrefix(metaResponseIndex[:]), nil)
 	defer respIter.Release()
 	for respIter.Next() {
 		k := respIter.Key()
 		v := respIter.Value()
 		h := keyWithSymbolToHeight(k)
 		var resp = &types.SignedResponseHeader{}
+		if v, err = c.vc.open(v); err != nil {
+			err = errors.Wrapf(err, "load resp, height %d, index %s", h, string(k))
+			return
+		}
 		if err = utils.DecodeMsgPack(v, resp); err != nil {
 			err = errors.Wrapf(err, "load resp, height %d, index %s", h, string(k))
 			return
@@ -386,21 +738,26 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		log.WithFields(log.Fields{
 			"height": h,
 			"header": resp.Hash().String(),
-			"db":     c.DatabaseID,
+			"db":     c.databaseID,
 		}).Debug("loaded new resp header")
+		resps = append(resps, resp)
 	}
 	if err = respIter.Error(); err != nil {
 		err = errors.Wrap(err, "load resp")
 		return
 	}
 
-	ackIter := chain.tdb.NewIterator(util.BytesPrefix(metaAckIndex[:]), nil)
+	ackIter := c.tdb.NewIterator(util.BytesPrefix(metaAckIndex[:]), nil)
 	defer ackIter.Release()
 	for ackIter.Next() {
 		k := ackIter.Key()
 		v := ackIter.Value()
 		h := keyWithSymbolToHeight(k)
 		var ack = &types.SignedAckHeader{}
+		if v, err = c.vc.open(v); err != nil {
+			err = errors.Wrapf(err, "load ack, height %d, index %s", h, string(k))
+			return
+		}
 		if err = utils.DecodeMsgPack(v, ack); err != nil {
 			err = errors.Wrapf(err, "load ack, height %d, index %s", h, string(k))
 			return
@@ -408,14 +765,127 @@ func LoadChainWithContext(ctx context.Context, c *Config) (chain *Chain, err err
 		log.WithFields(log.Fields{
 			"height": h,
 			"header": ack.Hash().String(),
-			"db":     c.DatabaseID,
+			"db":     c.databaseID,
 		}).Debug("loaded new ack header")
+		acks = append(acks, ack)
 	}
-	if err = respIter.Error(); err != nil {
+	if err = ackIter.Error(); err != nil {
 		err = errors.Wrap(err, "load ack")
 		return
 	}
+	return
+}
+
+// restoreAckIndex rebuilds the ack index ai from the persisted responses and acks which are
+// still valid, and replays the queries of the blocks from head in the same validity window on top
+// of them. The responses are always added before the acks are registered, so that an ack finds
+// its response in either the persisted responses or the blocks.
+func (c *Chain) restoreAckIndex(
+	ai *ackIndex,
+	head *blockNode,
+	resps []*types.SignedResponseHeader,
+	acks []*types.SignedAckHeader,
+) (err error) {
+	// The chain may not be synchronized to the current turn yet, e.g., while loading, so the
+	// validity window is computed from the current time rather than the next turn.
+	var (
+		minHeight = c.rt.getCurrentHeight() - c.rt.queryTTL
+		blocks    []*types.Block
+	)
+	for node := head; node != nil && node.height >= minHeight; node = node.parent {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(node); err != nil {
+			return
+		}
+		blocks = append(blocks, block)
+	}
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+
+	var skip = func(err error) bool {
+		var cause = errors.Cause(err)
+		return cause == ErrQueryExpired || cause == ErrQueryNotFound
+	}
+	for _, v := range resps {
+		var h = c.rt.getHeightFromTime(v.GetRequestTimestamp())
+		if h < minHeight {
+			continue
+		}
+		if err = ai.addResponse(h, v); err != nil && !skip(err) {
+			return errors.Wrapf(err, "restore resp %s", v.Hash().String())
+		}
+	}
+	for _, b := range blocks {
+		for _, v := range b.QueryTxs {
+			var h = c.rt.getHeightFromTime(v.Response.GetRequestTimestamp())
+			if err = ai.addResponse(h, v.Response); err != nil && !skip(err) {
+				return errors.Wrapf(err, "restore resp %s", v.Response.Hash().String())
+			}
+		}
+	}
+	for _, v := range acks {
+		var h = c.rt.getHeightFromTime(v.GetRequestTimestamp())
+		if h < minHeight {
+			continue
+		}
+		// The response may have been persisted by neither this node nor the blocks
+		if err = ai.register(h, v); err != nil && !skip(err) {
+			return errors.Wrapf(err, "restore ack %s", v.Hash().String())
+		}
+	}
+	for _, b := range blocks {
+		for _, v := range b.Acks {
+			var h = c.rt.getHeightFromTime(v.GetRequestTimestamp())
+			if err = ai.remove(h, v); err != nil && !skip(err) {
+				return errors.Wrapf(err, "restore ack %s", v.Hash().String())
+			}
+		}
+	}
+	err = nil
+	return
+}
+
+// rebuildAckIndex rebuilds the ack index from the persisted and journaled responses and acks with
+// the queries of the blocks from head, and replaces the live ack index with it, e.g., after the
+// best chain is switched to another branch.
+func (c *Chain) rebuildAckIndex(head *blockNode) (err error) {
+	var (
+		ai        = newAckIndex()
+		resps     []*types.SignedResponseHeader
+		acks      []*types.SignedAckHeader
+		journaled []*types.SignedAckHeader
+	)
+	if resps, acks, err = c.loadQueryHeaders(); err != nil {
+		return
+	}
+	if journaled, err = c.replayAckWAL(); err != nil {
+		return
+	}
+	if err = c.restoreAckIndex(ai, head, resps, append(acks, journaled...)); err != nil {
+		return
+	}
+	c.ai.replace(ai)
+	return
+}
 
+// checkSequenceID reports a block whose next sequence id nid isn't strictly greater than the
+// running max id of the preceding blocks, which signals a sequence id bug that would cause
+// duplicate sequence numbers. It returns an error if the chain is configured to be strict.
+func (c *Chain) checkSequenceID(b *types.Block, height int32, nid, id uint64) (err error) {
+	var le = log.WithFields(log.Fields{
+		"height":  height,
+		"block":   b.BlockHash().String(),
+		"next_id": nid,
+		"max_id":  id,
+		"db":      c.databaseID,
+	})
+	if c.rt.strictSequenceID {
+		le.Error("inconsistent sequence id in block")
+		return errors.Wrapf(ErrInconsistentSequenceID,
+			"next id %d of block at height %d, max id %d", nid, height, id)
+	}
+	le.Warning("inconsistent sequence id in block")
 	return
 }
 
@@ -429,12 +899,19 @@ func (c *Chain) pushBlock(b *types.Block) (err error) {
 		Head:   node.hash,
 		Height: node.height,
 	}
-	var encBlock, encState *bytes.Buffer
+	var (
+		encBlock, encState *bytes.Buffer
+		blockValue         []byte
+	)
 
 	if encBlock, err = utils.EncodeMsgPack(b); err != nil {
 		return
 	}
 
+	if blockValue, err = c.vc.seal(encBlock.Bytes()); err != nil {
+		return
+	}
+
 	if encState, err = utils.EncodeMsgPack(st); err != nil {
 		return
 	}
@@ -447,41 +924,47 @@ func (c *Chain) pushBlock(b *types.Block) (err error) {
 		return
 	}
 	blockKey := utils.ConcatAll(metaBlockIndex[:], node.indexKey())
-	if err = t.Put(blockKey, encBlock.Bytes(), nil); err != nil {
+	if err = t.Put(blockKey, blockValue, nil); err != nil {
 		err = errors.Wrapf(err, "put %s", string(node.indexKey()))
 		t.Discard()
 		return
 	}
+	if err = c.putAccountIndex(t, node.height, b); err != nil {
+		t.Discard()
+		return
+	}
+	// Keep track of the queries from the new block, all or nothing with the block
+	var j = c.ai.journal()
+	if err = c.trackBlockQueries(j, b); err != nil {
+		log.WithFields(log.Fields{
+			"producer":   b.Producer(),
+			"block_hash": b.BlockHash(),
+			"db":         c.databaseID,
+		}).WithError(err).Warn("failed to update ackIndex, rolled back")
+		j.rollback()
+		t.Discard()
+		return
+	}
+	if err = checkPushFault(b); err != nil {
+		j.rollback()
+		t.Discard()
+		return
+	}
 	if err = t.Commit(); err != nil {
 		err = errors.Wrapf(err, "commit error")
+		j.rollback()
 		t.Discard()
 		return
 	}
 	c.rt.setHead(st)
 	c.bi.addBlock(node)
-
-	// Keep track of the queries from the new block
-	var ierr error
-	for i, v := range b.QueryTxs {
-		if ierr = c.AddResponse(v.Response); ierr != nil {
-			log.WithFields(log.Fields{
-				"index":      i,
-				"producer":   b.Producer(),
-				"block_hash": b.BlockHash(),
-				"db":         c.databaseID,
-			}).WithError(ierr).Warn("failed to add response to ackIndex")
-		}
-	}
-	for i, v := range b.Acks {
-		if ierr = c.remove(v); ierr != nil {
-			log.WithFields(log.Fields{
-				"index":      i,
-				"producer":   b.Producer(),
-				"block_hash": b.BlockHash(),
-				"db":         c.databaseID,
-			}).WithError(ierr).Warn("failed to remove Ack from ackIndex")
-		}
+	c.truncateAckWAL(b)
+	c.notifyQueryCommitted(b, node.height)
+	if node.height >= c.rt.getNextTurn()-1 {
+		c.markSynced()
 	}
+	c.publishChainEvent(BlockPushed, node)
+	c.publishChainEvent(HeadChanged, node)
 
 	if err == nil {
 		log.WithFields(log.Fields{
@@ -508,25 +991,41 @@ func (c *Chain) pushBlock(b *types.Block) (err error) {
 	return
 }
 
-// pushAckedQuery pushes a acknowledged, signed and verified query into the chain.
+// pushAckedQuery pushes a acknowledged, signed and verified query into the chain. The ack is
+// buffered and pushed in a batch later if ack batching is enabled.
 func (c *Chain) pushAckedQuery(ack *types.SignedAckHeader) (err error) {
 	log.WithField("db", c.databaseID).Debugf("push ack %s", ack.Hash().String())
 	h := c.rt.getHeightFromTime(ack.GetResponseTimestamp())
 	k := heightToKey(h)
-	var enc *bytes.Buffer
+	var (
+		enc   *bytes.Buffer
+		value []byte
+	)
 
 	if enc, err = utils.EncodeMsgPack(ack); err != nil {
 		return
 	}
 
+	if value, err = c.vc.seal(enc.Bytes()); err != nil {
+		return
+	}
+
 	tdbKey := utils.ConcatAll(metaAckIndex[:], k, ack.Hash().AsBytes())
 
+	if c.ackBatch != nil {
+		var ba = &bufferedAck{ack: ack, key: tdbKey, value: value}
+		if c.ackBatch.add(ba, c.flushAcksInBackground) {
+			err = c.FlushAcks()
+		}
+		return
+	}
+
 	if err = c.register(ack); err != nil {
 		err = errors.Wrapf(err, "register ack %v at height %d", ack.Hash(), h)
 		return
 	}
 
-	if err = c.tdb.Put(tdbKey, enc.Bytes(), nil); err != nil {
+	if err = c.tdb.Put(tdbKey, value, c.rt.writeOptions); err != nil {
 		err = errors.Wrapf(err, "put ack %d %s", h, ack.Hash().String())
 		return
 	}
@@ -534,15 +1033,98 @@ func (c *Chain) pushAckedQuery(ack *types.SignedAckHeader) (err error) {
 	return
 }
 
+// DrainPending extracts the pending queries which are executed by the state but not yet packed
+// in any block, e.g., to export and resubmit them elsewhere before a planned shutdown. The
+// executed requests are returned in their executing order, followed by the failed ones.
+//
+// Draining removes the requests from the pending set, so they will never be packed in a block
+// produced by this node. Note that the writes of the drained queries stay applied to the local
+// state, thus the chain should be stopped right after draining.
+func (c *Chain) DrainPending() (reqs []*types.Request, err error) {
+	var (
+		frs []*types.Request
+		qts []*x.QueryTracker
+	)
+	if err = c.awaitProduced(c.rt.ctx); err != nil {
+		return
+	}
+	if frs, qts, err = c.st.CommitEx(); err != nil {
+		return
+	}
+	reqs = make([]*types.Request, 0, len(qts)+len(frs))
+	for _, v := range qts {
+		reqs = append(reqs, v.Req)
+	}
+	reqs = append(reqs, frs...)
+	log.WithFields(log.Fields{
+		"queries": len(qts),
+		"failed":  len(frs),
+		"db":      c.databaseID,
+	}).Info("drained pending queries")
+	return
+}
+
+// packableQueries returns the number of the leading queries of block to pack within the query
+// count and byte caps of the produced blocks. At least one query is packed if any.
+func (c *Chain) packableQueries(block *types.Block) (n int, err error) {
+	n = len(block.QueryTxs)
+	if max := c.rt.maxBlockQueries; max > 0 && n > max {
+		n = max
+	}
+	var max = c.rt.maxBlockBytes
+	if max <= 0 || n == 0 {
+		return
+	}
+	var (
+		enc  *bytes.Buffer
+		txs  = block.QueryTxs
+		size int
+	)
+	block.QueryTxs = nil
+	enc, err = utils.EncodeMsgPack(block)
+	block.QueryTxs = txs
+	if err != nil {
+		return
+	}
+	size = enc.Len()
+	for i := 0; i < n; i++ {
+		if enc, err = utils.EncodeMsgPack(txs[i]); err != nil {
+			return
+		}
+		if size += enc.Len(); size > max && i > 0 {
+			return i, nil
+		}
+	}
+	return
+}
+
 // produceBlock prepares, signs and advises the pending block to the other peers.
+//
+// The block producing is serialized with the block processing: a new commit cycle never starts
+// until the previously produced block has been processed, i.e., pushed to the chain or dropped.
+// Therefore the pending queries are always extracted on top of the durably pushed head, and
+// never reordered or duplicated by overlapping extractions.
 func (c *Chain) produceBlock(now time.Time) (err error) {
 	var (
 		frs []*types.Request
 		qts []*x.QueryTracker
+		sum hash.Hash
 	)
-	if frs, qts, err = c.st.CommitEx(); err != nil {
+	if err = c.awaitProduced(c.rt.ctx); err != nil {
+		return
+	}
+	if c.rt.stateChecksum {
+		frs, qts, sum, err = c.st.CommitExWithChecksum(c.rt.ctx)
+	} else {
+		frs, qts, err = c.st.CommitEx()
+	}
+	if err != nil {
 		return
 	}
+	// Include the buffered acks
+	if err = c.FlushAcks(); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning("failed to flush acks")
+	}
 	var block = &types.Block{
 		SignedHeader: types.SignedHeader{
 			Header: types.Header{
@@ -554,19 +1136,18 @@ func (c *Chain) produceBlock(now time.Time) (err error) {
 				Timestamp: now,
 			},
 		},
-		FailedReqs: frs,
-		QueryTxs:   make([]*types.QueryAsTx, len(qts)),
-		Acks:       c.ai.acks(c.rt.getHeightFromTime(now)),
+		FailedReqs:      frs,
+		QueryTxs:        make([]*types.QueryAsTx, len(qts)),
+		Acks:            c.ai.acks(c.rt.getHeightFromTime(now)),
+		ProducerVersion: c.rt.producerVersion,
+		StateChecksum:   sum,
 	}
-	statBlock(block)
 	for i, v := range qts {
-		// TODO(leventeliu): maybe block waiting at a ready channel instead?
-		for !v.Ready() {
-			time.Sleep(1 * time.Millisecond)
-			if c.rt.ctx.Err() != nil {
-				err = c.rt.ctx.Err()
-				return
-			}
+		select {
+		case <-v.Done():
+		case <-c.rt.ctx.Done():
+			err = c.rt.ctx.Err()
+			return
 		}
 		block.QueryTxs[i] = &types.QueryAsTx{
 			// TODO(leventeliu): add acks for billing.
@@ -574,15 +1155,41 @@ func (c *Chain) produceBlock(now time.Time) (err error) {
 			Response: &v.Resp.Header,
 		}
 	}
+	var n int
+	if n, err = c.packableQueries(block); err != nil {
+		return
+	}
+	if deferred := len(qts) - n; deferred > 0 {
+		block.QueryTxs = block.QueryTxs[:n]
+		c.st.Requeue(qts[n:])
+		// The deferred writes are applied to the local state but not in the block
+		block.StateChecksum = hash.Hash{}
+		log.WithFields(log.Fields{
+			"peer":      c.rt.getPeerInfoString(),
+			"packed":    n,
+			"deferred":  deferred,
+			"max_count": c.rt.maxBlockQueries,
+			"max_bytes": c.rt.maxBlockBytes,
+			"db":        c.databaseID,
+		}).Warning("block is full, deferred queries to the next period")
+	}
+	statBlock(block)
 	// Sign block
 	if err = block.PackAndSignBlock(c.pk); err != nil {
 		return
 	}
+	c.recordProduceDelay(now)
 	// Send to pending list
-	select {
-	case c.blocks <- block:
-	case <-c.rt.ctx.Done():
-		err = c.rt.ctx.Err()
+	if !c.beginProduced(block) {
+		atomic.AddInt64(&c.missedProductions, 1)
+		log.WithFields(log.Fields{
+			"peer":       c.rt.getPeerInfoString(),
+			"block_hash": block.BlockHash().String(),
+			"db":         c.databaseID,
+		}).Warning("chain is stopping, drop produced block")
+		return
+	}
+	if err = c.sendProduced(block, now); err != nil {
 		return
 	}
 	log.WithFields(log.Fields{
@@ -613,24 +1220,32 @@ func (c *Chain) produceBlock(now time.Time) (err error) {
 				}(),
 			},
 		}
-		peers = c.rt.getPeers()
-		wg    = &sync.WaitGroup{}
+		peers    = c.rt.getPeers()
+		wg       = &sync.WaitGroup{}
+		failures = &adviseFailures{}
+		advised  int
+		// Advising should be done within the current turn
+		ctx, cancel = context.WithDeadline(c.rt.ctx, now.Add(c.rt.period))
 	)
+	defer cancel()
 	for _, s := range peers.Servers {
 		if s != c.rt.getServer() {
+			advised++
 			wg.Add(1)
 			go func(id proto.NodeID) {
 				defer wg.Done()
-				resp := &MuxAdviseNewBlockResp{}
-				if err := c.cl.CallNodeWithContext(
-					c.rt.ctx, id, route.SQLCAdviseNewBlock.String(), req, resp,
-				); err != nil {
+				if err := c.adviseNewBlock(ctx, id, req); err != nil {
+					if !c.rt.verboseAdvise {
+						failures.add(id, err)
+						return
+					}
 					log.WithFields(log.Fields{
 						"peer":            c.rt.getPeerInfoString(),
 						"time":            c.rt.getChainTimeString(),
 						"curr_turn":       c.rt.getNextTurn(),
 						"using_timestamp": now.Format(time.RFC3339Nano),
 						"block_hash":      block.BlockHash().String(),
+						"remote":          id,
 						"db":              c.databaseID,
 					}).WithError(err).Error("failed to advise new block")
 				}
@@ -638,78 +1253,264 @@ func (c *Chain) produceBlock(now time.Time) (err error) {
 		}
 	}
 	wg.Wait()
+	if len(failures.errs) > 0 {
+		log.WithFields(log.Fields{
+			"peer":            c.rt.getPeerInfoString(),
+			"time":            c.rt.getChainTimeString(),
+			"curr_turn":       c.rt.getNextTurn(),
+			"using_timestamp": now.Format(time.RFC3339Nano),
+			"block_hash":      block.BlockHash().String(),
+			"errors":          failures.errors(),
+			"db":              c.databaseID,
+		}).Error(failures.summary(advised))
+	}
 
 	return
 }
 
-func (c *Chain) syncHead() {
-	// Try to fetch if the block of the current turn is not advised yet
-	if h := c.rt.getNextTurn() - 1; c.rt.getHead().Height < h {
-		var err error
-		req := &MuxFetchBlockReq{
-			Envelope: proto.Envelope{
-				// TODO(leventeliu): Add fields.
-			},
-			DatabaseID: c.databaseID,
-			FetchBlockReq: FetchBlockReq{
-				Height: h,
-			},
+// sendProduced hands the produced block over to the local block processing.
+//
+// If Config.LocalBlockSendTimeout is set and the block processing can't accept the block in time,
+// e.g., it's still replaying a slow block, the block is handed over in the background instead, so
+// that advising the block to the peers isn't delayed by the local processing lag. The peers may
+// push the block before the local node in such case, and the next block producing still waits
+// until the block is processed locally.
+func (c *Chain) sendProduced(block *types.Block, now time.Time) (err error) {
+	var timeout <-chan time.Time
+	if d := c.rt.localSendTimeout; d > 0 {
+		var timer = time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case c.blocks <- block:
+		return
+	case <-timeout:
+	case <-c.rt.ctx.Done():
+		c.endProduced(block)
+		err = c.rt.ctx.Err()
+		return
+	}
+	log.WithFields(log.Fields{
+		"peer":            c.rt.getPeerInfoString(),
+		"time":            c.rt.getChainTimeString(),
+		"curr_turn":       c.rt.getNextTurn(),
+		"using_timestamp": now.Format(time.RFC3339Nano),
+		"block_hash":      block.BlockHash().String(),
+		"timeout":         c.rt.localSendTimeout,
+		"db":              c.databaseID,
+	}).Warning("local block processing is lagging, advise the produced block first")
+	c.rt.goFunc(func(ctx context.Context) {
+		select {
+		case c.blocks <- block:
+		case <-ctx.Done():
+			c.endProduced(block)
 		}
-		resp := &MuxFetchBlockResp{}
-		peers := c.rt.getPeers()
-		succ := false
+	})
+	return
+}
 
-		for i, s := range peers.Servers {
-			if s != c.rt.getServer() {
-				if err = c.cl.CallNode(
-					s, route.SQLCFetchBlock.String(), req, resp,
-				); err != nil || resp.Block == nil {
-					log.WithFields(log.Fields{
-						"peer":        c.rt.getPeerInfoString(),
-						"time":        c.rt.getChainTimeString(),
-						"remote":      fmt.Sprintf("[%d/%d] %s", i, len(peers.Servers), s),
-						"curr_turn":   c.rt.getNextTurn(),
-						"head_height": c.rt.getHead().Height,
-						"head_block":  c.rt.getHead().Head.String(),
-						"db":          c.databaseID,
-					}).WithError(err).Debug(
-						"Failed to fetch block from peer")
-				} else {
-					statBlock(resp.Block)
-					select {
-					case c.blocks <- resp.Block:
-					case <-c.rt.ctx.Done():
-						err = c.rt.ctx.Err()
-						return
-					}
-					log.WithFields(log.Fields{
-						"peer":        c.rt.getPeerInfoString(),
-						"time":        c.rt.getChainTimeString(),
-						"remote":      fmt.Sprintf("[%d/%d] %s", i, len(peers.Servers), s),
-						"curr_turn":   c.rt.getNextTurn(),
-						"head_height": c.rt.getHead().Height,
-						"head_block":  c.rt.getHead().Head.String(),
-						"db":          c.databaseID,
-					}).Debug(
-						"Fetch block from remote peer successfully")
-					succ = true
-					break
-				}
-			}
+// adviseFailures collects the failures of advising a block to the peers.
+type adviseFailures struct {
+	sync.Mutex
+	errs map[proto.NodeID]error
+}
+
+func (f *adviseFailures) add(id proto.NodeID, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[proto.NodeID]error)
+	}
+	f.errs[id] = err
+}
+
+// errors returns the error messages of the failed peers.
+func (f *adviseFailures) errors() (errs map[proto.NodeID]string) {
+	f.Lock()
+	defer f.Unlock()
+	errs = make(map[proto.NodeID]string, len(f.errs))
+	for k, v := range f.errs {
+		errs[k] = v.Error()
+	}
+	return
+}
+
+// summary summarizes the failures among the total advised peers, e.g.,
+// "advised 8/12 peers, 4 failed: [id0 id1 id2 id3]".
+func (f *adviseFailures) summary(total int) string {
+	f.Lock()
+	defer f.Unlock()
+	var ids = make([]string, 0, len(f.errs))
+	for k := range f.errs {
+		ids = append(ids, string(k))
+	}
+	sort.Strings(ids)
+	return fmt.Sprintf("advised %d/%d peers, %d failed: %v", total-len(ids), total, len(ids), ids)
+}
+
+// adviseNewBlock advises the new block to the peer id, and retries with backoff on failure.
+func (c *Chain) adviseNewBlock(
+	ctx context.Context, id proto.NodeID, req *MuxAdviseNewBlockReq) (err error,
+) {
+	var retried int32
+	retried, err = retryWithBackoff(ctx, c.rt.adviseRetries, c.rt.retryBackoff, func() (err error) {
+		var (
+			resp = &MuxAdviseNewBlockResp{}
+			sent = time.Now()
+		)
+		if err = c.cl.CallNodeWithContext(
+			ctx, id, route.SQLCAdviseNewBlock.String(), req, resp,
+		); err == nil {
+			c.rt.reportPeerTime(id, sent, time.Now(), resp.Timestamp)
 		}
+		return
+	})
+	atomic.AddInt64(&c.adviseRetryCount, int64(retried))
+	if err != nil {
+		atomic.AddInt64(&c.adviseFailureCount, 1)
+	}
+	return
+}
 
-		if !succ {
-			log.WithFields(log.Fields{
-				"peer":        c.rt.getPeerInfoString(),
-				"time":        c.rt.getChainTimeString(),
-				"curr_turn":   c.rt.getNextTurn(),
-				"head_height": c.rt.getHead().Height,
-				"head_block":  c.rt.getHead().Head.String(),
-				"db":          c.databaseID,
-			}).Debug(
-				"Cannot get block from any peer")
+func (c *Chain) syncHead() {
+	// Try to fetch if the block of the current turn is not advised yet
+	var h = c.rt.getNextTurn() - 1
+	if c.rt.getHead().Height >= h {
+		c.markSynced()
+		return
+	}
+	var (
+		peers   = c.rt.getPeers()
+		wg      = &sync.WaitGroup{}
+		results = make(chan *types.Block, len(peers.Servers))
+		// Fetching should be done within a period, the first valid block cancels the others
+		ctx, cancel = context.WithTimeout(c.rt.ctx, c.rt.period)
+	)
+	defer cancel()
+	for i, s := range peers.Servers {
+		if s != c.rt.getServer() {
+			wg.Add(1)
+			go func(remote string, id proto.NodeID) {
+				defer wg.Done()
+				if block := c.fetchBlockFromPeer(ctx, remote, id, h); block != nil {
+					results <- block
+				}
+			}(fmt.Sprintf("[%d/%d] %s", i, len(peers.Servers), s), s)
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var block, ok = <-results
+	cancel()
+	if !ok {
+		log.WithFields(log.Fields{
+			"peer":        c.rt.getPeerInfoString(),
+			"time":        c.rt.getChainTimeString(),
+			"curr_turn":   c.rt.getNextTurn(),
+			"head_height": c.rt.getHead().Height,
+			"head_block":  c.rt.getHead().Head.String(),
+			"db":          c.databaseID,
+		}).Debug(
+			"Cannot get block from any peer")
+		return
+	}
+	statBlock(block)
+	select {
+	case c.blocks <- block:
+	case <-c.rt.ctx.Done():
+		return
+	}
+	log.WithFields(log.Fields{
+		"peer":        c.rt.getPeerInfoString(),
+		"time":        c.rt.getChainTimeString(),
+		"curr_turn":   c.rt.getNextTurn(),
+		"head_height": c.rt.getHead().Height,
+		"head_block":  c.rt.getHead().Head.String(),
+		"block":       block.BlockHash().String(),
+		"db":          c.databaseID,
+	}).Debug(
+		"Fetch block from remote peer successfully")
+}
+
+// fetchBlockFromPeer fetches the block at height h from the peer id, which is described by remote
+// in logs. It returns nil if the peer fails to serve a valid block, and the peer is reported if
+// the served block fails the verification.
+func (c *Chain) fetchBlockFromPeer(
+	ctx context.Context, remote string, id proto.NodeID, h int32) (block *types.Block,
+) {
+	var (
+		req = &MuxFetchBlockReq{
+			Envelope: proto.Envelope{
+				// TODO(leventeliu): Add fields.
+			},
+			DatabaseID: c.databaseID,
+			FetchBlockReq: FetchBlockReq{
+				Height: h,
+			},
 		}
+		resp = &MuxFetchBlockResp{}
+		err  error
+	)
+	_, err = retryWithBackoff(ctx, c.rt.fetchRetries, c.rt.retryBackoff, func() (err error) {
+		var sent = time.Now()
+		if err = c.cl.CallNodeWithContext(
+			ctx, id, route.SQLCFetchBlock.String(), req, resp,
+		); err == nil {
+			c.rt.reportPeerTime(id, sent, time.Now(), resp.Timestamp)
+		}
+		return
+	})
+	if err != nil || resp.Block == nil {
+		log.WithFields(log.Fields{
+			"peer":        c.rt.getPeerInfoString(),
+			"time":        c.rt.getChainTimeString(),
+			"remote":      remote,
+			"curr_turn":   c.rt.getNextTurn(),
+			"head_height": c.rt.getHead().Height,
+			"head_block":  c.rt.getHead().Head.String(),
+			"db":          c.databaseID,
+		}).WithError(err).Debug(
+			"Failed to fetch block from peer")
+		return
+	}
+	if err = c.verifyFetchedBlock(resp.Block, h); err != nil {
+		c.rt.reportBadBlock(id)
+		log.WithFields(log.Fields{
+			"peer":   c.rt.getPeerInfoString(),
+			"time":   c.rt.getChainTimeString(),
+			"remote": remote,
+			"block":  resp.Block.BlockHash().String(),
+			"height": h,
+			"db":     c.databaseID,
+		}).WithError(err).Warning("Fetched invalid block from peer")
+		return
+	}
+	return resp.Block
+}
+
+// verifyFetchedBlock checks the block fetched for height h without the chain state, so that an
+// invalid block is refused before it's accepted for processing.
+func (c *Chain) verifyFetchedBlock(block *types.Block, h int32) (err error) {
+	if bh := c.rt.getHeightFromTime(block.Timestamp()); bh != h {
+		return errors.Wrapf(ErrBlockHeightMismatch, "block %d, fetched %d", bh, h)
+	}
+	if err = c.checkBlockTime(block); err != nil {
+		return
+	}
+	if err = block.Verify(); err != nil {
+		return
+	}
+	if err = c.rt.schemes.checkBlock(block); err != nil {
+		return
 	}
+	if _, found := c.rt.getPeers().Find(block.Producer()); !found {
+		return ErrUnknownProducer
+	}
+	return c.checkResponseAccounts(block)
 }
 
 // runCurrentTurn does the check and runs block producing if its my turn.
@@ -717,6 +1518,14 @@ func (c *Chain) runCurrentTurn(now time.Time) {
 	defer func() {
 		c.stat()
 		c.pruneBlockCache()
+		c.pruneForks()
+		c.pruneAcks()
+		if n := c.rt.snapshotInterval; n > 0 && c.rt.getNextTurn()%n == 0 {
+			if err := c.snapshotIndex(); err != nil {
+				log.WithField("db", c.databaseID).WithError(err).Warning(
+					"failed to snapshot block index")
+			}
+		}
 		c.rt.setNextTurn()
 		c.ai.advance(c.rt.getMinValidHeight())
 		// Info the block processing goroutine that the chain height has grown, so please return
@@ -735,6 +1544,7 @@ func (c *Chain) runCurrentTurn(now time.Time) {
 	}).Debug("run current turn")
 
 	if c.rt.getHead().Height < c.rt.getNextTurn()-1 {
+		atomic.AddInt64(&c.skippedTurns, 1)
 		log.WithFields(log.Fields{
 			"peer":            c.rt.getPeerInfoString(),
 			"time":            c.rt.getChainTimeString(),
@@ -746,11 +1556,24 @@ func (c *Chain) runCurrentTurn(now time.Time) {
 		}).Error("A block will be skipped")
 	}
 
-	if !c.rt.isMyTurn() {
+	if c.rt.observer || c.isStopping() || !c.rt.isMyTurn() {
+		return
+	}
+
+	if !c.rt.hasEnoughPeers() {
+		log.WithFields(log.Fields{
+			"peer":            c.rt.getPeerInfoString(),
+			"time":            c.rt.getChainTimeString(),
+			"curr_turn":       c.rt.getNextTurn(),
+			"min_peers":       c.rt.minPeersToProduce,
+			"using_timestamp": now.Format(time.RFC3339Nano),
+			"db":              c.databaseID,
+		}).Warning("not enough peers to produce block, skip current turn")
 		return
 	}
 
 	if err := c.produceBlock(now); err != nil {
+		atomic.AddInt64(&c.missedProductions, 1)
 		log.WithFields(log.Fields{
 			"peer":            c.rt.getPeerInfoString(),
 			"time":            c.rt.getChainTimeString(),
@@ -762,8 +1585,104 @@ func (c *Chain) runCurrentTurn(now time.Time) {
 	}
 }
 
+// awaitProduced blocks until the in-flight produced block, if any, is processed.
+func (c *Chain) awaitProduced(ctx context.Context) (err error) {
+	c.producedMutex.Lock()
+	var ch = c.produced
+	c.producedMutex.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// beginProduced marks block as the in-flight produced block, or returns false if the chain is
+// stopping.
+func (c *Chain) beginProduced(block *types.Block) bool {
+	c.producedMutex.Lock()
+	defer c.producedMutex.Unlock()
+	if c.stopping {
+		return false
+	}
+	c.producedHash = *block.BlockHash()
+	c.produced = make(chan struct{})
+	return true
+}
+
+// isStopping reports whether the chain is stopping, i.e., no more block will be produced.
+func (c *Chain) isStopping() bool {
+	c.producedMutex.Lock()
+	defer c.producedMutex.Unlock()
+	return c.stopping
+}
+
+// drainProduced stops the block producing, and waits for the in-flight produced block, if any, to
+// be persisted for at most Config.StopDrainTimeout. The block is left to the block processing if
+// the chain is started, so that the blocks are never pushed concurrently. Otherwise, the block
+// still pending in the blocks channel is persisted directly.
+func (c *Chain) drainProduced() (err error) {
+	c.producedMutex.Lock()
+	c.stopping = true
+	c.producedMutex.Unlock()
+	var (
+		timer  = time.NewTimer(c.rt.drainTimeout)
+		blocks = c.blocks
+	)
+	defer timer.Stop()
+	if atomic.LoadInt32(&c.started) != 0 {
+		// Never receive from the nil channel
+		blocks = nil
+	}
+	for {
+		c.producedMutex.Lock()
+		var ch, h = c.produced, c.producedHash
+		c.producedMutex.Unlock()
+		if ch == nil || c.bi.hasBlock(&h) {
+			// Nothing in flight, or it's already pushed by someone else
+			return
+		}
+		select {
+		case <-ch:
+		case block := <-blocks:
+			if ierr := c.CheckAndPushNewBlock(block); ierr != nil {
+				log.WithFields(log.Fields{
+					"peer":       c.rt.getPeerInfoString(),
+					"block_hash": block.BlockHash().String(),
+					"db":         c.databaseID,
+				}).WithError(ierr).Warning("failed to persist pending block on stop")
+			}
+			c.endProduced(block)
+		case <-timer.C:
+			return errors.Wrapf(ErrDrainTimeout, "drain produced block %s", h.String())
+		}
+	}
+}
+
+// endProduced releases the next block producing if block is the in-flight produced block.
+func (c *Chain) endProduced(block *types.Block) {
+	c.producedMutex.Lock()
+	defer c.producedMutex.Unlock()
+	if c.produced != nil && c.producedHash.IsEqual(block.BlockHash()) {
+		close(c.produced)
+		c.produced = nil
+	}
+}
+
 // mainCycle runs main cycle of the sql-chain.
 func (c *Chain) mainCycle(ctx context.Context) {
+	// Sleep until the genesis time for a scheduled-launch chain
+	if d := c.TimeUntilGenesis(); d > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d):
+		}
+	}
 	for {
 		select {
 		case <-ctx.Done():
@@ -790,6 +1709,15 @@ func (c *Chain) mainCycle(ctx context.Context) {
 	}
 }
 
+// TimeUntilGenesis returns the duration until the genesis time of the chain, or 0 if the chain
+// has already begun.
+func (c *Chain) TimeUntilGenesis() time.Duration {
+	if d := c.rt.chainInitTime.Sub(c.rt.now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
 // sync synchronizes blocks and queries from the other peers.
 func (c *Chain) sync() (err error) {
 	log.WithFields(log.Fields{
@@ -798,6 +1726,23 @@ func (c *Chain) sync() (err error) {
 		"db":   c.databaseID,
 	}).Debug("synchronizing chain state")
 
+	if d := c.TimeUntilGenesis(); d > 0 {
+		log.WithFields(log.Fields{
+			"peer":    c.rt.getPeerInfoString(),
+			"genesis": c.rt.chainInitTime.Format(time.RFC3339Nano),
+			"until":   d,
+			"db":      c.databaseID,
+		}).Info("chain genesis is in the future, nothing to synchronize")
+		return
+	}
+	if c.rt.isCountDriven() {
+		// The turns follow the processed blocks instead of the chain time
+		for c.rt.getNextTurn() <= c.rt.getHead().Height {
+			c.rt.setNextTurn()
+		}
+		return
+	}
+
 	for {
 		now := c.rt.now()
 		height := c.rt.getHeightFromTime(now)
@@ -807,6 +1752,10 @@ func (c *Chain) sync() (err error) {
 		}
 
 		for c.rt.getNextTurn() <= height {
+			// Abort promptly if the chain is stopped during initial sync
+			if err = c.rt.ctx.Err(); err != nil {
+				return
+			}
 			// TODO(leventeliu): fetch blocks and queries.
 			c.rt.setNextTurn()
 		}
@@ -815,6 +1764,51 @@ func (c *Chain) sync() (err error) {
 	return
 }
 
+// catchUpHead fetches the block of the current turn from the remote peers until the local head
+// catches up with the turn. The head may never catch up, e.g., if the peers are slower than a
+// very short period, so the initial sync gives up after Config.MaxSyncStalls consecutive
+// attempts without any head progress, and leaves the rest to the background sync of the main
+// cycle.
+func (c *Chain) catchUpHead() (err error) {
+	if c.TimeUntilGenesis() > 0 || !c.rt.hasRemotePeers() {
+		return
+	}
+	var (
+		last   = c.rt.getHead().Height
+		stalls int32
+	)
+	for {
+		// Keep up with the current turn
+		if err = c.sync(); err != nil {
+			return
+		}
+		var head, target = c.rt.getHead().Height, c.rt.getNextTurn() - 1
+		if head >= target {
+			return
+		}
+		if head > last {
+			last, stalls = head, 0
+		} else if stalls++; stalls > c.rt.maxSyncStalls {
+			log.WithFields(log.Fields{
+				"peer":        c.rt.getPeerInfoString(),
+				"time":        c.rt.getChainTimeString(),
+				"head_height": head,
+				"target":      target,
+				"stalls":      stalls - 1,
+				"db":          c.databaseID,
+			}).Warning("initial sync makes no progress, continue syncing in background")
+			return
+		}
+		c.syncHead()
+		select {
+		case <-c.rt.ctx.Done():
+			err = c.rt.ctx.Err()
+			return
+		case <-time.After(c.rt.tick):
+		}
+	}
+}
+
 func (c *Chain) processBlocks(ctx context.Context) {
 	var (
 		cld, ccl = context.WithCancel(ctx)
@@ -855,6 +1849,17 @@ func (c *Chain) processBlocks(ctx context.Context) {
 				stash = nil
 			}
 		case block := <-c.blocks:
+			if err := c.checkBlockTime(block); err != nil {
+				log.WithFields(log.Fields{
+					"peer":       c.rt.getPeerInfoString(),
+					"time":       c.rt.getChainTimeString(),
+					"block_time": block.Timestamp().Format(time.RFC3339Nano),
+					"block_hash": block.BlockHash().String(),
+					"db":         c.databaseID,
+				}).WithError(err).Warning("reject block with skewed timestamp")
+				c.endProduced(block)
+				continue
+			}
 			height := c.rt.getHeightFromTime(block.Timestamp())
 			log.WithFields(log.Fields{
 				"peer":         c.rt.getPeerInfoString(),
@@ -867,15 +1872,49 @@ func (c *Chain) processBlocks(ctx context.Context) {
 				"db":           c.databaseID,
 			}).Debug("processing new block")
 
-			if height > c.rt.getNextTurn()-1 {
+			if c.rt.isTooFarAhead(height) {
+				// Blocks too far ahead are most likely invalid or from a divergent chain
+				log.WithFields(log.Fields{
+					"peer":         c.rt.getPeerInfoString(),
+					"curr_turn":    c.rt.getNextTurn(),
+					"block_height": height,
+					"block_hash":   block.BlockHash().String(),
+					"max_stashed":  c.rt.maxStashedHeights,
+					"db":           c.databaseID,
+				}).Warning("reject future block too far ahead of current turn")
+				c.endProduced(block)
+			} else if height > c.rt.getNextTurn()-1 {
+				if len(stash) >= c.rt.maxStashedBlocks {
+					// Bound the stash against a flood of future blocks
+					log.WithFields(log.Fields{
+						"peer":         c.rt.getPeerInfoString(),
+						"curr_turn":    c.rt.getNextTurn(),
+						"block_height": height,
+						"block_hash":   block.BlockHash().String(),
+						"max_stashed":  c.rt.maxStashedBlocks,
+						"db":           c.databaseID,
+					}).Warning("reject future block as the stash is full")
+					c.endProduced(block)
+					continue
+				}
 				// Stash newer blocks for later check
 				stash = append(stash, block)
 			} else {
 				// Process block
-				if height < c.rt.getNextTurn()-1 {
-					// TODO(leventeliu): check and add to fork list.
+				if height < c.rt.getNextTurn()-1 && !c.extendsSideBranch(block) {
+					c.addOrphan(block, height, OrphanStaleTurn)
+					c.endProduced(block)
 				} else {
-					if err := c.CheckAndPushNewBlock(block); err != nil {
+					var (
+						prev = c.rt.getHead().node
+						err  = c.CheckAndPushNewBlock(block)
+					)
+					// Release the next block producing once the block is durably pushed
+					c.endProduced(block)
+					if err != nil {
+						if err == ErrInvalidBlock {
+							c.addOrphan(block, height, OrphanLostFork)
+						}
 						log.WithFields(log.Fields{
 							"peer":         c.rt.getPeerInfoString(),
 							"time":         c.rt.getChainTimeString(),
@@ -886,35 +1925,9 @@ func (c *Chain) processBlocks(ctx context.Context) {
 							"block_hash":   block.BlockHash().String(),
 							"db":           c.databaseID,
 						}).WithError(err).Error("Failed to check and push new block")
-					} else {
-						head := c.rt.getHead()
-						currentCount := uint64(head.node.count)
-						if currentCount%c.updatePeriod == 0 {
-							ub, err := c.billing(head.node)
-							if err != nil {
-								log.WithError(err).WithField("db", c.databaseID).Error("billing failed")
-							}
-							// allocate nonce
-							nonceReq := &types.NextAccountNonceReq{}
-							nonceResp := &types.NextAccountNonceResp{}
-							nonceReq.Addr = *c.addr
-							if err = rpc.RequestBP(route.MCCNextAccountNonce.String(), nonceReq, nonceResp); err != nil {
-								// allocate nonce failed
-								log.WithError(err).WithField("db", c.databaseID).Warning("allocate nonce for transaction failed")
-							}
-							ub.Nonce = nonceResp.Nonce
-							if err = ub.Sign(c.pk); err != nil {
-								log.WithError(err).WithField("db", c.databaseID).Warning("sign tx failed")
-							}
-
-							addTxReq := &types.AddTxReq{TTL: 1}
-							addTxResp := &types.AddTxResp{}
-							addTxReq.Tx = ub
-							log.WithField("db", c.databaseID).Debugf("nonce in processBlocks: %d, addr: %s",
-								addTxReq.Tx.GetAccountNonce(), addTxReq.Tx.GetAccountAddress())
-							if err = rpc.RequestBP(route.MCCAddTx.String(), addTxReq, addTxResp); err != nil {
-								log.WithError(err).WithField("db", c.databaseID).Warning("send tx failed")
-							}
+					} else if head := c.rt.getHead(); head.node != prev {
+						for _, v := range c.dueBillings(head.node) {
+							c.submitBilling(v)
 						}
 					}
 				}
@@ -925,13 +1938,19 @@ func (c *Chain) processBlocks(ctx context.Context) {
 	}
 }
 
-// Start starts the main process of the sql-chain.
+// Start starts the main process of the sql-chain. It returns the context error if the chain is
+// stopped during the initial sync.
 func (c *Chain) Start() (err error) {
+	atomic.StoreInt32(&c.started, 1)
+	// Blocks fetched during initial sync are processed as usual
+	c.rt.goFunc(c.processBlocks)
 	if err = c.sync(); err != nil {
 		return
 	}
+	if err = c.catchUpHead(); err != nil {
+		return
+	}
 
-	c.rt.goFunc(c.processBlocks)
 	c.rt.goFunc(c.mainCycle)
 	c.rt.startService(c)
 	return
@@ -945,14 +1964,29 @@ func (c *Chain) Stop() (err error) {
 		"time": c.rt.getChainTimeString(),
 		"db":   c.databaseID,
 	}).Debug("stopping chain")
+	chainMetrics.unregister(c)
+	// Persist the in-flight produced block before stopping the block processing
+	var ierr error
+	if ierr = c.drainProduced(); ierr != nil {
+		err = ierr
+	}
 	c.rt.stop(c.databaseID)
 	log.WithFields(log.Fields{
 		"peer": c.rt.getPeerInfoString(),
 		"time": c.rt.getChainTimeString(),
 		"db":   c.databaseID,
 	}).Debug("chain service and workers stopped")
+	// Flush buffered acks
+	if ierr = c.FlushAcks(); ierr != nil && err == nil {
+		err = ierr
+	}
+	// Snapshot block index for the next load
+	if c.rt.snapshotInterval > 0 {
+		if ierr = c.snapshotIndex(); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
 	// Close LevelDB file
-	var ierr error
 	if ierr = c.bdb.Close(); ierr != nil && err == nil {
 		err = ierr
 	}
@@ -978,18 +2012,148 @@ func (c *Chain) Stop() (err error) {
 		"time": c.rt.getChainTimeString(),
 		"db":   c.databaseID,
 	}).WithError(ierr).Debug("chain state storage closed")
+	// Close finalized state replica
+	c.fsMutex.Lock()
+	if c.fs != nil {
+		if ierr = c.fs.close(); ierr != nil && err == nil {
+			err = ierr
+		}
+		c.fs = nil
+	}
+	c.fsMutex.Unlock()
+	return
+}
+
+// RecentHeader represents the header of a recent block on the best chain.
+type RecentHeader struct {
+	Height int32
+	Count  int32
+	Hash   hash.Hash
+	Header types.Header
+	// ProducerVersion is the software version tag of the block producer, or empty if the
+	// producer doesn't tag its blocks.
+	ProducerVersion string
+}
+
+// RecentHeaders returns the headers of the most recent n blocks on the best chain, from the head
+// to the older ones.
+func (c *Chain) RecentHeaders(n int) (headers []RecentHeader, err error) {
+	for node := c.rt.getHead().node; node != nil && len(headers) < n; node = node.parent {
+		var (
+			block   *types.Block
+			release func()
+		)
+		if block, release, err = c.fetchTransientBlockOfNode(node); err != nil {
+			return
+		}
+		headers = append(headers, RecentHeader{
+			Height:          node.height,
+			Count:           node.count,
+			Hash:            node.hash,
+			Header:          block.SignedHeader.Header,
+			ProducerVersion: block.ProducerVersion,
+		})
+		release()
+	}
 	return
 }
 
 // FetchBlock fetches the block at specified height from local cache.
+//
+// A nil block with a nil error is returned if there is no block at height in the current chain.
+// If the block is indexed but absent from the block store, the returned error has
+// ErrBlockNotFound as its cause; any other error indicates a storage failure.
 func (c *Chain) FetchBlock(height int32) (b *types.Block, err error) {
 	if n := c.rt.getHead().node.ancestor(height); n != nil {
-		b, err = c.fetchBlockByIndexKey(n.indexKey())
-		if err != nil {
+		if b, err = c.fetchBlockByIndexKey(n.indexKey()); err != nil {
+			if errors.Cause(err) == ErrBlockNotFound {
+				log.WithFields(log.Fields{
+					"db":     c.databaseID,
+					"height": height,
+					"block":  n.hash.String(),
+				}).Warning("indexed block is missing from block store")
+			}
+			return
+		}
+	}
+
+	return
+}
+
+// FetchBlockRange fetches the blocks of the current chain in height range [from, to] in ascending
+// height. At most maxFetchBlockRange blocks are returned, from the lowest heights, so that the
+// caller continues from the height after the last returned block. The range is truncated to the
+// current head, and the blocks evicted from the cache are read from the block store.
+func (c *Chain) FetchBlockRange(from, to int32) (blocks []*types.Block, err error) {
+	if from < 0 || from > to {
+		err = errors.Errorf("invalid height range [%d, %d]", from, to)
+		return
+	}
+	var nodes []*blockNode
+	for node := c.rt.getHead().node; node != nil && node.height >= from; node = node.parent {
+		if node.height <= to {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) > maxFetchBlockRange {
+		nodes = nodes[len(nodes)-maxFetchBlockRange:]
+	}
+	blocks = make([]*types.Block, len(nodes))
+	for i, v := range nodes {
+		// Nodes are collected in descending height
+		if blocks[len(nodes)-1-i], err = c.fetchBlockOfNode(v); err != nil {
+			blocks = nil
 			return
 		}
 	}
+	return
+}
 
+// FindGaps returns the heights in range [from, to] whose blocks of the current chain are missing
+// from the block store in ascending order, e.g., to find the blocks to re-fetch after a partial
+// loss of the block store. The range is truncated to the current head. A height without any block
+// in the current chain, i.e., a skipped turn, is never reported as a gap.
+func (c *Chain) FindGaps(from, to int32) (gaps []int32, err error) {
+	if from < 0 || from > to {
+		err = errors.Errorf("invalid height range [%d, %d]", from, to)
+		return
+	}
+	var head = c.rt.getHead().node
+	if head == nil || from > head.height {
+		return
+	}
+	if to > head.height {
+		to = head.height
+	}
+	// Collect the persisted index keys in range
+	var (
+		persisted = make(map[string]struct{})
+		iter      = c.bdb.NewIterator(&util.Range{
+			Start: utils.ConcatAll(metaBlockIndex[:], heightToKey(from)),
+			Limit: utils.ConcatAll(metaBlockIndex[:], heightToKey(to+1)),
+		}, nil)
+	)
+	for iter.Next() {
+		persisted[string(iter.Key()[len(metaBlockIndex):])] = struct{}{}
+	}
+	err = iter.Error()
+	iter.Release()
+	if err != nil {
+		err = errors.Wrap(err, "scan block index")
+		return
+	}
+	for node := head; node != nil && node.height >= from; node = node.parent {
+		if node.height > to {
+			continue
+		}
+		if _, ok := persisted[string(node.indexKey())]; !ok {
+			gaps = append(gaps, node.height)
+		}
+	}
+	// Nodes are visited in descending height
+	for i, j := 0, len(gaps)-1; i < j; i, j = i+1, j-1 {
+		gaps[i], gaps[j] = gaps[j], gaps[i]
+	}
 	return
 }
 
@@ -1017,17 +2181,29 @@ func (c *Chain) FetchBlockByCount(count int32) (b *types.Block, realCount int32,
 }
 
 func (c *Chain) fetchBlockByIndexKey(indexKey []byte) (b *types.Block, err error) {
+	b = &types.Block{}
+	statBlock(b)
+	if err = c.loadBlockByIndexKey(indexKey, b); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// loadBlockByIndexKey loads the block of indexKey from bdb into b.
+func (c *Chain) loadBlockByIndexKey(indexKey []byte, b *types.Block) (err error) {
 	k := utils.ConcatAll(metaBlockIndex[:], indexKey)
 	var v []byte
 	v, err = c.bdb.Get(k, nil)
+	if err == leveldb.ErrNotFound {
+		err = errors.Wrapf(ErrBlockNotFound, "fetch block %s", string(k))
+		return
+	}
 	if err != nil {
 		err = errors.Wrapf(err, "fetch block %s", string(k))
 		return
 	}
 
-	b = &types.Block{}
-	statBlock(b)
-	err = utils.DecodeMsgPack(v, b)
+	err = c.decodeBlock(k, v, b)
 	if err != nil {
 		err = errors.Wrapf(err, "fetch block %s", string(k))
 		return
@@ -1036,25 +2212,205 @@ func (c *Chain) fetchBlockByIndexKey(indexKey []byte) (b *types.Block, err error
 	return
 }
 
-// CheckAndPushNewBlock implements ChainRPCServer.CheckAndPushNewBlock.
-func (c *Chain) CheckAndPushNewBlock(block *types.Block) (err error) {
-	height := c.rt.getHeightFromTime(block.Timestamp())
-	head := c.rt.getHead()
-	peers := c.rt.getPeers()
-	total := int32(len(peers.Servers))
-	next := func() int32 {
-		if total > 0 {
-			return (c.rt.getNextTurn() - 1) % total
+// decodeBlock decrypts and decodes the block value v stored with key k, and checks that the
+// decoded block matches the block hash in k.
+func (c *Chain) decodeBlock(k, v []byte, b *types.Block) (err error) {
+	if v, err = c.vc.open(v); err != nil {
+		return
+	}
+	if err = utils.DecodeMsgPack(v, b); err != nil {
+		return
+	}
+	if offset := len(metaBlockIndex) + 4; len(k) >= offset+hash.HashSize {
+		var h *hash.Hash
+		if h, err = hash.NewHash(k[offset : offset+hash.HashSize]); err != nil {
+			return
 		}
-		return -1
-	}()
-	log.WithFields(log.Fields{
-		"peer":        c.rt.getPeerInfoString(),
-		"time":        c.rt.getChainTimeString(),
-		"block":       block.BlockHash().String(),
-		"producer":    block.Producer(),
-		"blocktime":   block.Timestamp().Format(time.RFC3339Nano),
-		"blockheight": height,
+		if !b.BlockHash().IsEqual(h) {
+			err = ErrBlockHashMismatch
+		}
+	}
+	return
+}
+
+// EvaluateBranch replays the blocks of the branch ending at tip against a throwaway sandbox
+// state, and reports whether all the blocks are valid. The live state of the chain is left
+// untouched, so it is safe to call before switching to the branch.
+//
+// The finalized state replica is used as the state checkpoint: the sandbox state is copied from
+// it if its blocks are on the branch, and only the blocks after it are replayed. Otherwise, the
+// sandbox state is rebuilt from the genesis block. A non-nil error is only returned if the
+// sandbox fails to replay for reasons other than the validity of the branch, e.g., a block is
+// missing in the database.
+func (c *Chain) EvaluateBranch(tip *blockNode) (valid bool, err error) {
+	if tip == nil {
+		err = errors.New("empty branch")
+		return
+	}
+
+	// Build sandbox state from the nearest checkpoint
+	var (
+		dir      string
+		filename string
+		base     *blockNode
+		st       *x.State
+		nodes    []*blockNode
+	)
+	if dir, err = ioutil.TempDir("", "sqlchain-sandbox-"); err != nil {
+		err = errors.Wrap(err, "create sandbox dir")
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename = filepath.Join(dir, "sandbox.db3")
+	if base, err = c.copyCheckpointState(tip, filename); err != nil {
+		return
+	}
+	if st, err = openReplicaState(c.rt.isolationLevel, c.rt.getServer(), filename); err != nil {
+		err = errors.Wrap(err, "open sandbox state")
+		return
+	}
+	defer st.Close(false)
+	for node := tip; node != base; node = node.parent {
+		nodes = append(nodes, node)
+	}
+
+	// Replay from the block after the checkpoint
+	for i := len(nodes) - 1; i >= 0; i-- {
+		var (
+			node  = nodes[i]
+			block *types.Block
+			ierr  error
+		)
+		if block, err = c.fetchBlockOfNode(node); err != nil {
+			return
+		}
+		if node.parent == nil {
+			ierr = block.VerifyAsGenesis()
+		} else {
+			ierr = block.Verify()
+		}
+		if ierr == nil {
+			ierr = replayBlock(c.rt.ctx, st, block)
+		}
+		if ierr != nil {
+			if err = c.rt.ctx.Err(); err != nil {
+				return
+			}
+			log.WithFields(log.Fields{
+				"tip":    tip.hash.String(),
+				"block":  node.hash.String(),
+				"height": node.height,
+				"db":     c.databaseID,
+			}).WithError(ierr).Warning("branch failed in sandbox replay")
+			return
+		}
+	}
+
+	valid = true
+	return
+}
+
+// copyCheckpointState copies the state at the nearest checkpoint on the branch ending at tip to
+// the sqlite database file filename, and returns the block node of the checkpoint. The finalized
+// state replica is caught up and used as the checkpoint if its blocks are on the branch, otherwise
+// nothing is copied and a nil node is returned to replay the branch from the genesis block.
+func (c *Chain) copyCheckpointState(tip *blockNode, filename string) (node *blockNode, err error) {
+	c.fsMutex.Lock()
+	defer c.fsMutex.Unlock()
+	if err = c.catchUpFinalizedState(c.rt.ctx); err != nil {
+		log.WithField("db", c.databaseID).WithError(err).Warning(
+			"failed to catch up finalized state, evaluate branch from genesis")
+		return nil, nil
+	}
+	if node = c.fs.node; node == nil || tip.ancestorByCount(node.count) != node {
+		return nil, nil
+	}
+	if err = c.fs.copyTo(filename); err != nil {
+		// Drop the replica which may be left closed, it's recreated on demand
+		if ierr := c.fs.close(); ierr != nil {
+			log.WithField("db", c.databaseID).WithError(ierr).Warning(
+				"failed to close finalized state")
+		}
+		c.fs = nil
+		return nil, err
+	}
+	return
+}
+
+// recordProduceDelay records the delay between the ideal timestamp of the turn at now and the
+// current time, and logs a warning if the delay risks the block being late.
+func (c *Chain) recordProduceDelay(now time.Time) {
+	if c.rt.isCountDriven() {
+		// The turns are not scheduled by time, so there is no delay to speak of
+		return
+	}
+	var (
+		ideal = c.rt.getTimeFromHeight(c.rt.getHeightFromTime(now))
+		delay = c.rt.now().Sub(ideal)
+	)
+	atomic.StoreInt64(&c.lastProduceDelay, int64(delay))
+	recordProduceDelay(c.databaseID, delay)
+	chainMetrics.observeProduceDelay(c, delay)
+	if float64(delay) > float64(c.rt.period)*produceDelayWarningRatio {
+		log.WithFields(log.Fields{
+			"peer":      c.rt.getPeerInfoString(),
+			"time":      c.rt.getChainTimeString(),
+			"curr_turn": c.rt.getNextTurn(),
+			"ideal":     ideal.Format(time.RFC3339Nano),
+			"delay":     delay,
+			"period":    c.rt.period,
+			"db":        c.databaseID,
+		}).Warning("block producing is falling behind its turn")
+	}
+}
+
+// checkBlockTime returns ErrBlockClockSkew if block timestamp deviates from the current chain time
+// by more than Config.MaxClockSkew, or ErrBlockFromFuture if block is timestamped later than the
+// current chain time plus Config.MaxBlockTimeSkew. The checks are skipped in count-driven
+// scheduling, where the block timestamps are not related to the chain time.
+func (c *Chain) checkBlockTime(block *types.Block) (err error) {
+	if c.rt.isCountDriven() {
+		return
+	}
+	var now, ts = c.rt.now(), block.Timestamp()
+	if skew := ts.Sub(now); c.rt.maxClockSkew > 0 && (skew > c.rt.maxClockSkew ||
+		skew < -c.rt.maxClockSkew) {
+		return errors.Wrapf(ErrBlockClockSkew, "block timestamp %s deviates %s from local time",
+			ts.Format(time.RFC3339Nano), skew)
+	}
+	if c.rt.maxBlockTimeSkew <= 0 {
+		return
+	}
+	if limit := now.Add(c.rt.maxBlockTimeSkew); ts.After(limit) {
+		err = errors.Wrapf(ErrBlockFromFuture, "block timestamp %s is %s ahead of the limit",
+			ts.Format(time.RFC3339Nano), ts.Sub(limit))
+	}
+	return
+}
+
+// CheckAndPushNewBlock implements ChainRPCServer.CheckAndPushNewBlock.
+func (c *Chain) CheckAndPushNewBlock(block *types.Block) (err error) {
+	if err = c.checkBlockTime(block); err != nil {
+		return
+	}
+	height := c.rt.getHeightFromTime(block.Timestamp())
+	head := c.rt.getHead()
+	peers := c.rt.getPeers()
+	total := int32(len(peers.Servers))
+	next := func() int32 {
+		if total > 0 {
+			return (c.rt.getNextTurn() - 1) % total
+		}
+		return -1
+	}()
+	log.WithFields(log.Fields{
+		"peer":        c.rt.getPeerInfoString(),
+		"time":        c.rt.getChainTimeString(),
+		"block":       block.BlockHash().String(),
+		"producer":    block.Producer(),
+		"version":     block.ProducerVersion,
+		"blocktime":   block.Timestamp().Format(time.RFC3339Nano),
+		"blockheight": height,
 		"blockparent": block.ParentHash().String(),
 		"headblock":   head.Head.String(),
 		"headheight":  head.Height,
@@ -1065,21 +2421,46 @@ func (c *Chain) CheckAndPushNewBlock(block *types.Block) (err error) {
 		// Maybe already set by FetchBlock
 		return nil
 	} else if !block.ParentHash().IsEqual(&head.Head) {
-		// Pushed block must extend the best chain
-		return ErrInvalidBlock
+		if !c.hasMissedPeriods(block, height, head) {
+			// Keep the block on a side branch if it extends a known block
+			return c.pushForkBlock(block, height)
+		}
+		// Catch up with the producer of the block for the missing blocks
+		if err = c.catchUp(block, height); err != nil {
+			return
+		}
+		head = c.rt.getHead()
 	}
+	return c.checkAndPushNext(block, head, next)
+}
 
+// checkAndPushNext checks block extending head and produced by the peer at index next, and
+// pushes it to the chain.
+func (c *Chain) checkAndPushNext(block *types.Block, head *state, next int32) (err error) {
 	// Verify block signatures
 	if err = block.Verify(); err != nil {
 		return
 	}
+	if err = c.rt.schemes.checkBlock(block); err != nil {
+		return
+	}
+	// Check trusted checkpoint
+	if err = c.checkCheckpoint(head.node.count+1, block.BlockHash()); err != nil {
+		return
+	}
+	if err = c.checkResponseAccounts(block); err != nil {
+		return
+	}
 
 	// Short circuit the checking process if it's a self-produced block
 	if block.Producer() == c.rt.server {
+		if err = c.checkBlockValidator(block, head.node); err != nil {
+			return
+		}
 		return c.pushBlock(block)
 	}
 	// Check block producer
-	index, found := peers.Find(block.Producer())
+	index, found := c.rt.getPeers().Find(block.Producer())
 
 	if !found {
 		return ErrUnknownProducer
@@ -1097,22 +2478,78 @@ func (c *Chain) CheckAndPushNewBlock(block *types.Block) (err error) {
 		return ErrInvalidProducer
 	}
 
-	// TODO(leventeliu): check if too many periods are skipped or store block for future use.
-	// if height-c.rt.getHead().Height > X {
-	// 	...
-	// }
+	if err = c.checkBlockValidator(block, head.node); err != nil {
+		return
+	}
 
 	// Replicate local state from the new block
-	if err = c.st.ReplayBlockWithContext(c.rt.ctx, block); err != nil {
+	if err = replayBlock(c.rt.ctx, c.st, block); err != nil {
+		return
+	}
+	if err = c.verifyStateChecksum(c.st, block); err != nil {
 		return
 	}
 
 	return c.pushBlock(block)
 }
 
+// checkBlockValidator checks block extending parent with the configured BlockValidator, if any.
+func (c *Chain) checkBlockValidator(block *types.Block, parent *blockNode) (err error) {
+	if c.validator == nil {
+		return
+	}
+	if err = c.validator(block, parent); err != nil {
+		log.WithFields(log.Fields{
+			"block":    block.BlockHash().String(),
+			"producer": block.Producer(),
+			"db":       c.databaseID,
+		}).WithError(err).Warning("block rejected by validator")
+		err = errors.Wrapf(err, "validate block %s", block.BlockHash().String())
+	}
+	return
+}
+
+// verifyStateChecksum verifies the local state st against the state checksum carried by block, if
+// any, after block is replayed on st.
+func (c *Chain) verifyStateChecksum(st *x.State, block *types.Block) (err error) {
+	if block.StateChecksum.IsEqual(&hash.Hash{}) {
+		return
+	}
+	var sum hash.Hash
+	if sum, err = st.Checksum(c.rt.ctx); err != nil {
+		return
+	}
+	if !sum.IsEqual(&block.StateChecksum) {
+		log.WithFields(log.Fields{
+			"block":    block.BlockHash().String(),
+			"producer": block.Producer(),
+			"expected": block.StateChecksum.String(),
+			"actual":   sum.String(),
+			"db":       c.databaseID,
+		}).Error("CRITICAL: local state diverges from block producer")
+		err = errors.Wrapf(ErrStateDivergence, "block %s", block.BlockHash().String())
+	}
+	return
+}
+
+// replayBlock replays block on state st. The replaying may fail by injected faults in the
+// builds with the faultinject tag.
+func replayBlock(ctx context.Context, st *x.State, block *types.Block) (err error) {
+	if err = checkReplayFault(block); err != nil {
+		return
+	}
+	return st.ReplayBlockWithContext(ctx, block)
+}
+
 // VerifyAndPushAckedQuery verifies a acknowledged and signed query, and pushed it if valid.
 func (c *Chain) VerifyAndPushAckedQuery(ack *types.SignedAckHeader) (err error) {
 	// TODO(leventeliu): check ack.
+	// The ack is indexed by both timestamps, which must be in order to land in consistent heights
+	if rt, st := ack.GetRequestTimestamp(), ack.GetResponseTimestamp(); st.Before(rt) {
+		err = errors.Wrapf(ErrInvalidAckTimestamps, "response at %s before request at %s",
+			st.Format(time.RFC3339Nano), rt.Format(time.RFC3339Nano))
+		return
+	}
 	if c.rt.queryTimeIsExpired(ack.GetResponseTimestamp()) {
 		err = errors.Wrapf(ErrQueryExpired, "Verify ack query, min valid height %d, ack height %d", c.rt.getMinValidHeight(), c.rt.getHeightFromTime(ack.Timestamp))
 		return
@@ -1121,8 +2558,21 @@ func (c *Chain) VerifyAndPushAckedQuery(ack *types.SignedAckHeader) (err error)
 	if err = ack.Verify(); err != nil {
 		return
 	}
+	if err = c.rt.schemes.checkAck(ack); err != nil {
+		return
+	}
 
-	return c.pushAckedQuery(ack)
+	// Journal the accepted ack before pushing, so that it survives a crash
+	if err = c.aw.append(ack); err != nil {
+		return
+	}
+	if err = c.pushAckedQuery(ack); err != nil {
+		if ierr := c.aw.truncate([]*types.SignedAckHeader{ack}); ierr != nil {
+			log.WithField("db", c.databaseID).WithError(ierr).Warning(
+				"failed to truncate ack journal")
+		}
+	}
+	return
 }
 
 // UpdatePeers updates peer list of the sql-chain.
@@ -1130,37 +2580,337 @@ func (c *Chain) UpdatePeers(peers *proto.Peers) error {
 	return c.rt.updatePeers(peers)
 }
 
-// Query queries req from local chain state and returns the query results in resp.
+// QueryOptions defines the local options to serve a query with. They're decided by the serving
+// node instead of being signed by the client, thus are kept out of types.Request.
+type QueryOptions struct {
+	// Priority is the scheduling priority of the query.
+	Priority types.QueryPriority
+	// MaxStaleness is the maximum number of blocks that the chain head may lag behind the current
+	// turn when serving a read query. Zero means no limit.
+	MaxStaleness int32
+	// Finalized requests the read query to be served by the state of the finalized blocks only.
+	Finalized bool
+}
+
+// Query queries req from local chain state with the default options and returns the query
+// results in resp.
 func (c *Chain) Query(
 	req *types.Request, isLeader bool) (tracker *x.QueryTracker, resp *types.Response, err error,
 ) {
+	tracker, resp, _, err = c.QueryWithOptions(req, isLeader, QueryOptions{})
+	return
+}
+
+// QueryWithOptions queries req from local chain state with opts and returns the query results in
+// resp. For read queries, height is the height of the chain head that the query is executed at.
+func (c *Chain) QueryWithOptions(req *types.Request, isLeader bool, opts QueryOptions) (
+	tracker *x.QueryTracker, resp *types.Response, height int32, err error,
+) {
+	if err = c.gate.enter(); err != nil {
+		return
+	}
+	defer c.gate.leave()
 	// TODO(leventeliu): we're using an external context passed by request. Make sure that
 	// cancelling will be propagated to this context before chain instance stops.
-	return c.st.QueryWithContext(req.GetContext(), req, isLeader)
+	if err = c.rt.queries.acquire(req.GetContext(), opts.Priority); err != nil {
+		return
+	}
+	defer c.rt.queries.release()
+	var ctx, cancel = c.queryContext(req)
+	defer cancel()
+	defer func() {
+		// Tell the timeout of the chain from the one of the client
+		if err != nil && ctx.Err() == context.DeadlineExceeded && req.GetContext().Err() == nil {
+			err = errors.Wrapf(ErrQueryTimeout, "exceeds %s: %v", c.rt.maxQueryDuration, err)
+		}
+	}()
+	if req.Header.QueryType != types.ReadQuery {
+		if c.rt.observer {
+			err = ErrObserverReadOnly
+			return
+		}
+		tracker, resp, err = c.st.QueryWithContext(ctx, req, isLeader)
+		return
+	}
+	if opts.Finalized {
+		return c.finalizedQuery(req)
+	}
+	height = c.rt.getHead().Height
+	if err = c.checkStaleness(height, opts.MaxStaleness); err != nil {
+		return
+	}
+	if c.rt.separateReadPath {
+		tracker, resp, err = c.st.ReadOnlyQueryWithContext(ctx, req)
+	} else {
+		tracker, resp, err = c.st.QueryWithContext(ctx, req, isLeader)
+	}
+	return
+}
+
+// queryContext returns the context to query req in the state, which is bounded by
+// Config.MaxQueryDuration if set.
+func (c *Chain) queryContext(req *types.Request) (context.Context, context.CancelFunc) {
+	if c.rt.maxQueryDuration <= 0 {
+		return req.GetContext(), func() {}
+	}
+	return context.WithTimeout(req.GetContext(), c.rt.maxQueryDuration)
+}
+
+// QueryStream executes a single-query read request and returns an iterator yielding the result
+// rows incrementally, which is preferred for large result sets. The iteration is interrupted once
+// ctx is cancelled, and the iterator must be closed after use. Streaming reads are always served
+// by the live state, and are not limited by Config.MaxConcurrentQueries. Only opts.MaxStaleness is
+// applied to streaming reads.
+//
+// New streams are rejected with ErrQueriesPaused while queries are paused, but the iterators
+// opened before pausing are not waited for: they should be closed by their callers.
+func (c *Chain) QueryStream(ctx context.Context, req *types.Request, opts QueryOptions) (
+	iter *x.RowIterator, err error,
+) {
+	if c.gate.isPaused() {
+		err = ErrQueriesPaused
+		return
+	}
+	if err = c.checkStaleness(c.rt.getHead().Height, opts.MaxStaleness); err != nil {
+		return
+	}
+	return c.st.QueryStream(ctx, req)
+}
+
+// PauseQueries stops serving client queries, which are rejected with ErrQueriesPaused until
+// ResumeQueries is called, while the chain keeps following and producing blocks. It blocks until
+// the in-flight queries are finished, or returns the error of ctx if they don't finish before
+// ctx is done, in which case the queries are still paused. This allows maintenance on the read
+// path, such as a schema migration of the underlying database, without leaving the consensus.
+func (c *Chain) PauseQueries(ctx context.Context) (err error) {
+	if err = c.gate.pause(ctx); err != nil {
+		return
+	}
+	log.WithField("db", c.databaseID).Info("client queries paused")
+	return
+}
+
+// ResumeQueries resumes serving client queries paused by PauseQueries.
+func (c *Chain) ResumeQueries() {
+	c.gate.resume()
+	log.WithField("db", c.databaseID).Info("client queries resumed")
+}
+
+// SwapStorage replaces the underlying storage of the chain state with strg without stopping the
+// chain, e.g., to migrate to another storage engine. Client queries are paused during the swap,
+// and the block producing and replaying are blocked by the state until it's done, so that the
+// swap is atomic to the in-flight operations. The current state is copied to strg if strg is
+// empty, otherwise strg must be caught up with the current storage. The replaced storage is
+// closed once swapped, so the query streams opened before the swap should be closed first.
+//
+// Note that the swapped storage isn't recorded in the chain config: a reorg rebuilds the state
+// in the sqlite storage of Config.DataFile, and so does reloading the chain.
+func (c *Chain) SwapStorage(ctx context.Context, strg xi.Storage) (err error) {
+	if !c.gate.isPaused() {
+		if err = c.PauseQueries(ctx); err != nil {
+			c.ResumeQueries()
+			return
+		}
+		defer c.ResumeQueries()
+	}
+	var old xi.Storage
+	if old, err = c.st.SwapStorage(ctx, strg); err != nil {
+		return
+	}
+	if err = old.Close(); err != nil {
+		log.WithField("db", c.databaseID).WithError(err).Warning(
+			"failed to close the replaced state storage")
+		err = nil
+	}
+	log.WithField("db", c.databaseID).Info("state storage swapped")
+	return
+}
+
+// checkStaleness returns ErrTooStale if the chain head at height lags behind the current turn
+// by more than maxStaleness blocks. A non-positive maxStaleness means no limit.
+func (c *Chain) checkStaleness(height, maxStaleness int32) (err error) {
+	if maxStaleness <= 0 {
+		return
+	}
+	if lag := c.rt.getCurrentHeight() - height; lag > maxStaleness {
+		err = errors.Wrapf(ErrTooStale, "head %d lags behind by %d blocks, max staleness is %d",
+			height, lag, maxStaleness)
+	}
+	return
+}
+
+// AwaitQueryCommitted blocks until the query of requestHash is committed in a block of the
+// chain, and returns the block height. Only the cached blocks are checked for the queries
+// committed before calling.
+func (c *Chain) AwaitQueryCommitted(
+	ctx context.Context, requestHash hash.Hash) (height int32, err error,
+) {
+	var ch = make(chan int32, 1)
+	c.waitersMutex.Lock()
+	c.waiters[requestHash] = append(c.waiters[requestHash], ch)
+	c.waitersMutex.Unlock()
+	defer c.removeQueryWaiter(requestHash, ch)
+
+	// Check cached blocks in case that the query is already committed
+	if h, ok := c.findCachedQuery(requestHash); ok {
+		return h, nil
+	}
+
+	select {
+	case height = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// findCachedQuery looks up the query of requestHash in the cached blocks of the current chain,
+// and returns the height of the block committing it if found.
+func (c *Chain) findCachedQuery(requestHash hash.Hash) (height int32, ok bool) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	for node := c.rt.getHead().node; node != nil && node.block != nil; node = node.parent {
+		for _, v := range node.block.QueryTxs {
+			if v.Response.RequestHash == requestHash {
+				return node.height, true
+			}
+		}
+	}
+	return
 }
 
-// AddResponse addes a response to the ackIndex, awaiting for acknowledgement.
+func (c *Chain) removeQueryWaiter(requestHash hash.Hash, ch chan int32) {
+	c.waitersMutex.Lock()
+	defer c.waitersMutex.Unlock()
+	var waiters = c.waiters[requestHash]
+	for i, v := range waiters {
+		if v == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.waiters, requestHash)
+	} else {
+		c.waiters[requestHash] = waiters
+	}
+}
+
+// notifyQueryCommitted notifies the waiters of the queries committed in block b.
+func (c *Chain) notifyQueryCommitted(b *types.Block, height int32) {
+	c.waitersMutex.Lock()
+	defer c.waitersMutex.Unlock()
+	if len(c.waiters) == 0 {
+		return
+	}
+	for _, v := range b.QueryTxs {
+		for _, ch := range c.waiters[v.Response.RequestHash] {
+			select {
+			case ch <- height:
+			default:
+			}
+		}
+	}
+}
+
+// AddResponse addes a response to the ackIndex, awaiting for acknowledgement. The response is
+// also persisted to the chain database, unless Config.DisableResponsePersistence is set.
 func (c *Chain) AddResponse(resp *types.SignedResponseHeader) (err error) {
-	return c.ai.addResponse(c.rt.getHeightFromTime(resp.GetRequestTimestamp()), resp)
+	var h = c.rt.getHeightFromTime(resp.GetRequestTimestamp())
+	if err = c.ai.addResponse(h, resp); err != nil {
+		return
+	}
+	if c.rt.persistResponses {
+		err = c.putResponse(resp)
+	}
+	return
+}
+
+// putResponse persists resp to tdb, so that it's restored to the ack index on the next load.
+func (c *Chain) putResponse(resp *types.SignedResponseHeader) (err error) {
+	var (
+		h     = c.rt.getHeightFromTime(resp.Timestamp)
+		enc   *bytes.Buffer
+		value []byte
+	)
+	if enc, err = utils.EncodeMsgPack(resp); err != nil {
+		return
+	}
+	if value, err = c.vc.seal(enc.Bytes()); err != nil {
+		return
+	}
+	var k = utils.ConcatAll(metaResponseIndex[:], heightToKey(h), resp.Hash().AsBytes())
+	if err = c.tdb.Put(k, value, c.rt.writeOptions); err != nil {
+		err = errors.Wrapf(err, "put resp %d %s", h, resp.Hash().String())
+	}
+	return
+}
+
+// trackBlockQueries adds the responses and removes the acks of block b in the ack index through
+// journal j. The queries which have already expired from the ack index or are not tracked by it
+// are skipped, only the conflicts with the indexed queries fail the tracking.
+func (c *Chain) trackBlockQueries(j *ackJournal, b *types.Block) (err error) {
+	var skip = func(err error) bool {
+		if cause := errors.Cause(err); cause != ErrQueryExpired && cause != ErrQueryNotFound {
+			return false
+		}
+		log.WithFields(log.Fields{
+			"block_hash": b.BlockHash().String(),
+			"db":         c.databaseID,
+		}).WithError(err).Debug("skip untracked query of block")
+		return true
+	}
+	for i, v := range b.QueryTxs {
+		err = j.addResponse(c.rt.getHeightFromTime(v.Response.GetRequestTimestamp()), v.Response)
+		if err != nil && !skip(err) {
+			return errors.Wrapf(err, "add response #%d", i)
+		}
+	}
+	for i, v := range b.Acks {
+		err = j.remove(c.rt.getHeightFromTime(v.GetRequestTimestamp()), v)
+		if err != nil && !skip(err) {
+			return errors.Wrapf(err, "remove ack #%d", i)
+		}
+	}
+	return nil
 }
 
 func (c *Chain) register(ack *types.SignedAckHeader) (err error) {
 	return c.ai.register(c.rt.getHeightFromTime(ack.GetRequestTimestamp()), ack)
 }
 
-func (c *Chain) remove(ack *types.SignedAckHeader) (err error) {
-	return c.ai.remove(c.rt.getHeightFromTime(ack.GetRequestTimestamp()), ack)
+// getBlockCacheTTL returns the cached block numbers.
+func (c *Chain) getBlockCacheTTL() int32 {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	return c.blockCacheTTL
+}
+
+// setBlockCacheTTL sets the cached block numbers and prunes the block cache with it.
+func (c *Chain) setBlockCacheTTL(ttl int32) {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	c.blockCacheTTL = ttl
+	c.pruneBlockCacheLocked()
 }
 
 func (c *Chain) pruneBlockCache() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
+	c.pruneBlockCacheLocked()
+}
+
+// pruneBlockCacheLocked drops the block references older than the block cache ttl, the caller
+// must hold cacheMutex.
+func (c *Chain) pruneBlockCacheLocked() {
 	var (
 		head    = c.rt.getHead().node
 		lastCnt int32
 	)
-	if head == nil {
+	if head == nil || c.rt.archive {
 		return
 	}
-	lastCnt = head.count - c.rt.blockCacheTTL
+	lastCnt = head.count - c.blockCacheTTL
 	// Move to last count position
 	for ; head != nil && head.count > lastCnt; head = head.parent {
 	}
@@ -1170,88 +2920,706 @@ func (c *Chain) pruneBlockCache() {
 	}
 }
 
+// SetBlockCacheTTL updates the cached block numbers at runtime and prunes the block cache
+// immediately. The ttl must be no less than minBlockCacheTTL and the billing update period, or
+// ErrInvalidBlockCacheTTL will be returned. It's safe to call concurrently with the main cycle,
+// which prunes the block cache with the new ttl since its next turn.
+func (c *Chain) SetBlockCacheTTL(ttl int32) (err error) {
+	var period, pending = c.getUpdatePeriod()
+	if pending != nil && pending.period > period {
+		period = pending.period
+	}
+	if ttl < minBlockCacheTTL || uint64(ttl) < period {
+		err = errors.Wrapf(ErrInvalidBlockCacheTTL,
+			"ttl %d, min %d, update period %d", ttl, minBlockCacheTTL, period)
+		return
+	}
+	c.setBlockCacheTTL(ttl)
+	log.WithFields(log.Fields{
+		"ttl": ttl,
+		"db":  c.databaseID,
+	}).Info("updated block cache ttl")
+	return
+}
+
 func (c *Chain) stat() {
-	var (
-		ic = atomic.LoadInt32(&multiIndexCount)
-		rc = atomic.LoadInt32(&responseCount)
-		tc = atomic.LoadInt32(&ackCount)
-		bc = atomic.LoadInt32(&cachedBlockCount)
-	)
+	var s = c.Stats()
 	// Print chain stats
 	log.WithFields(log.Fields{
 		"database_id":           c.databaseID,
-		"multiIndex_count":      ic,
-		"response_header_count": rc,
-		"query_tracker_count":   tc,
-		"cached_block_count":    bc,
+		"multiIndex_count":      s.MultiIndexCount,
+		"response_header_count": s.ResponseHeaderCount,
+		"query_tracker_count":   s.AckCount,
+		"cached_block_count":    s.CachedBlockCount,
+		"block_cache_ttl":       s.BlockCacheTTL,
+		"fork_count":            s.ForkCount,
+		"skipped_turns":         s.SkippedTurns,
+		"missed_productions":    s.MissedProductions,
+		"gas_price":             s.GasPrice,
+		"update_period":         s.UpdatePeriod,
 		"db":                    c.databaseID,
 	}).Info("chain mem stats")
 	// Print xeno stats
-	c.st.Stat(c.databaseID)
+	log.WithFields(log.Fields{
+		"database_id":               c.databaseID,
+		"pooled_fail_request_count": s.PooledFailedRequests,
+		"pooled_query_tracker":      s.PooledQueryTrackers,
+	}).Info("xeno pool stats")
+	// Update throughput stats
+	var qps, bps, err = c.Throughput(throughputStatPeriods * c.rt.period)
+	if err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning("failed to stat throughput")
+		return
+	}
+	c.statsMutex.Lock()
+	defer c.statsMutex.Unlock()
+	c.queriesPerSec, c.blocksPerSec = qps, bps
 }
 
-func (c *Chain) billing(node *blockNode) (ub *types.UpdateBilling, err error) {
-	log.WithField("db", c.databaseID).Debugf("begin to billing from count %d", node.count)
+// Stats returns the statistics of the chain.
+func (c *Chain) Stats() ChainStats {
 	var (
-		i, j      uint64
-		minerAddr proto.AccountAddress
-		userAddr  proto.AccountAddress
-		usersMap  = make(map[proto.AccountAddress]uint64)
-		minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+		head            = c.rt.getHead()
+		updatePeriod, _ = c.getUpdatePeriod()
+		fc, tc          = c.st.PoolStats()
 	)
+	c.statsMutex.RLock()
+	defer c.statsMutex.RUnlock()
+	return ChainStats{
+		QueriesPerSec:      c.queriesPerSec,
+		BlocksPerSec:       c.blocksPerSec,
+		AdviseRetryCount:   atomic.LoadInt64(&c.adviseRetryCount),
+		AdviseFailureCount: atomic.LoadInt64(&c.adviseFailureCount),
+		LastProduceDelay:   time.Duration(atomic.LoadInt64(&c.lastProduceDelay)),
+		SkippedTurns:       atomic.LoadInt64(&c.skippedTurns),
+		MissedProductions:  atomic.LoadInt64(&c.missedProductions),
+		QueryQueueDepths:   c.rt.queries.depths(),
+		ForkCount:          c.rt.getForkCount(),
+		BadBlockCounts:     c.rt.getBadBlockCounts(),
+
+		MultiIndexCount:      atomic.LoadInt32(&multiIndexCount),
+		ResponseHeaderCount:  atomic.LoadInt32(&responseCount),
+		AckCount:             atomic.LoadInt32(&ackCount),
+		CachedBlockCount:     atomic.LoadInt32(&cachedBlockCount),
+		BlockCacheTTL:        c.getBlockCacheTTL(),
+		HeadHeight:           head.Height,
+		Head:                 head.Head,
+		NextTurn:             c.rt.getNextTurn(),
+		PooledFailedRequests: fc,
+		PooledQueryTrackers:  tc,
+		GasPrice:             c.getGasPrice(),
+		UpdatePeriod:         updatePeriod,
+	}
+}
 
-	for i = 0; i < c.updatePeriod && node != nil; i++ {
-		var block = node.block
-		// Not cached, recover from storage
+// Throughput calculates the query and block throughput of the chain within the last window
+// duration. Both succeeded and failed queries are counted.
+func (c *Chain) Throughput(window time.Duration) (queriesPerSec, blocksPerSec float64, err error) {
+	if window <= 0 {
+		err = errors.Errorf("invalid throughput window %v", window)
+		return
+	}
+	var (
+		begin   = c.rt.getHeightFromTime(c.rt.now().Add(-window))
+		queries int
+		blocks  int
+	)
+	for node := c.rt.getHead().node; node != nil && node.height > begin; node = node.parent {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(node); err != nil {
+			return
+		}
+		queries += len(block.QueryTxs) + len(block.FailedReqs)
+		blocks++
+	}
+	queriesPerSec = float64(queries) / window.Seconds()
+	blocksPerSec = float64(blocks) / window.Seconds()
+	return
+}
+
+// fetchBlockOfNode returns the cached block of node, or recovers it from storage if the block is
+// not cached.
+func (c *Chain) fetchBlockOfNode(node *blockNode) (block *types.Block, err error) {
+	if block = node.block; block == nil {
+		block, err = c.fetchBlockByIndexKey(node.indexKey())
+	}
+	return
+}
+
+// fetchTransientBlockOfNode returns the block of node for a transient use. The release function
+// must be called once the block is no longer used, and the block must not be retained after
+// that. The block is decoded into a pooled structure if it isn't cached and the block pool is
+// enabled.
+func (c *Chain) fetchTransientBlockOfNode(
+	node *blockNode) (block *types.Block, release func(), err error,
+) {
+	if block = node.block; block != nil || !c.rt.poolTransientBlocks {
+		release = func() {}
 		if block == nil {
-			if block, err = c.FetchBlock(node.height); err != nil {
-				return
-			}
+			block, err = c.fetchBlockByIndexKey(node.indexKey())
 		}
-		for _, tx := range block.QueryTxs {
-			minerAddr = tx.Response.ResponseAccount
-			if userAddr, err = crypto.PubKeyHash(tx.Request.Header.Signee); err != nil {
-				log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: miner addr")
-				return
-			}
+		return
+	}
+	block = getPooledBlock()
+	if err = c.loadBlockByIndexKey(node.indexKey(), block); err != nil {
+		releasePooledBlock(block)
+		return nil, nil, err
+	}
+	release = func() { releasePooledBlock(block) }
+	return
+}
+
+// aggregateBilling aggregates the query costs of block into usersMap and minersMap, which are
+// indexed by user address and user-miner address pair respectively. Only the users in part are
+// aggregated.
+func (c *Chain) aggregateBilling(
+	block *types.Block,
+	part billingPartition,
+	usersMap map[proto.AccountAddress]uint64,
+	minersMap map[proto.AccountAddress]map[proto.AccountAddress]uint64,
+) (err error) {
+	var minerAddr, userAddr proto.AccountAddress
+	for _, tx := range block.QueryTxs {
+		minerAddr = tx.Response.ResponseAccount
+		if userAddr, err = crypto.PubKeyHash(tx.Request.Header.Signee); err != nil {
+			log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: miner addr")
+			return
+		}
+		if !part.contains(userAddr) {
+			continue
+		}
+
+		if _, ok := minersMap[userAddr]; !ok {
+			minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
+		}
+		if tx.Request.Header.QueryType == types.ReadQuery {
+			minersMap[userAddr][minerAddr] += tx.Response.RowCount
+			usersMap[userAddr] += tx.Response.RowCount
+		} else {
+			minersMap[userAddr][minerAddr] += uint64(tx.Response.AffectedRows)
+			usersMap[userAddr] += uint64(tx.Response.AffectedRows)
+		}
+	}
+
+	for _, req := range block.FailedReqs {
+		if minerAddr, err = crypto.PubKeyHash(block.Signee()); err != nil {
+			log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: miner addr")
+			return
+		}
+		if userAddr, err = crypto.PubKeyHash(req.Header.Signee); err != nil {
+			log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: user addr")
+			return
+		}
+		if !part.contains(userAddr) {
+			continue
+		}
+		if _, ok := minersMap[userAddr]; !ok {
+			minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
+		}
+
+		minersMap[userAddr][minerAddr] += uint64(len(req.Payload.Queries))
+		usersMap[userAddr] += uint64(len(req.Payload.Queries))
+	}
+	return
+}
+
+// ackRetentionHorizon returns the height below which acks can be pruned, or -1 if acks should
+// be retained forever, e.g., on an archive node. The acks which may be included in the unsettled
+// billing window are always retained.
+func (c *Chain) ackRetentionHorizon() (horizon int32) {
+	var node = c.rt.getHead().node
+	if c.rt.archive || c.rt.ackRetention <= 0 || node == nil {
+		return -1
+	}
+	horizon = node.height - c.rt.ackRetention
+	// Move to the first block of the unsettled billing window
+	if c.periodAt(node.count).period > 0 {
+		var lastCount = c.lastBillingBoundary(node.count)
+		for ; node.parent != nil && node.parent.count > lastCount; node = node.parent {
+		}
+	}
+	// Acks are indexed by response time, which may be earlier than the including block
+	if unsettled := node.height - c.rt.queryTTL; unsettled < horizon {
+		horizon = unsettled
+	}
+	if horizon < 0 {
+		horizon = 0
+	}
+	return
+}
+
+// pruneAcks removes the acks and responses below the retention horizon from tdb.
+func (c *Chain) pruneAcks() {
+	var horizon = c.ackRetentionHorizon()
+	if horizon <= 0 {
+		return
+	}
+	var batch = new(leveldb.Batch)
+	for _, prefix := range [][]byte{metaAckIndex[:], metaResponseIndex[:]} {
+		var iter = c.tdb.NewIterator(&util.Range{
+			Start: prefix,
+			Limit: utils.ConcatAll(prefix, heightToKey(horizon)),
+		}, nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		var err = iter.Error()
+		iter.Release()
+		if err != nil {
+			log.WithField("db", c.databaseID).WithError(err).Warning(
+				"failed to iterate acks to prune")
+			return
+		}
+	}
+	if batch.Len() == 0 {
+		return
+	}
+	if err := c.tdb.Write(batch, nil); err != nil {
+		log.WithField("db", c.databaseID).WithError(err).Warning("failed to prune acks")
+		return
+	}
+	log.WithFields(log.Fields{
+		"horizon": horizon,
+		"count":   batch.Len(),
+		"db":      c.databaseID,
+	}).Debug("pruned acks")
+}
+
+// Diagnostics returns the internal states of the chain for diagnostics.
+func (c *Chain) Diagnostics() (diag ChainDiagnostics) {
+	diag.AckRetentionHorizon = c.ackRetentionHorizon()
+	diag.BlocksDecodedOnLoad = c.decodedOnLoad
+	var err error
+	if diag.BlockStateSize, diag.TransactionsSize, diag.StateDataSize,
+		err = c.StorageBreakdown(); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning("failed to measure storage")
+		diag.BlockStateSize, diag.TransactionsSize, diag.StateDataSize = -1, -1, -1
+	}
+	return
+}
+
+// PendingBilling returns the costs of each user accrued since the last billing period, which
+// are not settled yet.
+func (c *Chain) PendingBilling() (costs map[proto.AccountAddress]uint64, err error) {
+	var (
+		node      = c.rt.getHead().node
+		minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+		lastCount int32
+	)
+	costs = make(map[proto.AccountAddress]uint64)
+	if node == nil {
+		return
+	}
+	if c.periodAt(node.count).period > 0 {
+		lastCount = c.lastBillingBoundary(node.count)
+	}
+	for ; node != nil && node.count > lastCount; node = node.parent {
+		var (
+			block   *types.Block
+			release func()
+		)
+		if block, release, err = c.fetchTransientBlockOfNode(node); err != nil {
+			return
+		}
+		err = c.aggregateBilling(block, billingPartition{}, costs, minersMap)
+		release()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// BillingContribution returns the costs of each user contributed by the single block b. The
+// contributions of the blocks in a billing period sum up to the user costs of the UpdateBilling
+// transaction of the period, which can be used to check the settled billings.
+func (c *Chain) BillingContribution(b *types.Block) (costs map[proto.AccountAddress]uint64, err error) {
+	var minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+	costs = make(map[proto.AccountAddress]uint64)
+	if err = c.aggregateBilling(b, billingPartition{}, costs, minersMap); err != nil {
+		costs = nil
+	}
+	return
+}
 
-			if _, ok := minersMap[userAddr]; !ok {
-				minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
+// MinersForUser returns the costs of user served by each miner in the blocks of count range
+// [fromCount, toCount]. The range is truncated to the current head.
+func (c *Chain) MinersForUser(user proto.AccountAddress, fromCount, toCount int32) (
+	miners map[proto.AccountAddress]uint64, err error,
+) {
+	if fromCount < 0 || fromCount > toCount {
+		err = errors.Errorf("invalid count range [%d, %d]", fromCount, toCount)
+		return
+	}
+	var node = c.rt.getHead().node
+	miners = make(map[proto.AccountAddress]uint64)
+	if node == nil {
+		return
+	}
+	if toCount < node.count {
+		node = node.ancestorByCount(toCount)
+	}
+	for ; node != nil && node.count >= fromCount; node = node.parent {
+		var (
+			block     *types.Block
+			release   func()
+			usersMap  = make(map[proto.AccountAddress]uint64)
+			minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+		)
+		if block, release, err = c.fetchTransientBlockOfNode(node); err != nil {
+			if errors.Cause(err) == ErrBlockNotFound {
+				err = errors.Wrapf(err, "billing block at count %d", node.count)
 			}
-			if tx.Request.Header.QueryType == types.ReadQuery {
-				minersMap[userAddr][minerAddr] += tx.Response.RowCount
-				usersMap[userAddr] += tx.Response.RowCount
-			} else {
-				minersMap[userAddr][minerAddr] += uint64(tx.Response.AffectedRows)
-				usersMap[userAddr] += uint64(tx.Response.AffectedRows)
+			return
+		}
+		err = c.aggregateBilling(block, billingPartition{}, usersMap, minersMap)
+		release()
+		if err != nil {
+			return
+		}
+		for k, v := range minersMap[user] {
+			miners[k] += v
+		}
+	}
+	return
+}
+
+// VerifyBillingConservation sums up the user costs and the miner incomes of the settled billings
+// whose periods end in the count range [fromCount, toCount], and returns ErrBillingNotConserved
+// along with both totals if they don't match. The range is truncated to the current head.
+func (c *Chain) VerifyBillingConservation(fromCount, toCount int32) (
+	userTotal, minerTotal uint64, err error,
+) {
+	if fromCount < 0 || fromCount > toCount {
+		err = errors.Errorf("invalid count range [%d, %d]", fromCount, toCount)
+		return
+	}
+	var node = c.rt.getHead().node
+	if node == nil {
+		return
+	}
+	if toCount < node.count {
+		node = node.ancestorByCount(toCount)
+	}
+	for ; node != nil && node.count >= fromCount; node = node.parent {
+		if !c.isBillingBoundary(node.count) {
+			continue
+		}
+		var ub *types.UpdateBilling
+		if ub, err = c.billing(node); err != nil {
+			err = errors.Wrapf(err, "billing period ending at count %d", node.count)
+			return
+		}
+		for _, u := range ub.Users {
+			userTotal += u.Cost
+			for _, m := range u.Miners {
+				minerTotal += m.Income
 			}
 		}
+	}
+	if userTotal != minerTotal {
+		err = errors.Wrapf(ErrBillingNotConserved,
+			"user total %d, miner total %d", userTotal, minerTotal)
+	}
+	return
+}
 
-		for _, req := range block.FailedReqs {
-			if minerAddr, err = crypto.PubKeyHash(block.Signee()); err != nil {
-				log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: miner addr")
-				return
+// PreviewBilling builds the UpdateBilling transaction of the blocks in the count range
+// [fromCount, toCount] of the best chain without signing or submitting it, e.g., to audit the
+// charges of a billing period before it's settled. The range is truncated to the current head,
+// and the blocks pruned from the block cache are read from the block store.
+//
+// The preview of a whole billing period is identical to the billing submitted for the period,
+// including the order of the users and the miners.
+func (c *Chain) PreviewBilling(fromCount, toCount int32) (ub *types.UpdateBilling, err error) {
+	if fromCount < 0 || fromCount > toCount {
+		err = errors.Errorf("invalid count range [%d, %d]", fromCount, toCount)
+		return
+	}
+	var (
+		node      = c.rt.getHead().node
+		usersMap  = make(map[proto.AccountAddress]uint64)
+		minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+	)
+	if node != nil && toCount < node.count {
+		node = node.ancestorByCount(toCount)
+	}
+	for ; node != nil && node.count >= fromCount; node = node.parent {
+		var (
+			block   *types.Block
+			release func()
+		)
+		if block, release, err = c.fetchTransientBlockOfNode(node); err != nil {
+			err = errors.Wrapf(err, "fetch block at count %d", node.count)
+			return
+		}
+		err = c.aggregateBilling(block, billingPartition{}, usersMap, minersMap)
+		release()
+		if err != nil {
+			return
+		}
+	}
+	return c.newUpdateBilling(usersMap, minersMap)
+}
+
+// dueBillings returns the nodes ending the billing periods which are completed by the new head
+// since the last triggered billing, and marks them as triggered. The periods are tracked by the
+// last billed count rather than the count alignment, so that a reorg changing the head count
+// never skips or duplicates a billing. A billing period change set by SetUpdatePeriod is applied
+// once the billings are triggered up to its base count.
+func (c *Chain) dueBillings(head *blockNode) (nodes []*blockNode) {
+	for {
+		c.applyPendingPeriod()
+		var period = c.periodAt(c.billedCount + 1).period
+		if period == 0 {
+			return
+		}
+		var next = c.billedCount + int32(period)
+		if next > head.count {
+			return
+		}
+		nodes = append(nodes, head.ancestorByCount(next))
+		c.billedCount = next
+	}
+}
+
+// submitBilling builds the UpdateBilling transactions from node and queues them for submission,
+// then submits the queued billings to the main chain. The billings queued during a main chain
+// outage are retried with the following billing periods, see drainBillingQueue.
+func (c *Chain) submitBilling(node *blockNode) {
+	ubs, err := c.billingChunks(node)
+	if errors.Cause(err) == ErrBlockNotFound {
+		// The billing period can't be aggregated without the missing block, so it's skipped
+		// rather than submitting an incomplete bill.
+		log.WithError(err).WithFields(log.Fields{
+			"db":    c.databaseID,
+			"count": node.count,
+		}).Error("billing skipped: block missing from block store")
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Error("billing failed")
+		return
+	}
+	for _, ub := range ubs {
+		c.publishBilling(ub, node.count)
+	}
+	if err = c.enqueueBillings(node.count, ubs); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"db":    c.databaseID,
+			"count": node.count,
+		}).Error("queue billing failed")
+		return
+	}
+	if err = c.drainBillingQueue(); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"db":      c.databaseID,
+			"count":   node.count,
+			"pending": c.PendingBillingSubmissions(),
+		}).Warning("send tx failed, billing is queued for retry")
+	}
+}
+
+// getCurrentBP returns the current block producer, or ErrNoBlockProducer if the block producer
+// route isn't initialized with the global config.
+func getCurrentBP() (proto.NodeID, error) {
+	if conf.GConf == nil {
+		return "", ErrNoBlockProducer
+	}
+	return rpc.GetCurrentBP()
+}
+
+// requestBP calls the current block producer, i.e., the main chain, with the chain caller.
+func (c *Chain) requestBP(method string, req, resp interface{}) (err error) {
+	var bp proto.NodeID
+	if bp, err = c.currentBP(); err != nil {
+		return errors.Wrap(err, "get current block producer")
+	}
+	return c.cl.CallNode(bp, method, req, resp)
+}
+
+// sendBilling signs ub with a newly allocated nonce and sends it to the main chain.
+func (c *Chain) sendBilling(ub *types.UpdateBilling) (err error) {
+	// allocate nonce
+	nonceReq := &types.NextAccountNonceReq{}
+	nonceResp := &types.NextAccountNonceResp{}
+	nonceReq.Addr = *c.addr
+	if err = c.requestBP(route.MCCNextAccountNonce.String(), nonceReq, nonceResp); err != nil {
+		// allocate nonce failed
+		log.WithError(err).WithField("db", c.databaseID).Warning("allocate nonce for transaction failed")
+		return
+	}
+	ub.Nonce = nonceResp.Nonce
+	if err = ub.Sign(c.pk); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning("sign tx failed")
+		return
+	}
+
+	addTxReq := &types.AddTxReq{TTL: 1}
+	addTxResp := &types.AddTxResp{}
+	addTxReq.Tx = ub
+	log.WithField("db", c.databaseID).Debugf("nonce in processBlocks: %d, addr: %s",
+		addTxReq.Tx.GetAccountNonce(), addTxReq.Tx.GetAccountAddress())
+	return c.requestBP(route.MCCAddTx.String(), addTxReq, addTxResp)
+}
+
+// lastBilling is the record of the last successfully submitted billing transaction.
+type lastBilling struct {
+	Count  int32
+	TxHash hash.Hash
+	At     time.Time
+}
+
+// putLastBilling persists lb as the last billing record into bdb.
+func (c *Chain) putLastBilling(lb *lastBilling) (err error) {
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(lb); err != nil {
+		return
+	}
+	if err = c.bdb.Put(metaLastBilling[:], enc.Bytes(), c.rt.writeOptions); err != nil {
+		err = errors.Wrapf(err, "put %s", string(metaLastBilling[:]))
+	}
+	return
+}
+
+// LastBilling returns the block count, the main chain transaction hash and the submission time
+// of the last successfully submitted billing. ErrNoBillingRecord is returned if no billing has
+// been submitted yet.
+func (c *Chain) LastBilling() (count int32, txHash hash.Hash, at time.Time, err error) {
+	var (
+		enc []byte
+		lb  = &lastBilling{}
+	)
+	if enc, err = c.bdb.Get(metaLastBilling[:], nil); err == leveldb.ErrNotFound {
+		err = ErrNoBillingRecord
+		return
+	} else if err != nil {
+		err = errors.Wrapf(err, "get %s", string(metaLastBilling[:]))
+		return
+	}
+	if err = utils.DecodeMsgPack(enc, lb); err != nil {
+		return
+	}
+	return lb.Count, lb.TxHash, lb.At, nil
+}
+
+// billingPartition selects the users whose addresses start with the leading bits of index.
+// The zero value selects all users.
+type billingPartition struct {
+	bits  uint
+	index uint64
+}
+
+func (p billingPartition) contains(addr proto.AccountAddress) bool {
+	return p.bits == 0 || binary.BigEndian.Uint64(addr[:8])>>(64-p.bits) == p.index
+}
+
+// split returns the first half of p, or false if p can't be split anymore.
+func (p billingPartition) split() (billingPartition, bool) {
+	if p.bits >= 64 {
+		return p, false
+	}
+	return billingPartition{bits: p.bits + 1, index: p.index << 1}, true
+}
+
+// next returns the succeeding partition of p with the same size, or false if p is the last one.
+func (p billingPartition) next() (billingPartition, bool) {
+	if p.bits == 0 || p.index == ^uint64(0)>>(64-p.bits) {
+		return p, false
+	}
+	return billingPartition{bits: p.bits, index: p.index + 1}, true
+}
+
+// billingChunks builds the UpdateBilling transactions of the billing period ending at node. The
+// users are split into disjoint address partitions with at most Config.MaxBillingUsers users in
+// each, and one transaction is built for each non-empty partition. Each partition reads through
+// the blocks of the period again, so the memory usage is bounded at the cost of extra reads.
+func (c *Chain) billingChunks(node *blockNode) (ubs []*types.UpdateBilling, err error) {
+	var (
+		ub       *types.UpdateBilling
+		overflow bool
+		part     billingPartition
+		ok       bool
+	)
+	for {
+		if ub, overflow, err = c.billingOfPartition(node, part, c.rt.maxBillingUsers); err != nil {
+			return
+		}
+		if overflow {
+			var sub billingPartition
+			if sub, ok = part.split(); ok {
+				part = sub
+				continue
 			}
-			if userAddr, err = crypto.PubKeyHash(req.Header.Signee); err != nil {
-				log.WithError(err).WithField("db", c.databaseID).Warning("billing fail: user addr")
+			// Not likely to happen: too many users sharing a same 64-bit address prefix, bill
+			// them all together anyway.
+			if ub, _, err = c.billingOfPartition(node, part, 0); err != nil {
 				return
 			}
-			if _, ok := minersMap[userAddr][minerAddr]; !ok {
-				minersMap[userAddr] = make(map[proto.AccountAddress]uint64)
-			}
+		}
+		// An unsplit billing is always submitted even if it's empty, as the unlimited one does
+		if len(ub.Users) > 0 || part.bits == 0 {
+			ubs = append(ubs, ub)
+		}
+		if part, ok = part.next(); !ok {
+			return
+		}
+	}
+}
 
-			minersMap[userAddr][minerAddr] += uint64(len(req.Payload.Queries))
-			usersMap[userAddr] += uint64(len(req.Payload.Queries))
+// billing builds the UpdateBilling transaction of all the users in the billing period ending at
+// node.
+func (c *Chain) billing(node *blockNode) (ub *types.UpdateBilling, err error) {
+	ub, _, err = c.billingOfPartition(node, billingPartition{}, 0)
+	return
+}
+
+// billingOfPartition builds the UpdateBilling transaction of the users in part. If maxUsers is
+// positive and the partition has more users, the aggregation is aborted and overflow is returned.
+func (c *Chain) billingOfPartition(node *blockNode, part billingPartition, maxUsers int) (
+	ub *types.UpdateBilling, overflow bool, err error,
+) {
+	log.WithField("db", c.databaseID).Debugf("begin to billing from count %d", node.count)
+	var (
+		i         uint64
+		period    = c.periodAt(node.count).period
+		usersMap  = make(map[proto.AccountAddress]uint64)
+		minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+	)
+
+	for i = 0; i < period && node != nil; i++ {
+		var (
+			block   *types.Block
+			release func()
+		)
+		if block, release, err = c.fetchTransientBlockOfNode(node); err != nil {
+			return
+		}
+		err = c.aggregateBilling(block, part, usersMap, minersMap)
+		release()
+		if err != nil {
+			return
+		}
+		if maxUsers > 0 && len(usersMap) > maxUsers {
+			overflow = true
+			return
 		}
 		node = node.parent
 	}
+	ub, err = c.newUpdateBilling(usersMap, minersMap)
+	return
+}
 
+// newUpdateBilling builds the UpdateBilling transaction from the aggregated user costs and miner
+// incomes, see aggregateBilling.
+func (c *Chain) newUpdateBilling(
+	usersMap map[proto.AccountAddress]uint64,
+	minersMap map[proto.AccountAddress]map[proto.AccountAddress]uint64,
+) (ub *types.UpdateBilling, err error) {
+	var i, j uint64
 	ub = types.NewUpdateBilling(&types.UpdateBillingHeader{
 		Users: make([]*types.UserCost, len(usersMap)),
 	})
-
-	i = 0
-	j = 0
 	for userAddr, cost := range usersMap {
 		log.WithField("db", c.databaseID).Debugf("user %s, cost %d", userAddr.String(), cost)
 		ub.Users[i] = &types.UserCost{
@@ -1268,9 +3636,18 @@ func (c *Chain) billing(node *blockNode) (ub *types.UpdateBilling, err error) {
 			}
 			j++
 		}
+		sort.Slice(ub.Users[i].Miners, func(x, y int) bool {
+			var mx, my = ub.Users[i].Miners[x].Miner, ub.Users[i].Miners[y].Miner
+			return bytes.Compare(mx[:], my[:]) < 0
+		})
 		j = 0
 		i++
 	}
+	// Keep the transaction reproducible regardless of the map iteration order
+	sort.Slice(ub.Users, func(x, y int) bool {
+		var ux, uy = ub.Users[x].User, ub.Users[y].User
+		return bytes.Compare(ux[:], uy[:]) < 0
+	})
 	ub.Receiver, err = c.databaseID.AccountAddress()
 	return
 }
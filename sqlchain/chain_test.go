@@ -18,22 +18,41 @@ package sqlchain
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"expvar"
 	"fmt"
 	"math/rand"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
 	"github.com/CovenantSQL/CovenantSQL/conf"
 	"github.com/CovenantSQL/CovenantSQL/consistent"
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/route"
 	"github.com/CovenantSQL/CovenantSQL/rpc"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
 )
 
 var (
@@ -359,3 +378,2525 @@ func TestMultiChain(t *testing.T) {
 
 	time.Sleep(time.Duration(testPeriodNumber) * testPeriod)
 }
+
+func TestThroughput(t *testing.T) {
+	Convey("Given a chain with some blocks pushed", t, func() {
+		var (
+			begin = time.Now().Add(-10*testPeriod - testPeriod/2)
+			cli   *nodeProfile
+			err   error
+		)
+		cli, err = newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), begin)
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, 9, func(i int) (txs []*types.QueryAsTx) {
+			for j := 0; j < 2; j++ {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+				So(err, ShouldBeNil)
+				txs = append(txs, tx)
+			}
+			return
+		})
+		So(err, ShouldBeNil)
+		Convey("The throughput should be calculated within the window", func() {
+			qps, bps, err := chain.Throughput(5 * testPeriod)
+			So(err, ShouldBeNil)
+			So(bps, ShouldAlmostEqual, 4/(5*testPeriod).Seconds())
+			So(qps, ShouldAlmostEqual, 8/(5*testPeriod).Seconds())
+			_, _, err = chain.Throughput(0)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("The throughput should be exposed via stats", func() {
+			chain.stat()
+			var stats = chain.Stats()
+			So(stats.BlocksPerSec, ShouldAlmostEqual, 9/(throughputStatPeriods*testPeriod).Seconds())
+			So(stats.QueriesPerSec, ShouldAlmostEqual, 18/(throughputStatPeriods*testPeriod).Seconds())
+		})
+		Convey("The counters and the head should be exposed via stats", func() {
+			var (
+				stats = chain.Stats()
+				head  = chain.rt.getHead()
+			)
+			So(stats.MultiIndexCount, ShouldEqual, atomic.LoadInt32(&multiIndexCount))
+			So(stats.ResponseHeaderCount, ShouldEqual, atomic.LoadInt32(&responseCount))
+			So(stats.AckCount, ShouldEqual, atomic.LoadInt32(&ackCount))
+			So(stats.CachedBlockCount, ShouldEqual, atomic.LoadInt32(&cachedBlockCount))
+			So(stats.BlockCacheTTL, ShouldEqual, chain.getBlockCacheTTL())
+			So(stats.HeadHeight, ShouldEqual, head.Height)
+			So(stats.HeadHeight, ShouldEqual, 9)
+			So(stats.Head, ShouldResemble, head.Head)
+			So(stats.NextTurn, ShouldEqual, chain.rt.getNextTurn())
+			var fc, tc = chain.st.PoolStats()
+			So(stats.PooledFailedRequests, ShouldEqual, fc)
+			So(stats.PooledQueryTrackers, ShouldEqual, tc)
+		})
+	})
+}
+
+func TestLoadChainWithCorruptedIndex(t *testing.T) {
+	Convey("Given a chain with some blocks and acks persisted", t, func() {
+		var (
+			cli  *nodeProfile
+			resp *types.SignedResponseHeader
+			ack  *types.SignedAckHeader
+			enc  *bytes.Buffer
+			err  error
+		)
+		cli, err = newRandomNode()
+		So(err, ShouldBeNil)
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			resp, err = createRandomQueryResponse(cli, cli)
+			So(err, ShouldBeNil)
+			ack, err = createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			enc, err = utils.EncodeMsgPack(ack)
+			So(err, ShouldBeNil)
+			err = chain.tdb.Put(
+				utils.ConcatAll(metaAckIndex[:], heightToKey(0), ack.Hash().AsBytes()),
+				enc.Bytes(), nil)
+			So(err, ShouldBeNil)
+		}
+		err = pushTestBlocks(chain, 5, nil)
+		So(err, ShouldBeNil)
+		// Flush blocks and acks to the table files
+		err = chain.bdb.CompactRange(util.Range{})
+		So(err, ShouldBeNil)
+		err = chain.tdb.CompactRange(util.Range{})
+		So(err, ShouldBeNil)
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		var corrupt = func(file string) {
+			tables, err := filepath.Glob(config.ChainFilePrefix + file + "/*.ldb")
+			So(err, ShouldBeNil)
+			So(len(tables), ShouldBeGreaterThan, 0)
+			for _, v := range tables {
+				f, err := os.OpenFile(v, os.O_RDWR, 0600)
+				So(err, ShouldBeNil)
+				_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 32), 16)
+				So(err, ShouldBeNil)
+				err = f.Close()
+				So(err, ShouldBeNil)
+			}
+		}
+		Convey("The chain should fail to load if the ack index is corrupted", func() {
+			corrupt("-ack-req-resp.ldb")
+			_, err = NewChain(config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "load ack")
+		})
+		var truncate = func(file string, prefix []byte) {
+			db, err := leveldb.OpenFile(config.ChainFilePrefix+file, nil)
+			So(err, ShouldBeNil)
+			var iter = db.NewIterator(util.BytesPrefix(prefix), nil)
+			So(iter.Next(), ShouldBeTrue)
+			var (
+				k = append([]byte{}, iter.Key()...)
+				v = append([]byte{}, iter.Value()...)
+			)
+			iter.Release()
+			So(iter.Error(), ShouldBeNil)
+			So(db.Put(k, v[:len(v)/2], nil), ShouldBeNil)
+			So(db.Close(), ShouldBeNil)
+		}
+		Convey("The chain should fail to load if an ack entry is truncated", func() {
+			truncate("-ack-req-resp.ldb", metaAckIndex[:])
+			_, err = NewChain(config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "load ack")
+		})
+		Convey("The chain should fail to load if a block entry is truncated", func() {
+			truncate("-block-state.ldb", metaBlockIndex[:])
+			_, err = NewChain(config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "decoding failed")
+		})
+	})
+}
+
+func TestAdviseNewBlockRetries(t *testing.T) {
+	Convey("Given a chain with advise retries configured", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.adviseRetries = 2
+		var (
+			mu    sync.Mutex
+			calls = make(map[proto.NodeID]int)
+			req   = &MuxAdviseNewBlockReq{DatabaseID: testDatabaseID}
+		)
+		// Node "flaky" fails twice and then succeeds, node "down" always fails
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[node]++
+			if node == "down" || calls[node] <= 2 {
+				return ErrUnknownMuxRequest
+			}
+			return nil
+		}}
+		Convey("Transient failures should be tolerated by retrying", func() {
+			err = chain.adviseNewBlock(context.Background(), "flaky", req)
+			So(err, ShouldBeNil)
+			So(calls["flaky"], ShouldEqual, 3)
+			err = chain.adviseNewBlock(context.Background(), "down", req)
+			So(err, ShouldNotBeNil)
+			So(calls["down"], ShouldEqual, 3)
+			var stats = chain.Stats()
+			So(stats.AdviseRetryCount, ShouldEqual, 4)
+			So(stats.AdviseFailureCount, ShouldEqual, 1)
+		})
+		Convey("Retrying should be bounded by the context deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), chain.rt.retryBackoff/2)
+			defer cancel()
+			err = chain.adviseNewBlock(ctx, "down", req)
+			So(err, ShouldNotBeNil)
+			So(calls["down"], ShouldEqual, 1)
+			So(chain.Stats().AdviseFailureCount, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestStoreVersion(t *testing.T) {
+	Convey("Given a stopped chain", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		var setVersion = func(enc []byte) {
+			bdb, err := leveldb.OpenFile(config.ChainFilePrefix+"-block-state.ldb", nil)
+			So(err, ShouldBeNil)
+			defer bdb.Close()
+			if enc == nil {
+				err = bdb.Delete(metaVersion[:], nil)
+			} else {
+				err = bdb.Put(metaVersion[:], enc, nil)
+			}
+			So(err, ShouldBeNil)
+		}
+		Convey("The chain should be reloaded with a compatible store version", func() {
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain without version marker should be reloaded as version 1", func() {
+			setVersion(nil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			enc, err := chain.bdb.Get(metaVersion[:], nil)
+			So(err, ShouldBeNil)
+			So(enc, ShouldResemble, heightToKey(int32(storeVersion)))
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain should not be reloaded with an incompatible store version", func() {
+			setVersion(heightToKey(2))
+			_, err = NewChain(config)
+			So(err, ShouldResemble, &ErrIncompatibleStoreVersion{Found: 2, Expected: storeVersion})
+			So(err.Error(), ShouldContainSubstring, "version 2")
+		})
+	})
+}
+
+func TestPendingBilling(t *testing.T) {
+	Convey("Given a chain with some blocks pushed", t, func() {
+		var (
+			cli      *nodeProfile
+			cliAddr  proto.AccountAddress
+			lastCost uint64
+			err      error
+		)
+		cli, err = newRandomNode()
+		So(err, ShouldBeNil)
+		cliAddr, err = crypto.PubKeyHash(cli.PublicKey)
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, int(testUpdatePeriod)+1, func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			lastCost = uint64(tx.Response.AffectedRows)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		Convey("Only the costs since the last billing period should be aggregated", func() {
+			costs, err := chain.PendingBilling()
+			So(err, ShouldBeNil)
+			So(costs, ShouldResemble, map[proto.AccountAddress]uint64{cliAddr: lastCost})
+		})
+	})
+}
+
+func TestBillingContribution(t *testing.T) {
+	Convey("Given a chain with a billing period of blocks pushed", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		cliAddr, err := crypto.PubKeyHash(cli.PublicKey)
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		Convey("The contributions should sum up to the billing of the period", func() {
+			var (
+				sum  = make(map[proto.AccountAddress]uint64)
+				head = chain.rt.getHead().node
+			)
+			for node := head; node != nil && node.count > 0; node = node.parent {
+				block, err := chain.fetchBlockOfNode(node)
+				So(err, ShouldBeNil)
+				costs, err := chain.BillingContribution(block)
+				So(err, ShouldBeNil)
+				So(len(costs), ShouldEqual, 1)
+				for k, v := range costs {
+					sum[k] += v
+				}
+			}
+			ub, err := chain.billing(head)
+			So(err, ShouldBeNil)
+			So(ub.Users, ShouldHaveLength, 1)
+			So(ub.Users[0].User, ShouldEqual, cliAddr)
+			So(sum, ShouldResemble, map[proto.AccountAddress]uint64{cliAddr: ub.Users[0].Cost})
+		})
+	})
+}
+
+func TestMinersForUser(t *testing.T) {
+	Convey("Given a chain with queries served by different miners", t, func() {
+		var nodes [3]*nodeProfile
+		for i := range nodes {
+			node, err := newRandomNode()
+			So(err, ShouldBeNil)
+			nodes[i] = node
+		}
+		var (
+			cli, other, miner = nodes[0], nodes[1], nodes[2]
+			addrs             [3]proto.AccountAddress
+			expected          = make(map[proto.AccountAddress]uint64)
+		)
+		for i, v := range nodes {
+			addr, err := crypto.PubKeyHash(v.PublicKey)
+			So(err, ShouldBeNil)
+			addrs[i] = addr
+		}
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, 4, func(i int) []*types.QueryAsTx {
+			tx1, err := createTestQueryTx(cli, miner, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			tx2, err := createTestQueryTx(other, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			if i > 0 {
+				expected[addrs[2]] += uint64(tx1.Response.AffectedRows)
+			}
+			return []*types.QueryAsTx{tx1, tx2}
+		})
+		So(err, ShouldBeNil)
+		Convey("Only the miners serving the user in the range should be aggregated", func() {
+			miners, err := chain.MinersForUser(addrs[0], 2, 100)
+			So(err, ShouldBeNil)
+			So(miners, ShouldResemble, expected)
+			miners, err = chain.MinersForUser(addrs[0], 0, 0)
+			So(err, ShouldBeNil)
+			So(miners, ShouldBeEmpty)
+		})
+		Convey("The invalid range should be rejected", func() {
+			_, err := chain.MinersForUser(addrs[0], 3, 2)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestVerifyBillingConservation(t *testing.T) {
+	Convey("Given a chain with two billing periods of blocks pushed", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		miner, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, 2*int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, miner, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		Convey("The user costs and the miner incomes should be conserved", func() {
+			var head = chain.rt.getHead().node
+			users, miners, err := chain.VerifyBillingConservation(0, head.count)
+			So(err, ShouldBeNil)
+			So(users, ShouldBeGreaterThan, 0)
+			So(miners, ShouldEqual, users)
+			ub, err := chain.billing(head)
+			So(err, ShouldBeNil)
+			So(ub.Users, ShouldHaveLength, 1)
+			users, miners, err = chain.VerifyBillingConservation(head.count, head.count)
+			So(err, ShouldBeNil)
+			So(users, ShouldEqual, ub.Users[0].Cost)
+			So(miners, ShouldEqual, users)
+		})
+		Convey("No billing should be settled in a range without period ends", func() {
+			users, miners, err := chain.VerifyBillingConservation(1, 1)
+			So(err, ShouldBeNil)
+			So(users, ShouldEqual, 0)
+			So(miners, ShouldEqual, 0)
+		})
+		Convey("The invalid range should be rejected", func() {
+			_, _, err := chain.VerifyBillingConservation(3, 2)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+// billingIncomes flattens the user costs and miner incomes of ub into maps.
+func billingIncomes(ub *types.UpdateBilling) (
+	costs map[proto.AccountAddress]uint64,
+	incomes map[proto.AccountAddress]map[proto.AccountAddress]uint64,
+) {
+	costs = make(map[proto.AccountAddress]uint64)
+	incomes = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+	for _, u := range ub.Users {
+		costs[u.User] = u.Cost
+		incomes[u.User] = make(map[proto.AccountAddress]uint64)
+		for _, m := range u.Miners {
+			incomes[u.User][m.Miner] = m.Income
+		}
+	}
+	return
+}
+
+func TestPreviewBilling(t *testing.T) {
+	Convey("Given a chain with two billing periods of blocks pushed", t, func() {
+		var nodes = make([]*nodeProfile, 4)
+		for i := range nodes {
+			node, err := newRandomNode()
+			So(err, ShouldBeNil)
+			nodes[i] = node
+		}
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		err = pushTestBlocks(chain, 2*int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			var txs []*types.QueryAsTx
+			for _, cli := range nodes[:2] {
+				for _, miner := range nodes[2:] {
+					tx, err := createTestQueryTx(cli, miner, types.WriteQuery, 0)
+					So(err, ShouldBeNil)
+					txs = append(txs, tx)
+				}
+			}
+			return txs
+		})
+		So(err, ShouldBeNil)
+		var (
+			head   = chain.rt.getHead().node
+			period = int32(testUpdatePeriod)
+		)
+		Convey("The preview of a period should match the billing to submit", func() {
+			for _, node := range []*blockNode{head, head.ancestorByCount(head.count - period)} {
+				ubs, err := chain.billingChunks(node)
+				So(err, ShouldBeNil)
+				So(ubs, ShouldHaveLength, 1)
+				ub, err := chain.PreviewBilling(node.count-period+1, node.count)
+				So(err, ShouldBeNil)
+				So(ub.Receiver, ShouldResemble, ubs[0].Receiver)
+				So(ub.Users, ShouldResemble, ubs[0].Users)
+				costs, incomes := billingIncomes(ub)
+				expectCosts, expectIncomes := billingIncomes(ubs[0])
+				So(costs, ShouldHaveLength, 2)
+				So(costs, ShouldResemble, expectCosts)
+				So(incomes, ShouldResemble, expectIncomes)
+			}
+		})
+		Convey("The pruned blocks should be read from the block store", func() {
+			var expect, err = chain.PreviewBilling(1, head.count)
+			So(err, ShouldBeNil)
+			for node := head; node != nil; node = node.parent {
+				node.block = nil
+			}
+			ub, err := chain.PreviewBilling(0, head.count+10)
+			So(err, ShouldBeNil)
+			costs, incomes := billingIncomes(ub)
+			expectCosts, expectIncomes := billingIncomes(expect)
+			So(costs, ShouldResemble, expectCosts)
+			So(incomes, ShouldResemble, expectIncomes)
+		})
+		Convey("The invalid range should be rejected", func() {
+			_, err := chain.PreviewBilling(3, 2)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFindGaps(t *testing.T) {
+	Convey("Given a chain with some blocks missing from the block store", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		So(pushTestBlocks(chain, 5, nil), ShouldBeNil)
+		var head = chain.rt.getHead().node
+		for _, h := range []int32{2, 4} {
+			var key = utils.ConcatAll(metaBlockIndex[:], head.ancestor(h).indexKey())
+			So(chain.bdb.Delete(key, nil), ShouldBeNil)
+		}
+		Convey("The heights of the missing blocks should be reported", func() {
+			gaps, err := chain.FindGaps(0, head.height+10)
+			So(err, ShouldBeNil)
+			So(gaps, ShouldResemble, []int32{2, 4})
+			gaps, err = chain.FindGaps(3, 4)
+			So(err, ShouldBeNil)
+			So(gaps, ShouldResemble, []int32{4})
+			gaps, err = chain.FindGaps(3, 3)
+			So(err, ShouldBeNil)
+			So(gaps, ShouldBeEmpty)
+			gaps, err = chain.FindGaps(head.height+1, head.height+10)
+			So(err, ShouldBeNil)
+			So(gaps, ShouldBeEmpty)
+		})
+		Convey("The invalid range should be rejected", func() {
+			_, err := chain.FindGaps(3, 2)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestStorageFactory(t *testing.T) {
+	Convey("Given a chain with a custom storage factory", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		So(chain.Stop(), ShouldBeNil)
+		So(os.RemoveAll(config.ChainFilePrefix+"-block-state.ldb"), ShouldBeNil)
+		So(os.RemoveAll(config.ChainFilePrefix+"-ack-req-resp.ldb"), ShouldBeNil)
+		var (
+			opened []string
+			// Keep the state data out of the data file
+			redirected = path.Join(testDataDir, fmt.Sprintf("%s-%d.db3", t.Name(), rand.Int63()))
+		)
+		config.DataFile = config.ChainFilePrefix + "-unused.db3"
+		config.StorageFactory = func(dataFile string) (xi.Storage, error) {
+			opened = append(opened, dataFile)
+			return xs.NewSqlite(redirected)
+		}
+		chain, err = NewChain(config)
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		So(opened, ShouldResemble, []string{config.DataFile})
+		Convey("The state should be served by the custom storage only", func() {
+			var newRequest = func(qt types.QueryType, pattern string) *types.Request {
+				return &types.Request{
+					Header: types.SignedRequestHeader{
+						RequestHeader: types.RequestHeader{
+							QueryType:  qt,
+							DatabaseID: testDatabaseID,
+							Timestamp:  time.Now().UTC(),
+						},
+					},
+					Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+				}
+			}
+			for _, v := range []string{
+				`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`,
+				`INSERT INTO t1 (k, v) VALUES (1, 'v1')`,
+			} {
+				_, _, err = chain.Query(newRequest(types.WriteQuery, v), true)
+				So(err, ShouldBeNil)
+			}
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT * FROM t1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 1)
+			_, err = os.Stat(config.DataFile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(redirected)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestMaxQueryDuration(t *testing.T) {
+	Convey("Given a chain with a query duration limit", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.maxQueryDuration = 100 * time.Millisecond
+		var newRequest = func(qt types.QueryType, pattern string) *types.Request {
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  qt,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+			}
+		}
+		_, _, err = chain.Query(newRequest(
+			types.WriteQuery, `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`), true)
+		So(err, ShouldBeNil)
+		_, _, err = chain.Query(newRequest(
+			types.WriteQuery, `CREATE TABLE t2 (k INT, PRIMARY KEY(k))`), true)
+		So(err, ShouldBeNil)
+		var values = make([]string, 100)
+		for i := range values {
+			values[i] = fmt.Sprintf("(%d)", i)
+		}
+		_, _, err = chain.Query(newRequest(types.WriteQuery,
+			`INSERT INTO t2 (k) VALUES `+strings.Join(values, ",")), true)
+		So(err, ShouldBeNil)
+		_, _, err = chain.st.CommitEx()
+		So(err, ShouldBeNil)
+		Convey("The slow read query should be interrupted", func() {
+			var (
+				// The 4-way cross join scans 10^8 rows, which is far beyond the duration limit
+				slow = newRequest(types.ReadQuery,
+					`SELECT count(*) FROM t2 AS a, t2 AS b, t2 AS c, t2 AS d`)
+				begin = time.Now()
+			)
+			tracker, _, err := chain.Query(slow, false)
+			So(errors.Cause(err), ShouldEqual, ErrQueryTimeout)
+			So(tracker, ShouldBeNil)
+			So(time.Since(begin), ShouldBeLessThan, 5*time.Second)
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT * FROM t1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 0)
+		})
+		Convey("The write query expired in queue should be refused", func() {
+			for i, isLeader := range []bool{true, false} {
+				chain.st.Lock()
+				var (
+					errCh = make(chan error, 1)
+					write = newRequest(types.WriteQuery,
+						fmt.Sprintf(`INSERT INTO t1 (k, v) VALUES (%d, 'v')`, i))
+				)
+				go func() {
+					tracker, _, err := chain.Query(write, isLeader)
+					if tracker != nil {
+						err = errors.New("unexpected tracker")
+					}
+					errCh <- err
+				}()
+				time.Sleep(2 * chain.rt.maxQueryDuration)
+				chain.st.Unlock()
+				So(errors.Cause(<-errCh), ShouldEqual, ErrQueryTimeout)
+			}
+			_, queries, err := chain.st.CommitEx()
+			So(err, ShouldBeNil)
+			So(queries, ShouldBeEmpty)
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT * FROM t1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 0)
+		})
+		Convey("The client deadline should not be reported as the chain timeout", func() {
+			chain.rt.maxQueryDuration = time.Hour
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			var slow = newRequest(types.ReadQuery, `WITH RECURSIVE c(x) AS (
+				SELECT 1 UNION ALL SELECT x+1 FROM c LIMIT 10000000000
+			) SELECT count(*) FROM c`)
+			slow.SetContext(ctx)
+			_, _, err = chain.Query(slow, false)
+			So(err, ShouldNotBeNil)
+			So(errors.Cause(err), ShouldNotEqual, ErrQueryTimeout)
+		})
+	})
+}
+
+func TestAwaitQueryCommitted(t *testing.T) {
+	Convey("Given a chain and some query waiting to be committed", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+		So(err, ShouldBeNil)
+		var (
+			height int32
+			werr   error
+			wg     = &sync.WaitGroup{}
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			height, werr = chain.AwaitQueryCommitted(ctx, tx.Request.Header.Hash())
+		}()
+		Convey("The waiter should be notified once the query is committed", func() {
+			err = pushTestBlocks(chain, 2, func(i int) []*types.QueryAsTx {
+				if i == 1 {
+					return []*types.QueryAsTx{tx}
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+			wg.Wait()
+			So(werr, ShouldBeNil)
+			So(height, ShouldEqual, chain.rt.getHead().Height)
+			Convey("The committed query should be found in the cached blocks", func() {
+				height, err = chain.AwaitQueryCommitted(
+					context.Background(), tx.Request.Header.Hash())
+				So(err, ShouldBeNil)
+				So(height, ShouldEqual, chain.rt.getHead().Height)
+				So(len(chain.waiters), ShouldEqual, 0)
+			})
+		})
+		Convey("The waiter should return on context cancellation", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = chain.AwaitQueryCommitted(ctx, hash.Hash{})
+			So(err, ShouldResemble, context.DeadlineExceeded)
+			err = pushTestBlocks(chain, 1, func(i int) []*types.QueryAsTx {
+				return []*types.QueryAsTx{tx}
+			})
+			So(err, ShouldBeNil)
+			wg.Wait()
+		})
+	})
+}
+
+func TestEncryptAtRest(t *testing.T) {
+	Convey("Given a chain with at-rest encryption enabled", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		err = os.RemoveAll(config.ChainFilePrefix + "-block-state.ldb")
+		So(err, ShouldBeNil)
+		err = os.RemoveAll(config.ChainFilePrefix + "-ack-req-resp.ldb")
+		So(err, ShouldBeNil)
+		config.EncryptAtRest = true
+		chain, err = NewChain(config)
+		So(err, ShouldBeNil)
+		So(chain.vc, ShouldNotBeNil)
+		err = pushTestBlocks(chain, 3, nil)
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead()
+
+		Convey("The stored block values should be encrypted", func() {
+			var (
+				k   = utils.ConcatAll(metaBlockIndex[:], head.node.indexKey())
+				v   []byte
+				blk = &types.Block{}
+			)
+			v, err = chain.bdb.Get(k, nil)
+			So(err, ShouldBeNil)
+			err = utils.DecodeMsgPack(v, blk)
+			So(err == nil && blk.BlockHash().IsEqual(&head.Head), ShouldBeFalse)
+			blk, err = chain.fetchBlockByIndexKey(head.node.indexKey())
+			So(err, ShouldBeNil)
+			So(blk.BlockHash(), ShouldResemble, &head.Head)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("A block stored under a mismatched key should be rejected", func() {
+			var (
+				k = utils.ConcatAll(metaBlockIndex[:], head.node.indexKey())
+				v []byte
+			)
+			v, err = chain.bdb.Get(k, nil)
+			So(err, ShouldBeNil)
+			err = chain.bdb.Put(
+				utils.ConcatAll(metaBlockIndex[:], head.node.parent.indexKey()), v, nil)
+			So(err, ShouldBeNil)
+			_, err = chain.fetchBlockByIndexKey(head.node.parent.indexKey())
+			So(errors.Cause(err), ShouldEqual, ErrBlockHashMismatch)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain should be reloaded with the same key", func() {
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain should not be reloaded without the encryption", func() {
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+			config.EncryptAtRest = false
+			_, err = NewChain(config)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSetBlockCacheTTL(t *testing.T) {
+	Convey("Given a chain with more blocks than the cache ttl", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, 2*int(minBlockCacheTTL), nil)
+		So(err, ShouldBeNil)
+		var countCached = func() (n int32) {
+			for node := chain.rt.getHead().node; node != nil; node = node.parent {
+				if node.block != nil {
+					n++
+				}
+			}
+			return
+		}
+		Convey("Invalid cache ttl values should be rejected", func() {
+			err = chain.SetBlockCacheTTL(minBlockCacheTTL - 1)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidBlockCacheTTL)
+			chain.updatePeriod = uint64(minBlockCacheTTL + 1)
+			err = chain.SetBlockCacheTTL(minBlockCacheTTL)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidBlockCacheTTL)
+			So(chain.getBlockCacheTTL(), ShouldEqual, minBlockCacheTTL)
+		})
+		Convey("The block cache should be pruned with the new cache ttl", func() {
+			err = chain.SetBlockCacheTTL(minBlockCacheTTL + 5)
+			So(err, ShouldBeNil)
+			So(countCached(), ShouldEqual, minBlockCacheTTL+5)
+			err = chain.SetBlockCacheTTL(minBlockCacheTTL)
+			So(err, ShouldBeNil)
+			So(countCached(), ShouldEqual, minBlockCacheTTL)
+			err = chain.SetBlockCacheTTL(minBlockCacheTTL + 10)
+			So(err, ShouldBeNil)
+			So(chain.getBlockCacheTTL(), ShouldEqual, minBlockCacheTTL+10)
+			So(countCached(), ShouldEqual, minBlockCacheTTL)
+		})
+		Convey("The cache ttl should be safely updated during the block cache prunes", func() {
+			var wg = &sync.WaitGroup{}
+			for i := int32(0); i < 8; i++ {
+				wg.Add(2)
+				go func(ttl int32) {
+					defer wg.Done()
+					if err := chain.SetBlockCacheTTL(ttl); err != nil {
+						t.Errorf("failed to set block cache ttl: %v", err)
+					}
+				}(minBlockCacheTTL + 8 - i)
+				go func() {
+					defer wg.Done()
+					chain.pruneBlockCache()
+				}()
+			}
+			wg.Wait()
+			So(chain.SetBlockCacheTTL(minBlockCacheTTL+1), ShouldBeNil)
+			So(countCached(), ShouldBeLessThanOrEqualTo, minBlockCacheTTL+1)
+			So(countCached(), ShouldBeGreaterThanOrEqualTo, minBlockCacheTTL)
+			So(chain.EffectiveConfig().BlockCacheTTL, ShouldEqual, minBlockCacheTTL+1)
+		})
+	})
+}
+
+func TestLocalBlockSendTimeout(t *testing.T) {
+	Convey("Given a chain whose local block processing is stuck", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.peers.Servers = append(chain.rt.peers.Servers, "remote")
+		chain.rt.localSendTimeout = 100 * time.Millisecond
+		var advised = make(chan *types.Block, 1)
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			if req, ok := args.(*MuxAdviseNewBlockReq); ok {
+				advised <- req.Block
+			}
+			return nil
+		}}
+		Convey("The produced block should be advised before being processed locally", func() {
+			var begin = time.Now()
+			So(chain.produceBlock(chain.rt.now()), ShouldBeNil)
+			So(time.Since(begin), ShouldBeLessThan, chain.rt.period)
+			var block = <-advised
+			chain.producedMutex.Lock()
+			So(chain.produced, ShouldNotBeNil)
+			chain.producedMutex.Unlock()
+			var processed = <-chain.blocks
+			So(processed.BlockHash(), ShouldResemble, block.BlockHash())
+			So(chain.CheckAndPushNewBlock(processed), ShouldBeNil)
+			chain.endProduced(processed)
+			So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+		})
+	})
+}
+
+func TestStopDrain(t *testing.T) {
+	Convey("Given a chain with a produced block pending in the blocks channel", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 2, nil), ShouldBeNil)
+		var errCh = make(chan error, 1)
+		go func() {
+			errCh <- chain.produceBlock(chain.rt.getTimeFromHeight(chain.rt.getHead().Height + 1))
+		}()
+		var produced hash.Hash
+		for {
+			chain.producedMutex.Lock()
+			var inflight = chain.produced != nil
+			produced = chain.producedHash
+			chain.producedMutex.Unlock()
+			if inflight {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		Convey("The block should be persisted by stop and reloadable after reopen", func() {
+			So(chain.Stop(), ShouldBeNil)
+			So(<-errCh, ShouldBeNil)
+			So(chain.isStopping(), ShouldBeTrue)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.rt.getHead().Head, ShouldResemble, produced)
+		})
+		Convey("The block should be persisted by the running block processing", func() {
+			for chain.rt.getNextTurn() <= chain.rt.getHead().Height+1 {
+				chain.rt.setNextTurn()
+			}
+			atomic.StoreInt32(&chain.started, 1)
+			chain.rt.goFunc(chain.processBlocks)
+			So(chain.Stop(), ShouldBeNil)
+			So(<-errCh, ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, produced)
+		})
+		Convey("The stop should fail if the block is not persisted in time", func() {
+			chain.rt.drainTimeout = 100 * time.Millisecond
+			var block = <-chain.blocks
+			err = chain.Stop()
+			So(errors.Cause(err), ShouldEqual, ErrDrainTimeout)
+			So(<-errCh, ShouldBeNil)
+			So(block.BlockHash(), ShouldResemble, &produced)
+		})
+	})
+}
+
+func TestBlockLimits(t *testing.T) {
+	Convey("Given a chain with a burst of pending queries", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var write = func(pattern string) {
+			var req = &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  types.WriteQuery,
+						NodeID:     cli.NodeID,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+			}
+			So(req.Sign(cli.PrivateKey), ShouldBeNil)
+			tracker, resp, err := chain.Query(req, true)
+			So(err, ShouldBeNil)
+			tracker.UpdateResp(resp)
+		}
+		write(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`)
+		for i := 1; i < 5; i++ {
+			write(fmt.Sprintf(`INSERT INTO t1 (k, v) VALUES (%d, 'v%d')`, i, i))
+		}
+		// produce produces and pushes a block, and returns the log offsets of its queries
+		var produce = func() (offsets []uint64) {
+			var errCh = make(chan error, 1)
+			go func() {
+				errCh <- chain.produceBlock(chain.rt.getTimeFromHeight(chain.rt.getHead().Height + 1))
+			}()
+			var block = <-chain.blocks
+			So(<-errCh, ShouldBeNil)
+			So(block.Verify(), ShouldBeNil)
+			So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+			chain.endProduced(block)
+			for _, v := range block.QueryTxs {
+				offsets = append(offsets, v.Response.LogOffset)
+			}
+			return
+		}
+		Convey("The queries beyond the count limit should be deferred to the next periods", func() {
+			chain.rt.maxBlockQueries = 2
+			So(produce(), ShouldResemble, []uint64{0, 1})
+			write(`INSERT INTO t1 (k, v) VALUES (5, 'v5')`)
+			So(produce(), ShouldResemble, []uint64{2, 3})
+			So(produce(), ShouldResemble, []uint64{4, 5})
+			So(produce(), ShouldBeEmpty)
+		})
+		Convey("The queries beyond the byte limit should be deferred to the next periods", func() {
+			chain.rt.maxBlockBytes = 1
+			for i := uint64(0); i < 5; i++ {
+				So(produce(), ShouldResemble, []uint64{i})
+			}
+			So(produce(), ShouldBeEmpty)
+		})
+		Convey("The queries within the limits should be packed in one block", func() {
+			chain.rt.maxBlockQueries = 5
+			chain.rt.maxBlockBytes = 1 << 20
+			So(produce(), ShouldResemble, []uint64{0, 1, 2, 3, 4})
+		})
+	})
+}
+
+func TestSerializedProducing(t *testing.T) {
+	Convey("Given a chain with slow block persistence", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var (
+			ctx, cancel = context.WithCancel(context.Background())
+			pushErrs    = make(chan error, 1000)
+			write       = func(pattern string, args ...interface{}) (err error) {
+				var query = types.Query{Pattern: pattern}
+				for _, v := range args {
+					query.Args = append(query.Args, types.NamedArg{Value: v})
+				}
+				var req = &types.Request{
+					Header: types.SignedRequestHeader{
+						RequestHeader: types.RequestHeader{
+							QueryType:  types.WriteQuery,
+							NodeID:     cli.NodeID,
+							DatabaseID: testDatabaseID,
+							Timestamp:  time.Now().UTC(),
+						},
+					},
+					Payload: types.RequestPayload{Queries: []types.Query{query}},
+				}
+				if err = req.Sign(cli.PrivateKey); err != nil {
+					return
+				}
+				tracker, resp, err := chain.Query(req, true)
+				if err != nil {
+					return
+				}
+				// Response is ready for block producing once signed
+				tracker.UpdateResp(resp)
+				return
+			}
+		)
+		defer cancel()
+		// Process the produced blocks slowly in place of processBlocks
+		go func() {
+			for {
+				select {
+				case block := <-chain.blocks:
+					time.Sleep(20 * time.Millisecond)
+					var err = chain.CheckAndPushNewBlock(block)
+					chain.endProduced(block)
+					pushErrs <- err
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		So(write(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`), ShouldBeNil)
+		Convey("The hammering production should never overlap commit cycles", func() {
+			const (
+				writers = 4
+				writes  = 20
+			)
+			var (
+				wg       = &sync.WaitGroup{}
+				queryErr = make(chan error, writers*writes)
+				produced int
+			)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < writes; j++ {
+						var k = i*writes + j
+						queryErr <- write(
+							`INSERT INTO t1 (k, v) VALUES (?, ?)`, k, fmt.Sprintf("v%d", k))
+						time.Sleep(time.Millisecond)
+					}
+				}(i)
+			}
+			var done = make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			for finished := false; !finished; {
+				select {
+				case <-done:
+					finished = true
+				default:
+				}
+				var next = chain.rt.getTimeFromHeight(chain.rt.getHead().Height + 1 + int32(produced))
+				So(chain.produceBlock(next), ShouldBeNil)
+				produced++
+			}
+			So(chain.awaitProduced(context.Background()), ShouldBeNil)
+			close(queryErr)
+			for err := range queryErr {
+				So(err, ShouldBeNil)
+			}
+			for i := 0; i < produced; i++ {
+				So(<-pushErrs, ShouldBeNil)
+			}
+			var (
+				seen  = make(map[hash.Hash]bool)
+				count int
+			)
+			for node := chain.rt.getHead().node; node != nil; node = node.parent {
+				block, err := chain.fetchBlockOfNode(node)
+				So(err, ShouldBeNil)
+				for _, v := range block.QueryTxs {
+					var h = v.Request.Header.Hash()
+					So(seen[h], ShouldBeFalse)
+					seen[h] = true
+					count++
+				}
+			}
+			So(count, ShouldEqual, writers*writes+1)
+		})
+	})
+}
+
+func TestSeparateReadPath(t *testing.T) {
+	Convey("Given a chain with separated read path", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.separateReadPath = true
+		var newRequest = func(qt types.QueryType, pattern string, args ...interface{}) *types.Request {
+			var query = types.Query{Pattern: pattern}
+			for _, v := range args {
+				query.Args = append(query.Args, types.NamedArg{Value: v})
+			}
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  qt,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{query}},
+			}
+		}
+		_, _, err = chain.Query(newRequest(
+			types.WriteQuery, `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`), true)
+		So(err, ShouldBeNil)
+		_, _, err = chain.Query(newRequest(
+			types.WriteQuery, `INSERT INTO t1 (k, v) VALUES (?, ?)`, 1, "v1"), true)
+		So(err, ShouldBeNil)
+		Convey("Read queries should not block on the state lock", func() {
+			chain.st.Lock()
+			defer chain.st.Unlock()
+			var done = make(chan *types.Response, 1)
+			go func() {
+				_, resp, _ := chain.Query(newRequest(
+					types.ReadQuery, `SELECT v FROM t1 WHERE k=?`, 1), false)
+				done <- resp
+			}()
+			select {
+			case resp := <-done:
+				So(resp, ShouldNotBeNil)
+				So(resp.Header.RowCount, ShouldEqual, 1)
+			case <-time.After(5 * time.Second):
+				So("read query blocked", ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+func TestReadStaleness(t *testing.T) {
+	Convey("Given a chain which head lags behind the current turn", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var newRead = func() *types.Request {
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  types.ReadQuery,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{
+					Queries: []types.Query{{Pattern: `SELECT 1`}},
+				},
+			}
+		}
+		Convey("The executed height should be returned with the response", func() {
+			_, _, height, err := chain.QueryWithOptions(newRead(), false, QueryOptions{})
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, chain.rt.getHead().Height)
+			_, _, height, err = chain.QueryWithOptions(
+				newRead(), false, QueryOptions{MaxStaleness: 100})
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, chain.rt.getHead().Height)
+		})
+		Convey("The read query should be rejected if the head is too stale", func() {
+			_, resp, _, err := chain.QueryWithOptions(
+				newRead(), false, QueryOptions{MaxStaleness: 3})
+			So(errors.Cause(err), ShouldEqual, ErrTooStale)
+			So(resp, ShouldBeNil)
+		})
+	})
+}
+
+func TestQueryStream(t *testing.T) {
+	Convey("Given a chain with some rows", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var newRequest = func(qt types.QueryType, pattern string, args ...interface{}) *types.Request {
+			var query = types.Query{Pattern: pattern}
+			for _, v := range args {
+				query.Args = append(query.Args, types.NamedArg{Value: v})
+			}
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  qt,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{query}},
+			}
+		}
+		_, _, err = chain.Query(newRequest(
+			types.WriteQuery, `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`), true)
+		So(err, ShouldBeNil)
+		for i := 0; i < 10; i++ {
+			_, _, err = chain.Query(newRequest(
+				types.WriteQuery, `INSERT INTO t1 (k, v) VALUES (?, ?)`, i, fmt.Sprintf("v%d", i)), true)
+			So(err, ShouldBeNil)
+		}
+		Convey("The rows should be streamed incrementally", func() {
+			iter, err := chain.QueryStream(context.Background(), newRequest(
+				types.ReadQuery, `SELECT k FROM t1 ORDER BY k`), QueryOptions{})
+			So(err, ShouldBeNil)
+			defer iter.Close()
+			var count int64
+			for ; iter.Next(); count++ {
+				So(iter.Values(), ShouldResemble, []interface{}{count})
+			}
+			So(iter.Err(), ShouldBeNil)
+			So(count, ShouldEqual, 10)
+		})
+	})
+}
+
+func TestPauseQueries(t *testing.T) {
+	Convey("Given a running chain", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		So(chain.Start(), ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var read = &types.Request{
+			Header: types.SignedRequestHeader{
+				RequestHeader: types.RequestHeader{
+					QueryType:  types.ReadQuery,
+					DatabaseID: testDatabaseID,
+					Timestamp:  time.Now().UTC(),
+				},
+			},
+			Payload: types.RequestPayload{
+				Queries: []types.Query{{Pattern: `SELECT 1`}},
+			},
+		}
+		So(chain.PauseQueries(context.Background()), ShouldBeNil)
+		Convey("Queries should be rejected while the chain keeps producing blocks", func() {
+			var height = chain.rt.getHead().Height
+			_, _, err = chain.Query(read, false)
+			So(err, ShouldEqual, ErrQueriesPaused)
+			_, err = chain.QueryStream(context.Background(), read, QueryOptions{})
+			So(err, ShouldEqual, ErrQueriesPaused)
+			time.Sleep(3 * testPeriod)
+			So(chain.rt.getHead().Height, ShouldBeGreaterThan, height)
+		})
+		Convey("Queries should be served again after resuming", func() {
+			chain.ResumeQueries()
+			_, _, err = chain.Query(read, false)
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestBlockFromFuture(t *testing.T) {
+	Convey("Given a chain and a block timestamped an hour ahead", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var head = chain.rt.getHead()
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(), time.Now().Add(time.Hour), nil)
+		So(err, ShouldBeNil)
+		Convey("The block should be rejected beyond the skew tolerance", func() {
+			chain.rt.maxBlockTimeSkew = time.Minute
+			err = chain.CheckAndPushNewBlock(block)
+			So(errors.Cause(err), ShouldEqual, ErrBlockFromFuture)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The block should not be rejected for its timestamp if the check is disabled", func() {
+			So(chain.checkBlockTime(block), ShouldBeNil)
+			chain.rt.maxBlockTimeSkew = 2 * time.Hour
+			So(chain.checkBlockTime(block), ShouldBeNil)
+		})
+	})
+}
+
+func TestBlockClockSkew(t *testing.T) {
+	Convey("Given a chain with a clock skew tolerance of a minute", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-time.Hour))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.maxClockSkew = time.Minute
+		var head = chain.rt.getHead()
+		Convey("The future-skewed block should be rejected", func() {
+			block, err := createTestBlock(
+				&head.Head, chain.rt.getServer(), time.Now().Add(10*time.Minute), nil)
+			So(err, ShouldBeNil)
+			err = chain.CheckAndPushNewBlock(block)
+			So(errors.Cause(err), ShouldEqual, ErrBlockClockSkew)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The past-skewed block should be rejected", func() {
+			block, err := createTestBlock(
+				&head.Head, chain.rt.getServer(), time.Now().Add(-10*time.Minute), nil)
+			So(err, ShouldBeNil)
+			err = chain.CheckAndPushNewBlock(block)
+			So(errors.Cause(err), ShouldEqual, ErrBlockClockSkew)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The block within the tolerance should pass the check", func() {
+			block, err := createTestBlock(
+				&head.Head, chain.rt.getServer(), time.Now().Add(-10*time.Second), nil)
+			So(err, ShouldBeNil)
+			So(chain.checkBlockTime(block), ShouldBeNil)
+			chain.rt.maxClockSkew = 0
+			block, err = createTestBlock(
+				&head.Head, chain.rt.getServer(), time.Now().Add(-10*time.Minute), nil)
+			So(err, ShouldBeNil)
+			So(chain.checkBlockTime(block), ShouldBeNil)
+		})
+	})
+}
+
+func TestProduceDelay(t *testing.T) {
+	Convey("Given a chain producing blocks", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		Convey("The produce delay should be recorded", func() {
+			var (
+				now   = chain.rt.now()
+				ideal = chain.rt.getTimeFromHeight(chain.rt.getHeightFromTime(now))
+			)
+			chain.recordProduceDelay(now)
+			var delay = chain.Stats().LastProduceDelay
+			So(delay, ShouldBeGreaterThanOrEqualTo, now.Sub(ideal))
+			So(delay, ShouldBeLessThan, chain.rt.now().Sub(ideal)+time.Millisecond)
+			So(expvar.Get("t_produce_delay:"+string(testDatabaseID)), ShouldNotBeNil)
+		})
+		Convey("The produce delay of a late block should be recorded", func() {
+			chain.recordProduceDelay(chain.rt.now().Add(-3 * chain.rt.period))
+			So(chain.Stats().LastProduceDelay, ShouldBeGreaterThan, 2*chain.rt.period)
+		})
+	})
+}
+
+func TestEvaluateBranch(t *testing.T) {
+	Convey("Given a chain with some blocks pushed", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var (
+			offset     uint64
+			newWriteTx = func(pattern string) *types.QueryAsTx {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, offset)
+				So(err, ShouldBeNil)
+				offset++
+				tx.Request.Payload.Queries = []types.Query{{Pattern: pattern}}
+				err = tx.Request.Sign(cli.PrivateKey)
+				So(err, ShouldBeNil)
+				tx.Response.RequestHash = tx.Request.Header.Hash()
+				err = tx.Response.BuildHash()
+				So(err, ShouldBeNil)
+				return tx
+			}
+			extend = func(parent *blockNode, txs ...*types.QueryAsTx) *blockNode {
+				var ts = chain.rt.getTimeFromHeight(parent.height + 1)
+				b, err := createTestBlock(&parent.hash, chain.rt.getServer(), ts, txs)
+				So(err, ShouldBeNil)
+				return newBlockNode(chain.rt.getHeightFromTime(ts), b, parent)
+			}
+		)
+		err = pushTestBlocks(chain, 3, func(i int) []*types.QueryAsTx {
+			if i == 0 {
+				return []*types.QueryAsTx{
+					newWriteTx(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`)}
+			}
+			return []*types.QueryAsTx{newWriteTx(
+				fmt.Sprintf(`INSERT INTO t1 (k, v) VALUES (%d, 'v%d')`, i, i))}
+		})
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead().node
+		Convey("The main chain should be evaluated as valid", func() {
+			valid, err := chain.EvaluateBranch(head)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+		})
+		Convey("A branch with valid queries should be evaluated as valid", func() {
+			var tip = extend(head, newWriteTx(`INSERT INTO t1 (k, v) VALUES (3, 'v3')`))
+			tip = extend(tip)
+			valid, err := chain.EvaluateBranch(tip)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+		})
+		Convey("The branch should be replayed from the nearest checkpoint", func() {
+			valid, err := chain.EvaluateBranch(head)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+			So(chain.fs.node, ShouldEqual, chain.finalizedNode())
+			// Fork before the checkpoint, so that the branch is replayed from the genesis block
+			offset = 2
+			var tip = extend(head.parent, newWriteTx(`INSERT INTO t1 (k, v) VALUES (2, 'v2')`))
+			So(tip.ancestorByCount(chain.fs.node.count), ShouldNotEqual, chain.fs.node)
+			valid, err = chain.EvaluateBranch(tip)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+		})
+		Convey("A branch failing in replay should be evaluated as invalid", func() {
+			var tip = extend(head, newWriteTx(`INSERT INTO t1 (k, v) VALUES (1, 'v1')`))
+			tip = extend(tip)
+			valid, err := chain.EvaluateBranch(tip)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeFalse)
+		})
+		Convey("A branch with a tampered block should be evaluated as invalid", func() {
+			var tip = extend(head)
+			tip.block.SignedHeader.Timestamp = tip.block.Timestamp().Add(time.Second)
+			valid, err := chain.EvaluateBranch(tip)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeFalse)
+		})
+		Convey("The live state should not be changed by evaluation", func() {
+			valid, err := chain.EvaluateBranch(head)
+			So(err, ShouldBeNil)
+			So(valid, ShouldBeTrue)
+			_, resp, err := chain.st.Query(&types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{QueryType: types.ReadQuery},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{
+					{Pattern: `SELECT name FROM sqlite_master WHERE name='t1'`}}},
+			}, false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestPruneAcks(t *testing.T) {
+	Convey("Given a chain with some acks and responses stored", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, 21, nil)
+		So(err, ShouldBeNil)
+		for h := int32(0); h <= chain.rt.getHead().Height; h++ {
+			for _, prefix := range [][]byte{metaAckIndex[:], metaResponseIndex[:]} {
+				var k = utils.ConcatAll(
+					prefix, heightToKey(h), hash.HashH(heightToKey(h)).AsBytes())
+				err = chain.tdb.Put(k, []byte("entry"), nil)
+				So(err, ShouldBeNil)
+			}
+		}
+		var heightRange = func(prefix []byte) (low, high int32) {
+			var iter = chain.tdb.NewIterator(util.BytesPrefix(prefix), nil)
+			defer iter.Release()
+			So(iter.First(), ShouldBeTrue)
+			low = keyWithSymbolToHeight(iter.Key())
+			So(iter.Last(), ShouldBeTrue)
+			high = keyWithSymbolToHeight(iter.Key())
+			return
+		}
+		var minAckHeight = func() (low int32) {
+			low, _ = heightRange(metaAckIndex[:])
+			return
+		}
+		Convey("Acks should be retained forever by default", func() {
+			So(chain.Diagnostics().AckRetentionHorizon, ShouldEqual, -1)
+			chain.pruneAcks()
+			So(minAckHeight(), ShouldEqual, 0)
+		})
+		Convey("Acks and responses older than the retention should be pruned in each turn", func() {
+			chain.rt.ackRetention = testQueryTTL + 5
+			var (
+				head    = chain.rt.getHead().node
+				horizon = chain.Diagnostics().AckRetentionHorizon
+			)
+			So(horizon, ShouldEqual, head.height-testQueryTTL-5)
+			// Run a turn without producing any block
+			chain.rt.observer = true
+			chain.runCurrentTurn(chain.rt.now())
+			for _, prefix := range [][]byte{metaAckIndex[:], metaResponseIndex[:]} {
+				var low, high = heightRange(prefix)
+				So(low, ShouldEqual, horizon)
+				So(high, ShouldEqual, head.height)
+			}
+		})
+		Convey("Acks within the unsettled billing window should be retained", func() {
+			chain.rt.ackRetention = 1
+			chain.updatePeriod = 10
+			var (
+				head    = chain.rt.getHead().node
+				horizon = chain.Diagnostics().AckRetentionHorizon
+			)
+			// The unsettled billing window starts at the block with count 21
+			So(horizon, ShouldEqual, head.height-testQueryTTL)
+			chain.pruneAcks()
+			So(minAckHeight(), ShouldEqual, horizon)
+			chain.updatePeriod = 8
+			horizon = chain.Diagnostics().AckRetentionHorizon
+			// The unsettled billing window starts at the block with count 17
+			So(horizon, ShouldEqual, head.height-4-testQueryTTL)
+			chain.updatePeriod = 30
+			horizon = chain.Diagnostics().AckRetentionHorizon
+			// The unsettled billing window starts at the block with count 1
+			So(horizon, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestLastBilling(t *testing.T) {
+	Convey("Given a new chain", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		_, _, _, err = chain.LastBilling()
+		So(err, ShouldEqual, ErrNoBillingRecord)
+		Convey("The last billing record should be persisted", func() {
+			var lb = &lastBilling{
+				Count:  int32(testUpdatePeriod),
+				TxHash: hash.HashH([]byte("tx")),
+				At:     time.Now().UTC(),
+			}
+			err = chain.putLastBilling(lb)
+			So(err, ShouldBeNil)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			count, txHash, at, err := chain.LastBilling()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, lb.Count)
+			So(txHash, ShouldResemble, lb.TxHash)
+			So(at.Equal(lb.At), ShouldBeTrue)
+		})
+	})
+}
+
+func TestBillingChunks(t *testing.T) {
+	Convey("Given a chain with a large number of distinct users in a billing period", t, func() {
+		const usersPerBlock = 1000
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			var txs = make([]*types.QueryAsTx, usersPerBlock)
+			for j := range txs {
+				tmpl, err := createTestQueryTx(cli, cli, types.WriteQuery, uint64(i*usersPerBlock+j))
+				So(err, ShouldBeNil)
+				_, pub, err := asymmetric.GenSecp256k1KeyPair()
+				So(err, ShouldBeNil)
+				var req = *tmpl.Request
+				req.Header.Signee = pub
+				txs[j] = &types.QueryAsTx{Request: &req, Response: tmpl.Response}
+			}
+			return txs
+		})
+		So(err, ShouldBeNil)
+		var (
+			head    = chain.rt.getHead().node
+			collect = func(ubs ...*types.UpdateBilling) map[proto.AccountAddress]*types.UserCost {
+				var users = make(map[proto.AccountAddress]*types.UserCost)
+				for _, ub := range ubs {
+					for _, v := range ub.Users {
+						So(users, ShouldNotContainKey, v.User)
+						users[v.User] = v
+					}
+				}
+				return users
+			}
+		)
+		expected, err := chain.billing(head)
+		So(err, ShouldBeNil)
+		So(expected.Users, ShouldHaveLength, usersPerBlock*int(testUpdatePeriod))
+		Convey("The billing should not be split without a cap", func() {
+			ubs, err := chain.billingChunks(head)
+			So(err, ShouldBeNil)
+			So(ubs, ShouldHaveLength, 1)
+			So(collect(ubs...), ShouldResemble, collect(expected))
+		})
+		Convey("The billing should be split into chunks without dropping any user", func() {
+			chain.rt.maxBillingUsers = 100
+			ubs, err := chain.billingChunks(head)
+			So(err, ShouldBeNil)
+			So(len(ubs), ShouldBeGreaterThan, len(expected.Users)/100)
+			for _, ub := range ubs {
+				So(len(ub.Users), ShouldBeBetweenOrEqual, 1, 100)
+				So(ub.Receiver, ShouldResemble, expected.Receiver)
+			}
+			So(collect(ubs...), ShouldResemble, collect(expected))
+		})
+	})
+}
+
+func TestBillingOrder(t *testing.T) {
+	Convey("Given a chain with several users served by several miners", t, func() {
+		const users, miners = 8, 4
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var pubs = make([]*asymmetric.PublicKey, users)
+		for i := range pubs {
+			_, pubs[i], err = asymmetric.GenSecp256k1KeyPair()
+			So(err, ShouldBeNil)
+		}
+		err = pushTestBlocks(chain, int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			var txs = make([]*types.QueryAsTx, 0, users*miners)
+			for j := 0; j < users*miners; j++ {
+				tmpl, err := createTestQueryTx(cli, cli, types.WriteQuery, uint64(i*users*miners+j))
+				So(err, ShouldBeNil)
+				var (
+					req  = *tmpl.Request
+					resp = *tmpl.Response
+				)
+				req.Header.Signee = pubs[j%users]
+				resp.ResponseAccount = proto.AccountAddress(hash.THashH([]byte{byte(j / users)}))
+				txs = append(txs, &types.QueryAsTx{Request: &req, Response: &resp})
+			}
+			return txs
+		})
+		So(err, ShouldBeNil)
+		Convey("The billing should be reproducible and sorted by addresses", func() {
+			var (
+				head       = chain.rt.getHead().node
+				userAddrs  = make([]proto.AccountAddress, users)
+				minerAddrs = make([]proto.AccountAddress, miners)
+				sortAddrs  = func(addrs []proto.AccountAddress) {
+					sort.Slice(addrs, func(i, j int) bool {
+						return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+					})
+				}
+			)
+			for i := range userAddrs {
+				userAddrs[i], err = crypto.PubKeyHash(pubs[i])
+				So(err, ShouldBeNil)
+			}
+			for i := range minerAddrs {
+				minerAddrs[i] = proto.AccountAddress(hash.THashH([]byte{byte(i)}))
+			}
+			sortAddrs(userAddrs)
+			sortAddrs(minerAddrs)
+			first, err := chain.billing(head)
+			So(err, ShouldBeNil)
+			So(first.Users, ShouldHaveLength, users)
+			for i, v := range first.Users {
+				So(v.User, ShouldEqual, userAddrs[i])
+				So(v.Miners, ShouldHaveLength, miners)
+				for j, m := range v.Miners {
+					So(m.Miner, ShouldEqual, minerAddrs[j])
+				}
+			}
+			for i := 0; i < 5; i++ {
+				again, err := chain.billing(head)
+				So(err, ShouldBeNil)
+				// The transaction timestamp is the only field which depends on the build time
+				again.Timestamp = first.Timestamp
+				enc0, err := utils.EncodeMsgPack(first)
+				So(err, ShouldBeNil)
+				enc1, err := utils.EncodeMsgPack(again)
+				So(err, ShouldBeNil)
+				So(enc1.Bytes(), ShouldResemble, enc0.Bytes())
+			}
+		})
+	})
+}
+
+func TestPoolTransientBlocks(t *testing.T) {
+	Convey("Given a chain with uncached blocks", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, int(testUpdatePeriod)*2, func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, uint64(i))
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead().node
+		for node := head; node != nil; node = node.parent {
+			node.block = nil
+		}
+		expected, err := chain.billing(head)
+		So(err, ShouldBeNil)
+		Convey("Billing should be the same with pooled blocks", func() {
+			chain.rt.poolTransientBlocks = true
+			for i := 0; i < 3; i++ {
+				ub, err := chain.billing(head)
+				So(err, ShouldBeNil)
+				So(ub.Users, ShouldResemble, expected.Users)
+			}
+		})
+		Convey("Pooled blocks should be cleaned on release", func() {
+			chain.rt.poolTransientBlocks = true
+			block, release, err := chain.fetchTransientBlockOfNode(head)
+			So(err, ShouldBeNil)
+			So(block.BlockHash(), ShouldResemble, &head.hash)
+			So(len(block.QueryTxs), ShouldEqual, 1)
+			release()
+			So(block.QueryTxs, ShouldBeEmpty)
+			So(block.SignedHeader, ShouldResemble, types.SignedHeader{})
+		})
+	})
+}
+
+func BenchmarkBillingPass(b *testing.B) {
+	cli, err := newRandomNode()
+	if err != nil {
+		b.Fatalf("error occurred: %v", err)
+	}
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Pooled=%v", pooled), func(b *testing.B) {
+			chain, _, err := createTestChain(b.Name(), time.Now())
+			if err != nil {
+				b.Fatalf("error occurred: %v", err)
+			}
+			defer chain.Stop()
+			chain.updatePeriod = 100
+			chain.rt.poolTransientBlocks = pooled
+			if err = pushTestBlocks(chain, int(chain.updatePeriod), func(i int) []*types.QueryAsTx {
+				var txs = make([]*types.QueryAsTx, 10)
+				for j := range txs {
+					if txs[j], err = createTestQueryTx(cli, cli, types.WriteQuery, 0); err != nil {
+						b.Fatalf("error occurred: %v", err)
+					}
+				}
+				return txs
+			}); err != nil {
+				b.Fatalf("error occurred: %v", err)
+			}
+			var head = chain.rt.getHead().node
+			for node := head; node != nil; node = node.parent {
+				node.block = nil
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = chain.billing(head); err != nil {
+					b.Fatalf("error occurred: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestInconsistentSequenceID(t *testing.T) {
+	Convey("Given a chain with inconsistent sequence ids in blocks", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		var offsets = []uint64{0, 10, 5}
+		err = pushTestBlocks(chain, len(offsets), func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, offsets[i])
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		Convey("The chain should be loaded with warnings by default", func() {
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain should not be loaded in strict mode", func() {
+			config.StrictSequenceID = true
+			_, err = NewChain(config)
+			So(errors.Cause(err), ShouldEqual, ErrInconsistentSequenceID)
+		})
+	})
+}
+
+func TestCancelInitialSync(t *testing.T) {
+	Convey("Given a chain with a long history to catch up", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-100000000*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		Convey("Start should return promptly when cancelled during initial sync", func() {
+			var (
+				begin = time.Now()
+				errCh = make(chan error, 1)
+			)
+			go func() { errCh <- chain.Start() }()
+			time.Sleep(50 * time.Millisecond)
+			chain.rt.cancel()
+			select {
+			case err = <-errCh:
+				So(err, ShouldEqual, context.Canceled)
+				So(time.Since(begin), ShouldBeLessThan, time.Second)
+			case <-time.After(5 * time.Second):
+				So("initial sync is not interrupted", ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+func TestFutureGenesis(t *testing.T) {
+	Convey("Given a chain with the genesis time in the future", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(time.Hour))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var d = chain.TimeUntilGenesis()
+		So(d, ShouldBeGreaterThan, time.Hour-time.Minute)
+		So(d, ShouldBeLessThanOrEqualTo, time.Hour)
+		Convey("The main cycle should wait for the genesis before doing any work", func() {
+			So(chain.sync(), ShouldBeNil)
+			var (
+				ctx, cancel = context.WithCancel(context.Background())
+				done        = make(chan struct{})
+			)
+			go func() {
+				defer close(done)
+				chain.mainCycle(ctx)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			So(chain.rt.getNextTurn(), ShouldEqual, 1)
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				So("main cycle is not interrupted", ShouldBeEmpty)
+			}
+		})
+	})
+	Convey("Given a chain which has already begun", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		So(chain.TimeUntilGenesis(), ShouldEqual, 0)
+	})
+}
+
+func TestProducerVersion(t *testing.T) {
+	Convey("Given a chain tagging the produced blocks with version", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.producerVersion = "v0.1.0"
+		So(pushTestBlocks(chain, 2, nil), ShouldBeNil)
+		Convey("The produced block should carry the version tag", func() {
+			var errCh = make(chan error, 1)
+			go func() {
+				errCh <- chain.produceBlock(chain.rt.getTimeFromHeight(chain.rt.getHead().Height + 1))
+			}()
+			var block = <-chain.blocks
+			So(<-errCh, ShouldBeNil)
+			So(block.ProducerVersion, ShouldEqual, "v0.1.0")
+			So(block.Verify(), ShouldBeNil)
+			So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+			headers, err := chain.RecentHeaders(2)
+			So(err, ShouldBeNil)
+			So(headers, ShouldHaveLength, 2)
+			So(headers[0].Hash, ShouldResemble, *block.BlockHash())
+			So(headers[0].ProducerVersion, ShouldEqual, "v0.1.0")
+			So(headers[1].Count, ShouldEqual, headers[0].Count-1)
+			So(headers[1].ProducerVersion, ShouldBeEmpty)
+		})
+		Convey("The recent headers should be truncated at the genesis block", func() {
+			headers, err := chain.RecentHeaders(10)
+			So(err, ShouldBeNil)
+			So(headers, ShouldHaveLength, 3)
+			So(headers[2].Count, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestBlockNotFound(t *testing.T) {
+	Convey("Given a chain with a billing period of blocks pushed", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		err = pushTestBlocks(chain, int(testUpdatePeriod), func(i int) []*types.QueryAsTx {
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			return []*types.QueryAsTx{tx}
+		})
+		So(err, ShouldBeNil)
+		var (
+			head = chain.rt.getHead().node
+			node = head.parent
+		)
+		So(node, ShouldNotBeNil)
+		node.block = nil
+		Convey("A block missing from the block store should be reported as not found", func() {
+			defer chain.Stop()
+			err = chain.bdb.Delete(utils.ConcatAll(metaBlockIndex[:], node.indexKey()), nil)
+			So(err, ShouldBeNil)
+			block, err := chain.FetchBlock(node.height)
+			So(errors.Cause(err), ShouldEqual, ErrBlockNotFound)
+			So(block, ShouldBeNil)
+			_, err = chain.billing(head)
+			So(errors.Cause(err), ShouldEqual, ErrBlockNotFound)
+			block, err = chain.FetchBlock(head.height + 1)
+			So(err, ShouldBeNil)
+			So(block, ShouldBeNil)
+		})
+		Convey("A block store I/O error should be preserved", func() {
+			So(chain.bdb.Close(), ShouldBeNil)
+			defer chain.Stop()
+			_, err := chain.FetchBlock(node.height)
+			So(errors.Cause(err), ShouldEqual, leveldb.ErrClosed)
+			_, err = chain.billing(head)
+			So(errors.Cause(err), ShouldEqual, leveldb.ErrClosed)
+		})
+	})
+}
+
+func TestStartWithStalledSync(t *testing.T) {
+	Convey("Given a chain lagging behind a peer which never serves any block", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.maxSyncStalls = 2
+		chain.rt.peers.Servers = append(chain.rt.peers.Servers, "remote")
+		var (
+			mu    sync.Mutex
+			calls int
+		)
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return ErrUnknownMuxRequest
+		}}
+		Convey("The chain should start after giving up the initial sync", func() {
+			err = chain.Start()
+			So(err, ShouldBeNil)
+			mu.Lock()
+			defer mu.Unlock()
+			// One fetch per stalled attempt, the main cycle may have fetched more since then
+			So(calls, ShouldBeGreaterThanOrEqualTo, chain.rt.maxSyncStalls)
+			So(chain.rt.getHead().Height, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestResponseAccounts(t *testing.T) {
+	Convey("Given a chain validating the response accounts", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.responseAccounts = make(map[proto.AccountAddress]struct{})
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		other, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var (
+			head     = chain.rt.getHead()
+			ts       = chain.rt.getTimeFromHeight(head.Height + 1)
+			producer = &nodeProfile{NodeID: chain.rt.getServer(), PublicKey: testPubKey}
+		)
+		var createBlock = func(worker *nodeProfile) *types.Block {
+			tx, err := createTestQueryTx(cli, worker, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, []*types.QueryAsTx{tx})
+			So(err, ShouldBeNil)
+			return block
+		}
+		Convey("A block crediting a different miner for its responses should be rejected", func() {
+			err = chain.CheckAndPushNewBlock(createBlock(other))
+			So(errors.Cause(err), ShouldEqual, ErrInvalidResponseAccount)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("A block crediting its producer should be accepted", func() {
+			err = chain.CheckAndPushNewBlock(createBlock(producer))
+			So(err, ShouldBeNil)
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+1)
+		})
+		Convey("A block crediting a delegated miner should be accepted", func() {
+			addr, err := crypto.PubKeyHash(other.PublicKey)
+			So(err, ShouldBeNil)
+			chain.rt.responseAccounts[addr] = struct{}{}
+			err = chain.CheckAndPushNewBlock(createBlock(other))
+			So(err, ShouldBeNil)
+		})
+	})
+}
+
+func TestPushBlockAckIndexRollback(t *testing.T) {
+	Convey("Given a chain and a block whose second response conflicts with the ack index", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		worker, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var txs = make([]*types.QueryAsTx, 2)
+		for i := range txs {
+			txs[i], err = createTestQueryTx(cli, worker, types.WriteQuery, uint64(i))
+			So(err, ShouldBeNil)
+		}
+		var conflict = *txs[1].Response
+		conflict.AffectedRows++
+		err = conflict.BuildHash()
+		So(err, ShouldBeNil)
+		err = chain.AddResponse(&conflict)
+		So(err, ShouldBeNil)
+		var (
+			head = chain.rt.getHead()
+			ts   = chain.rt.getTimeFromHeight(head.Height + 1)
+		)
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, txs)
+		So(err, ShouldBeNil)
+		Convey("The failed push should leave both the chain and the ack index untouched", func() {
+			err = chain.pushBlock(block)
+			So(errors.Cause(err), ShouldEqual, ErrResponseSeqNotMatch)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			fetched, err := chain.FetchBlock(head.Height + 1)
+			So(err, ShouldBeNil)
+			So(fetched, ShouldBeNil)
+			var index = func(resp *types.SignedResponseHeader) *types.SignedResponseHeader {
+				mi, err := chain.ai.load(chain.rt.getHeightFromTime(resp.GetRequestTimestamp()))
+				So(err, ShouldBeNil)
+				mi.RLock()
+				defer mi.RUnlock()
+				return mi.respIndex[resp.Request.GetQueryKey()]
+			}
+			So(index(txs[0].Response), ShouldBeNil)
+			So(index(txs[1].Response), ShouldEqual, &conflict)
+		})
+		Convey("The block should be pushed once the conflict is resolved", func() {
+			err = chain.ai.remove(chain.rt.getHeightFromTime(conflict.GetRequestTimestamp()),
+				&types.SignedAckHeader{AckHeader: types.AckHeader{Response: conflict.ResponseHeader}})
+			So(err, ShouldBeNil)
+			err = chain.pushBlock(block)
+			So(err, ShouldBeNil)
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+1)
+		})
+		Convey("A block acknowledging an untracked query should be pushed", func() {
+			resp, err := createRandomQueryResponse(cli, worker)
+			So(err, ShouldBeNil)
+			ack, err := createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			block.Acks = []*types.SignedAckHeader{ack}
+			block.QueryTxs = txs[:1]
+			So(block.PackAndSignBlock(testPrivKey), ShouldBeNil)
+			err = chain.pushBlock(block)
+			So(err, ShouldBeNil)
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+1)
+		})
+	})
+}
+
+func TestResponsePersistence(t *testing.T) {
+	Convey("Given a chain with an unacknowledged and an acknowledged response", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var (
+			resps = make([]*types.SignedResponseHeader, 2)
+			index = func(resp *types.SignedResponseHeader) *types.SignedResponseHeader {
+				mi, err := chain.ai.load(chain.rt.getHeightFromTime(resp.GetRequestTimestamp()))
+				So(err, ShouldBeNil)
+				mi.RLock()
+				defer mi.RUnlock()
+				return mi.respIndex[resp.Request.GetQueryKey()]
+			}
+		)
+		var addResponses = func() {
+			for i := range resps {
+				resps[i], err = createRandomQueryResponse(cli, cli)
+				So(err, ShouldBeNil)
+				So(chain.AddResponse(resps[i]), ShouldBeNil)
+			}
+			ack, err := createRandomQueryAckWithResponse(resps[1], cli)
+			So(err, ShouldBeNil)
+			So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+		}
+		Convey("The unacknowledged response should survive a restart", func() {
+			addResponses()
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(index(resps[0]), ShouldResemble, resps[0])
+			So(index(resps[1]), ShouldBeNil)
+		})
+		Convey("No response should be restored if the persistence is disabled", func() {
+			chain.rt.persistResponses = false
+			addResponses()
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(index(resps[0]), ShouldBeNil)
+			So(index(resps[1]), ShouldBeNil)
+		})
+	})
+}
+
+func TestAckWithInvertedTimestamps(t *testing.T) {
+	Convey("Given a response timestamped before its request", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		resp, err := createRandomQueryResponse(cli, cli)
+		So(err, ShouldBeNil)
+		resp.Timestamp = resp.Request.Timestamp.Add(-testPeriod)
+		So(resp.BuildHash(), ShouldBeNil)
+		So(chain.AddResponse(resp), ShouldBeNil)
+		ack, err := createRandomQueryAckWithResponse(resp, cli)
+		So(err, ShouldBeNil)
+		Convey("The ack should be rejected before any index mutation", func() {
+			err = chain.VerifyAndPushAckedQuery(ack)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidAckTimestamps)
+			mi, err := chain.ai.load(chain.rt.getHeightFromTime(resp.GetRequestTimestamp()))
+			So(err, ShouldBeNil)
+			mi.RLock()
+			So(mi.respIndex[resp.Request.GetQueryKey()], ShouldResemble, resp)
+			So(mi.ackIndex[resp.Request.GetQueryKey()], ShouldBeNil)
+			mi.RUnlock()
+			var iter = chain.tdb.NewIterator(util.BytesPrefix(metaAckIndex[:]), nil)
+			defer iter.Release()
+			So(iter.Next(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestRestoreAckIndex(t *testing.T) {
+	Convey("Given a chain with a pending response and a pending ack persisted", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var resps = make([]*types.SignedResponseHeader, 2)
+		for i := range resps {
+			resps[i], err = createRandomQueryResponse(cli, cli)
+			So(err, ShouldBeNil)
+			So(chain.AddResponse(resps[i]), ShouldBeNil)
+		}
+		ack, err := createRandomQueryAckWithResponse(resps[1], cli)
+		So(err, ShouldBeNil)
+		So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+		Convey("Both of them should reappear in the ack index after a restart", func() {
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			var load = func(resp *types.SignedResponseHeader) (
+				*types.SignedResponseHeader, *types.SignedAckHeader,
+			) {
+				mi, err := chain.ai.load(chain.rt.getHeightFromTime(resp.GetRequestTimestamp()))
+				So(err, ShouldBeNil)
+				mi.RLock()
+				defer mi.RUnlock()
+				var key = resp.Request.GetQueryKey()
+				return mi.respIndex[key], mi.ackIndex[key]
+			}
+			resp, rack := load(resps[0])
+			So(resp, ShouldResemble, resps[0])
+			So(rack, ShouldBeNil)
+			resp, rack = load(resps[1])
+			So(resp, ShouldBeNil)
+			So(rack, ShouldResemble, ack)
+		})
+	})
+}
+
+func TestSyncHeadWithInvalidBlock(t *testing.T) {
+	Convey("Given a chain lagging behind a bad peer and a good peer", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.peers.Servers = append(chain.rt.peers.Servers, "bad", "good")
+		chain.rt.setNextTurn()
+		var (
+			head = chain.rt.getHead()
+			ts   = chain.rt.getTimeFromHeight(head.Height + 1)
+		)
+		good, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+		So(err, ShouldBeNil)
+		bad, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+		So(err, ShouldBeNil)
+		bad.ProducerVersion = "tampered"
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			switch node {
+			case "bad":
+				reply.(*MuxFetchBlockResp).Block = bad
+			case "good":
+				reply.(*MuxFetchBlockResp).Block = good
+			}
+			return nil
+		}}
+		Convey("The block should be fetched from the good peer after the bad one", func() {
+			go chain.syncHead()
+			var fetched *types.Block
+			select {
+			case fetched = <-chain.blocks:
+			case <-time.After(10 * time.Second):
+			}
+			So(fetched, ShouldEqual, good)
+			// The bad peer is fetched concurrently and may be reported later
+			for i := 0; i < 100 && len(chain.Stats().BadBlockCounts) == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(chain.Stats().BadBlockCounts, ShouldResemble, map[proto.NodeID]int64{"bad": 1})
+		})
+	})
+}
+
+func TestDrainPending(t *testing.T) {
+	Convey("Given a chain with some pending queries", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var newRequest = func(pattern string) *types.Request {
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  types.WriteQuery,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+			}
+		}
+		var reqs = []*types.Request{
+			newRequest(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`),
+			newRequest(`INSERT INTO t1 (k, v) VALUES (1, 'v1')`),
+		}
+		for _, v := range reqs {
+			_, _, err = chain.Query(v, true)
+			So(err, ShouldBeNil)
+		}
+		Convey("The pending queries should be drained in order", func() {
+			drained, err := chain.DrainPending()
+			So(err, ShouldBeNil)
+			So(drained, ShouldResemble, reqs)
+			Convey("Nothing should be left in the pending set", func() {
+				drained, err = chain.DrainPending()
+				So(err, ShouldBeNil)
+				So(drained, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestFetchBlockRange(t *testing.T) {
+	Convey("Given a chain with more blocks than a range can return", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, maxFetchBlockRange+1, nil)
+		So(err, ShouldBeNil)
+		chain.pruneBlockCache()
+		var (
+			head  = chain.rt.getHead().node
+			nodes []*blockNode
+		)
+		for n := head; n != nil; n = n.parent {
+			nodes = append([]*blockNode{n}, nodes...)
+		}
+		So(nodes[0].block, ShouldBeNil)
+		So(head.block, ShouldNotBeNil)
+		var check = func(blocks []*types.Block, nodes []*blockNode) {
+			So(blocks, ShouldHaveLength, len(nodes))
+			for i, v := range blocks {
+				So(v.BlockHash(), ShouldResemble, &nodes[i].hash)
+			}
+		}
+		Convey("The blocks spanning the pruned and cached ones should be fetched in order", func() {
+			blocks, err := chain.FetchBlockRange(2, head.height)
+			So(err, ShouldBeNil)
+			check(blocks, nodes[2:])
+		})
+		Convey("The number of the fetched blocks should be capped", func() {
+			blocks, err := chain.FetchBlockRange(0, head.height+10)
+			So(err, ShouldBeNil)
+			check(blocks, nodes[:maxFetchBlockRange])
+		})
+		Convey("No block should be fetched beyond the current head", func() {
+			blocks, err := chain.FetchBlockRange(head.height+1, head.height+10)
+			So(err, ShouldBeNil)
+			So(blocks, ShouldBeEmpty)
+		})
+		Convey("The invalid range should be rejected", func() {
+			_, err := chain.FetchBlockRange(2, 1)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("The blocks should be fetched through the RPC service", func() {
+			var (
+				mux = &MuxService{}
+				req = &MuxFetchBlockRangeReq{
+					DatabaseID:         chain.databaseID,
+					FetchBlockRangeReq: FetchBlockRangeReq{From: 1, To: 3},
+				}
+				resp = &MuxFetchBlockRangeResp{}
+			)
+			mux.register(chain.databaseID, newChainRPCService(chain, nil))
+			err = mux.FetchBlockRange(req, resp)
+			So(err, ShouldBeNil)
+			check(resp.Blocks, nodes[1:4])
+		})
+	})
+}
+
+func TestAdviseFailures(t *testing.T) {
+	Convey("Given the failures of advising a block to some peers", t, func() {
+		var (
+			failures = &adviseFailures{}
+			errFail  = errors.New("unreachable")
+		)
+		for _, v := range []proto.NodeID{"c", "a", "b"} {
+			failures.add(v, errFail)
+		}
+		Convey("They should be summarized in a single line", func() {
+			So(failures.summary(5), ShouldEqual, "advised 2/5 peers, 3 failed: [a b c]")
+			So(failures.errors(), ShouldResemble, map[proto.NodeID]string{
+				"a": "unreachable", "b": "unreachable", "c": "unreachable",
+			})
+		})
+	})
+}
+
+func TestSyncHeadWithSlowPeer(t *testing.T) {
+	Convey("Given a chain lagging behind a slow peer and a fast peer", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.peers.Servers = append(chain.rt.peers.Servers, "slow", "fast")
+		chain.rt.setNextTurn()
+		var (
+			head      = chain.rt.getHead()
+			ts        = chain.rt.getTimeFromHeight(head.Height + 1)
+			cancelled = make(chan struct{})
+		)
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+		So(err, ShouldBeNil)
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			if node == "slow" {
+				select {
+				case <-ctx.Done():
+					close(cancelled)
+					return ctx.Err()
+				case <-time.After(10 * time.Second):
+				}
+			}
+			reply.(*MuxFetchBlockResp).Block = block
+			return nil
+		}}
+		Convey("The block should be taken from the fast peer without waiting", func() {
+			var start = time.Now()
+			go chain.syncHead()
+			var fetched *types.Block
+			select {
+			case fetched = <-chain.blocks:
+			case <-time.After(5 * time.Second):
+			}
+			So(fetched, ShouldEqual, block)
+			So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				So("slow fetch not cancelled", ShouldBeEmpty)
+			}
+			select {
+			case <-chain.blocks:
+				So("block accepted twice", ShouldBeEmpty)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	})
+}
+
+func TestSwapStorage(t *testing.T) {
+	Convey("Given a chain with some data in its state", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var newRequest = func(qt types.QueryType, pattern string) *types.Request {
+			return &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  qt,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+			}
+		}
+		for _, v := range []string{
+			`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`,
+			`INSERT INTO t1 (k, v) VALUES (1, 'v1')`,
+		} {
+			_, _, err = chain.Query(newRequest(types.WriteQuery, v), true)
+			So(err, ShouldBeNil)
+		}
+		var newStorage = func() *xs.SQLite3 {
+			strg, err := xs.NewSqlite(path.Join(testDataDir,
+				fmt.Sprintf("%s-%d.db3", t.Name(), rand.Int63())))
+			So(err, ShouldBeNil)
+			return strg
+		}
+		Convey("The state should be copied to an empty storage and served from it", func() {
+			var strg = newStorage()
+			err = chain.SwapStorage(context.Background(), strg)
+			So(err, ShouldBeNil)
+			So(chain.EffectiveConfig().QueriesPaused, ShouldBeFalse)
+			_, _, err = chain.Query(newRequest(
+				types.WriteQuery, `INSERT INTO t1 (k, v) VALUES (2, 'v2')`), true)
+			So(err, ShouldBeNil)
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT * FROM t1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 2)
+		})
+		Convey("A storage which is not caught up should be rejected", func() {
+			var strg = newStorage()
+			defer strg.Close()
+			_, err = strg.Writer().Exec(`CREATE TABLE t2 (k INT)`)
+			So(err, ShouldBeNil)
+			err = chain.SwapStorage(context.Background(), strg)
+			So(errors.Cause(err), ShouldEqual, x.ErrStorageNotCaughtUp)
+			So(chain.EffectiveConfig().QueriesPaused, ShouldBeFalse)
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT * FROM t1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 1)
+		})
+	})
+}
+
+func TestAggregateBillingWithFailedRequests(t *testing.T) {
+	Convey("Given blocks with the queries of a user to two miners", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		worker, err := newRandomNode()
+		So(err, ShouldBeNil)
+		tx, err := createTestQueryTx(cli, worker, types.WriteQuery, 0)
+		So(err, ShouldBeNil)
+		failed, err := createTestQueryTx(cli, worker, types.WriteQuery, 0)
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead()
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(),
+			chain.rt.getTimeFromHeight(head.Height+1), []*types.QueryAsTx{tx})
+		So(err, ShouldBeNil)
+		// The failed requests are credited to the block producer
+		block.FailedReqs = []*types.Request{failed.Request}
+		So(block.PackAndSignBlock(testPrivKey), ShouldBeNil)
+		userAddr, err := crypto.PubKeyHash(cli.PublicKey)
+		So(err, ShouldBeNil)
+		workerAddr, err := crypto.PubKeyHash(worker.PublicKey)
+		So(err, ShouldBeNil)
+		producerAddr, err := crypto.PubKeyHash(testPubKey)
+		So(err, ShouldBeNil)
+		Convey("The incomes of both miners should be retained", func() {
+			var (
+				usersMap  = make(map[proto.AccountAddress]uint64)
+				minersMap = make(map[proto.AccountAddress]map[proto.AccountAddress]uint64)
+				queries   = uint64(len(failed.Request.Payload.Queries))
+				affected  = uint64(tx.Response.AffectedRows)
+			)
+			So(chain.aggregateBilling(block, billingPartition{}, usersMap, minersMap), ShouldBeNil)
+			So(minersMap[userAddr], ShouldResemble, map[proto.AccountAddress]uint64{
+				workerAddr:   affected,
+				producerAddr: queries,
+			})
+			So(usersMap[userAddr], ShouldEqual, affected+queries)
+			// Aggregate the block once more as if it were another block of the period
+			So(chain.aggregateBilling(block, billingPartition{}, usersMap, minersMap), ShouldBeNil)
+			So(minersMap[userAddr], ShouldResemble, map[proto.AccountAddress]uint64{
+				workerAddr:   2 * affected,
+				producerAddr: 2 * queries,
+			})
+			So(usersMap[userAddr], ShouldEqual, 2*(affected+queries))
+		})
+	})
+}
+
+func TestBlockValidator(t *testing.T) {
+	Convey("Given a chain with a block validator rejecting the blocks with queries", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		var (
+			head      = chain.rt.getHead()
+			ts        = chain.rt.getTimeFromHeight(head.Height + 1)
+			producer  = &nodeProfile{NodeID: chain.rt.getServer(), PublicKey: testPubKey}
+			errPolicy = errors.New("queries not allowed")
+			parents   []*blockNode
+		)
+		chain.validator = func(block *types.Block, parent *blockNode) error {
+			parents = append(parents, parent)
+			if len(block.QueryTxs) > 0 {
+				return errPolicy
+			}
+			return nil
+		}
+		Convey("An otherwise valid block should be rejected by the validator", func() {
+			tx, err := createTestQueryTx(cli, producer, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			block, err := createTestBlock(
+				&head.Head, chain.rt.getServer(), ts, []*types.QueryAsTx{tx})
+			So(err, ShouldBeNil)
+			err = chain.CheckAndPushNewBlock(block)
+			So(errors.Cause(err), ShouldEqual, errPolicy)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			So(parents, ShouldResemble, []*blockNode{head.node})
+			Convey("The block should be accepted without the validator", func() {
+				chain.validator = nil
+				So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+				So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+			})
+		})
+		Convey("A block passing the validator should be accepted", func() {
+			block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+			So(err, ShouldBeNil)
+			So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+			So(chain.rt.getHead().Height, ShouldEqual, head.Height+1)
+			So(parents, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// chainEventBuffer is the number of pending chain events buffered for each subscriber.
+const chainEventBuffer = 64
+
+// ChainEventType is the type of a chain event.
+type ChainEventType int
+
+const (
+	// BlockPushed indicates that a block is pushed to the best chain.
+	BlockPushed ChainEventType = iota
+	// HeadChanged indicates that the head of the best chain is changed, by a pushed block, a reorg
+	// or a rewind.
+	HeadChanged
+	// Reorg indicates that the best chain is switched to a side branch, see ReorgEvent. It's
+	// followed by the BlockPushed events of the applied blocks.
+	Reorg
+)
+
+func (t ChainEventType) String() string {
+	switch t {
+	case BlockPushed:
+		return "BlockPushed"
+	case HeadChanged:
+		return "HeadChanged"
+	case Reorg:
+		return "Reorg"
+	default:
+		return "Unknown"
+	}
+}
+
+// ChainEvent describes a progress of the chain. Hash, Height and Count are of the pushed block for
+// BlockPushed, or of the new head for HeadChanged and Reorg.
+type ChainEvent struct {
+	Type   ChainEventType
+	Hash   hash.Hash
+	Height int32
+	Count  int32
+}
+
+// chainSubscribers is the set of chain event subscribers of a chain.
+type chainSubscribers struct {
+	sync.Mutex
+	subs []chan ChainEvent
+}
+
+// Subscribe subscribes to the chain events, and returns the event channel and a function to
+// unsubscribe, which closes the channel. The events are sent in the order they happen, and are
+// dropped with warnings if the subscriber falls behind, so that block processing is never
+// stalled.
+func (c *Chain) Subscribe() (<-chan ChainEvent, func()) {
+	var (
+		events = make(chan ChainEvent, chainEventBuffer)
+		once   sync.Once
+	)
+	c.chainSubs.Lock()
+	c.chainSubs.subs = append(c.chainSubs.subs, events)
+	c.chainSubs.Unlock()
+	return events, func() {
+		once.Do(func() {
+			c.chainSubs.Lock()
+			defer c.chainSubs.Unlock()
+			for i, v := range c.chainSubs.subs {
+				if v == events {
+					c.chainSubs.subs = append(c.chainSubs.subs[:i], c.chainSubs.subs[i+1:]...)
+					break
+				}
+			}
+			close(events)
+		})
+	}
+}
+
+// publishChainEvent publishes an event of type typ about node to the subscribers without
+// blocking.
+func (c *Chain) publishChainEvent(typ ChainEventType, node *blockNode) {
+	c.chainSubs.Lock()
+	defer c.chainSubs.Unlock()
+	var ev = ChainEvent{Type: typ, Hash: node.hash, Height: node.height, Count: node.count}
+	for i, events := range c.chainSubs.subs {
+		select {
+		case events <- ev:
+		default:
+			log.WithFields(log.Fields{
+				"db":         c.databaseID,
+				"type":       typ.String(),
+				"subscriber": i,
+			}).Warning("chain event dropped: subscriber falls behind")
+		}
+	}
+}
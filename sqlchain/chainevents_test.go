@@ -0,0 +1,102 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestSubscribe(t *testing.T) {
+	Convey("Given a chain with a subscriber", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var (
+			events, unsubscribe = chain.Subscribe()
+			genesis             = chain.rt.getHead().node
+			next                = func() (ev ChainEvent) {
+				select {
+				case ev = <-events:
+				case <-time.After(time.Second):
+					So("chain event is not received", ShouldBeEmpty)
+				}
+				return
+			}
+		)
+		Convey("The pushed blocks should be published in order", func() {
+			defer unsubscribe()
+			So(pushTestBlocks(chain, 2, nil), ShouldBeNil)
+			var head = chain.rt.getHead().node
+			for _, n := range []*blockNode{head.parent, head} {
+				So(next(), ShouldResemble, ChainEvent{
+					Type: BlockPushed, Hash: n.hash, Height: n.height, Count: n.count,
+				})
+				So(next(), ShouldResemble, ChainEvent{
+					Type: HeadChanged, Hash: n.hash, Height: n.height, Count: n.count,
+				})
+			}
+			Convey("The reorg should be published with the applied blocks", func() {
+				chain.rt.confirmationDepth = 5
+				var (
+					parent = genesis.hash
+					side   []*types.Block
+				)
+				for h := int32(1); h <= 3; h++ {
+					var ts = chain.rt.getTimeFromHeight(h).Add(time.Millisecond)
+					block, err := createTestBlock(&parent, chain.rt.getServer(), ts, nil)
+					So(err, ShouldBeNil)
+					So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+					side = append(side, block)
+					parent = *block.BlockHash()
+				}
+				var tip = chain.rt.getHead().node
+				So(tip.hash, ShouldResemble, *side[2].BlockHash())
+				So(next(), ShouldResemble, ChainEvent{
+					Type: Reorg, Hash: tip.hash, Height: tip.height, Count: tip.count,
+				})
+				for i, v := range side {
+					var ev = next()
+					So(ev.Type, ShouldEqual, BlockPushed)
+					So(ev.Hash, ShouldResemble, *v.BlockHash())
+					So(ev.Count, ShouldEqual, i+1)
+				}
+				So(next(), ShouldResemble, ChainEvent{
+					Type: HeadChanged, Hash: tip.hash, Height: tip.height, Count: tip.count,
+				})
+			})
+		})
+		Convey("The events should be dropped if the subscriber falls behind", func() {
+			So(pushTestBlocks(chain, chainEventBuffer, nil), ShouldBeNil)
+			So(events, ShouldHaveLength, chainEventBuffer)
+			Convey("The channel should be closed once unsubscribed", func() {
+				unsubscribe()
+				unsubscribe()
+				var n int
+				for range events {
+					n++
+				}
+				So(n, ShouldEqual, chainEventBuffer)
+				So(pushTestBlocks(chain, 1, nil), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// checkCheckpoint returns ErrCheckpointMismatch if a trusted checkpoint exists at count and h
+// isn't its block hash. A mismatch means that the chain has forked before a known-good block,
+// so it's reported as a critical alert.
+func (c *Chain) checkCheckpoint(count int32, h *hash.Hash) (err error) {
+	var expected, ok = c.rt.checkpoints[count]
+	if !ok || expected.IsEqual(h) {
+		return
+	}
+	log.WithFields(log.Fields{
+		"db":       c.databaseID,
+		"count":    count,
+		"expected": expected.String(),
+		"actual":   h.String(),
+	}).Error("CRITICAL: chain diverges from trusted checkpoint")
+	return errors.Wrapf(ErrCheckpointMismatch, "block %s at count %d, expected %s",
+		h.String(), count, expected.String())
+}
+
+// checkCheckpointsOfBranch checks that the branch ending at tip passes through all the trusted
+// checkpoints it has reached.
+func (c *Chain) checkCheckpointsOfBranch(tip *blockNode) (err error) {
+	if tip == nil {
+		return
+	}
+	for count := range c.rt.checkpoints {
+		var node = tip.ancestorByCount(count)
+		if node == nil {
+			// Not reached yet
+			continue
+		}
+		if err = c.checkCheckpoint(count, &node.hash); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+)
+
+func TestCheckpoints(t *testing.T) {
+	Convey("Given a chain with some blocks", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 2, nil), ShouldBeNil)
+		var (
+			head     = chain.rt.getHead()
+			next     = head.node.count + 1
+			trusted  = head.node.ancestorByCount(1).hash
+			diverged = hash.THashH([]byte(t.Name()))
+		)
+		block, err := createTestBlock(
+			&head.Head, chain.rt.getServer(), chain.rt.getTimeFromHeight(head.Height+1), nil)
+		So(err, ShouldBeNil)
+		Convey("A block diverging from the checkpoint should be rejected", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			chain.rt.checkpoints = map[int32]hash.Hash{next: diverged}
+			err = chain.CheckAndPushNewBlock(block)
+			So(errors.Cause(err), ShouldEqual, ErrCheckpointMismatch)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("A block matching the checkpoint should be accepted", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			chain.rt.checkpoints = map[int32]hash.Hash{next: *block.BlockHash()}
+			So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+		})
+		Convey("Loading a chain passing through the checkpoints should succeed", func() {
+			So(chain.Stop(), ShouldBeNil)
+			config.Checkpoints = map[int32]hash.Hash{1: trusted, next + 10: diverged}
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			So(chain.Stop(), ShouldBeNil)
+		})
+		Convey("Loading a chain diverging from the checkpoint should fail", func() {
+			So(chain.Stop(), ShouldBeNil)
+			config.Checkpoints = map[int32]hash.Hash{1: diverged}
+			_, err = NewChain(config)
+			So(errors.Cause(err), ShouldEqual, ErrCheckpointMismatch)
+		})
+	})
+}
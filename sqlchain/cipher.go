@@ -0,0 +1,66 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/symmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// valueCipher encrypts and decrypts the values stored in bdb/tdb. Keys are kept in plain text
+// so that the prefix iteration still works. A nil valueCipher leaves values unchanged.
+type valueCipher struct {
+	key  []byte
+	salt []byte
+}
+
+// newValueCipher returns a valueCipher with the key derived from the local private key, or nil
+// if the at-rest encryption is not enabled.
+func newValueCipher(enabled bool, pk *asymmetric.PrivateKey, id proto.DatabaseID) (vc *valueCipher) {
+	if !enabled {
+		return
+	}
+	return &valueCipher{
+		key:  pk.Serialize(),
+		salt: []byte(id),
+	}
+}
+
+// seal encrypts the plain value before putting it into the database.
+func (vc *valueCipher) seal(in []byte) (out []byte, err error) {
+	if vc == nil {
+		return in, nil
+	}
+	if out, err = symmetric.EncryptWithPassword(in, vc.key, vc.salt); err != nil {
+		err = errors.Wrap(err, "encrypt value")
+	}
+	return
+}
+
+// open decrypts the value read from the database.
+func (vc *valueCipher) open(in []byte) (out []byte, err error) {
+	if vc == nil {
+		return in, nil
+	}
+	if out, err = symmetric.DecryptWithPassword(in, vc.key, vc.salt); err != nil {
+		err = errors.Wrap(err, "decrypt value")
+	}
+	return
+}
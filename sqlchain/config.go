@@ -19,19 +19,43 @@ package sqlchain
 import (
 	"time"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/types"
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
 )
 
+// StorageFactory opens the state storage of a sql-chain at the given data file.
+type StorageFactory func(dataFile string) (xi.Storage, error)
+
+// BlockValidator validates a new block extending parent, i.e., the node of the current head, and
+// rejects the block with a non-nil error.
+type BlockValidator func(block *types.Block, parent *blockNode) error
+
 // Config represents a sql-chain config.
 type Config struct {
 	DatabaseID      proto.DatabaseID
 	ChainFilePrefix string
 	DataFile        string
+	// StorageFactory opens the state storage at DataFile in place of the default sqlite storage,
+	// e.g., to plug in an in-memory storage for testing.
+	//
+	// NOTE: rebuilding the state for a reorg moves the sqlite files of the rebuilt storage to
+	// DataFile, thus it's only supported by a storage backed by the sqlite files at the given path.
+	StorageFactory StorageFactory
+	// BlockValidator is an optional extra validation of the new blocks pushed by
+	// CheckAndPushNewBlock, e.g., to enforce a local query policy or a producer whitelist. It's
+	// called after the built-in checks and before the block is replayed, nil to disable.
+	BlockValidator BlockValidator
 
 	Genesis *types.Block
 	Period  time.Duration
 	Tick    time.Duration
+	// MaxTickJitter bounds a random delay added to each tick of the main cycle, so that the sync
+	// and advise traffic of the peers spreads out instead of bursting at the turn boundaries. The
+	// producer of the next turn is never delayed past its turn. It's clamped to half of Period,
+	// 0 to disable.
+	MaxTickJitter time.Duration
 
 	MuxService *MuxService
 	Peers      *proto.Peers
@@ -47,6 +71,223 @@ type Config struct {
 
 	BlockCacheTTL int32
 
+	// MinPeersToProduce sets the minimum peer number required before the local node starts
+	// producing blocks, set it to 0 for a standalone chain.
+	MinPeersToProduce int32
+	// AdviseRetries sets the maximum retry times of advising a new block to each peer.
+	AdviseRetries int32
+	// FetchRetries sets the maximum retry times of fetching a block from each peer in the head
+	// syncing.
+	FetchRetries int32
+	// RPCRetryBackoff sets the initial backoff between the retries of advising and fetching
+	// blocks, which is doubled and jittered for each retry. Set it to 0 to use the default value.
+	RPCRetryBackoff time.Duration
+	// VerboseAdviseErrors logs each failure of advising a new block to a peer, otherwise the
+	// failures of a block are aggregated into a single summary line to keep the logs readable
+	// on large clusters.
+	VerboseAdviseErrors bool
+	// ObserverMode makes the node follow the chain without ever producing or advising blocks: it
+	// still syncs and replays the blocks of the peers, serves the read queries and the block
+	// fetches, but rejects the write queries with ErrObserverReadOnly. An observer should be left
+	// out of the producing peers, otherwise its turns are skipped.
+	ObserverMode bool
+	// LocalBlockSendTimeout bounds the wait for the local block processing to accept a produced
+	// block, 0 to wait until accepted. On timeout, the block is advised to the peers first and
+	// handed over to the local processing in the background.
+	LocalBlockSendTimeout time.Duration
+	// StopDrainTimeout bounds the wait for the in-flight produced block to be persisted while the
+	// chain is stopping, 0 for a block period.
+	StopDrainTimeout time.Duration
+	// SignatureSchemes restricts the accepted signature schemes of acks and blocks, including the
+	// requests and acks packed in blocks, nil for accepting DefaultSignatureSchemes.
+	SignatureSchemes []SignatureScheme
+
+	// MaxClockSkewCorrection bounds the correction applied to the local chain time, which is
+	// estimated from the timestamps reported by peers. Set it to 0 to disable the correction.
+	//
+	// NOTE: the correction is a safety net for a slightly skewed clock, and is not a
+	// replacement for NTP.
+	MaxClockSkewCorrection time.Duration
+	// ClockSkewWarning sets the estimated clock skew threshold to log warnings, 0 for a tenth
+	// of Period.
+	ClockSkewWarning time.Duration
+
+	// EncryptAtRest enables encrypting the block/ack/response values in the chain databases
+	// with a key derived from the local private key. Keys are left in plain text.
+	//
+	// NOTE: every database read and write will pay an extra AES-256 round and the stored values
+	// grow by up to 2 cipher blocks, and the chain files can only be reopened with the same
+	// private key.
+	EncryptAtRest bool
+
+	// MaxAckRetention sets the number of block periods to retain acks in the chain database. Acks
+	// older than the retention are pruned, except those which may still be needed by the
+	// unsettled billing window. Set it to 0 to retain acks forever.
+	MaxAckRetention int32
+
+	// DisableResponsePersistence keeps the added query responses in memory only, for the
+	// deployments which only need the acks for billing. Otherwise the responses are persisted
+	// to the chain database and the unacknowledged ones are restored on the next load.
+	DisableResponsePersistence bool
+
+	// SyncWrites syncs the writes of the acks, responses and other chain metadata to the disk
+	// before returning, so that they survive an OS crash at the cost of write latency. The blocks
+	// are always committed in durable transactions with their derived index entries.
+	SyncWrites bool
+
+	// StoreCompression, StoreBlockCacheCapacity and StoreWriteBuffer tune the leveldb databases
+	// of the blocks, states, acks and responses of this chain. The compression defaults to
+	// snappy, and the sizes in bytes default to the leveldb defaults if set to 0.
+	StoreCompression        StoreCompression
+	StoreBlockCacheCapacity int
+	StoreWriteBuffer        int
+
+	// ArchiveMode disables all pruning for a dedicated archive node, from which the other peers
+	// can bootstrap: the block cache is never dropped regardless of BlockCacheTTL, and acks are
+	// retained forever regardless of MaxAckRetention. The block store is also tuned for serving
+	// large historical block ranges with a larger read cache.
+	//
+	// NOTE: an archive node holds every block of the chain in memory and every ack on disk, so
+	// both the memory and the storage footprint grow linearly with the chain, see
+	// Chain.StorageBreakdown for monitoring.
+	ArchiveMode bool
+
+	// AckBatchSize enables buffering the pushed acks and writing them to the chain database in
+	// batches of up to AckBatchSize acks, 0 to write each ack immediately. A batch is also flushed
+	// once its first ack has waited for AckBatchWindow, which defaults to 10ms.
+	//
+	// NOTE: a buffered ack is not included in blocks or reported for registering errors until it's
+	// flushed, see Chain.FlushAcks.
+	AckBatchSize   int
+	AckBatchWindow time.Duration
+
+	// PoolTransientBlocks enables reusing the block structures of transient decodes, e.g., the
+	// blocks walked through by billing, to reduce GC churn.
+	PoolTransientBlocks bool
+
+	// StrictSequenceID fails the chain loading if a block reports a next sequence id which isn't
+	// greater than the preceding blocks, otherwise only a warning is logged.
+	StrictSequenceID bool
+
+	// Middlewares wraps all the chain RPC endpoints, see Middleware for the applying order.
+	Middlewares []Middleware
+
+	// HeightScheme creates the time-to-height conversion of the chain from the genesis block, nil
+	// for NewLinearHeightScheme. It must be the same for all the peers during the whole life of the
+	// chain, see HeightScheme for the invariants.
+	HeightScheme HeightSchemeFactory
+
+	// SchedulingMode sets how the turns of the chain begin, WallClockScheduling by default. It must
+	// be the same for all the peers during the whole life of the chain, see CountDrivenScheduling
+	// for the implications.
+	SchedulingMode SchedulingMode
+
+	// MaxConcurrentQueries limits the number of concurrently running queries, 0 for unlimited.
+	// When saturated, the waiting queries are served by their request priorities.
+	MaxConcurrentQueries int
+	// MaxQueryDuration bounds the duration of a query in the state, after which ErrQueryTimeout
+	// is returned, 0 for unlimited. A read query is interrupted on expiry, while a write query is
+	// only refused if it expires before being executed, since interrupting a write rolls back the
+	// whole ongoing transaction of the state.
+	MaxQueryDuration time.Duration
+
+	// SeparateReadPath dispatches read queries to the read-only path of the state, which reads
+	// through the reader pool of the storage and never blocks on write locks. Write queries are
+	// always serialized through the write path.
+	SeparateReadPath bool
+
+	// MaxBlockTimeSkew sets the tolerance of a block timestamp ahead of the local chain time.
+	// Blocks timestamped later are rejected before being stashed. Set it to 0 to accept the
+	// future blocks within MaxStashedHeights.
+	MaxBlockTimeSkew time.Duration
+
+	// MaxClockSkew sets the tolerance of a block timestamp deviating from the local time in either
+	// direction. Blocks beyond are rejected before any verification. Since stale blocks are also
+	// rejected, it should be larger than the lag a node is expected to catch up through block
+	// syncing. Set it to 0 to disable the check.
+	MaxClockSkew time.Duration
+
+	// MaxSyncStalls sets the number of consecutive attempts without head progress for the initial
+	// sync in Start to give up catching up with the peers, after which the sync continues in the
+	// background. Set it to 0 to use the default value.
+	MaxSyncStalls int32
+
+	// MaxHealthyLag sets the max number of turns the head may lag behind the current turn for the
+	// chain to be reported as synced by Chain.Health. Set it to 0 to use the default value.
+	MaxHealthyLag int32
+
+	// MaxSkippedPeriods sets the max number of periods a new block may run ahead of the head
+	// while its parent is unknown. Beyond that, the head is considered to have missed the blocks
+	// in between, and the missing range is fetched from the producer of the new block before the
+	// block is processed. Set it to 0 to use the default value.
+	MaxSkippedPeriods int32
+
+	// IndexSnapshotInterval sets the number of turns between persisting the block index, 0 to
+	// disable it. Loading a chain with a valid snapshot only decodes and verifies the blocks newer
+	// than the snapshot, otherwise all the blocks are read to rebuild the index.
+	IndexSnapshotInterval int32
+
+	// MaxStashedHeights sets the number of turns ahead of the current turn to stash the future
+	// blocks for later check, blocks beyond are rejected. Set it to 0 to use the default value.
+	MaxStashedHeights int32
+
+	// MaxStashedBlocks sets the max number of future blocks stashed for later check, blocks beyond
+	// are rejected. Set it to 0 to use the default value.
+	MaxStashedBlocks int
+
+	// MaxOrphanBlocks sets the number of the orphan blocks, i.e., the blocks losing a fork race or
+	// arriving for an already decided turn, to keep in the chain database for analysis. The oldest
+	// ones are evicted beyond the capacity. Set it to 0 to drop the orphan blocks.
+	MaxOrphanBlocks int
+
+	// ConfirmationDepth sets the number of subsequent blocks building on a block before it is
+	// considered final, 0 for every accepted block being final. Read queries requesting finalized
+	// results are served by a state replica which only replays the finalized blocks.
+	//
+	// It also bounds the reorgs: the best chain is never switched to a side branch forking below
+	// the finalized block, so the chain never reorganizes with a 0 depth.
+	ConfirmationDepth int32
+
+	// ProducerVersion is an optional software version tag carried by the blocks produced by this
+	// node, which lets operators inspect the version distribution of the peers from the recent
+	// blocks. It's never used to reject blocks.
+	ProducerVersion string
+	// StateChecksum sets the checksum of the local state to the blocks produced by this node, so
+	// that the peers replaying the blocks detect a divergent state, see ErrStateDivergence. The
+	// checksum reads through the whole state for each block. The checksum carried by a block is
+	// always verified regardless of this option.
+	StateChecksum bool
+
+	// MaxBillingUsers caps the number of distinct users aggregated in memory while billing a
+	// period, 0 for unlimited. A period with more users is billed by multiple UpdateBilling
+	// transactions, each covering a disjoint range of user addresses, so that no user cost is
+	// dropped.
+	//
+	// NOTE: the blocks of the period are read once more for each extra transaction, so a small
+	// cap trades block store reads and main chain transactions for bounded memory.
+	MaxBillingUsers int
+
+	// MaxQueriesPerBlock and MaxBlockBytes cap the number of queries and the encoded size of each
+	// produced block, 0 for unlimited. The pending queries beyond the caps are deferred to the
+	// blocks of the next periods in order. A single query exceeding MaxBlockBytes is still packed
+	// alone, so that it never blocks the following ones.
+	MaxQueriesPerBlock int
+	MaxBlockBytes      int
+
+	// Checkpoints sets the trusted block hashes indexed by block count. A chain which doesn't pass
+	// through any of them is rejected: blocks diverging at a checkpoint count are refused, and
+	// loading a diverged chain fails.
+	Checkpoints map[int32]hash.Hash
+
+	// ValidateResponseAccounts rejects the blocks with any response crediting an account other
+	// than the block producer and DelegatedResponseAccounts, e.g., the accounts of the other
+	// miners of the database whose acked queries may be collected by the producer.
+	//
+	// NOTE: it must be consistent among the peers, otherwise the blocks collecting the responses
+	// of an undelegated miner are refused by the validating peers.
+	ValidateResponseAccounts  bool
+	DelegatedResponseAccounts []proto.AccountAddress
+
 	// DBAccount info
 	TokenType    types.TokenType
 	GasPrice     uint64
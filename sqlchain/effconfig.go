@@ -0,0 +1,193 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// ChainConfigView is a read-only snapshot of the active configuration of a running chain. The
+// fields are named after their Config counterparts, see Config for the details.
+type ChainConfigView struct {
+	DatabaseID proto.DatabaseID
+	Period     time.Duration
+	Tick       time.Duration
+	Server     proto.NodeID
+	Peers      *proto.Peers
+
+	QueryTTL          int32
+	BlockCacheTTL     int32
+	MinPeersToProduce int32
+	AdviseRetries     int32
+	SignatureSchemes  []SignatureScheme
+
+	MaxClockSkewCorrection time.Duration
+	ClockSkewWarning       time.Duration
+	// ClockOffset is the current correction applied to the local clock.
+	ClockOffset time.Duration
+
+	EncryptAtRest        bool
+	ArchiveMode          bool
+	MaxAckRetention      int32
+	AckBatchSize         int
+	AckBatchWindow       time.Duration
+	PoolTransientBlocks  bool
+	StrictSequenceID     bool
+	MaxConcurrentQueries int
+	SeparateReadPath     bool
+	MaxStashedHeights    int32
+	MaxBlockTimeSkew     time.Duration
+	MaxClockSkew         time.Duration
+	MaxStashedBlocks     int
+	MaxOrphanBlocks      int
+	ConfirmationDepth    int32
+	ProducerVersion      string
+	StateChecksum        bool
+	MaxBillingUsers      int
+	MaxQueriesPerBlock   int
+	MaxBlockBytes        int
+	Checkpoints          map[int32]hash.Hash
+
+	ValidateResponseAccounts   bool
+	DelegatedResponseAccounts  []proto.AccountAddress
+	IndexSnapshotInterval      int32
+	DisableResponsePersistence bool
+	SyncWrites                 bool
+	VerboseAdviseErrors        bool
+	SchedulingMode             SchedulingMode
+	ObserverMode               bool
+	LocalBlockSendTimeout      time.Duration
+	StopDrainTimeout           time.Duration
+	MaxHealthyLag              int32
+	MaxTickJitter              time.Duration
+	FetchRetries               int32
+	RPCRetryBackoff            time.Duration
+	StoreCompression           StoreCompression
+	StoreBlockCacheCapacity    int
+	StoreWriteBuffer           int
+	MaxQueryDuration           time.Duration
+	MaxSkippedPeriods          int32
+	// QueriesPaused reports whether the client queries are paused, see Chain.PauseQueries.
+	QueriesPaused bool
+
+	TokenType      types.TokenType
+	GasPrice       uint64
+	UpdatePeriod   uint64
+	IsolationLevel sql.IsolationLevel
+}
+
+// EffectiveConfig returns a snapshot of the active configuration of the chain, including the
+// changes applied at runtime, e.g., by SetBlockCacheTTL or UpdatePeers. The defaults filled in
+// for the unset Config fields are reported as is.
+func (c *Chain) EffectiveConfig() (view ChainConfigView) {
+	var updatePeriod, _ = c.getUpdatePeriod()
+	view = ChainConfigView{
+		DatabaseID: c.databaseID,
+		Period:     c.rt.period,
+		Tick:       c.rt.tick,
+		Server:     c.rt.getServer(),
+		Peers:      c.rt.getPeers(),
+
+		QueryTTL:          c.rt.queryTTL,
+		BlockCacheTTL:     c.getBlockCacheTTL(),
+		MinPeersToProduce: c.rt.minPeersToProduce,
+		AdviseRetries:     c.rt.adviseRetries,
+
+		MaxClockSkewCorrection: c.rt.maxSkewCorrection,
+		ClockSkewWarning:       c.rt.skewWarning,
+		ClockOffset:            c.rt.getOffset(),
+
+		EncryptAtRest:       c.vc != nil,
+		ArchiveMode:         c.rt.archive,
+		MaxAckRetention:     c.rt.ackRetention,
+		PoolTransientBlocks: c.rt.poolTransientBlocks,
+		StrictSequenceID:    c.rt.strictSequenceID,
+		SeparateReadPath:    c.rt.separateReadPath,
+		MaxStashedHeights:   c.rt.maxStashedHeights,
+		MaxBlockTimeSkew:    c.rt.maxBlockTimeSkew,
+		MaxClockSkew:        c.rt.maxClockSkew,
+		MaxStashedBlocks:    c.rt.maxStashedBlocks,
+		MaxOrphanBlocks:     c.rt.maxOrphans,
+		ConfirmationDepth:   c.rt.confirmationDepth,
+		ProducerVersion:     c.rt.producerVersion,
+		StateChecksum:       c.rt.stateChecksum,
+		MaxBillingUsers:     c.rt.maxBillingUsers,
+		MaxQueriesPerBlock:  c.rt.maxBlockQueries,
+		MaxBlockBytes:       c.rt.maxBlockBytes,
+		QueriesPaused:       c.gate.isPaused(),
+
+		IndexSnapshotInterval:      c.rt.snapshotInterval,
+		DisableResponsePersistence: !c.rt.persistResponses,
+		SyncWrites:                 c.rt.writeOptions != nil,
+		VerboseAdviseErrors:        c.rt.verboseAdvise,
+		SchedulingMode:             c.rt.schedulingMode,
+		ObserverMode:               c.rt.observer,
+		LocalBlockSendTimeout:      c.rt.localSendTimeout,
+		StopDrainTimeout:           c.rt.drainTimeout,
+		MaxHealthyLag:              c.rt.maxHealthyLag,
+		MaxTickJitter:              c.rt.maxTickJitter,
+		FetchRetries:               c.rt.fetchRetries,
+		RPCRetryBackoff:            c.rt.retryBackoff,
+		StoreCompression:           c.rt.storeCompression(),
+		StoreBlockCacheCapacity:    c.rt.storeOptions.BlockCacheCapacity,
+		StoreWriteBuffer:           c.rt.storeOptions.WriteBuffer,
+		MaxQueryDuration:           c.rt.maxQueryDuration,
+		MaxSkippedPeriods:          c.rt.maxSkippedPeriods,
+
+		TokenType:      c.tokenType,
+		GasPrice:       c.getGasPrice(),
+		UpdatePeriod:   updatePeriod,
+		IsolationLevel: c.rt.isolationLevel,
+	}
+	for k := range c.rt.schemes {
+		view.SignatureSchemes = append(view.SignatureSchemes, k)
+	}
+	sort.Slice(view.SignatureSchemes, func(i, j int) bool {
+		return view.SignatureSchemes[i] < view.SignatureSchemes[j]
+	})
+	if c.ackBatch != nil {
+		view.AckBatchSize = c.ackBatch.size
+		view.AckBatchWindow = c.ackBatch.window
+	}
+	if c.rt.queries != nil {
+		view.MaxConcurrentQueries = c.rt.queries.capacity
+	}
+	if len(c.rt.checkpoints) > 0 {
+		view.Checkpoints = make(map[int32]hash.Hash, len(c.rt.checkpoints))
+		for k, v := range c.rt.checkpoints {
+			view.Checkpoints[k] = v
+		}
+	}
+	if c.rt.responseAccounts != nil {
+		view.ValidateResponseAccounts = true
+		for k := range c.rt.responseAccounts {
+			view.DelegatedResponseAccounts = append(view.DelegatedResponseAccounts, k)
+		}
+		sort.Slice(view.DelegatedResponseAccounts, func(i, j int) bool {
+			return bytes.Compare(
+				view.DelegatedResponseAccounts[i][:], view.DelegatedResponseAccounts[j][:]) < 0
+		})
+	}
+	return
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	Convey("Given a running chain", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		Convey("The effective config should reflect the construction config", func() {
+			var view = chain.EffectiveConfig()
+			So(view.DatabaseID, ShouldEqual, config.DatabaseID)
+			So(view.Period, ShouldEqual, config.Period)
+			So(view.Tick, ShouldEqual, config.Tick)
+			So(view.Server, ShouldEqual, config.Server)
+			So(view.Peers.Servers, ShouldResemble, config.Peers.Servers)
+			So(view.QueryTTL, ShouldEqual, config.QueryTTL)
+			So(view.UpdatePeriod, ShouldEqual, config.UpdatePeriod)
+			So(view.SignatureSchemes, ShouldResemble, DefaultSignatureSchemes)
+			So(view.MaxStashedHeights, ShouldEqual, defaultMaxStashedHeights)
+			So(view.MaxStashedBlocks, ShouldEqual, defaultMaxStashedBlocks)
+			So(view.EncryptAtRest, ShouldBeFalse)
+			So(view.QueriesPaused, ShouldBeFalse)
+		})
+		Convey("The effective config should reflect the runtime changes", func() {
+			var ttl = chain.EffectiveConfig().BlockCacheTTL + 10
+			So(chain.SetBlockCacheTTL(ttl), ShouldBeNil)
+			So(chain.PauseQueries(context.Background()), ShouldBeNil)
+			var view = chain.EffectiveConfig()
+			So(view.BlockCacheTTL, ShouldEqual, ttl)
+			So(view.QueriesPaused, ShouldBeTrue)
+		})
+	})
+}
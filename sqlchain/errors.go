@@ -18,6 +18,7 @@ package sqlchain
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
@@ -37,9 +38,102 @@ var (
 	ErrUnknownProducer = errors.New("unknown block producer")
 	// ErrInvalidProducer indicates that the block has an invalid producer.
 	ErrInvalidProducer = errors.New("invalid block producer")
+	// ErrNoBlockProducer indicates that there is no block producer to send the transactions to.
+	ErrNoBlockProducer = errors.New("no block producer available")
 	// ErrQueryNotFound indicates that a query is not found in the index.
 	ErrQueryNotFound = errors.New("query not found")
 	// ErrResponseSeqNotMatch indicates that a response sequence id doesn't match the original one
 	// in the index.
 	ErrResponseSeqNotMatch = errors.New("response sequence id doesn't match")
+	// ErrBlockHashMismatch indicates that the stored block doesn't match the hash in its key.
+	ErrBlockHashMismatch = errors.New("block hash mismatch")
+	// ErrBlockNotFound indicates that the block is absent from the block store.
+	ErrBlockNotFound = errors.New("block not found")
+
+	// ErrInvalidBlockCacheTTL indicates that the block cache ttl is too small to keep the
+	// blocks required by billing.
+	ErrInvalidBlockCacheTTL = errors.New("invalid block cache ttl")
+
+	// ErrNoBillingRecord indicates that no billing has been successfully submitted yet.
+	ErrNoBillingRecord = errors.New("no billing record")
+
+	// ErrInconsistentSequenceID indicates that the next sequence id of a block isn't greater
+	// than the max id of the preceding blocks.
+	ErrInconsistentSequenceID = errors.New("inconsistent sequence id")
+
+	// ErrTooStale indicates that the chain head lags behind the current turn by more blocks than
+	// the max staleness specified by a read query.
+	ErrTooStale = errors.New("chain head is too stale")
+
+	// ErrDisallowedSignatureScheme indicates that an object is signed with a signature scheme
+	// which is not accepted by the chain.
+	ErrDisallowedSignatureScheme = errors.New("disallowed signature scheme")
+
+	// ErrQueriesPaused indicates that client queries are paused by the chain operator.
+	ErrQueriesPaused = errors.New("queries are paused")
+
+	// ErrCheckpointMismatch indicates that the chain doesn't pass through a trusted checkpoint.
+	ErrCheckpointMismatch = errors.New("checkpoint mismatch")
+
+	// ErrBlockFromFuture indicates that the block is timestamped too far in the future.
+	ErrBlockFromFuture = errors.New("block from future")
+
+	// ErrBlockClockSkew indicates that the block timestamp deviates too far from the local time.
+	ErrBlockClockSkew = errors.New("block clock skew")
+
+	// ErrInvalidResponseAccount indicates that a response in the block credits an account other
+	// than the block producer and the delegated miners.
+	ErrInvalidResponseAccount = errors.New("invalid response account")
+
+	// ErrBillingNotConserved indicates that the miner incomes of the settled billings don't sum
+	// up to the user costs.
+	ErrBillingNotConserved = errors.New("billing not conserved")
+
+	// ErrBlockHeightMismatch indicates that the fetched block isn't at the requested height.
+	ErrBlockHeightMismatch = errors.New("block height mismatch")
+
+	// ErrObserverReadOnly indicates that a write query is sent to an observer, which never packs
+	// the local writes into blocks.
+	ErrObserverReadOnly = errors.New("observer is read-only")
+
+	// ErrInvalidAckTimestamps indicates that the acknowledged response is timestamped before its
+	// request.
+	ErrInvalidAckTimestamps = errors.New("invalid ack timestamps")
+
+	// ErrDrainTimeout indicates that the in-flight produced block is not persisted in time while
+	// the chain is stopping.
+	ErrDrainTimeout = errors.New("drain timeout")
+
+	// ErrChainStarted indicates that the operation requires the chain not to be started yet.
+	ErrChainStarted = errors.New("chain is started")
+
+	// ErrInvalidRewindHeight indicates that the rewind target height is below the genesis block.
+	ErrInvalidRewindHeight = errors.New("invalid rewind height")
+
+	// ErrStateDivergence indicates that the local state diverges from the block producer after
+	// replaying a block, i.e., the state checksums mismatch.
+	ErrStateDivergence = errors.New("state divergence")
+
+	// ErrQueryTimeout indicates that the query exceeds Config.MaxQueryDuration.
+	ErrQueryTimeout = errors.New("query timeout")
+
+	// ErrInvalidUpdatePeriod indicates that the billing update period exceeds the block cache ttl.
+	ErrInvalidUpdatePeriod = errors.New("invalid update period")
+	// ErrHeightSchemeMismatch indicates that the chain is loaded with a height scheme other than
+	// the one it's created with.
+	ErrHeightSchemeMismatch = errors.New("height scheme mismatch")
 )
+
+// ErrIncompatibleStoreVersion indicates that the persisted chain storage is written in a format
+// version which is incompatible with the current binary.
+type ErrIncompatibleStoreVersion struct {
+	Found    uint32
+	Expected uint32
+}
+
+func (e *ErrIncompatibleStoreVersion) Error() string {
+	return fmt.Sprintf(
+		"incompatible chain store version %d, expected %d: "+
+			"please open it with a binary supporting store version %d",
+		e.Found, e.Expected, e.Found)
+}
@@ -0,0 +1,100 @@
+// +build faultinject
+
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// This file is only compiled with the faultinject build tag, so that the fault injection hooks
+// can never be enabled in production binaries.
+
+type replayFault struct {
+	nth      int
+	attempts int
+	err      error
+}
+
+var (
+	replayFaultsLock sync.Mutex
+	replayFaults     = make(map[hash.Hash]*replayFault)
+)
+
+// InjectReplayFault makes the nth replaying attempt (counting from 1) of the block with hash h
+// fail with err. The other attempts are not affected.
+func InjectReplayFault(h hash.Hash, nth int, err error) {
+	replayFaultsLock.Lock()
+	defer replayFaultsLock.Unlock()
+	replayFaults[h] = &replayFault{nth: nth, err: err}
+}
+
+// ClearReplayFaults removes all the injected replay faults.
+func ClearReplayFaults() {
+	replayFaultsLock.Lock()
+	defer replayFaultsLock.Unlock()
+	replayFaults = make(map[hash.Hash]*replayFault)
+}
+
+func checkReplayFault(block *types.Block) error {
+	replayFaultsLock.Lock()
+	defer replayFaultsLock.Unlock()
+	var fault, ok = replayFaults[*block.BlockHash()]
+	if !ok {
+		return nil
+	}
+	if fault.attempts++; fault.attempts == fault.nth {
+		return fault.err
+	}
+	return nil
+}
+
+var (
+	pushFaultsLock sync.Mutex
+	pushFaults     = make(map[hash.Hash]error)
+)
+
+// InjectPushFault makes the next pushing of the block with hash h fail with err, after the block
+// and its index entries are written but before they are committed, as if the process crashed
+// in between.
+func InjectPushFault(h hash.Hash, err error) {
+	pushFaultsLock.Lock()
+	defer pushFaultsLock.Unlock()
+	pushFaults[h] = err
+}
+
+// ClearPushFaults removes all the injected push faults.
+func ClearPushFaults() {
+	pushFaultsLock.Lock()
+	defer pushFaultsLock.Unlock()
+	pushFaults = make(map[hash.Hash]error)
+}
+
+func checkPushFault(block *types.Block) error {
+	pushFaultsLock.Lock()
+	defer pushFaultsLock.Unlock()
+	var h = *block.BlockHash()
+	if err, ok := pushFaults[h]; ok {
+		delete(pushFaults, h)
+		return err
+	}
+	return nil
+}
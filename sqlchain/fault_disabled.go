@@ -0,0 +1,33 @@
+// +build !faultinject
+
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// checkReplayFault is a no-op without the faultinject build tag.
+func checkReplayFault(block *types.Block) error {
+	return nil
+}
+
+// checkPushFault is a no-op without the faultinject build tag.
+func checkPushFault(block *types.Block) error {
+	return nil
+}
@@ -0,0 +1,117 @@
+// +build faultinject
+
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestReplayFault(t *testing.T) {
+	Convey("Given a chain replaying blocks to the finalized state", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		defer ClearReplayFaults()
+		So(pushTestBlocks(chain, 3, nil), ShouldBeNil)
+		var (
+			head     = chain.rt.getHead().node
+			errFault = errors.New("injected fault")
+			req      = &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{QueryType: types.ReadQuery},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{{Pattern: `SELECT 1`}}},
+			}
+			opts = QueryOptions{Finalized: true}
+		)
+		Convey("The replaying should fail on the injected attempt and recover afterwards", func() {
+			InjectReplayFault(head.parent.hash, 1, errFault)
+			_, _, _, err := chain.QueryWithOptions(req, false, opts)
+			So(errors.Cause(err), ShouldEqual, errFault)
+			So(chain.fs.node, ShouldEqual, head.parent.parent)
+			_, _, height, err := chain.QueryWithOptions(req, false, opts)
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, head.height)
+			So(chain.fs.node, ShouldEqual, head)
+		})
+		Convey("The replaying should not be affected before the injected attempt", func() {
+			InjectReplayFault(head.hash, 2, errFault)
+			_, _, _, err := chain.QueryWithOptions(req, false, opts)
+			So(err, ShouldBeNil)
+			So(chain.fs.node, ShouldEqual, head)
+		})
+	})
+}
+
+func TestPushFault(t *testing.T) {
+	Convey("Given a chain and a block failing to be pushed after it's written", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer ClearPushFaults()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+		So(err, ShouldBeNil)
+		var (
+			head     = chain.rt.getHead()
+			ts       = chain.rt.getTimeFromHeight(head.Height + 1)
+			errFault = errors.New("injected fault")
+			index    = func(chain *Chain) *types.SignedResponseHeader {
+				var resp = tx.Response
+				mi, err := chain.ai.load(chain.rt.getHeightFromTime(resp.GetRequestTimestamp()))
+				So(err, ShouldBeNil)
+				mi.RLock()
+				defer mi.RUnlock()
+				return mi.respIndex[resp.Request.GetQueryKey()]
+			}
+		)
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, []*types.QueryAsTx{tx})
+		So(err, ShouldBeNil)
+		InjectPushFault(*block.BlockHash(), errFault)
+		err = chain.pushBlock(block)
+		So(errors.Cause(err), ShouldEqual, errFault)
+		Convey("Neither the block nor its queries should be found", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			So(index(chain), ShouldBeNil)
+		})
+		Convey("Neither the block nor its queries should be found after a restart", func() {
+			So(chain.Stop(), ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			fetched, err := chain.FetchBlock(head.Height + 1)
+			So(err, ShouldBeNil)
+			So(fetched, ShouldBeNil)
+			So(index(chain), ShouldBeNil)
+			Convey("The block should be pushed again together with its queries", func() {
+				So(chain.pushBlock(block), ShouldBeNil)
+				So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+				So(index(chain), ShouldResemble, tx.Response)
+			})
+		})
+	})
+}
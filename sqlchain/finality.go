@@ -0,0 +1,225 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+	xs "github.com/CovenantSQL/CovenantSQL/xenomint/sqlite"
+)
+
+// finalizedState is a state replica which only replays the finalized blocks.
+type finalizedState struct {
+	dir    string
+	level  sql.IsolationLevel
+	server proto.NodeID
+	st     *x.State
+	// node is the last replayed block node, nil if no block is replayed yet.
+	node *blockNode
+}
+
+func newFinalizedState(level sql.IsolationLevel, server proto.NodeID) (
+	fs *finalizedState, err error,
+) {
+	var dir string
+	if dir, err = ioutil.TempDir("", "sqlchain-finalized-"); err != nil {
+		err = errors.Wrap(err, "create finalized state dir")
+		return
+	}
+	fs = &finalizedState{
+		dir:    dir,
+		level:  level,
+		server: server,
+	}
+	if fs.st, err = openReplicaState(level, server, fs.filename()); err != nil {
+		os.RemoveAll(dir)
+		err = errors.Wrap(err, "open finalized state")
+		return nil, err
+	}
+	return
+}
+
+// openReplicaState opens a state replica on the sqlite database file filename. The applied seq
+// is tracked in the storage and restored on opening, so that the replica can be copied and
+// reopened to continue replaying blocks.
+func openReplicaState(level sql.IsolationLevel, server proto.NodeID, filename string) (
+	st *x.State, err error,
+) {
+	var (
+		strg    xi.Storage
+		applied uint64
+		ok      bool
+	)
+	if strg, err = xs.NewSqlite(filename); err != nil {
+		return
+	}
+	st = x.NewState(level, server, strg)
+	if applied, ok, err = st.TrackAppliedSeq(); err != nil {
+		st.Close(false)
+		return nil, err
+	}
+	if ok {
+		st.SetSeq(applied)
+	}
+	return
+}
+
+func (fs *finalizedState) filename() string {
+	return filepath.Join(fs.dir, "finalized.db3")
+}
+
+// copyTo copies the replica storage to the sqlite database file filename. The replica is closed
+// during copying to flush all its data into the database file, and is reopened afterwards.
+func (fs *finalizedState) copyTo(filename string) (err error) {
+	if err = fs.st.Close(true); err != nil {
+		return
+	}
+	for _, v := range sqliteFileSuffixes {
+		if _, err = utils.CopyFile(fs.filename()+v, filename+v); os.IsNotExist(err) {
+			err = nil
+		} else if err != nil {
+			err = errors.Wrap(err, "copy finalized state storage")
+			break
+		}
+	}
+	var st, ierr = openReplicaState(fs.level, fs.server, fs.filename())
+	if ierr != nil {
+		ierr = errors.Wrap(ierr, "reopen finalized state")
+		if err == nil {
+			err = ierr
+		}
+		return
+	}
+	fs.st = st
+	return
+}
+
+func (fs *finalizedState) close() (err error) {
+	err = fs.st.Close(false)
+	if ierr := os.RemoveAll(fs.dir); ierr != nil && err == nil {
+		err = ierr
+	}
+	return
+}
+
+// resetFinalizedState drops the finalized state replica, e.g., after the best chain is switched.
+// It's recreated on demand.
+func (c *Chain) resetFinalizedState() {
+	c.fsMutex.Lock()
+	defer c.fsMutex.Unlock()
+	if c.fs == nil {
+		return
+	}
+	if err := c.fs.close(); err != nil {
+		log.WithError(err).WithField("db", c.databaseID).Warning(
+			"failed to close finalized state")
+	}
+	c.fs = nil
+}
+
+// finalizedNode returns the block node which has been built on by at least confirmationDepth
+// subsequent blocks on the best chain.
+func (c *Chain) finalizedNode() *blockNode {
+	var head = c.rt.getHead().node
+	if head == nil || c.rt.confirmationDepth <= 0 {
+		return head
+	}
+	var count = head.count - c.rt.confirmationDepth
+	if count < 0 {
+		count = 0
+	}
+	return head.ancestorByCount(count)
+}
+
+// FinalizedHeight returns the height of the last finalized block, i.e., the block which has been
+// built on by at least Config.ConfirmationDepth subsequent blocks. Without a confirmation depth,
+// every accepted block is final and the head height is returned.
+func (c *Chain) FinalizedHeight() int32 {
+	if node := c.finalizedNode(); node != nil {
+		return node.height
+	}
+	return -1
+}
+
+// finalizedQuery executes the read query req against the state replayed from the finalized
+// blocks only, and returns the finalized height it's executed at. The replica is created and
+// caught up with the finalized height on demand.
+func (c *Chain) finalizedQuery(req *types.Request) (
+	tracker *x.QueryTracker, resp *types.Response, height int32, err error,
+) {
+	c.fsMutex.Lock()
+	defer c.fsMutex.Unlock()
+	if err = c.catchUpFinalizedState(req.GetContext()); err != nil {
+		return
+	}
+	if tracker, resp, err = c.fs.st.ReadOnlyQueryWithContext(req.GetContext(), req); err != nil {
+		return
+	}
+	height = c.fs.node.height
+	return
+}
+
+// catchUpFinalizedState creates the finalized state replica if it doesn't exist, and replays the
+// newly finalized blocks to it in order. It must be called with fsMutex held.
+func (c *Chain) catchUpFinalizedState(ctx context.Context) (err error) {
+	if c.fs == nil {
+		if c.fs, err = newFinalizedState(c.rt.isolationLevel, c.rt.getServer()); err != nil {
+			return
+		}
+	}
+
+	// Collect the newly finalized blocks and replay them in order
+	var (
+		target = c.finalizedNode()
+		nodes  []*blockNode
+	)
+	for node := target; node != c.fs.node; node = node.parent {
+		if node == nil {
+			err = errors.Errorf("finalized block %s is reverted", c.fs.node.hash.String())
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(nodes[i]); err != nil {
+			return
+		}
+		if err = replayBlock(ctx, c.fs.st, block); err != nil {
+			log.WithFields(log.Fields{
+				"block":  nodes[i].hash.String(),
+				"height": nodes[i].height,
+				"db":     c.databaseID,
+			}).WithError(err).Error("failed to replay finalized block")
+			return
+		}
+		c.fs.node = nodes[i]
+	}
+	return
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestFinalizedQuery(t *testing.T) {
+	Convey("Given a chain with confirmation depth", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.confirmationDepth = 2
+		var (
+			offset     uint64
+			newWriteTx = func(pattern string) []*types.QueryAsTx {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, offset)
+				So(err, ShouldBeNil)
+				offset++
+				tx.Request.Payload.Queries = []types.Query{{Pattern: pattern}}
+				err = tx.Request.Sign(cli.PrivateKey)
+				So(err, ShouldBeNil)
+				tx.Response.RequestHash = tx.Request.Header.Hash()
+				err = tx.Response.BuildHash()
+				So(err, ShouldBeNil)
+				return []*types.QueryAsTx{tx}
+			}
+			newRead = func() *types.Request {
+				return &types.Request{
+					Header: types.SignedRequestHeader{
+						RequestHeader: types.RequestHeader{QueryType: types.ReadQuery},
+					},
+					Payload: types.RequestPayload{
+						Queries: []types.Query{{Pattern: `SELECT COUNT(1) FROM t1`}},
+					},
+				}
+			}
+			inserted int
+			insert   = func(n int) {
+				err := pushTestBlocks(chain, n, func(i int) []*types.QueryAsTx {
+					inserted++
+					return newWriteTx(fmt.Sprintf(
+						`INSERT INTO t1 (k, v) VALUES (%d, 'v%d')`, inserted, inserted))
+				})
+				So(err, ShouldBeNil)
+			}
+		)
+		So(chain.FinalizedHeight(), ShouldEqual, 0)
+		err = pushTestBlocks(chain, 1, func(i int) []*types.QueryAsTx {
+			return newWriteTx(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`)
+		})
+		So(err, ShouldBeNil)
+		insert(3)
+		Convey("The finalized height should lag behind the head by the confirmation depth", func() {
+			var head = chain.rt.getHead().node
+			So(chain.FinalizedHeight(), ShouldEqual, head.ancestorByCount(head.count-2).height)
+			chain.rt.confirmationDepth = 0
+			So(chain.FinalizedHeight(), ShouldEqual, head.height)
+		})
+		Convey("The finalized query should only see the finalized blocks", func() {
+			_, resp, height, err := chain.QueryWithOptions(
+				newRead(), false, QueryOptions{Finalized: true})
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, chain.FinalizedHeight())
+			So(resp.Payload.Rows, ShouldHaveLength, 1)
+			So(resp.Payload.Rows[0].Values[0], ShouldEqual, 1)
+			insert(2)
+			_, resp, height, err = chain.QueryWithOptions(
+				newRead(), false, QueryOptions{Finalized: true})
+			So(err, ShouldBeNil)
+			So(height, ShouldEqual, chain.FinalizedHeight())
+			So(resp.Payload.Rows[0].Values[0], ShouldEqual, 3)
+		})
+	})
+}
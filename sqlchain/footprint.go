@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/storage"
+)
+
+// sqliteFileSuffixes are the suffixes of the files making up a sqlite database in WAL mode.
+var sqliteFileSuffixes = [...]string{"", "-wal", "-shm"}
+
+// StorageBreakdown returns the approximate disk usage in bytes of each chain storage: the block
+// and state database, the ack/request/response database, and the sqlite data files of the state.
+func (c *Chain) StorageBreakdown() (blockState, transactions, stateData int64, err error) {
+	if blockState, err = leveldbSize(c.bdb); err != nil {
+		err = errors.Wrap(err, "measure block state storage")
+		return
+	}
+	if transactions, err = leveldbSize(c.tdb); err != nil {
+		err = errors.Wrap(err, "measure transaction storage")
+		return
+	}
+	if stateData, err = sqliteSize(c.dataFile); err != nil {
+		err = errors.Wrap(err, "measure state data storage")
+	}
+	return
+}
+
+// leveldbSize returns the total size of the table files of db. The recent writes which are not
+// flushed to table files yet are not counted.
+func leveldbSize(db *leveldb.DB) (size int64, err error) {
+	var stats leveldb.DBStats
+	if err = db.Stats(&stats); err != nil {
+		return
+	}
+	for _, v := range stats.LevelSizes {
+		size += v
+	}
+	return
+}
+
+// sqliteSize returns the total file size of the sqlite database of dsn, including its WAL files.
+func sqliteSize(dsn string) (size int64, err error) {
+	var parsed *storage.DSN
+	if parsed, err = storage.NewDSN(dsn); err != nil {
+		return
+	}
+	for _, v := range sqliteFileSuffixes {
+		var fi os.FileInfo
+		if fi, err = os.Stat(parsed.GetFileName() + v); os.IsNotExist(err) {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		size += fi.Size()
+	}
+	return
+}
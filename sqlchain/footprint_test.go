@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestStorageBreakdown(t *testing.T) {
+	Convey("Given a chain with some blocks flushed to disk", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 5, nil), ShouldBeNil)
+		So(chain.bdb.CompactRange(util.Range{}), ShouldBeNil)
+		Convey("The storage of each component should be measured", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			blockState, transactions, stateData, err := chain.StorageBreakdown()
+			So(err, ShouldBeNil)
+			So(blockState, ShouldBeGreaterThan, 0)
+			So(transactions, ShouldBeGreaterThanOrEqualTo, 0)
+			So(stateData, ShouldBeGreaterThan, 0)
+			var diag = chain.Diagnostics()
+			So(diag.BlockStateSize, ShouldEqual, blockState)
+			So(diag.TransactionsSize, ShouldEqual, transactions)
+			So(diag.StateDataSize, ShouldBeGreaterThan, 0)
+		})
+		Convey("The diagnostics should report failures of measuring", func() {
+			So(chain.Stop(), ShouldBeNil)
+			_, _, _, err := chain.StorageBreakdown()
+			So(err, ShouldNotBeNil)
+			var diag = chain.Diagnostics()
+			So(diag.BlockStateSize, ShouldEqual, -1)
+			So(diag.TransactionsSize, ShouldEqual, -1)
+			So(diag.StateDataSize, ShouldEqual, -1)
+		})
+	})
+}
@@ -0,0 +1,542 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/storage"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+	x "github.com/CovenantSQL/CovenantSQL/xenomint"
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+)
+
+// reorgEventBuffer is the number of pending reorg events buffered for each subscriber.
+const reorgEventBuffer = 16
+
+// ReorgEvent describes a switch of the best chain to a side branch.
+type ReorgEvent struct {
+	// OldHead and NewHead are the heads of the best chain before and after the switch.
+	OldHead, NewHead hash.Hash
+	// ForkPoint is the common ancestor of the two branches at ForkHeight.
+	ForkPoint  hash.Hash
+	ForkHeight int32
+	// Reverted and Applied are the numbers of blocks reverted from the old branch and applied
+	// from the new branch respectively.
+	Reverted, Applied int32
+}
+
+// ReorgHandler handles a reorg of the best chain.
+type ReorgHandler func(ev *ReorgEvent)
+
+// reorgSubscribers is the set of reorg event subscribers of a chain.
+type reorgSubscribers struct {
+	sync.Mutex
+	subs []chan *ReorgEvent
+}
+
+// OnReorg subscribes fn to the reorgs of the chain. Each subscriber is called in its own
+// goroutine in the order of the reorgs, and a panicking call is recovered and logged. The events
+// are dropped with warnings if a subscriber falls behind, so that block processing is never
+// stalled.
+func (c *Chain) OnReorg(fn ReorgHandler) {
+	var events = make(chan *ReorgEvent, reorgEventBuffer)
+	c.reorgSubs.Lock()
+	c.reorgSubs.subs = append(c.reorgSubs.subs, events)
+	c.reorgSubs.Unlock()
+	go func(ctx context.Context) {
+		var call = func(ev *ReorgEvent) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.WithFields(log.Fields{
+						"db":    c.databaseID,
+						"panic": r,
+					}).Error("reorg handler panicked")
+				}
+			}()
+			fn(ev)
+		}
+		for {
+			select {
+			case ev := <-events:
+				call(ev)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(c.rt.ctx)
+}
+
+// publishReorg publishes ev to the subscribers without blocking.
+func (c *Chain) publishReorg(ev *ReorgEvent) {
+	c.reorgSubs.Lock()
+	defer c.reorgSubs.Unlock()
+	for i, events := range c.reorgSubs.subs {
+		var cp = *ev
+		select {
+		case events <- &cp:
+		default:
+			log.WithFields(log.Fields{
+				"db":         c.databaseID,
+				"subscriber": i,
+			}).Warning("reorg event dropped: subscriber falls behind")
+		}
+	}
+}
+
+// pushForkBlock keeps block at height on the side branch extending a known block, and switches
+// the best chain to the branch once it's longer, i.e., has a higher block count, than the best
+// chain. The blocks on side branches are only kept in memory until they're switched to.
+func (c *Chain) pushForkBlock(block *types.Block, height int32) (err error) {
+	var parent = c.bi.lookupNode(block.ParentHash())
+	if parent == nil || height <= parent.height {
+		return ErrInvalidBlock
+	}
+	if c.bi.hasBlock(block.BlockHash()) {
+		return
+	}
+
+	// Verify the block as a new block at its own turn
+	if err = block.Verify(); err != nil {
+		return
+	}
+	if err = c.rt.schemes.checkBlock(block); err != nil {
+		return
+	}
+	if err = c.checkCheckpoint(parent.count+1, block.BlockHash()); err != nil {
+		return
+	}
+	if err = c.checkResponseAccounts(block); err != nil {
+		return
+	}
+	var (
+		peers        = c.rt.getPeers()
+		index, found = peers.Find(block.Producer())
+	)
+	if !found {
+		return ErrUnknownProducer
+	}
+	if total := int32(len(peers.Servers)); index != height%total {
+		return ErrInvalidProducer
+	}
+	if err = c.checkBlockValidator(block, parent); err != nil {
+		return
+	}
+
+	var node = newBlockNode(height, block, parent)
+	c.bi.addBlock(node)
+	c.rt.addFork(node)
+	log.WithFields(log.Fields{
+		"block":  node.hash.String(),
+		"height": node.height,
+		"count":  node.count,
+		"parent": parent.hash.String(),
+		"db":     c.databaseID,
+	}).Info("kept block on side branch")
+
+	if node.count <= c.rt.getHead().node.count {
+		return
+	}
+	return c.reorg(node)
+}
+
+// extendsSideBranch reports whether block extends a known block other than the head.
+func (c *Chain) extendsSideBranch(block *types.Block) bool {
+	var parent = c.bi.lookupNode(block.ParentHash())
+	return parent != nil && parent != c.rt.getHead().node
+}
+
+// commonAncestor returns the latest block node shared by the branches ending at a and b.
+func commonAncestor(a, b *blockNode) *blockNode {
+	for a != nil && b != nil && a != b {
+		if a.count > b.count {
+			a = a.parent
+		} else {
+			b = b.parent
+		}
+	}
+	if a != b {
+		return nil
+	}
+	return a
+}
+
+// reorg switches the best chain to the branch ending at tip.
+//
+// The state can't be rolled back to the fork point, since the committed queries are never kept
+// apart by blocks in the state storage. Instead, the state of the new branch is rebuilt aside by
+// replaying the branch from the genesis block, and then swapped with the live state while the
+// client queries are paused. The live state is untouched if the rebuilding fails, e.g., a block
+// of the new branch fails to replay, and it's swapped back if the new branch fails to persist.
+// The chain stays on the current branch in either case.
+//
+// The reorg is refused if the fork point is below the finalized block, see
+// Config.ConfirmationDepth, so that a finalized block is never reverted. The ack index is
+// rebuilt with the new branch, so that the queries of the reverted blocks are tracked again and
+// billed by a later block unless they are also included by the new branch.
+func (c *Chain) reorg(tip *blockNode) (err error) {
+	var (
+		head = c.rt.getHead()
+		fork = commonAncestor(head.node, tip)
+		le   = log.WithFields(log.Fields{
+			"old_head": head.Head.String(),
+			"new_head": tip.hash.String(),
+			"db":       c.databaseID,
+		})
+	)
+	if fork == nil {
+		return errors.Wrapf(ErrParentNotFound, "no common ancestor with %s", tip.hash.String())
+	}
+	le = le.WithFields(log.Fields{"fork": fork.hash.String(), "fork_height": fork.height})
+	if final := c.finalizedNode(); final != nil && fork.count < final.count {
+		le.Warning("refused to reorg below the finalized block")
+		return
+	}
+
+	// Rebuild the state of the new branch aside
+	var (
+		dsn *storage.DSN
+		nid uint64
+	)
+	if dsn, nid, err = c.rebuildState(tip); err != nil {
+		le.WithError(err).Error("failed to rebuild state for reorg")
+		return
+	}
+	defer removeSqliteFiles(dsn.GetFileName())
+
+	// Swap the live state and persist the new branch as the best chain, the live state is
+	// restored if the branch fails to persist
+	var (
+		branch   []*blockNode
+		reverted []*blockNode
+		st       = &state{node: tip, Head: tip.hash, Height: tip.height}
+		finish   func(keep bool) error
+	)
+	for n := tip; n != fork; n = n.parent {
+		branch = append([]*blockNode{n}, branch...)
+	}
+	for n := head.node; n != fork; n = n.parent {
+		reverted = append(reverted, n)
+	}
+	if !c.gate.isPaused() {
+		if err = c.PauseQueries(c.rt.ctx); err != nil {
+			c.ResumeQueries()
+			return
+		}
+		defer c.ResumeQueries()
+	}
+	if finish, err = c.swapState(dsn, nid); err != nil {
+		le.WithError(err).Error("failed to swap state for reorg")
+		return
+	}
+	if err = c.persistBranch(st, branch, reverted); err != nil {
+		le.WithError(err).Error("failed to persist branch for reorg")
+		if rerr := finish(false); rerr != nil {
+			le.WithError(rerr).Error("CRITICAL: failed to restore state for reorg")
+		}
+		return
+	}
+	if rerr := finish(true); rerr != nil {
+		le.WithError(rerr).Warning("failed to remove replaced state files")
+	}
+	c.rt.switchHead(st)
+	c.resetFinalizedState()
+	// Rebuild the ack index, so that the queries of the reverted blocks are tracked again unless
+	// they are also included by the new branch
+	if ierr := c.rebuildAckIndex(tip); ierr != nil {
+		le.WithError(ierr).Error("failed to rebuild ack index for reorg")
+	}
+	for _, n := range branch {
+		var block, ierr = c.fetchBlockOfNode(n)
+		if ierr != nil {
+			le.WithError(ierr).Warning("failed to fetch block for reorg")
+			continue
+		}
+		c.truncateAckWAL(block)
+		c.notifyQueryCommitted(block, n.height)
+	}
+	c.publishReorg(&ReorgEvent{
+		OldHead:    head.Head,
+		NewHead:    tip.hash,
+		ForkPoint:  fork.hash,
+		ForkHeight: fork.height,
+		Reverted:   int32(len(reverted)),
+		Applied:    int32(len(branch)),
+	})
+	c.publishChainEvent(Reorg, tip)
+	for _, n := range branch {
+		c.publishChainEvent(BlockPushed, n)
+	}
+	c.publishChainEvent(HeadChanged, tip)
+	le.WithFields(log.Fields{
+		"reverted": len(reverted),
+		"applied":  len(branch),
+	}).Warning("reorganized best chain")
+	return
+}
+
+// rebuildState rebuilds the state of the branch ending at tip to a new state storage beside the
+// live one, and returns the DSN of the new storage and the next sequence id of the branch. The
+// new storage is copied from the finalized state checkpoint if its blocks are on the branch, see
+// copyCheckpointState, and only the blocks after it are replayed. Otherwise, the branch is
+// replayed from the genesis block. Each replayed block is verified by its state checksum, if any,
+// and ErrStateDivergence is returned if the rebuilt state diverges from it.
+func (c *Chain) rebuildState(tip *blockNode) (dsn *storage.DSN, nid uint64, err error) {
+	var live *storage.DSN
+	if live, err = storage.NewDSN(c.dataFile); err != nil {
+		return
+	}
+	dsn = live.Clone()
+	dsn.SetFileName(live.GetFileName() + ".reorg")
+	if err = removeSqliteFiles(dsn.GetFileName()); err != nil {
+		return
+	}
+
+	var (
+		base    *blockNode
+		strg    xi.Storage
+		st      *x.State
+		nodes   []*blockNode
+		applied uint64
+		ok      bool
+	)
+	if base, err = c.copyCheckpointState(tip, dsn.GetFileName()); err != nil {
+		removeSqliteFiles(dsn.GetFileName())
+		return
+	}
+	if strg, err = c.newStorage(dsn.Format()); err != nil {
+		err = errors.Wrap(err, "open rebuilt state storage")
+		return
+	}
+	st = x.NewState(c.rt.isolationLevel, c.rt.getServer(), strg)
+	defer func() {
+		if ierr := st.Close(err == nil); ierr != nil && err == nil {
+			err = ierr
+		}
+		if err != nil {
+			removeSqliteFiles(dsn.GetFileName())
+		}
+	}()
+	if applied, ok, err = st.TrackAppliedSeq(); err != nil {
+		return
+	}
+	if ok {
+		st.SetSeq(applied)
+		nid = applied
+	}
+	for n := tip; n != base; n = n.parent {
+		nodes = append(nodes, n)
+	}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(nodes[i]); err != nil {
+			return
+		}
+		if id, ok := block.CalcNextID(); ok && id > nid {
+			nid = id
+		}
+		if err = replayBlock(c.rt.ctx, st, block); err != nil {
+			err = errors.Wrapf(err, "replay block %s", nodes[i].hash.String())
+			return
+		}
+		if err = c.verifyStateChecksum(st, block); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// persistBranch writes the blocks of branch and the new chain state st to bdb in a transaction,
+// and removes the account index of the reverted blocks. The block index snapshot is invalidated,
+// since the branch may be written below it.
+func (c *Chain) persistBranch(st *state, branch, reverted []*blockNode) (err error) {
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(st); err != nil {
+		return
+	}
+	var t *leveldb.Transaction
+	if t, err = c.bdb.OpenTransaction(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			t.Discard()
+		}
+	}()
+	for _, n := range reverted {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(n); err != nil {
+			return
+		}
+		if err = c.delAccountIndex(t, n.height, block); err != nil {
+			return
+		}
+	}
+	for _, n := range branch {
+		var (
+			block    *types.Block
+			encBlock *bytes.Buffer
+			value    []byte
+		)
+		if block, err = c.fetchBlockOfNode(n); err != nil {
+			return
+		}
+		if encBlock, err = utils.EncodeMsgPack(block); err != nil {
+			return
+		}
+		if value, err = c.vc.seal(encBlock.Bytes()); err != nil {
+			return
+		}
+		if err = t.Put(utils.ConcatAll(metaBlockIndex[:], n.indexKey()), value, nil); err != nil {
+			err = errors.Wrapf(err, "put %s", string(n.indexKey()))
+			return
+		}
+		if err = c.putAccountIndex(t, n.height, block); err != nil {
+			return
+		}
+	}
+	if err = t.Put(metaState[:], enc.Bytes(), nil); err != nil {
+		err = errors.Wrapf(err, "put %s", string(metaState[:]))
+		return
+	}
+	if err = t.Delete(metaSnapshotState[:], nil); err != nil {
+		err = errors.Wrap(err, "invalidate block index snapshot")
+		return
+	}
+	if err = t.Commit(); err != nil {
+		err = errors.Wrap(err, "commit error")
+		return
+	}
+	c.resetIndexSnapshot()
+	return
+}
+
+// swapState replaces the storage of the live state with the rebuilt one at dsn, whose next
+// sequence id is nid. The storage is replaced inside the state, so that the users of the state
+// never see a closed one. The replaced files are kept aside until finish is called, which swaps
+// them back if the swap is not kept, or removes them otherwise. The client queries should be
+// paused by the caller.
+func (c *Chain) swapState(dsn *storage.DSN, nid uint64) (finish func(keep bool) error, err error) {
+	var live *storage.DSN
+	if live, err = storage.NewDSN(c.dataFile); err != nil {
+		return
+	}
+	var (
+		liveFile   = live.GetFileName()
+		backupFile = liveFile + ".backup"
+		prev       uint64
+	)
+	if err = removeSqliteFiles(backupFile); err != nil {
+		return
+	}
+	if prev, err = c.st.ReplaceStorage(
+		c.replaceStateFiles(liveFile, dsn.GetFileName(), backupFile), nid); err != nil {
+		return
+	}
+	finish = func(keep bool) (err error) {
+		if keep {
+			return removeSqliteFiles(backupFile)
+		}
+		_, err = c.st.ReplaceStorage(c.replaceStateFiles(liveFile, backupFile, ""), prev)
+		return
+	}
+	return
+}
+
+// replaceStateFiles returns a replace function of x.State.ReplaceStorage, which closes the live
+// state storage, moves its files at live aside, or removes them if aside is empty, and opens the
+// files moved in place from src as the new storage. The live files are moved back and reopened
+// if any step fails.
+func (c *Chain) replaceStateFiles(live, src, aside string) func(xi.Storage) (xi.Storage, error) {
+	return func(old xi.Storage) (strg xi.Storage, err error) {
+		var moved = aside
+		if moved == "" {
+			moved = live + ".replaced"
+		}
+		if err = old.Close(); err == nil {
+			if err = moveSqliteFiles(live, moved); err == nil {
+				if err = moveSqliteFiles(src, live); err == nil {
+					if strg, err = c.newStorage(c.dataFile); err == nil {
+						if aside == "" {
+							removeSqliteFiles(moved)
+						}
+						return
+					}
+					moveSqliteFiles(live, src)
+				}
+				moveSqliteFiles(moved, live)
+			}
+		}
+		var rerr error
+		if strg, rerr = c.newStorage(c.dataFile); rerr != nil {
+			log.WithField("db", c.databaseID).WithError(rerr).Error(
+				"CRITICAL: failed to reopen state storage")
+			strg = nil
+		}
+		return
+	}
+}
+
+// moveSqliteFiles renames the files making up the sqlite database at from to the ones at to.
+func moveSqliteFiles(from, to string) (err error) {
+	for _, v := range sqliteFileSuffixes {
+		if err = os.Rename(from+v, to+v); os.IsNotExist(err) {
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// removeSqliteFiles removes the files making up the sqlite database at filename.
+func removeSqliteFiles(filename string) (err error) {
+	for _, v := range sqliteFileSuffixes {
+		if err = os.Remove(filename + v); os.IsNotExist(err) {
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pruneForks drops the side branches falling behind the best chain by more than the block cache
+// TTL, which are unlikely to overtake the best chain.
+func (c *Chain) pruneForks() {
+	var head = c.rt.getHead().node
+	if head == nil {
+		return
+	}
+	for _, tip := range c.rt.dropForks(head.count - c.getBlockCacheTTL()) {
+		for n := tip; n != nil && head.ancestorByCount(n.count) != n; n = n.parent {
+			if c.rt.isForkNode(n) {
+				break
+			}
+			c.bi.removeBlock(&n.hash)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/storage"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestReorg(t *testing.T) {
+	Convey("Given a chain and a side branch forking from the genesis block", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		err = pushTestBlocks(chain, 2, nil)
+		So(err, ShouldBeNil)
+		var (
+			head    = chain.rt.getHead()
+			genesis = head.node.ancestorByCount(0)
+			parent  = genesis.hash
+			side    []*types.Block
+			events  = make(chan *ReorgEvent, 1)
+		)
+		for h := int32(1); h <= 3; h++ {
+			// Shift the timestamps to differ from the blocks of the best chain
+			var ts = chain.rt.getTimeFromHeight(h).Add(time.Millisecond)
+			block, err := createTestBlock(&parent, chain.rt.getServer(), ts, nil)
+			So(err, ShouldBeNil)
+			side = append(side, block)
+			parent = *block.BlockHash()
+		}
+		chain.OnReorg(func(ev *ReorgEvent) { events <- ev })
+		Convey("The chain should switch to the side branch once it's longer", func() {
+			chain.rt.confirmationDepth = 5
+			for _, v := range side[:2] {
+				err = chain.CheckAndPushNewBlock(v)
+				So(err, ShouldBeNil)
+				So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			}
+			So(chain.Stats().ForkCount, ShouldEqual, 1)
+			err = chain.CheckAndPushNewBlock(side[2])
+			So(err, ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, *side[2].BlockHash())
+			So(chain.Stats().ForkCount, ShouldEqual, 1)
+			block, err := chain.FetchBlock(1)
+			So(err, ShouldBeNil)
+			So(block.BlockHash(), ShouldResemble, side[0].BlockHash())
+			var ev *ReorgEvent
+			select {
+			case ev = <-events:
+			case <-time.After(time.Second):
+			}
+			So(ev, ShouldNotBeNil)
+			So(ev.OldHead, ShouldResemble, head.Head)
+			So(ev.ForkPoint, ShouldResemble, genesis.hash)
+			So(ev.Reverted, ShouldEqual, 2)
+			So(ev.Applied, ShouldEqual, 3)
+			Convey("The switched head should be loaded after restart", func() {
+				err = chain.Stop()
+				So(err, ShouldBeNil)
+				chain, err = NewChain(config)
+				So(err, ShouldBeNil)
+				defer func() { So(chain.Stop(), ShouldBeNil) }()
+				So(chain.rt.getHead().Head, ShouldResemble, *side[2].BlockHash())
+				So(chain.rt.getHead().node.count, ShouldEqual, 3)
+			})
+		})
+		Convey("The chain should never revert a finalized block", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			for _, v := range side {
+				err = chain.CheckAndPushNewBlock(v)
+				So(err, ShouldBeNil)
+			}
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			So(chain.Stats().ForkCount, ShouldEqual, 1)
+		})
+		Convey("The chain should not switch to a side branch rejected by the validator", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			chain.rt.confirmationDepth = 5
+			chain.validator = func(block *types.Block, parent *blockNode) error {
+				if block.BlockHash().IsEqual(side[2].BlockHash()) {
+					return errors.New("rejected")
+				}
+				return nil
+			}
+			for _, v := range side[:2] {
+				err = chain.CheckAndPushNewBlock(v)
+				So(err, ShouldBeNil)
+			}
+			err = chain.CheckAndPushNewBlock(side[2])
+			So(err, ShouldNotBeNil)
+			So(chain.bi.hasBlock(side[2].BlockHash()), ShouldBeFalse)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			var ev *ReorgEvent
+			select {
+			case ev = <-events:
+			default:
+			}
+			So(ev, ShouldBeNil)
+		})
+	})
+}
+
+func TestReorgRestoresAcks(t *testing.T) {
+	Convey("Given a chain with an acknowledged query included by the best chain", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.confirmationDepth = 5
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		resp, err := createRandomQueryResponse(cli, cli)
+		So(err, ShouldBeNil)
+		So(chain.AddResponse(resp), ShouldBeNil)
+		ack, err := createRandomQueryAckWithResponse(resp, cli)
+		So(err, ShouldBeNil)
+		So(chain.VerifyAndPushAckedQuery(ack), ShouldBeNil)
+		var (
+			head    = chain.rt.getHead()
+			genesis = head.node.ancestorByCount(0)
+			parent  = genesis.hash
+			h       = chain.rt.getHeightFromTime(ack.GetRequestTimestamp())
+			indexed = func() (ret []hash.Hash) {
+				for _, v := range chain.ai.acks(h) {
+					ret = append(ret, v.Hash())
+				}
+				return
+			}
+		)
+		So(indexed(), ShouldResemble, []hash.Hash{ack.Hash()})
+		var block = &types.Block{
+			SignedHeader: types.SignedHeader{
+				Header: types.Header{
+					Version:    0x01000000,
+					Producer:   chain.rt.getServer(),
+					ParentHash: head.Head,
+					Timestamp:  chain.rt.getTimeFromHeight(head.Height + 1),
+				},
+			},
+			Acks: []*types.SignedAckHeader{ack},
+		}
+		So(block.PackAndSignBlock(testPrivKey), ShouldBeNil)
+		So(chain.pushBlock(block), ShouldBeNil)
+		So(pushTestBlocks(chain, 1, nil), ShouldBeNil)
+		So(indexed(), ShouldBeEmpty)
+		Convey("The ack should be tracked again once the block is reverted by a reorg", func() {
+			for h := int32(1); h <= 3; h++ {
+				var ts = chain.rt.getTimeFromHeight(h).Add(time.Millisecond)
+				block, err := createTestBlock(&parent, chain.rt.getServer(), ts, nil)
+				So(err, ShouldBeNil)
+				So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+				parent = *block.BlockHash()
+			}
+			So(chain.rt.getHead().Head, ShouldResemble, parent)
+			So(indexed(), ShouldResemble, []hash.Hash{ack.Hash()})
+		})
+	})
+}
+
+func TestBillingAcrossReorg(t *testing.T) {
+	Convey("Given a chain billed at a period boundary and a longer side branch", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.confirmationDepth = 5
+		err = pushTestBlocks(chain, int(testUpdatePeriod), nil)
+		So(err, ShouldBeNil)
+		var (
+			head   = chain.rt.getHead().node
+			parent = head.ancestorByCount(0).hash
+			counts = func(nodes []*blockNode) (ret []int32) {
+				for _, v := range nodes {
+					ret = append(ret, v.count)
+				}
+				return
+			}
+		)
+		So(counts(chain.dueBillings(head)), ShouldResemble, []int32{2})
+		for h := int32(1); h <= 3; h++ {
+			var ts = chain.rt.getTimeFromHeight(h).Add(time.Millisecond)
+			block, err := createTestBlock(&parent, chain.rt.getServer(), ts, nil)
+			So(err, ShouldBeNil)
+			err = chain.CheckAndPushNewBlock(block)
+			So(err, ShouldBeNil)
+			parent = *block.BlockHash()
+		}
+		So(chain.rt.getHead().Head, ShouldResemble, parent)
+		Convey("The billed period should not be billed again after the reorg", func() {
+			So(chain.dueBillings(chain.rt.getHead().node), ShouldBeEmpty)
+			Convey("Each following period should be billed exactly once", func() {
+				err = pushTestBlocks(chain, 3, nil)
+				So(err, ShouldBeNil)
+				var head = chain.rt.getHead().node
+				So(counts(chain.dueBillings(head)), ShouldResemble, []int32{4, 6})
+				So(chain.dueBillings(head), ShouldBeEmpty)
+				So(chain.dueBillings(head.parent), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestSwapState(t *testing.T) {
+	Convey("Given a chain and a state rebuilt aside", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, 2, nil)
+		So(err, ShouldBeNil)
+		dsn, nid, err := chain.rebuildState(chain.rt.getHead().node)
+		So(err, ShouldBeNil)
+		defer removeSqliteFiles(dsn.GetFileName())
+		live, err := storage.NewDSN(config.DataFile)
+		So(err, ShouldBeNil)
+		var (
+			stat = func(filename string) os.FileInfo {
+				fi, err := os.Stat(filename)
+				So(err, ShouldBeNil)
+				return fi
+			}
+			liveFile = live.GetFileName()
+			old      = stat(liveFile)
+			rebuilt  = stat(dsn.GetFileName())
+		)
+		finish, err := chain.swapState(dsn, nid)
+		So(err, ShouldBeNil)
+		So(os.SameFile(stat(liveFile), rebuilt), ShouldBeTrue)
+		Convey("The live state should be swapped back if the swap isn't kept", func() {
+			So(finish(false), ShouldBeNil)
+			So(os.SameFile(stat(liveFile), old), ShouldBeTrue)
+			_, err = os.Stat(liveFile + ".backup")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("The replaced files should be removed if the swap is kept", func() {
+			So(finish(true), ShouldBeNil)
+			So(os.SameFile(stat(liveFile), rebuilt), ShouldBeTrue)
+			_, err = os.Stat(liveFile + ".backup")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+	})
+}
+
+func TestRebuildStateFromCheckpoint(t *testing.T) {
+	Convey("Given a chain with finalized blocks", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.confirmationDepth = 1
+		err = pushTestBlocks(chain, 3, nil)
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead().node
+		dsn, _, err := chain.rebuildState(head)
+		So(err, ShouldBeNil)
+		So(removeSqliteFiles(dsn.GetFileName()), ShouldBeNil)
+		So(chain.fs.node, ShouldEqual, chain.finalizedNode())
+		Convey("The blocks below the checkpoint should not be replayed again", func() {
+			cli, err := newRandomNode()
+			So(err, ShouldBeNil)
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 100)
+			So(err, ShouldBeNil)
+			var node = head.ancestorByCount(1)
+			node.block, err = createTestBlock(
+				&node.parent.hash, chain.rt.getServer(), node.block.Timestamp(),
+				[]*types.QueryAsTx{tx})
+			So(err, ShouldBeNil)
+			dsn, _, err = chain.rebuildState(head)
+			So(err, ShouldBeNil)
+			So(removeSqliteFiles(dsn.GetFileName()), ShouldBeNil)
+			chain.fsMutex.Lock()
+			So(chain.fs.close(), ShouldBeNil)
+			chain.fs = nil
+			chain.fsMutex.Unlock()
+			_, _, err = chain.rebuildState(head)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+// encodedBlockHeader decodes the signed header of an encoded types.Block only, the other fields
+// of the block are skipped by the decoder without being materialized.
+type encodedBlockHeader struct {
+	SignedHeader types.SignedHeader
+}
+
+// loadBlockHeaderByIndexKey reads the signed header of the block at indexKey from the block store.
+func (c *Chain) loadBlockHeaderByIndexKey(indexKey []byte) (header *types.SignedHeader, err error) {
+	var (
+		k   = utils.ConcatAll(metaBlockIndex[:], indexKey)
+		v   []byte
+		enc = &encodedBlockHeader{}
+	)
+	if v, err = c.bdb.Get(k, nil); err == leveldb.ErrNotFound {
+		return nil, errors.Wrapf(ErrBlockNotFound, "fetch block header %s", string(k))
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "fetch block header %s", string(k))
+	}
+	if v, err = c.vc.open(v); err != nil {
+		return nil, errors.Wrapf(err, "fetch block header %s", string(k))
+	}
+	if err = utils.DecodeMsgPack(v, enc); err != nil {
+		return nil, errors.Wrapf(err, "fetch block header %s", string(k))
+	}
+	if offset := len(metaBlockIndex) + 4; len(k) >= offset+hash.HashSize {
+		var h *hash.Hash
+		if h, err = hash.NewHash(k[offset : offset+hash.HashSize]); err != nil {
+			return
+		}
+		if !enc.SignedHeader.HSV.DataHash.IsEqual(h) {
+			return nil, ErrBlockHashMismatch
+		}
+	}
+	return &enc.SignedHeader, nil
+}
+
+// FetchBlockHeader fetches the signed header of the block at height of the current chain, or nil
+// if there is no block at the height. Like FetchBlock, the header is read from the block store,
+// but the queries and acks of the block are never decoded.
+func (c *Chain) FetchBlockHeader(height int32) (header *types.SignedHeader, err error) {
+	var n = c.rt.getHead().node.ancestor(height)
+	if n == nil {
+		return
+	}
+	return c.loadBlockHeaderByIndexKey(n.indexKey())
+}
+
+// verifyFetchedHeader checks the signed header fetched for height h, i.e., it's signed by its own
+// signee with an allowed scheme, and the producer is a known peer. The payload of the block is
+// not available to verify the merkle root.
+func (c *Chain) verifyFetchedHeader(header *types.SignedHeader, h int32) (err error) {
+	if bh := c.rt.getHeightFromTime(header.Timestamp); bh != h {
+		return errors.Wrapf(ErrBlockHeightMismatch, "block %d, fetched %d", bh, h)
+	}
+	if err = header.Verify(); err != nil {
+		return
+	}
+	if err = c.rt.schemes.check(header.HSV.Signee); err != nil {
+		return
+	}
+	if _, found := c.rt.getPeers().Find(header.Producer); !found {
+		return ErrUnknownProducer
+	}
+	return
+}
+
+// FetchBlockHeaderFromPeer fetches and verifies the signed header of the block at height h from
+// the peer id, which is much lighter than fetching the full block for a header chain sync.
+func (c *Chain) FetchBlockHeaderFromPeer(
+	ctx context.Context, id proto.NodeID, h int32) (header *types.SignedHeader, err error,
+) {
+	var (
+		req = &MuxFetchBlockHeaderReq{
+			DatabaseID:          c.databaseID,
+			FetchBlockHeaderReq: FetchBlockHeaderReq{Height: h},
+		}
+		resp = &MuxFetchBlockHeaderResp{}
+	)
+	if _, err = retryWithBackoff(ctx, c.rt.fetchRetries, c.rt.retryBackoff, func() (err error) {
+		var sent = time.Now()
+		if err = c.cl.CallNodeWithContext(
+			ctx, id, route.SQLCFetchBlockHeader.String(), req, resp,
+		); err == nil {
+			c.rt.reportPeerTime(id, sent, time.Now(), resp.Timestamp)
+		}
+		return
+	}); err != nil || resp.Header == nil {
+		return
+	}
+	if err = c.verifyFetchedHeader(resp.Header, h); err != nil {
+		c.rt.reportBadBlock(id)
+		return nil, errors.Wrapf(err, "verify block header from %s", id)
+	}
+	return resp.Header, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+func TestFetchBlockHeader(t *testing.T) {
+	Convey("Given a chain with some blocks of queries", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		err = pushTestBlocks(chain, 5, func(i int) (txs []*types.QueryAsTx) {
+			for j := 0; j < 4; j++ {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+				So(err, ShouldBeNil)
+				txs = append(txs, tx)
+			}
+			return
+		})
+		So(err, ShouldBeNil)
+		chain.setBlockCacheTTL(2)
+		chain.pruneBlockCache()
+		var head = chain.rt.getHead().node
+		So(head.ancestor(1).block, ShouldBeNil)
+		So(head.block, ShouldNotBeNil)
+		Convey("The headers should match the full blocks in a much smaller size", func() {
+			for _, h := range []int32{1, head.height} {
+				block, err := chain.FetchBlock(h)
+				So(err, ShouldBeNil)
+				header, err := chain.FetchBlockHeader(h)
+				So(err, ShouldBeNil)
+				So(header, ShouldResemble, &block.SignedHeader)
+				So(chain.verifyFetchedHeader(header, h), ShouldBeNil)
+				encBlock, err := utils.EncodeMsgPack(block)
+				So(err, ShouldBeNil)
+				encHeader, err := utils.EncodeMsgPack(header)
+				So(err, ShouldBeNil)
+				So(encHeader.Len(), ShouldBeLessThan, encBlock.Len()/2)
+			}
+		})
+		Convey("No header should be fetched beyond the current head", func() {
+			header, err := chain.FetchBlockHeader(head.height + 1)
+			So(err, ShouldBeNil)
+			So(header, ShouldBeNil)
+		})
+		Convey("The tampered header should be refused", func() {
+			header, err := chain.FetchBlockHeader(1)
+			So(err, ShouldBeNil)
+			header.Producer = "tampered"
+			So(chain.verifyFetchedHeader(header, 1), ShouldNotBeNil)
+			header, err = chain.FetchBlockHeader(1)
+			So(err, ShouldBeNil)
+			So(chain.verifyFetchedHeader(header, 2), ShouldNotBeNil)
+		})
+		Convey("The header should be fetched from a peer through the RPC service", func() {
+			var mux = &MuxService{}
+			mux.register(chain.databaseID, newChainRPCService(chain, nil))
+			chain.cl = &mockCaller{call: func(
+				ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+			) error {
+				return mux.FetchBlockHeader(
+					args.(*MuxFetchBlockHeaderReq), reply.(*MuxFetchBlockHeaderResp))
+			}}
+			block, err := chain.FetchBlock(2)
+			So(err, ShouldBeNil)
+			header, err := chain.FetchBlockHeaderFromPeer(
+				context.Background(), chain.rt.getServer(), 2)
+			So(err, ShouldBeNil)
+			So(header, ShouldResemble, &block.SignedHeader)
+		})
+	})
+}
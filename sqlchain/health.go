@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ChainHealth describes the sync status of the chain, see Chain.Health.
+type ChainHealth struct {
+	// HeadHeight is the height of the current head.
+	HeadHeight int32
+	// ExpectedHeight is the height of the current turn, i.e., the head height of a synced chain.
+	ExpectedHeight int32
+	// Lag is the number of turns the head lags behind the current turn.
+	Lag int32
+	// LastSynced is the last time when the head is found caught up with the current turn, or the
+	// zero time if never.
+	LastSynced time.Time
+	// Synced reports whether the lag is within Config.MaxHealthyLag.
+	Synced bool
+}
+
+// markSynced records now as the last time when the head is found caught up.
+func (c *Chain) markSynced() {
+	atomic.StoreInt64(&c.lastSynced, time.Now().UnixNano())
+}
+
+// Health returns the sync status of the chain, e.g., for the readiness checks of the load
+// balancers. It only reads the memory states, thus it's cheap and safe to call at any time.
+func (c *Chain) Health() (h ChainHealth) {
+	h.HeadHeight = c.rt.getHead().Height
+	h.ExpectedHeight = c.rt.getNextTurn() - 1
+	if h.Lag = h.ExpectedHeight - h.HeadHeight; h.Lag < 0 {
+		h.Lag = 0
+	}
+	if ns := atomic.LoadInt64(&c.lastSynced); ns > 0 {
+		h.LastSynced = time.Unix(0, ns)
+	}
+	h.Synced = h.Lag <= c.rt.maxHealthyLag
+	return
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealth(t *testing.T) {
+	Convey("Given a chain lagging behind the current turn", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		So(chain.sync(), ShouldBeNil)
+		chain.rt.maxHealthyLag = 2
+		var (
+			expected = chain.rt.getNextTurn() - 1
+			health   = chain.Health()
+		)
+		So(expected, ShouldBeGreaterThan, 3)
+		So(health.HeadHeight, ShouldEqual, 0)
+		So(health.ExpectedHeight, ShouldEqual, expected)
+		So(health.Lag, ShouldEqual, expected)
+		So(health.Synced, ShouldBeFalse)
+		var lastSynced = health.LastSynced
+		Convey("The chain should be synced once the lag is within the threshold", func() {
+			So(pushTestBlocks(chain, int(expected)-3, nil), ShouldBeNil)
+			health = chain.Health()
+			So(health.Lag, ShouldEqual, 3)
+			So(health.Synced, ShouldBeFalse)
+			So(pushTestBlocks(chain, 1, nil), ShouldBeNil)
+			health = chain.Health()
+			So(health.Lag, ShouldEqual, 2)
+			So(health.Synced, ShouldBeTrue)
+			So(health.LastSynced, ShouldResemble, lastSynced)
+			So(pushTestBlocks(chain, 2, nil), ShouldBeNil)
+			health = chain.Health()
+			So(health.HeadHeight, ShouldEqual, expected)
+			So(health.Lag, ShouldEqual, 0)
+			So(health.Synced, ShouldBeTrue)
+			So(health.LastSynced.After(lastSynced), ShouldBeTrue)
+		})
+		Convey("The chain should be out of sync if it falls behind again", func() {
+			So(pushTestBlocks(chain, int(expected), nil), ShouldBeNil)
+			So(chain.Health().Synced, ShouldBeTrue)
+			for i := int32(0); i <= chain.rt.maxHealthyLag; i++ {
+				chain.rt.setNextTurn()
+			}
+			health = chain.Health()
+			So(health.Lag, ShouldEqual, chain.rt.maxHealthyLag+1)
+			So(health.Synced, ShouldBeFalse)
+			So(health.LastSynced.After(lastSynced), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"time"
+)
+
+// SchedulingMode defines how the turns of a sql-chain begin.
+type SchedulingMode int
+
+const (
+	// WallClockScheduling begins a new turn at each beginning time of the heights, i.e., the
+	// turns advance with the coordinated chain time no matter whether the blocks are produced.
+	WallClockScheduling SchedulingMode = iota
+	// CountDrivenScheduling begins a new turn as soon as the block of the previous turn is
+	// processed, ignoring the chain time. Each block is stamped with the beginning time of its
+	// height, so the heights of the blocks are still derived from their timestamps by the
+	// HeightScheme, while the current height is tracked explicitly by the processed blocks.
+	//
+	// It's mainly intended for testing and for the chains which should advance with the query
+	// workload instead of the time. Note the implications for the multi-node chains:
+	//
+	//  1. The chain never skips a turn, so it stalls until the producer of the current turn is
+	//     back online and its block is received, instead of leaving an empty height behind.
+	//  2. The block timestamps are no longer related to the wall clock, so the block time skew
+	//     check is disabled, and the query TTL and staleness are measured in processed blocks.
+	//     The request timestamps are still mapped to heights by the wall clock, thus the clients
+	//     may see their queries expire early if the chain runs faster than the period.
+	//  3. All the peers must use the same mode during the whole life of the chain.
+	CountDrivenScheduling
+)
+
+// HeightScheme converts between the chain time and the block heights of a sql-chain.
+//
+// A custom scheme must satisfy the following invariants:
+//
+//  1. It is determined by the genesis block and the chain config, so that every peer and every
+//     restart of the chain maps the same time to the same height.
+//  2. HeightFromTime(genesis timestamp) is 0, and HeightFromTime is non-decreasing in time.
+//  3. TimeFromHeight is strictly increasing, and TimeFromHeight(h) is the beginning of height h,
+//     i.e., HeightFromTime(t) is h for any t in [TimeFromHeight(h), TimeFromHeight(h+1)).
+type HeightScheme interface {
+	// ID returns the identifier of the scheme, which is persisted at genesis and validated when
+	// the chain is loaded, so that a chain is never reopened with a different scheme.
+	ID() string
+	// HeightFromTime returns the height of the given time reading.
+	HeightFromTime(t time.Time) int32
+	// TimeFromHeight returns the beginning time of the given height.
+	TimeFromHeight(h int32) time.Time
+}
+
+// HeightSchemeFactory creates the HeightScheme of a sql-chain with the timestamp of its genesis
+// block and the configured block period.
+type HeightSchemeFactory func(genesis time.Time, period time.Duration) HeightScheme
+
+// linearHeightScheme maps time to height linearly with a fixed period.
+type linearHeightScheme struct {
+	begin  time.Time
+	period time.Duration
+}
+
+// NewLinearHeightScheme returns the default HeightScheme with a fixed period since genesis.
+func NewLinearHeightScheme(genesis time.Time, period time.Duration) HeightScheme {
+	return &linearHeightScheme{
+		begin:  genesis,
+		period: period,
+	}
+}
+
+// ID implements HeightScheme.ID.
+func (s *linearHeightScheme) ID() string {
+	return "linear"
+}
+
+// HeightFromTime implements HeightScheme.HeightFromTime.
+func (s *linearHeightScheme) HeightFromTime(t time.Time) int32 {
+	return int32(t.Sub(s.begin) / s.period)
+}
+
+// TimeFromHeight implements HeightScheme.TimeFromHeight.
+func (s *linearHeightScheme) TimeFromHeight(h int32) time.Time {
+	return s.begin.Add(time.Duration(h) * s.period)
+}
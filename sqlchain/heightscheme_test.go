@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// steppedHeightScheme doubles the period since height step.
+type steppedHeightScheme struct {
+	begin  time.Time
+	period time.Duration
+	step   int32
+}
+
+func (s *steppedHeightScheme) ID() string {
+	return "stepped"
+}
+
+func (s *steppedHeightScheme) HeightFromTime(t time.Time) int32 {
+	var d = t.Sub(s.begin)
+	if d < time.Duration(s.step)*s.period {
+		return int32(d / s.period)
+	}
+	return s.step + int32((d-time.Duration(s.step)*s.period)/(2*s.period))
+}
+
+func (s *steppedHeightScheme) TimeFromHeight(h int32) time.Time {
+	if h < s.step {
+		return s.begin.Add(time.Duration(h) * s.period)
+	}
+	return s.begin.Add(time.Duration(s.step)*s.period + time.Duration(h-s.step)*2*s.period)
+}
+
+func checkHeightSchemeInvariants(s HeightScheme, begin time.Time, period time.Duration) {
+	So(s.HeightFromTime(begin), ShouldEqual, 0)
+	for h := int32(0); h < 20; h++ {
+		var t0, t1 = s.TimeFromHeight(h), s.TimeFromHeight(h + 1)
+		So(t1.After(t0), ShouldBeTrue)
+		So(s.HeightFromTime(t0), ShouldEqual, h)
+		So(s.HeightFromTime(t0.Add(period/2)), ShouldEqual, h)
+		So(s.HeightFromTime(t1.Add(-1)), ShouldEqual, h)
+	}
+}
+
+func TestHeightScheme(t *testing.T) {
+	Convey("Given a genesis block", t, func() {
+		var begin = time.Now().UTC()
+		genesis, err := createTestGenesis(begin)
+		So(err, ShouldBeNil)
+		Convey("The linear height scheme should satisfy the invariants", func() {
+			checkHeightSchemeInvariants(
+				NewLinearHeightScheme(begin, testPeriod), begin, testPeriod)
+		})
+		Convey("The custom height scheme should satisfy the invariants", func() {
+			checkHeightSchemeInvariants(
+				&steppedHeightScheme{begin: begin, period: testPeriod, step: 5}, begin, testPeriod)
+		})
+		Convey("The runtime should convert time with the custom height scheme", func() {
+			var rt = newRunTime(context.Background(), &Config{
+				Genesis: genesis,
+				Peers:   &proto.Peers{},
+				Period:  testPeriod,
+				Tick:    testPeriod,
+				HeightScheme: func(genesis time.Time, period time.Duration) HeightScheme {
+					return &steppedHeightScheme{begin: genesis, period: period, step: 5}
+				},
+			})
+			So(rt.getHeightFromTime(begin.Add(4*testPeriod)), ShouldEqual, 4)
+			So(rt.getHeightFromTime(begin.Add(6*testPeriod)), ShouldEqual, 5)
+			So(rt.getHeightFromTime(begin.Add(7*testPeriod)), ShouldEqual, 6)
+			So(rt.getTimeFromHeight(7), ShouldResemble, begin.Add(9*testPeriod))
+			rt.nextTurn = 7
+			var now, d = rt.nextTick()
+			So(now.Add(d), ShouldHappenOnOrBefore, begin.Add(9*testPeriod))
+		})
+	})
+}
+
+func TestCountDrivenScheduling(t *testing.T) {
+	Convey("Given a runtime with count-driven scheduling", t, func() {
+		var begin = time.Now().UTC()
+		genesis, err := createTestGenesis(begin)
+		So(err, ShouldBeNil)
+		var rt = newRunTime(context.Background(), &Config{
+			Genesis:        genesis,
+			Peers:          &proto.Peers{},
+			Period:         time.Hour,
+			Tick:           testTick,
+			SchedulingMode: CountDrivenScheduling,
+		})
+		rt.head.Height = 0
+		Convey("The next turn should begin once the previous block is processed", func() {
+			var now, d = rt.nextTick()
+			So(d, ShouldEqual, 0)
+			So(now, ShouldResemble, rt.getTimeFromHeight(1))
+			So(rt.getCurrentHeight(), ShouldEqual, 0)
+			rt.setNextTurn()
+			now, d = rt.nextTick()
+			So(d, ShouldEqual, testTick)
+			So(rt.getCurrentHeight(), ShouldEqual, 1)
+			rt.head.Height = 1
+			now, d = rt.nextTick()
+			So(d, ShouldEqual, 0)
+			So(now, ShouldResemble, rt.getTimeFromHeight(2))
+		})
+	})
+	Convey("Given a running chain with count-driven scheduling", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.schedulingMode = CountDrivenScheduling
+		So(chain.Start(), ShouldBeNil)
+		Convey("The chain should advance ahead of the wall clock", func() {
+			var (
+				target   int32 = 20
+				deadline       = time.Now().Add(10 * time.Second)
+			)
+			for chain.rt.getHead().Height < target && time.Now().Before(deadline) {
+				time.Sleep(testTick)
+			}
+			So(chain.rt.getHead().Height, ShouldBeGreaterThanOrEqualTo, target)
+			So(chain.rt.getHeightFromTime(time.Now()), ShouldBeLessThan, target)
+			So(chain.EffectiveConfig().SchedulingMode, ShouldEqual, CountDrivenScheduling)
+		})
+	})
+}
+
+func TestHeightSchemePersistence(t *testing.T) {
+	Convey("Given a stopped chain created with the linear height scheme", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		enc, err := chain.bdb.Get(metaHeightScheme[:], nil)
+		So(err, ShouldBeNil)
+		So(string(enc), ShouldEqual, "linear")
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		Convey("The chain should be reloaded with the same height scheme", func() {
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			err = chain.Stop()
+			So(err, ShouldBeNil)
+		})
+		Convey("The chain should not be reloaded with a different height scheme", func() {
+			config.HeightScheme = func(genesis time.Time, period time.Duration) HeightScheme {
+				return &steppedHeightScheme{begin: genesis, period: period, step: 5}
+			}
+			_, err = NewChain(config)
+			So(errors.Cause(err), ShouldEqual, ErrHeightSchemeMismatch)
+		})
+	})
+}
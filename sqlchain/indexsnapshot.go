@@ -0,0 +1,214 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// indexSnapshotNode is a persisted block index node, which is keyed by
+// ['I', 'S', 'N', 'P', height, hash], i.e., the index key of the node.
+type indexSnapshotNode struct {
+	ParentHash hash.Hash
+	Count      int32
+}
+
+// indexSnapshotState records the last block index node of the snapshot, and the max next
+// sequence id of the snapshotted blocks.
+type indexSnapshotState struct {
+	LastKey []byte
+	NextID  uint64
+}
+
+// snapshotIndex persists the block index nodes up to the current head which aren't snapshotted
+// yet, so that they are restored without decoding and verifying the blocks on the next load.
+func (c *Chain) snapshotIndex() (err error) {
+	var head = c.rt.getHead().node
+	if head == nil {
+		return
+	}
+	c.snapMutex.Lock()
+	defer c.snapMutex.Unlock()
+	var (
+		snap  = indexSnapshotState{LastKey: head.indexKey(), NextID: c.snap.NextID}
+		batch = new(leveldb.Batch)
+		nodes []*blockNode
+	)
+	if bytes.Equal(snap.LastKey, c.snap.LastKey) {
+		return
+	}
+	// New blocks always extend the head, so no block will be added below the snapshot later
+	c.bi.mu.RLock()
+	for _, v := range c.bi.index {
+		var k = v.indexKey()
+		if bytes.Compare(k, c.snap.LastKey) > 0 && bytes.Compare(k, snap.LastKey) <= 0 {
+			nodes = append(nodes, v)
+		}
+	}
+	c.bi.mu.RUnlock()
+
+	for _, v := range nodes {
+		var (
+			block = v.block
+			value = indexSnapshotNode{Count: v.count}
+			enc   *bytes.Buffer
+		)
+		if v.parent != nil {
+			value.ParentHash = v.parent.hash
+		}
+		if block == nil {
+			if block, err = c.fetchBlockByIndexKey(v.indexKey()); err != nil {
+				return
+			}
+		}
+		if nid, ok := block.CalcNextID(); ok && nid > snap.NextID {
+			snap.NextID = nid
+		}
+		if enc, err = utils.EncodeMsgPack(&value); err != nil {
+			return
+		}
+		batch.Put(utils.ConcatAll(metaIndexSnapshot[:], v.indexKey()), enc.Bytes())
+	}
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(&snap); err != nil {
+		return
+	}
+	batch.Put(metaSnapshotState[:], enc.Bytes())
+	if err = c.bdb.Write(batch, c.rt.writeOptions); err != nil {
+		err = errors.Wrap(err, "write block index snapshot")
+		return
+	}
+	c.snap = snap
+	log.WithFields(log.Fields{
+		"count":  len(nodes),
+		"height": head.height,
+		"db":     c.databaseID,
+	}).Debug("snapshotted block index")
+	return
+}
+
+// resetIndexSnapshot resets the snapshot state after the persisted snapshot is invalidated, so
+// that the next snapshot covers the whole block index.
+func (c *Chain) resetIndexSnapshot() {
+	c.snapMutex.Lock()
+	defer c.snapMutex.Unlock()
+	c.snap = indexSnapshotState{}
+}
+
+// loadIndexSnapshot restores the block index from the snapshot without decoding the snapshotted
+// blocks, except the genesis block. It returns a nil last node if there is no snapshot, or the
+// last snapshotted node and the max next sequence id of the snapshotted blocks.
+func (c *Chain) loadIndexSnapshot() (last *blockNode, id uint64, err error) {
+	var (
+		enc  []byte
+		snap indexSnapshotState
+	)
+	if enc, err = c.bdb.Get(metaSnapshotState[:], nil); err == leveldb.ErrNotFound {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	if err = utils.DecodeMsgPack(enc, &snap); err != nil {
+		return
+	}
+	var ok bool
+	if ok, err = c.bdb.Has(utils.ConcatAll(metaBlockIndex[:], snap.LastKey), nil); err != nil {
+		return
+	} else if !ok {
+		err = errors.Wrapf(ErrBlockNotFound, "last snapshotted block %x", snap.LastKey)
+		return
+	}
+
+	// Set constant fields from genesis block
+	var (
+		genesis   = &types.Block{}
+		blockIter = c.bdb.NewIterator(util.BytesPrefix(metaBlockIndex[:]), nil)
+	)
+	defer blockIter.Release()
+	if !blockIter.Next() {
+		if err = blockIter.Error(); err == nil {
+			err = errors.Wrap(ErrBlockNotFound, "genesis block")
+		}
+		return
+	}
+	if err = c.decodeBlock(blockIter.Key(), blockIter.Value(), genesis); err != nil {
+		return
+	}
+	if err = genesis.VerifyAsGenesis(); err != nil {
+		err = errors.Wrap(err, "genesis verification failed")
+		return
+	}
+
+	var nodeIter = c.bdb.NewIterator(util.BytesPrefix(metaIndexSnapshot[:]), nil)
+	defer nodeIter.Release()
+	for nodeIter.Next() {
+		var (
+			k     = nodeIter.Key()[len(metaIndexSnapshot):]
+			value indexSnapshotNode
+			node  = &blockNode{}
+		)
+		if len(k) != hash.HashSize+4 {
+			err = errors.Errorf("invalid block index snapshot key %x", k)
+			return
+		}
+		if err = utils.DecodeMsgPack(nodeIter.Value(), &value); err != nil {
+			err = errors.Wrapf(err, "decode block index snapshot %x", k)
+			return
+		}
+		node.height = int32(binary.BigEndian.Uint32(k[:4]))
+		node.count = value.Count
+		copy(node.hash[:], k[4:])
+		if node.count == 0 {
+			if !node.hash.IsEqual(genesis.BlockHash()) {
+				err = errors.Errorf("snapshotted genesis %s mismatches block %s",
+					node.hash.String(), genesis.BlockHash().String())
+				return
+			}
+		} else if node.parent = c.bi.lookupNode(&value.ParentHash); node.parent == nil ||
+			node.parent.count+1 != node.count {
+			err = errors.Wrapf(ErrParentNotFound, "snapshotted block %s", node.hash.String())
+			return
+		}
+		c.bi.addBlock(node)
+		if bytes.Equal(k, snap.LastKey) {
+			last = node
+		}
+	}
+	if err = nodeIter.Error(); err != nil {
+		return
+	}
+	if last == nil {
+		err = errors.Errorf("last snapshotted block %x not indexed", snap.LastKey)
+		return
+	}
+
+	c.rt.setGenesis(genesis)
+	c.snap = snap
+	id = snap.NextID
+	return
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestIndexSnapshot(t *testing.T) {
+	Convey("Given a chain with a block index snapshot", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-time.Hour))
+		So(err, ShouldBeNil)
+		err = pushTestBlocks(chain, 20, nil)
+		So(err, ShouldBeNil)
+		err = chain.snapshotIndex()
+		So(err, ShouldBeNil)
+		err = pushTestBlocks(chain, 3, nil)
+		So(err, ShouldBeNil)
+		var head = chain.rt.getHead()
+		err = chain.Stop()
+		So(err, ShouldBeNil)
+		Convey("Reopening should only decode the blocks newer than the snapshot", func() {
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.Diagnostics().BlocksDecodedOnLoad, ShouldEqual, 3)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			So(chain.rt.getHead().node.count, ShouldEqual, head.node.count)
+			block, err := chain.FetchBlock(1)
+			So(err, ShouldBeNil)
+			So(block, ShouldNotBeNil)
+			Convey("The snapshot should be extended incrementally", func() {
+				err = chain.snapshotIndex()
+				So(err, ShouldBeNil)
+				So(chain.snap.LastKey, ShouldResemble, head.node.indexKey())
+			})
+		})
+		Convey("Reopening should rebuild the whole index if the snapshot is corrupted", func() {
+			bdb, err := leveldb.OpenFile(config.ChainFilePrefix+"-block-state.ldb", nil)
+			So(err, ShouldBeNil)
+			err = bdb.Put(metaSnapshotState[:], []byte("corrupted"), nil)
+			So(err, ShouldBeNil)
+			err = bdb.Close()
+			So(err, ShouldBeNil)
+			chain, err = NewChain(config)
+			So(err, ShouldBeNil)
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			So(chain.Diagnostics().BlocksDecodedOnLoad, ShouldEqual, 24)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+	})
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+// HeightGap is an inclusive range of heights without any block.
+type HeightGap struct {
+	From, To int32
+}
+
+// ChainReport summarizes the persisted databases of a chain, see InspectChain.
+type ChainReport struct {
+	// BlockCount is the number of blocks, including the forks.
+	BlockCount int
+	// Head and HeadHeight are the persisted head of the chain.
+	Head       hash.Hash
+	HeadHeight int32
+	// MinHeight and MaxHeight are the lowest and highest heights of the blocks, -1 without any
+	// block.
+	MinHeight, MaxHeight int32
+	// Gaps are the heights between MinHeight and MaxHeight without any block. Note that a gap may
+	// be legit, e.g., a producer missed its turn.
+	Gaps []HeightGap
+	// OrphanedAcks and OrphanedResponses are the numbers of the acks and responses indexed at the
+	// heights not above the head which have no block.
+	OrphanedAcks, OrphanedResponses int
+	// BlockStateEntries and TransactionEntries are the numbers of records in the block-state and
+	// ack-req-resp databases, and BlockStateSize and TransactionSize are their approximate sizes
+	// in bytes, see Chain.StorageBreakdown.
+	BlockStateEntries, TransactionEntries int
+	BlockStateSize, TransactionSize       int64
+}
+
+// InspectChain opens the chain databases with prefix read-only and reports their contents for
+// debugging. It doesn't start any goroutine of a chain, and is intended to be used offline against
+// the files of a stopped node.
+func InspectChain(prefix string) (report *ChainReport, err error) {
+	var (
+		bdb, tdb *leveldb.DB
+		o        = leveldbConf
+	)
+	o.ReadOnly, o.ErrorIfMissing = true, true
+	if bdb, err = leveldb.OpenFile(prefix+"-"+backupBlockStateFile, &o); err != nil {
+		return nil, errors.Wrap(err, "open block-state database")
+	}
+	defer bdb.Close()
+	if tdb, err = leveldb.OpenFile(prefix+"-"+backupAckReqRespFile, &o); err != nil {
+		return nil, errors.Wrap(err, "open ack-req-resp database")
+	}
+	defer tdb.Close()
+
+	report = &ChainReport{MinHeight: -1, MaxHeight: -1}
+	var (
+		st  = &state{}
+		enc []byte
+	)
+	if enc, err = bdb.Get(metaState[:], nil); err != nil {
+		return nil, errors.Wrapf(err, "get %s", string(metaState[:]))
+	}
+	if err = utils.DecodeMsgPack(enc, st); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", string(metaState[:]))
+	}
+	report.Head, report.HeadHeight = st.Head, st.Height
+
+	// Collect the block heights, which are ordered by the index keys
+	var (
+		heights = make(map[int32]struct{})
+		iter    = bdb.NewIterator(util.BytesPrefix(metaBlockIndex[:]), nil)
+	)
+	for iter.Next() {
+		var k = iter.Key()[len(metaBlockIndex):]
+		if len(k) < 4 {
+			continue
+		}
+		var h = int32(binary.BigEndian.Uint32(k))
+		if report.BlockCount == 0 {
+			report.MinHeight = h
+		} else if last := report.MaxHeight; h > last+1 {
+			report.Gaps = append(report.Gaps, HeightGap{From: last + 1, To: h - 1})
+		}
+		report.MaxHeight = h
+		report.BlockCount++
+		heights[h] = struct{}{}
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return nil, errors.Wrap(err, "iterate blocks")
+	}
+
+	// Count the orphaned acks and responses
+	var countOrphans = func(meta [4]byte) (n int, err error) {
+		var iter = tdb.NewIterator(util.BytesPrefix(meta[:]), nil)
+		defer iter.Release()
+		for iter.Next() {
+			var h = keyWithSymbolToHeight(iter.Key())
+			if _, ok := heights[h]; !ok && h <= st.Height {
+				n++
+			}
+		}
+		err = iter.Error()
+		return
+	}
+	if report.OrphanedAcks, err = countOrphans(metaAckIndex); err != nil {
+		return nil, errors.Wrap(err, "iterate acks")
+	}
+	if report.OrphanedResponses, err = countOrphans(metaResponseIndex); err != nil {
+		return nil, errors.Wrap(err, "iterate responses")
+	}
+
+	// Measure the databases
+	if report.BlockStateEntries, err = countEntries(bdb); err != nil {
+		return nil, errors.Wrap(err, "count block-state entries")
+	}
+	if report.TransactionEntries, err = countEntries(tdb); err != nil {
+		return nil, errors.Wrap(err, "count ack-req-resp entries")
+	}
+	if report.BlockStateSize, err = leveldbSize(bdb); err != nil {
+		return nil, errors.Wrap(err, "measure block-state database")
+	}
+	if report.TransactionSize, err = leveldbSize(tdb); err != nil {
+		return nil, errors.Wrap(err, "measure ack-req-resp database")
+	}
+	return
+}
+
+// countEntries returns the number of records in db.
+func countEntries(db *leveldb.DB) (n int, err error) {
+	var iter = db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		n++
+	}
+	err = iter.Error()
+	return
+}
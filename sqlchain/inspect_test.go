@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+func TestInspectChain(t *testing.T) {
+	Convey("Given the databases of a stopped chain with a gap and an orphaned ack", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 5, nil), ShouldBeNil)
+		var (
+			head = chain.rt.getHead()
+			gap  = head.node.ancestor(3)
+		)
+		So(chain.Stop(), ShouldBeNil)
+
+		bdb, err := leveldb.OpenFile(config.ChainFilePrefix+"-block-state.ldb", nil)
+		So(err, ShouldBeNil)
+		So(bdb.Delete(utils.ConcatAll(metaBlockIndex[:], gap.indexKey()), nil), ShouldBeNil)
+		So(bdb.Close(), ShouldBeNil)
+		tdb, err := leveldb.OpenFile(config.ChainFilePrefix+"-ack-req-resp.ldb", nil)
+		So(err, ShouldBeNil)
+		var ackKey = func(h int32, seed string) []byte {
+			var hh = hash.THashH([]byte(seed))
+			return utils.ConcatAll(metaAckIndex[:], heightToKey(h), hh[:])
+		}
+		So(tdb.Put(ackKey(2, "owned"), []byte("ack"), nil), ShouldBeNil)
+		So(tdb.Put(ackKey(3, "orphaned"), []byte("ack"), nil), ShouldBeNil)
+		So(tdb.Put(ackKey(6, "pending"), []byte("ack"), nil), ShouldBeNil)
+		So(tdb.Close(), ShouldBeNil)
+
+		Convey("The report should show the gap and the orphaned ack", func() {
+			report, err := InspectChain(config.ChainFilePrefix)
+			So(err, ShouldBeNil)
+			So(report.Head, ShouldResemble, head.Head)
+			So(report.HeadHeight, ShouldEqual, 5)
+			So(report.BlockCount, ShouldEqual, 5)
+			So(report.MinHeight, ShouldEqual, 0)
+			So(report.MaxHeight, ShouldEqual, 5)
+			So(report.Gaps, ShouldResemble, []HeightGap{{From: 3, To: 3}})
+			So(report.OrphanedAcks, ShouldEqual, 1)
+			So(report.OrphanedResponses, ShouldEqual, 0)
+			So(report.BlockStateEntries, ShouldBeGreaterThan, 5)
+			So(report.TransactionEntries, ShouldBeGreaterThanOrEqualTo, 3)
+		})
+		Convey("The inspection should fail without the databases", func() {
+			_, err := InspectChain(config.ChainFilePrefix + "-missing")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+)
+
+// LatencyStats summarizes the response latencies of a miner, i.e., the durations between the
+// request timestamps and the response timestamps.
+type LatencyStats struct {
+	Count int
+	Min   time.Duration
+	Avg   time.Duration
+	P99   time.Duration
+}
+
+// newLatencyStats computes the stats of the latencies ls, which are sorted in place.
+func newLatencyStats(ls []time.Duration) (stats LatencyStats) {
+	if len(ls) == 0 {
+		return
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+	var sum time.Duration
+	for _, v := range ls {
+		sum += v
+	}
+	stats.Count = len(ls)
+	stats.Min = ls[0]
+	stats.Avg = sum / time.Duration(len(ls))
+	// Nearest-rank percentile
+	stats.P99 = ls[(len(ls)*99+99)/100-1]
+	return
+}
+
+// MinerLatencyStats computes the response latency stats of each miner from the persisted
+// responses and acks at heights [fromHeight, toHeight], which are indexed by the response
+// timestamps. A response is counted once even if it's also acknowledged, and the miners are
+// identified by the response accounts.
+//
+// NOTE: the acks buffered by the ack batching are not included until flushed, and the latencies
+// are measured with the clocks of both the client and the miner, so they are only as accurate as
+// the clock synchronization between them.
+func (c *Chain) MinerLatencyStats(
+	fromHeight, toHeight int32) (stats map[proto.AccountAddress]LatencyStats, err error,
+) {
+	var (
+		seen      = make(map[hash.Hash]struct{})
+		latencies = make(map[proto.AccountAddress][]time.Duration)
+		add       = func(resp *types.SignedResponseHeader) {
+			var h = resp.Hash()
+			if _, ok := seen[h]; ok {
+				return
+			}
+			seen[h] = struct{}{}
+			latencies[resp.ResponseAccount] = append(latencies[resp.ResponseAccount],
+				resp.Timestamp.Sub(resp.GetRequestTimestamp()))
+		}
+	)
+	if fromHeight < 0 {
+		fromHeight = 0
+	}
+	if toHeight < fromHeight {
+		return make(map[proto.AccountAddress]LatencyStats), nil
+	}
+	if err = c.scanQueryIndex(metaResponseIndex[:], fromHeight, toHeight, func(v []byte) error {
+		var resp = &types.SignedResponseHeader{}
+		if err := utils.DecodeMsgPack(v, resp); err != nil {
+			return err
+		}
+		add(resp)
+		return nil
+	}); err != nil {
+		err = errors.Wrap(err, "scan responses")
+		return
+	}
+	if err = c.scanQueryIndex(metaAckIndex[:], fromHeight, toHeight, func(v []byte) error {
+		var ack = &types.SignedAckHeader{}
+		if err := utils.DecodeMsgPack(v, ack); err != nil {
+			return err
+		}
+		add(&types.SignedResponseHeader{
+			ResponseHeader: ack.Response,
+			ResponseHash:   ack.ResponseHash,
+		})
+		return nil
+	}); err != nil {
+		err = errors.Wrap(err, "scan acks")
+		return
+	}
+	stats = make(map[proto.AccountAddress]LatencyStats, len(latencies))
+	for k, v := range latencies {
+		stats[k] = newLatencyStats(v)
+	}
+	return
+}
+
+// scanQueryIndex calls fn with the opened values of the tdb index prefix at heights [from, to].
+func (c *Chain) scanQueryIndex(prefix []byte, from, to int32, fn func(v []byte) error) (err error) {
+	var iter = c.tdb.NewIterator(&util.Range{
+		Start: utils.ConcatAll(prefix, heightToKey(from)),
+		Limit: utils.ConcatAll(prefix, heightToKey(to+1)),
+	}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var v []byte
+		if v, err = c.vc.open(iter.Value()); err != nil {
+			err = errors.Wrapf(err, "height %d", keyWithSymbolToHeight(iter.Key()))
+			return
+		}
+		if err = fn(v); err != nil {
+			err = errors.Wrapf(err, "height %d", keyWithSymbolToHeight(iter.Key()))
+			return
+		}
+	}
+	return iter.Error()
+}
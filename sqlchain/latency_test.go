@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestMinerLatencyStats(t *testing.T) {
+	Convey("Given a chain with some persisted responses and acks", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		miner1, err := newRandomNode()
+		So(err, ShouldBeNil)
+		miner2, err := newRandomNode()
+		So(err, ShouldBeNil)
+		addr1, err := crypto.PubKeyHash(miner1.PublicKey)
+		So(err, ShouldBeNil)
+		addr2, err := crypto.PubKeyHash(miner2.PublicKey)
+		So(err, ShouldBeNil)
+		var (
+			// Align to the beginning of the current height to keep all the responses in it
+			height      = chain.rt.getHeightFromTime(chain.rt.now())
+			base        = chain.rt.getTimeFromHeight(height).UTC()
+			newResponse = func(worker *nodeProfile, latency time.Duration) *types.SignedResponseHeader {
+				resp, err := createRandomQueryResponse(cli, worker)
+				So(err, ShouldBeNil)
+				resp.ResponseAccount, err = crypto.PubKeyHash(worker.PublicKey)
+				So(err, ShouldBeNil)
+				resp.Request.Timestamp = base
+				resp.Timestamp = base.Add(latency)
+				So(resp.BuildHash(), ShouldBeNil)
+				return resp
+			}
+		)
+		// Responses without acks
+		for i := 1; i <= 100; i++ {
+			So(chain.putResponse(newResponse(miner1, time.Duration(i)*time.Millisecond)), ShouldBeNil)
+		}
+		// Acknowledged responses
+		for _, v := range []time.Duration{10 * time.Millisecond, 30 * time.Millisecond} {
+			var resp = newResponse(miner2, v)
+			So(chain.AddResponse(resp), ShouldBeNil)
+			ack, err := createRandomQueryAckWithResponse(resp, cli)
+			So(err, ShouldBeNil)
+			So(chain.pushAckedQuery(ack), ShouldBeNil)
+		}
+		Convey("The latency stats should be computed for each miner", func() {
+			stats, err := chain.MinerLatencyStats(0, height+1)
+			So(err, ShouldBeNil)
+			So(stats, ShouldHaveLength, 2)
+			So(stats[addr1], ShouldResemble, LatencyStats{
+				Count: 100,
+				Min:   time.Millisecond,
+				Avg:   50500 * time.Microsecond,
+				P99:   99 * time.Millisecond,
+			})
+			So(stats[addr2], ShouldResemble, LatencyStats{
+				Count: 2,
+				Min:   10 * time.Millisecond,
+				Avg:   20 * time.Millisecond,
+				P99:   30 * time.Millisecond,
+			})
+		})
+		Convey("The responses out of the height range should be ignored", func() {
+			stats, err := chain.MinerLatencyStats(height+1, height+10)
+			So(err, ShouldBeNil)
+			So(stats, ShouldBeEmpty)
+			stats, err = chain.MinerLatencyStats(height, height-1)
+			So(err, ShouldBeNil)
+			So(stats, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// ChainManifest represents the identity metadata of a sql-chain, which is much lighter than the
+// chain data and diagnostics.
+type ChainManifest struct {
+	DatabaseID proto.DatabaseID `json:"db"`
+	Genesis    hash.Hash        `json:"genesis"`
+	Head       hash.Hash        `json:"head"`
+	Height     int32            `json:"height"`
+	Count      int32            `json:"count"`
+	Leader     proto.NodeID     `json:"leader"`
+	Servers    []proto.NodeID   `json:"servers"`
+	Period     time.Duration    `json:"period"`
+	Tick       time.Duration    `json:"tick"`
+	Scheme     string           `json:"scheme"`
+	TokenType  types.TokenType  `json:"token"`
+}
+
+// Hash returns a stable hash of the immutable chain identity in the manifest, i.e., the database
+// id, the genesis hash, the period, the tick and the height scheme, so that two nodes can compare
+// the chain identity with a single value. The head and peers are not included, thus the hash
+// doesn't change as the chain grows.
+func (m *ChainManifest) Hash() hash.Hash {
+	var (
+		buf         = &bytes.Buffer{}
+		writeString = func(s string) {
+			binary.Write(buf, binary.BigEndian, uint32(len(s)))
+			buf.WriteString(s)
+		}
+	)
+	writeString(string(m.DatabaseID))
+	buf.Write(m.Genesis[:])
+	binary.Write(buf, binary.BigEndian, int64(m.Period))
+	binary.Write(buf, binary.BigEndian, int64(m.Tick))
+	writeString(m.Scheme)
+	return hash.THashH(buf.Bytes())
+}
+
+// Manifest returns the identity metadata of the chain.
+func (c *Chain) Manifest() ChainManifest {
+	var (
+		head  = c.rt.getHead()
+		peers = c.rt.getPeers()
+		count int32
+	)
+	if head.node != nil {
+		count = head.node.count
+	}
+	return ChainManifest{
+		DatabaseID: c.databaseID,
+		Genesis:    c.rt.genesisHash,
+		Head:       head.Head,
+		Height:     head.Height,
+		Count:      count,
+		Leader:     peers.Leader,
+		Servers:    append([]proto.NodeID(nil), peers.Servers...),
+		Period:     c.rt.period,
+		Tick:       c.rt.tick,
+		Scheme:     c.rt.heights.ID(),
+		TokenType:  c.tokenType,
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManifest(t *testing.T) {
+	Convey("Given a new chain", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var manifest = chain.Manifest()
+		So(manifest.DatabaseID, ShouldEqual, testDatabaseID)
+		So(manifest.Genesis, ShouldResemble, *config.Genesis.BlockHash())
+		So(manifest.Head, ShouldResemble, manifest.Genesis)
+		So(manifest.Height, ShouldEqual, 0)
+		So(manifest.Servers, ShouldResemble, config.Peers.Servers)
+		So(manifest.Period, ShouldEqual, testPeriod)
+		So(manifest.Tick, ShouldEqual, config.Tick)
+		So(manifest.Scheme, ShouldEqual, "linear")
+		Convey("The manifest hash should be stable", func() {
+			var again = chain.Manifest()
+			So(again.Hash(), ShouldResemble, manifest.Hash())
+			again.Servers = append(again.Servers, again.Servers...)
+			So(again.Hash(), ShouldResemble, manifest.Hash())
+			again.Tick++
+			So(again.Hash(), ShouldNotResemble, manifest.Hash())
+		})
+		Convey("The manifest should follow the chain head", func() {
+			So(pushTestBlocks(chain, 3, nil), ShouldBeNil)
+			var updated = chain.Manifest()
+			So(updated.Genesis, ShouldResemble, manifest.Genesis)
+			So(updated.Head, ShouldResemble, chain.rt.getHead().Head)
+			So(updated.Count, ShouldEqual, manifest.Count+3)
+			So(updated.Hash(), ShouldResemble, manifest.Hash())
+		})
+	})
+}
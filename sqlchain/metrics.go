@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	mw "github.com/zserge/metric"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+const metricsNamespace = "sqlchain"
+
+var (
+	produceDelayExpvarLock sync.Mutex
+
+	// The memory counters are shared by all the chains in the process, thus they are exported
+	// without the per-chain labels.
+	multiIndexCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "multi_index_count"),
+		"Number of the multi-indexes in the ack indexes of the process.",
+		nil, nil,
+	)
+	responseCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "response_count"),
+		"Number of the indexed response headers in the process.",
+		nil, nil,
+	)
+	ackCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "ack_count"),
+		"Number of the indexed ack headers in the process.",
+		nil, nil,
+	)
+	cachedBlockCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cached_block_count"),
+		"Number of the blocks cached in the block indexes of the process.",
+		nil, nil,
+	)
+
+	chainMetricsLabels = []string{"database_id", "node"}
+	headHeightDesc     = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "head_height"),
+		"Height of the chain head.",
+		chainMetricsLabels, nil,
+	)
+	nextTurnDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "next_turn"),
+		"Height of the next block to be produced.",
+		chainMetricsLabels, nil,
+	)
+	forkCountDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "fork_count"),
+		"Number of the forks tracked by the chain.",
+		chainMetricsLabels, nil,
+	)
+	skippedTurnsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "skipped_turns_total"),
+		"Number of the turns passed without a block.",
+		chainMetricsLabels, nil,
+	)
+	missedProductionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "missed_productions_total"),
+		"Number of the own turns in which the local node failed to produce a block.",
+		chainMetricsLabels, nil,
+	)
+
+	chainMetrics = newChainCollector()
+)
+
+// chainMetricsKey identifies a chain instance in the chain collector.
+type chainMetricsKey struct {
+	databaseID proto.DatabaseID
+	node       proto.NodeID
+}
+
+// chainCollector implements the prometheus.Collector interface to export the metrics of all the
+// chains running in the process, labeled by their database IDs and local nodes.
+type chainCollector struct {
+	sync.RWMutex
+	chains       map[chainMetricsKey]*Chain
+	produceDelay *prometheus.HistogramVec
+}
+
+func newChainCollector() *chainCollector {
+	return &chainCollector{
+		chains: make(map[chainMetricsKey]*Chain),
+		produceDelay: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "produce_delay_seconds",
+			Help:      "Delay between the ideal timestamp of a turn and the local block signing.",
+			Buckets:   prometheus.ExponentialBuckets(.001, 4, 8),
+		}, chainMetricsLabels),
+	}
+}
+
+func chainMetricsKeyOf(c *Chain) chainMetricsKey {
+	return chainMetricsKey{databaseID: c.databaseID, node: c.rt.getServer()}
+}
+
+// register adds c to the collector. A chain replaces any previous instance with the same
+// database ID and local node, so that the exported series never collide.
+func (cc *chainCollector) register(c *Chain) {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.chains[chainMetricsKeyOf(c)] = c
+}
+
+// unregister removes c and its series from the collector.
+func (cc *chainCollector) unregister(c *Chain) {
+	var key = chainMetricsKeyOf(c)
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.chains[key] != c {
+		return
+	}
+	delete(cc.chains, key)
+	cc.produceDelay.DeleteLabelValues(string(key.databaseID), string(key.node))
+}
+
+func (cc *chainCollector) observeProduceDelay(c *Chain, delay time.Duration) {
+	var key = chainMetricsKeyOf(c)
+	cc.RLock()
+	defer cc.RUnlock()
+	if cc.chains[key] != c {
+		return
+	}
+	cc.produceDelay.WithLabelValues(string(key.databaseID), string(key.node)).Observe(
+		delay.Seconds())
+}
+
+// Describe implements the prometheus.Collector interface.
+func (cc *chainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- multiIndexCountDesc
+	ch <- responseCountDesc
+	ch <- ackCountDesc
+	ch <- cachedBlockCountDesc
+	ch <- headHeightDesc
+	ch <- nextTurnDesc
+	ch <- forkCountDesc
+	ch <- skippedTurnsDesc
+	ch <- missedProductionsDesc
+	cc.produceDelay.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (cc *chainCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, v := range []struct {
+		desc *prometheus.Desc
+		val  *int32
+	}{
+		{multiIndexCountDesc, &multiIndexCount},
+		{responseCountDesc, &responseCount},
+		{ackCountDesc, &ackCount},
+		{cachedBlockCountDesc, &cachedBlockCount},
+	} {
+		ch <- prometheus.MustNewConstMetric(
+			v.desc, prometheus.GaugeValue, float64(atomic.LoadInt32(v.val)))
+	}
+	cc.RLock()
+	defer cc.RUnlock()
+	for k, c := range cc.chains {
+		var labels = []string{string(k.databaseID), string(k.node)}
+		if head := c.rt.getHead(); head != nil {
+			ch <- prometheus.MustNewConstMetric(
+				headHeightDesc, prometheus.GaugeValue, float64(head.Height), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			nextTurnDesc, prometheus.GaugeValue, float64(c.rt.getNextTurn()), labels...)
+		ch <- prometheus.MustNewConstMetric(
+			forkCountDesc, prometheus.GaugeValue, float64(c.rt.getForkCount()), labels...)
+		ch <- prometheus.MustNewConstMetric(skippedTurnsDesc, prometheus.CounterValue,
+			float64(atomic.LoadInt64(&c.skippedTurns)), labels...)
+		ch <- prometheus.MustNewConstMetric(missedProductionsDesc, prometheus.CounterValue,
+			float64(atomic.LoadInt64(&c.missedProductions)), labels...)
+	}
+	cc.produceDelay.Collect(ch)
+}
+
+// RegisterMetrics registers the collector of the sql-chain metrics to registry. The collector
+// is shared by all the chains in the process, thus it should be registered only once for each
+// registry.
+func RegisterMetrics(registry prometheus.Registerer) error {
+	return registry.Register(chainMetrics)
+}
+
+// recordProduceDelay records the delay between the ideal timestamp of a turn and the time the
+// local block of the turn is signed.
+func recordProduceDelay(id proto.DatabaseID, delay time.Duration) {
+	var (
+		name = "t_produce_delay:" + string(id)
+		val  expvar.Var
+	)
+	// Optimistically, val will not be nil except the first produced block
+	if val = expvar.Get(name); val == nil {
+		produceDelayExpvarLock.Lock()
+		if val = expvar.Get(name); val == nil {
+			val = mw.NewHistogram("10s1s", "1m5s", "1h1m")
+			expvar.Publish(name, val)
+		}
+		produceDelayExpvarLock.Unlock()
+	}
+	val.(mw.Metric).Add(delay.Seconds())
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// gatherChainMetric returns the metric named name of chain from the gathered families, or nil
+// if not found.
+func gatherChainMetric(mfs []*dto.MetricFamily, name string, chain *Chain) *dto.Metric {
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var labels = make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if len(labels) == 0 || (labels["database_id"] == string(chain.databaseID) &&
+				labels["node"] == string(chain.rt.getServer())) {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func TestChainMetrics(t *testing.T) {
+	Convey("Given a registry with the chain metrics registered", t, func() {
+		var registry = prometheus.NewRegistry()
+		So(RegisterMetrics(registry), ShouldBeNil)
+		So(RegisterMetrics(registry), ShouldNotBeNil)
+		Convey("The metrics of multiple chains should be exported without collisions", func() {
+			var chains = make([]*Chain, 2)
+			for i := range chains {
+				chain, _, err := createTestChain(t.Name(), time.Now())
+				So(err, ShouldBeNil)
+				// Run the chains as different databases on the same node
+				chainMetrics.unregister(chain)
+				chain.databaseID = proto.DatabaseID(fmt.Sprintf("%s-%d", testDatabaseID, i))
+				chainMetrics.register(chain)
+				chains[i] = chain
+			}
+			var stopped = false
+			defer func() {
+				if !stopped {
+					for _, v := range chains {
+						So(v.Stop(), ShouldBeNil)
+					}
+				}
+			}()
+			So(pushTestBlocks(chains[0], 3, nil), ShouldBeNil)
+			chains[1].recordProduceDelay(chains[1].rt.now())
+
+			mfs, err := registry.Gather()
+			So(err, ShouldBeNil)
+			for _, v := range []string{
+				"sqlchain_multi_index_count",
+				"sqlchain_response_count",
+				"sqlchain_ack_count",
+				"sqlchain_cached_block_count",
+			} {
+				So(gatherChainMetric(mfs, v, chains[0]), ShouldNotBeNil)
+			}
+			for i, v := range chains {
+				var m = gatherChainMetric(mfs, "sqlchain_head_height", v)
+				So(m, ShouldNotBeNil)
+				So(m.GetGauge().GetValue(), ShouldEqual, float64(v.rt.getHead().Height))
+				m = gatherChainMetric(mfs, "sqlchain_next_turn", v)
+				So(m, ShouldNotBeNil)
+				So(m.GetGauge().GetValue(), ShouldEqual, float64(v.rt.getNextTurn()))
+				m = gatherChainMetric(mfs, "sqlchain_fork_count", v)
+				So(m, ShouldNotBeNil)
+				So(m.GetGauge().GetValue(), ShouldEqual, float64(v.rt.getForkCount()))
+				m = gatherChainMetric(mfs, "sqlchain_produce_delay_seconds", v)
+				if i == 0 {
+					So(m, ShouldBeNil)
+				} else {
+					So(m, ShouldNotBeNil)
+					So(m.GetHistogram().GetSampleCount(), ShouldEqual, uint64(1))
+				}
+			}
+			So(gatherChainMetric(mfs, "sqlchain_head_height", chains[0]).GetGauge().GetValue(),
+				ShouldEqual, float64(3))
+
+			stopped = true
+			for _, v := range chains {
+				So(v.Stop(), ShouldBeNil)
+			}
+			mfs, err = registry.Gather()
+			So(err, ShouldBeNil)
+			for _, v := range chains {
+				So(gatherChainMetric(mfs, "sqlchain_head_height", v), ShouldBeNil)
+				So(gatherChainMetric(mfs, "sqlchain_produce_delay_seconds", v), ShouldBeNil)
+			}
+		})
+	})
+}
+
+func TestSkippedTurns(t *testing.T) {
+	Convey("Given a standalone chain running its turns manually", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var runTurn = func() {
+			chain.runCurrentTurn(chain.rt.now())
+			<-chain.heights
+		}
+		Convey("The turn passed without a block should be counted as skipped", func() {
+			chain.rt.observer = true
+			runTurn()
+			So(chain.Stats().SkippedTurns, ShouldEqual, 0)
+			runTurn()
+			So(chain.Stats().SkippedTurns, ShouldEqual, 1)
+			runTurn()
+			So(chain.Stats().SkippedTurns, ShouldEqual, 2)
+			So(chain.Stats().MissedProductions, ShouldEqual, 0)
+		})
+		Convey("The failed own production should be counted as missed", func() {
+			var ctx, cancel = context.WithCancel(context.Background())
+			cancel()
+			chain.rt.stateChecksum = true
+			chain.rt.ctx, ctx = ctx, chain.rt.ctx
+			runTurn()
+			chain.rt.ctx = ctx
+			So(chain.Stats().MissedProductions, ShouldEqual, 1)
+
+			var registry = prometheus.NewRegistry()
+			So(RegisterMetrics(registry), ShouldBeNil)
+			mfs, err := registry.Gather()
+			So(err, ShouldBeNil)
+			var m = gatherChainMetric(mfs, "sqlchain_missed_productions_total", chain)
+			So(m, ShouldNotBeNil)
+			So(m.GetCounter().GetValue(), ShouldEqual, 1)
+			m = gatherChainMetric(mfs, "sqlchain_skipped_turns_total", chain)
+			So(m, ShouldNotBeNil)
+			So(m.GetCounter().GetValue(), ShouldEqual, 0)
+		})
+	})
+}
@@ -103,12 +103,41 @@ type MuxFetchBlockResp struct {
 	FetchBlockResp
 }
 
+// MuxFetchBlockRangeReq defines a request of the FetchBlockRange RPC method.
+type MuxFetchBlockRangeReq struct {
+	proto.Envelope
+	proto.DatabaseID
+	FetchBlockRangeReq
+}
+
+// MuxFetchBlockRangeResp defines a response of the FetchBlockRange RPC method.
+type MuxFetchBlockRangeResp struct {
+	proto.Envelope
+	proto.DatabaseID
+	FetchBlockRangeResp
+}
+
+// MuxFetchBlockHeaderReq defines a request of the FetchBlockHeader RPC method.
+type MuxFetchBlockHeaderReq struct {
+	proto.Envelope
+	proto.DatabaseID
+	FetchBlockHeaderReq
+}
+
+// MuxFetchBlockHeaderResp defines a response of the FetchBlockHeader RPC method.
+type MuxFetchBlockHeaderResp struct {
+	proto.Envelope
+	proto.DatabaseID
+	FetchBlockHeaderResp
+}
+
 // AdviseNewBlock is the RPC method to advise a new produced block to the target server.
 func (s *MuxService) AdviseNewBlock(req *MuxAdviseNewBlockReq, resp *MuxAdviseNewBlockResp) error {
 	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
 		resp.Envelope = req.Envelope
 		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseNewBlock(&req.AdviseNewBlockReq, &resp.AdviseNewBlockResp)
+		return v.(*ChainRPCService).serve(MethodAdviseNewBlock,
+			&req.Envelope, &req.AdviseNewBlockReq, &resp.AdviseNewBlockResp)
 	}
 
 	return ErrUnknownMuxRequest
@@ -119,7 +148,8 @@ func (s *MuxService) AdviseBinLog(req *MuxAdviseBinLogReq, resp *MuxAdviseBinLog
 	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
 		resp.Envelope = req.Envelope
 		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseBinLog(&req.AdviseBinLogReq, &resp.AdviseBinLogResp)
+		return v.(*ChainRPCService).serve(MethodAdviseBinLog,
+			&req.Envelope, &req.AdviseBinLogReq, &resp.AdviseBinLogResp)
 	}
 
 	return ErrUnknownMuxRequest
@@ -131,8 +161,8 @@ func (s *MuxService) AdviseAckedQuery(
 	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
 		resp.Envelope = req.Envelope
 		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).AdviseAckedQuery(
-			&req.AdviseAckedQueryReq, &resp.AdviseAckedQueryResp)
+		return v.(*ChainRPCService).serve(MethodAdviseAckedQuery,
+			&req.Envelope, &req.AdviseAckedQueryReq, &resp.AdviseAckedQueryResp)
 	}
 
 	return ErrUnknownMuxRequest
@@ -143,7 +173,36 @@ func (s *MuxService) FetchBlock(req *MuxFetchBlockReq, resp *MuxFetchBlockResp)
 	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
 		resp.Envelope = req.Envelope
 		resp.DatabaseID = req.DatabaseID
-		return v.(*ChainRPCService).FetchBlock(&req.FetchBlockReq, &resp.FetchBlockResp)
+		return v.(*ChainRPCService).serve(MethodFetchBlock,
+			&req.Envelope, &req.FetchBlockReq, &resp.FetchBlockResp)
+	}
+
+	return ErrUnknownMuxRequest
+}
+
+// FetchBlockRange is the RPC method to fetch the known blocks in a height range from the target
+// server.
+func (s *MuxService) FetchBlockRange(
+	req *MuxFetchBlockRangeReq, resp *MuxFetchBlockRangeResp) (err error) {
+	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
+		resp.Envelope = req.Envelope
+		resp.DatabaseID = req.DatabaseID
+		return v.(*ChainRPCService).serve(MethodFetchBlockRange,
+			&req.Envelope, &req.FetchBlockRangeReq, &resp.FetchBlockRangeResp)
+	}
+
+	return ErrUnknownMuxRequest
+}
+
+// FetchBlockHeader is the RPC method to fetch the signed header of a known block from the target
+// server.
+func (s *MuxService) FetchBlockHeader(
+	req *MuxFetchBlockHeaderReq, resp *MuxFetchBlockHeaderResp) (err error) {
+	if v, ok := s.serviceMap.Load(req.DatabaseID); ok {
+		resp.Envelope = req.Envelope
+		resp.DatabaseID = req.DatabaseID
+		return v.(*ChainRPCService).serve(MethodFetchBlockHeader,
+			&req.Envelope, &req.FetchBlockHeaderReq, &resp.FetchBlockHeaderResp)
 	}
 
 	return ErrUnknownMuxRequest
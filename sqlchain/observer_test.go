@@ -0,0 +1,96 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestObserverMode(t *testing.T) {
+	Convey("Given an observer chain", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.observer = true
+		var (
+			mu      sync.Mutex
+			advised int
+		)
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if method == route.SQLCAdviseNewBlock.String() {
+				advised++
+			}
+			return ErrUnknownMuxRequest
+		}}
+		var head = chain.rt.getHead()
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(),
+			chain.rt.getTimeFromHeight(head.Height+1), nil)
+		So(err, ShouldBeNil)
+		So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+		So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+
+		Convey("The observer should never produce or advise blocks in its turns", func() {
+			So(chain.rt.isMyTurn(), ShouldBeTrue)
+			So(chain.Start(), ShouldBeNil)
+			time.Sleep(3 * testPeriod)
+			So(chain.rt.getNextTurn(), ShouldBeGreaterThan, 3)
+			So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+			chain.producedMutex.Lock()
+			So(chain.produced, ShouldBeNil)
+			chain.producedMutex.Unlock()
+			mu.Lock()
+			So(advised, ShouldEqual, 0)
+			mu.Unlock()
+			So(chain.EffectiveConfig().ObserverMode, ShouldBeTrue)
+		})
+		Convey("The observer should serve the block fetches and the read queries only", func() {
+			fetched, err := chain.FetchBlock(head.Height + 1)
+			So(err, ShouldBeNil)
+			So(fetched.BlockHash(), ShouldResemble, block.BlockHash())
+			var newRequest = func(qt types.QueryType, pattern string) *types.Request {
+				return &types.Request{
+					Header: types.SignedRequestHeader{
+						RequestHeader: types.RequestHeader{
+							QueryType:  qt,
+							DatabaseID: testDatabaseID,
+							Timestamp:  time.Now().UTC(),
+						},
+					},
+					Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+				}
+			}
+			_, _, err = chain.Query(newRequest(types.WriteQuery, `CREATE TABLE t1 (k INT)`), true)
+			So(err, ShouldEqual, ErrObserverReadOnly)
+			_, resp, err := chain.Query(newRequest(types.ReadQuery, `SELECT 1`), false)
+			So(err, ShouldBeNil)
+			So(resp.Header.RowCount, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// OrphanReason describes why a block is orphaned.
+type OrphanReason string
+
+const (
+	// OrphanStaleTurn indicates that the block arrived for an already decided turn.
+	OrphanStaleTurn OrphanReason = "stale turn"
+	// OrphanLostFork indicates that the block doesn't extend the best chain, i.e., it lost a fork
+	// race.
+	OrphanLostFork OrphanReason = "lost fork"
+)
+
+// OrphanBlockInfo represents a block dropped from the best chain and the metadata about why
+// and when it is orphaned.
+type OrphanBlockInfo struct {
+	Block      *types.Block
+	Height     int32
+	Reason     OrphanReason
+	OrphanedAt time.Time
+	// Winner is the hash of the block at the same height on the best chain, or the zero hash if
+	// there is none.
+	Winner hash.Hash
+}
+
+// orphanKey returns the orphan store key of info, which sorts the orphans by their orphaned
+// time.
+func orphanKey(info *OrphanBlockInfo) []byte {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(info.OrphanedAt.UnixNano()))
+	return utils.ConcatAll(metaOrphanIndex[:], ts[:], info.Block.BlockHash()[:])
+}
+
+// addOrphan keeps block of height in the orphan store if it's enabled, and evicts the oldest
+// orphans beyond the capacity.
+func (c *Chain) addOrphan(block *types.Block, height int32, reason OrphanReason) {
+	if c.rt.maxOrphans <= 0 {
+		return
+	}
+	var info = &OrphanBlockInfo{
+		Block:      block,
+		Height:     height,
+		Reason:     reason,
+		OrphanedAt: c.rt.now(),
+	}
+	if head := c.rt.getHead().node; head != nil {
+		if winner := head.ancestor(height); winner != nil {
+			info.Winner = winner.hash
+		}
+	}
+	var le = log.WithFields(log.Fields{
+		"block_height": height,
+		"block_hash":   block.BlockHash().String(),
+		"reason":       reason,
+		"winner":       info.Winner.String(),
+		"db":           c.databaseID,
+	})
+	if err := c.putOrphan(info); err != nil {
+		le.WithError(err).Warning("failed to keep orphan block")
+		return
+	}
+	le.Debug("kept orphan block")
+}
+
+func (c *Chain) putOrphan(info *OrphanBlockInfo) (err error) {
+	var (
+		enc   *bytes.Buffer
+		value []byte
+	)
+	if enc, err = utils.EncodeMsgPack(info); err != nil {
+		return
+	}
+	if value, err = c.vc.seal(enc.Bytes()); err != nil {
+		return
+	}
+
+	c.orphanMutex.Lock()
+	defer c.orphanMutex.Unlock()
+	if err = c.bdb.Put(orphanKey(info), value, nil); err != nil {
+		return errors.Wrap(err, "put orphan block")
+	}
+
+	// Evict the oldest orphans beyond the capacity
+	var (
+		keys [][]byte
+		iter = c.bdb.NewIterator(util.BytesPrefix(metaOrphanIndex[:]), nil)
+	)
+	for iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return errors.Wrap(err, "iterate orphan blocks")
+	}
+	if excess := len(keys) - c.rt.maxOrphans; excess > 0 {
+		var batch = &leveldb.Batch{}
+		for _, k := range keys[:excess] {
+			batch.Delete(k)
+		}
+		if err = c.bdb.Write(batch, nil); err != nil {
+			return errors.Wrap(err, "evict orphan blocks")
+		}
+	}
+	return
+}
+
+// Orphans returns the kept orphan blocks from the oldest to the newest.
+func (c *Chain) Orphans() (orphans []OrphanBlockInfo, err error) {
+	var iter = c.bdb.NewIterator(util.BytesPrefix(metaOrphanIndex[:]), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var (
+			value []byte
+			info  OrphanBlockInfo
+		)
+		if value, err = c.vc.open(iter.Value()); err != nil {
+			return
+		}
+		if err = utils.DecodeMsgPack(value, &info); err != nil {
+			return
+		}
+		orphans = append(orphans, info)
+	}
+	if err = iter.Error(); err != nil {
+		err = errors.Wrap(err, "iterate orphan blocks")
+	}
+	return
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestOrphans(t *testing.T) {
+	Convey("Given a chain with some blocks pushed", t, func() {
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		So(pushTestBlocks(chain, 3, nil), ShouldBeNil)
+		var (
+			genesis = config.Genesis.BlockHash()
+			forks   []*types.Block
+		)
+		for h := int32(1); h <= 3; h++ {
+			b, err := createTestBlock(
+				genesis, chain.rt.getServer(), chain.rt.getTimeFromHeight(h).Add(time.Millisecond), nil)
+			So(err, ShouldBeNil)
+			forks = append(forks, b)
+		}
+		Convey("The orphan blocks should be dropped by default", func() {
+			for i, v := range forks {
+				chain.addOrphan(v, int32(i+1), OrphanLostFork)
+			}
+			orphans, err := chain.Orphans()
+			So(err, ShouldBeNil)
+			So(orphans, ShouldBeEmpty)
+		})
+		Convey("The newest orphan blocks should be kept up to the capacity", func() {
+			chain.rt.maxOrphans = 2
+			for i, v := range forks {
+				chain.addOrphan(v, int32(i+1), OrphanStaleTurn)
+			}
+			orphans, err := chain.Orphans()
+			So(err, ShouldBeNil)
+			So(orphans, ShouldHaveLength, 2)
+			for i, v := range orphans {
+				var height = int32(i + 2)
+				So(v.Height, ShouldEqual, height)
+				So(v.Reason, ShouldEqual, OrphanStaleTurn)
+				So(v.Block.BlockHash(), ShouldResemble, forks[height-1].BlockHash())
+				So(v.Winner, ShouldResemble, chain.rt.getHead().node.ancestor(height).hash)
+			}
+		})
+	})
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"sync"
+)
+
+// queryGate admits client queries unless paused, and keeps track of the admitted queries so
+// that pausing can wait for them to finish.
+type queryGate struct {
+	sync.Mutex
+	paused   bool
+	inflight int
+	// drained is closed once the in-flight queries are all finished after pausing.
+	drained chan struct{}
+}
+
+// enter admits a query, or returns ErrQueriesPaused if the gate is paused. An admitted query
+// must call leave once it's finished.
+func (g *queryGate) enter() (err error) {
+	g.Lock()
+	defer g.Unlock()
+	if g.paused {
+		return ErrQueriesPaused
+	}
+	g.inflight++
+	return
+}
+
+// leave marks an admitted query as finished.
+func (g *queryGate) leave() {
+	g.Lock()
+	defer g.Unlock()
+	g.inflight--
+	if g.inflight == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// pause stops admitting new queries and waits until the in-flight ones are finished or ctx is
+// done. The gate stays paused even if waiting is interrupted.
+func (g *queryGate) pause(ctx context.Context) (err error) {
+	g.Lock()
+	g.paused = true
+	if g.inflight == 0 {
+		g.Unlock()
+		return
+	}
+	if g.drained == nil {
+		g.drained = make(chan struct{})
+	}
+	var drained = g.drained
+	g.Unlock()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// resume starts admitting queries again.
+func (g *queryGate) resume() {
+	g.Lock()
+	defer g.Unlock()
+	g.paused = false
+}
+
+// isPaused reports whether the gate is paused.
+func (g *queryGate) isPaused() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.paused
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueryGate(t *testing.T) {
+	Convey("Given a query gate with an in-flight query", t, func() {
+		var g queryGate
+		So(g.enter(), ShouldBeNil)
+		Convey("Pausing should reject new queries and wait for the in-flight one", func() {
+			var paused = make(chan error, 1)
+			go func() { paused <- g.pause(context.Background()) }()
+			for !g.isPaused() {
+				time.Sleep(time.Millisecond)
+			}
+			So(g.enter(), ShouldEqual, ErrQueriesPaused)
+			select {
+			case <-paused:
+				So("pause returned before the in-flight query finished", ShouldBeEmpty)
+			case <-time.After(10 * time.Millisecond):
+			}
+			g.leave()
+			So(<-paused, ShouldBeNil)
+			g.resume()
+			So(g.enter(), ShouldBeNil)
+			g.leave()
+		})
+		Convey("Pausing should stay in effect if waiting is interrupted", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			So(g.pause(ctx), ShouldResemble, context.DeadlineExceeded)
+			So(g.enter(), ShouldEqual, ErrQueriesPaused)
+			g.leave()
+			So(g.pause(context.Background()), ShouldBeNil)
+		})
+	})
+}
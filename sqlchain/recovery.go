@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// recoverState reconciles the applied seq recorded by the state with the next sequence id nid of
+// the persisted head, and sets the state seq accordingly:
+//
+//   - the state matches the head: nothing to recover;
+//   - the state is behind the head: the queries of the persisted blocks not applied yet are
+//     replayed, e.g., the process crashed after a block is persisted but before its queries are
+//     committed to the state;
+//   - the state is ahead of the head: the extra queries are kept and the state continues from its
+//     own seq, e.g., the process crashed after a block is replayed or produced but before it's
+//     persisted. The block is skipped by replaying if it's received again.
+//
+// A state without the applied seq record, e.g., written by an old binary, is assumed to match the
+// head.
+func (c *Chain) recoverState(nid uint64) (err error) {
+	var (
+		applied uint64
+		ok      bool
+		le      = log.WithField("db", c.databaseID)
+	)
+	if applied, ok, err = c.st.TrackAppliedSeq(); err != nil {
+		return
+	}
+	if !ok || applied == nid {
+		c.st.SetSeq(nid)
+		return
+	}
+	le = le.WithFields(log.Fields{"applied": applied, "next": nid})
+	c.st.SetSeq(applied)
+	if applied > nid {
+		le.Warning("state is ahead of the persisted chain, continue from the state")
+		return
+	}
+
+	// Collect the blocks which are not fully applied, from the head back
+	var (
+		head   = c.rt.getHead().node
+		blocks []*types.Block
+	)
+	for node := head; node != nil; node = node.parent {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(node); err != nil {
+			return
+		}
+		if id, ok := block.CalcNextID(); ok && id <= applied {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+	le.WithField("blocks", len(blocks)).Info("state is behind the persisted chain, replaying")
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err = replayBlock(c.rt.ctx, c.st, blocks[i]); err != nil {
+			err = errors.Wrapf(err, "recover state from block %s", blocks[i].BlockHash())
+			return
+		}
+	}
+	// Drop the replayed queries from the pool, they are committed already
+	_, _, err = c.st.CommitExWithContext(c.rt.ctx)
+	return
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestRecoverState(t *testing.T) {
+	Convey("Given a chain with some blocks applied to the state", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		var (
+			offset   uint64
+			newBlock = func(pattern string) *types.Block {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, offset)
+				So(err, ShouldBeNil)
+				offset++
+				tx.Request.Payload.Queries = []types.Query{{Pattern: pattern}}
+				So(tx.Request.Sign(cli.PrivateKey), ShouldBeNil)
+				tx.Response.RequestHash = tx.Request.Header.Hash()
+				So(tx.Response.BuildHash(), ShouldBeNil)
+				var head = chain.rt.getHead()
+				block, err := createTestBlock(&head.Head, chain.rt.getServer(),
+					chain.rt.getTimeFromHeight(head.Height+1), []*types.QueryAsTx{tx})
+				So(err, ShouldBeNil)
+				return block
+			}
+			newRequest = func(qt types.QueryType, pattern string) *types.Request {
+				return &types.Request{
+					Header: types.SignedRequestHeader{
+						RequestHeader: types.RequestHeader{
+							QueryType:  qt,
+							DatabaseID: testDatabaseID,
+							Timestamp:  time.Now().UTC(),
+						},
+					},
+					Payload: types.RequestPayload{Queries: []types.Query{{Pattern: pattern}}},
+				}
+			}
+			apply = func(block *types.Block) {
+				So(replayBlock(chain.rt.ctx, chain.st, block), ShouldBeNil)
+			}
+			push = func(block *types.Block) {
+				So(chain.pushBlock(block), ShouldBeNil)
+			}
+			reload = func() {
+				So(chain.Stop(), ShouldBeNil)
+				chain, err = NewChain(config)
+				So(err, ShouldBeNil)
+			}
+			// check checks the rows in the state and the seq of the next write
+			check = func(rows int, seq uint64) {
+				_, resp, err := chain.Query(newRequest(
+					types.ReadQuery, `SELECT COUNT(1) FROM t1`), false)
+				So(err, ShouldBeNil)
+				So(resp.Payload.Rows[0].Values[0], ShouldEqual, rows)
+				_, resp, err = chain.Query(newRequest(types.WriteQuery, fmt.Sprintf(
+					`INSERT INTO t1 (k, v) VALUES (%d, 'x')`, 100+rows)), true)
+				So(err, ShouldBeNil)
+				So(resp.Header.LogOffset, ShouldEqual, seq)
+			}
+		)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		for _, v := range []string{
+			`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`,
+			`INSERT INTO t1 (k, v) VALUES (1, 'v1')`,
+		} {
+			var block = newBlock(v)
+			apply(block)
+			push(block)
+		}
+		Convey("The state matching the persisted chain should be kept as is", func() {
+			reload()
+			check(1, 2)
+		})
+		Convey("The state ahead by one block should continue from its own seq", func() {
+			var block = newBlock(`INSERT INTO t1 (k, v) VALUES (2, 'v2')`)
+			apply(block)
+			reload()
+			// Receiving the block again should not apply it twice
+			apply(block)
+			push(block)
+			check(2, 3)
+		})
+		Convey("The state behind by one block should replay the missing block", func() {
+			push(newBlock(`INSERT INTO t1 (k, v) VALUES (2, 'v2')`))
+			reload()
+			check(2, 3)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// checkResponseAccounts returns ErrInvalidResponseAccount if any response of block credits an
+// account other than the block producer and the delegated miners. It's a no-op unless
+// Config.ValidateResponseAccounts is set.
+func (c *Chain) checkResponseAccounts(block *types.Block) (err error) {
+	if c.rt.responseAccounts == nil || len(block.QueryTxs) == 0 {
+		return
+	}
+	var producer proto.AccountAddress
+	if producer, err = crypto.PubKeyHash(block.Signee()); err != nil {
+		return
+	}
+	for _, v := range block.QueryTxs {
+		var addr = v.Response.ResponseAccount
+		if addr == producer {
+			continue
+		}
+		if _, ok := c.rt.responseAccounts[addr]; ok {
+			continue
+		}
+		return errors.Wrapf(ErrInvalidResponseAccount, "response %s credits %s in block %s",
+			v.Response.Hash().String(), addr.String(), block.BlockHash().String())
+	}
+	return
+}
+
+// VerifyResponseHeader checks resp against the public key of the miner which is supposed to
+// produce it, without any chain state: the response hash must match the header, and the response
+// must credit the account of minerPubKey, or ErrInvalidResponseAccount will be returned.
+//
+// NOTE: the response headers carry no signatures in the current protocol, so this proves that
+// resp is intact and attributed to the miner, but not that the miner actually produced it. A
+// response is only proven to be produced by the miner once it's packed in a block signed by the
+// miner.
+func VerifyResponseHeader(
+	resp *types.SignedResponseHeader, minerPubKey *asymmetric.PublicKey) (err error,
+) {
+	var addr proto.AccountAddress
+	if err = resp.VerifyHash(); err != nil {
+		return
+	}
+	if addr, err = crypto.PubKeyHash(minerPubKey); err != nil {
+		return
+	}
+	if resp.ResponseAccount != addr {
+		err = errors.Wrapf(ErrInvalidResponseAccount, "response %s credits %s instead of miner %s",
+			resp.Hash().String(), resp.ResponseAccount.String(), addr.String())
+	}
+	return
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto"
+)
+
+func TestVerifyResponseHeader(t *testing.T) {
+	Convey("Given a response header of a miner", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		miner, err := newRandomNode()
+		So(err, ShouldBeNil)
+		other, err := newRandomNode()
+		So(err, ShouldBeNil)
+		resp, err := createRandomQueryResponse(cli, miner)
+		So(err, ShouldBeNil)
+		resp.ResponseAccount, err = crypto.PubKeyHash(miner.PublicKey)
+		So(err, ShouldBeNil)
+		So(resp.BuildHash(), ShouldBeNil)
+		Convey("The response should be verified with the miner public key", func() {
+			So(VerifyResponseHeader(resp, miner.PublicKey), ShouldBeNil)
+		})
+		Convey("The response should be rejected with another public key", func() {
+			err = VerifyResponseHeader(resp, other.PublicKey)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidResponseAccount)
+		})
+		Convey("A tampered response should be rejected", func() {
+			resp.AffectedRows++
+			So(VerifyResponseHeader(resp, miner.PublicKey), ShouldNotBeNil)
+			resp.AffectedRows--
+			resp.ResponseAccount, err = crypto.PubKeyHash(other.PublicKey)
+			So(err, ShouldBeNil)
+			So(VerifyResponseHeader(resp, other.PublicKey), ShouldNotBeNil)
+		})
+	})
+}
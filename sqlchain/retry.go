@@ -0,0 +1,50 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryWithBackoff calls fn until it succeeds or has been retried for retries times, and returns
+// the retry count and the last error of fn. The backoff between the attempts starts from base and
+// is doubled for each retry, of which a random part up to a half is cut off to de-synchronize the
+// callers. It gives up early once ctx is done, or if the next backoff passes the ctx deadline.
+func retryWithBackoff(
+	ctx context.Context, retries int32, base time.Duration, fn func() error) (retried int32, err error,
+) {
+	for backoff := base; ; backoff *= 2 {
+		if err = fn(); err == nil || retried >= retries {
+			return
+		}
+		var sleep = backoff
+		if half := int64(backoff / 2); half > 0 {
+			sleep -= time.Duration(rand.Int63n(half + 1))
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(sleep).After(deadline) {
+			return
+		}
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return
+		}
+		retried++
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	Convey("Given a function failing twice before succeeding", t, func() {
+		var (
+			calls int
+			errFn = errors.New("transient error")
+			fn    = func() error {
+				if calls++; calls <= 2 {
+					return errFn
+				}
+				return nil
+			}
+		)
+		Convey("It should succeed with enough retries", func() {
+			var begin = time.Now()
+			retried, err := retryWithBackoff(context.Background(), 3, 10*time.Millisecond, fn)
+			So(err, ShouldBeNil)
+			So(retried, ShouldEqual, 2)
+			So(calls, ShouldEqual, 3)
+			// The backoffs are at least half of 10ms and 20ms respectively
+			So(time.Since(begin), ShouldBeGreaterThanOrEqualTo, 15*time.Millisecond)
+		})
+		Convey("It should give up after the max retries", func() {
+			retried, err := retryWithBackoff(context.Background(), 1, time.Millisecond, fn)
+			So(err, ShouldEqual, errFn)
+			So(retried, ShouldEqual, 1)
+			So(calls, ShouldEqual, 2)
+		})
+		Convey("It should give up if the next backoff passes the deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			var begin = time.Now()
+			retried, err := retryWithBackoff(ctx, 3, time.Second, fn)
+			So(err, ShouldEqual, errFn)
+			So(retried, ShouldEqual, 0)
+			So(calls, ShouldEqual, 1)
+			So(time.Since(begin), ShouldBeLessThan, 100*time.Millisecond)
+		})
+	})
+}
+
+func TestSyncHeadRetries(t *testing.T) {
+	Convey("Given a chain lagging behind a flaky peer", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.peers.Servers = append(chain.rt.peers.Servers, "flaky")
+		chain.rt.setNextTurn()
+		chain.rt.fetchRetries = 2
+		chain.rt.retryBackoff = 10 * time.Millisecond
+		var (
+			head  = chain.rt.getHead()
+			ts    = chain.rt.getTimeFromHeight(head.Height + 1)
+			mu    sync.Mutex
+			calls int
+		)
+		block, err := createTestBlock(&head.Head, chain.rt.getServer(), ts, nil)
+		So(err, ShouldBeNil)
+		chain.cl = &mockCaller{call: func(
+			ctx context.Context, node proto.NodeID, method string, args, reply interface{},
+		) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if calls++; calls <= 2 {
+				return ErrUnknownMuxRequest
+			}
+			reply.(*MuxFetchBlockResp).Block = block
+			return nil
+		}}
+		Convey("The block should be fetched by retrying within the period", func() {
+			var start = time.Now()
+			go chain.syncHead()
+			var fetched *types.Block
+			select {
+			case fetched = <-chain.blocks:
+			case <-time.After(chain.rt.period):
+			}
+			So(fetched, ShouldEqual, block)
+			So(time.Since(start), ShouldBeLessThan, chain.rt.period)
+			mu.Lock()
+			defer mu.Unlock()
+			So(calls, ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"bytes"
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/CovenantSQL/CovenantSQL/storage"
+	"github.com/CovenantSQL/CovenantSQL/types"
+	"github.com/CovenantSQL/CovenantSQL/utils"
+	"github.com/CovenantSQL/CovenantSQL/utils/log"
+)
+
+// Rewind rewinds the chain to its block at targetHeight, or the latest one below targetHeight if
+// there is no block at the height, and discards the later blocks for disaster recovery.
+//
+// The state of the remaining chain is rebuilt aside and swapped with the live state as a reorg
+// does, see Chain.reorg, and the responses and acks of the discarded heights are pruned from tdb.
+// The rewind must be done before the chain is started, otherwise ErrChainStarted is returned. It
+// refuses to rewind below the genesis block, and never reverts the billings already submitted for
+// the discarded blocks.
+func (c *Chain) Rewind(targetHeight int32) (err error) {
+	if atomic.LoadInt32(&c.started) != 0 {
+		return ErrChainStarted
+	}
+	var (
+		head    = c.rt.getHead()
+		genesis = head.node.ancestorByCount(0)
+		target  = head.node
+		le      = log.WithFields(log.Fields{
+			"head":          head.Head.String(),
+			"head_height":   head.Height,
+			"target_height": targetHeight,
+			"db":            c.databaseID,
+		})
+	)
+	if targetHeight < genesis.height {
+		return errors.Wrapf(ErrInvalidRewindHeight,
+			"target height %d below genesis height %d", targetHeight, genesis.height)
+	}
+	for target.height > targetHeight {
+		target = target.parent
+	}
+	if target == head.node {
+		return
+	}
+
+	// Rebuild the state of the remaining chain aside
+	var (
+		dsn *storage.DSN
+		nid uint64
+	)
+	if dsn, nid, err = c.rebuildState(target); err != nil {
+		le.WithError(err).Error("failed to rebuild state for rewind")
+		return
+	}
+	defer removeSqliteFiles(dsn.GetFileName())
+
+	// Swap the live state and discard the later blocks and queries, the live state is restored
+	// if the blocks fail to be discarded
+	var (
+		discarded []*blockNode
+		st        = &state{node: target, Head: target.hash, Height: target.height}
+		finish    func(keep bool) error
+	)
+	for n := head.node; n != target; n = n.parent {
+		discarded = append(discarded, n)
+	}
+	if finish, err = c.swapState(dsn, nid); err != nil {
+		le.WithError(err).Error("failed to swap state for rewind")
+		return
+	}
+	if err = c.persistRewind(st, discarded); err != nil {
+		le.WithError(err).Error("failed to persist rewind")
+		if rerr := finish(false); rerr != nil {
+			le.WithError(rerr).Error("CRITICAL: failed to restore state for rewind")
+		}
+		return
+	}
+	if rerr := finish(true); rerr != nil {
+		le.WithError(rerr).Warning("failed to remove replaced state files")
+	}
+	if err = c.pruneQueriesAbove(target.height); err != nil {
+		le.WithError(err).Error("failed to prune queries for rewind")
+		return
+	}
+
+	// Reset the memory index to the rewound head
+	c.rt.setHead(st)
+	for _, n := range discarded {
+		c.bi.removeBlock(&n.hash)
+	}
+	for _, tip := range c.rt.dropForks(math.MaxInt32) {
+		for n := tip; n != nil && n.height > target.height; n = n.parent {
+			c.bi.removeBlock(&n.hash)
+		}
+	}
+	c.resetFinalizedState()
+	if err = c.rebuildAckIndex(target); err != nil {
+		return
+	}
+	c.publishChainEvent(HeadChanged, target)
+	le.WithFields(log.Fields{
+		"new_head":  target.hash.String(),
+		"new_count": target.count,
+		"discarded": len(discarded),
+	}).Warning("rewound chain")
+	return
+}
+
+// persistRewind removes the blocks above the new chain state st and the account index of the
+// discarded blocks from bdb in a transaction, and writes st as the chain state. The block index
+// snapshot is invalidated, since it may include the discarded blocks.
+func (c *Chain) persistRewind(st *state, discarded []*blockNode) (err error) {
+	var enc *bytes.Buffer
+	if enc, err = utils.EncodeMsgPack(st); err != nil {
+		return
+	}
+	var t *leveldb.Transaction
+	if t, err = c.bdb.OpenTransaction(); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			t.Discard()
+		}
+	}()
+	for _, n := range discarded {
+		var block *types.Block
+		if block, err = c.fetchBlockOfNode(n); err != nil {
+			return
+		}
+		if err = c.delAccountIndex(t, n.height, block); err != nil {
+			return
+		}
+	}
+	var (
+		keys [][]byte
+		iter = t.NewIterator(&util.Range{
+			Start: utils.ConcatAll(metaBlockIndex[:], heightToKey(st.Height+1)),
+			Limit: util.BytesPrefix(metaBlockIndex[:]).Limit,
+		}, nil)
+	)
+	for iter.Next() {
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err = iter.Error(); err != nil {
+		return
+	}
+	for _, k := range keys {
+		if err = t.Delete(k, nil); err != nil {
+			err = errors.Wrapf(err, "delete %s", string(k))
+			return
+		}
+	}
+	if err = t.Put(metaState[:], enc.Bytes(), nil); err != nil {
+		err = errors.Wrapf(err, "put %s", string(metaState[:]))
+		return
+	}
+	if err = t.Delete(metaSnapshotState[:], nil); err != nil {
+		err = errors.Wrap(err, "invalidate block index snapshot")
+		return
+	}
+	if err = t.Commit(); err != nil {
+		err = errors.Wrap(err, "commit error")
+		return
+	}
+	c.resetIndexSnapshot()
+	return
+}
+
+// pruneQueriesAbove removes the responses and acks above height from tdb.
+func (c *Chain) pruneQueriesAbove(height int32) (err error) {
+	var batch = &leveldb.Batch{}
+	for _, prefix := range [][4]byte{metaResponseIndex, metaAckIndex} {
+		var iter = c.tdb.NewIterator(&util.Range{
+			Start: utils.ConcatAll(prefix[:], heightToKey(height+1)),
+			Limit: util.BytesPrefix(prefix[:]).Limit,
+		}, nil)
+		for iter.Next() {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+		}
+		iter.Release()
+		if err = iter.Error(); err != nil {
+			return
+		}
+	}
+	if err = c.tdb.Write(batch, c.rt.writeOptions); err != nil {
+		err = errors.Wrap(err, "prune queries")
+	}
+	return
+}
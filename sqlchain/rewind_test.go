@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestRewind(t *testing.T) {
+	Convey("Given a chain with several blocks and persisted responses", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, config, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		So(pushTestBlocks(chain, 5, nil), ShouldBeNil)
+		chain.rt.persistResponses = true
+		resp, err := createRandomQueryResponse(cli, cli)
+		So(err, ShouldBeNil)
+		So(chain.AddResponse(resp), ShouldBeNil)
+		var (
+			head     = chain.rt.getHead()
+			countKey = func(db *leveldb.DB, prefix [4]byte) (n int) {
+				var iter = db.NewIterator(util.BytesPrefix(prefix[:]), nil)
+				defer iter.Release()
+				for iter.Next() {
+					n++
+				}
+				return
+			}
+		)
+		So(head.Height, ShouldEqual, 5)
+		So(countKey(chain.tdb, metaResponseIndex), ShouldEqual, 1)
+		Convey("The chain should refuse to rewind below the genesis block", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			err = chain.Rewind(-1)
+			So(errors.Cause(err), ShouldEqual, ErrInvalidRewindHeight)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The chain should refuse to rewind once started", func() {
+			defer func() { So(chain.Stop(), ShouldBeNil) }()
+			atomic.StoreInt32(&chain.started, 1)
+			So(chain.Rewind(2), ShouldEqual, ErrChainStarted)
+			So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+		})
+		Convey("The chain should be rewound by several blocks", func() {
+			var target = head.node.ancestor(2)
+			So(chain.Rewind(2), ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, target.hash)
+			So(chain.rt.getHead().node.count, ShouldEqual, 2)
+			for h := int32(3); h <= 5; h++ {
+				So(chain.bi.hasBlock(&head.node.ancestor(h).hash), ShouldBeFalse)
+				block, err := chain.FetchBlock(h)
+				So(err, ShouldBeNil)
+				So(block, ShouldBeNil)
+			}
+			So(countKey(chain.bdb, metaBlockIndex), ShouldEqual, 3)
+			So(countKey(chain.tdb, metaResponseIndex), ShouldEqual, 0)
+			So(chain.Rewind(5), ShouldBeNil)
+			So(chain.rt.getHead().Head, ShouldResemble, target.hash)
+			Convey("The production should continue from the rewound head", func() {
+				var errCh = make(chan error, 1)
+				go func() {
+					errCh <- chain.produceBlock(chain.rt.getTimeFromHeight(3))
+				}()
+				var block = <-chain.blocks
+				So(<-errCh, ShouldBeNil)
+				So(block.ParentHash(), ShouldResemble, &target.hash)
+				So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+				chain.endProduced(block)
+				So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+				So(chain.rt.getHead().node.count, ShouldEqual, 3)
+				So(chain.Stop(), ShouldBeNil)
+				chain, err = NewChain(config)
+				So(err, ShouldBeNil)
+				defer func() { So(chain.Stop(), ShouldBeNil) }()
+				So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+				So(chain.rt.getHead().node.count, ShouldEqual, 3)
+				So(chain.rt.getHead().node.parent.hash, ShouldResemble, target.hash)
+			})
+		})
+	})
+}
@@ -17,12 +17,101 @@
 package sqlchain
 
 import (
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/types"
 )
 
+// Method names of the chain RPC endpoints.
+const (
+	MethodAdviseNewBlock   = "AdviseNewBlock"
+	MethodAdviseBinLog     = "AdviseBinLog"
+	MethodAdviseAckedQuery = "AdviseAckedQuery"
+	MethodFetchBlock       = "FetchBlock"
+	MethodFetchBlockRange  = "FetchBlockRange"
+	MethodFetchBlockHeader = "FetchBlockHeader"
+)
+
+// RPCCall represents an incoming call to a chain RPC endpoint.
+type RPCCall struct {
+	// Method is the called method name, e.g. MethodAdviseNewBlock.
+	Method string
+	// Envelope is the envelope of the muxed request, which carries the caller info.
+	Envelope *proto.Envelope
+	// Req and Resp are the request and response of the method, e.g. *AdviseNewBlockReq and
+	// *AdviseNewBlockResp.
+	Req, Resp interface{}
+	// Received is the local clock reading when the call is received, before it's handled by any
+	// middleware. It's reported to the caller for clock skew estimation.
+	Received time.Time
+}
+
+// Handler handles an incoming chain RPC call.
+type Handler func(call *RPCCall) error
+
+// Middleware wraps a Handler to handle cross-cutting concerns of all the chain RPC endpoints,
+// such as authentication, rate limiting and request logging.
+//
+// Middlewares are applied in the order they are registered: the first registered middleware
+// is the outermost one, which sees the call first and the returned error last. A middleware may
+// return an error without calling next to reject the call.
+type Middleware func(next Handler) Handler
+
 // ChainRPCService defines a sql-chain RPC server.
 type ChainRPCService struct {
-	chain *Chain
+	chain   *Chain
+	handler Handler
+}
+
+// newChainRPCService returns a new ChainRPCService of chain with middlewares applied.
+func newChainRPCService(chain *Chain, middlewares []Middleware) (s *ChainRPCService) {
+	s = &ChainRPCService{chain: chain}
+	s.handler = s.dispatch
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		s.handler = middlewares[i](s.handler)
+	}
+	return
+}
+
+// serve handles an incoming muxed call through the middlewares.
+func (s *ChainRPCService) serve(
+	method string, envelope *proto.Envelope, req, resp interface{}) error {
+	return s.handler(&RPCCall{
+		Method:   method,
+		Envelope: envelope,
+		Req:      req,
+		Resp:     resp,
+		Received: time.Now().UTC(),
+	})
+}
+
+// dispatch dispatches the call to the RPC method, it's the innermost handler.
+func (s *ChainRPCService) dispatch(call *RPCCall) error {
+	switch call.Method {
+	case MethodAdviseNewBlock:
+		var resp = call.Resp.(*AdviseNewBlockResp)
+		resp.Timestamp = call.Received
+		return s.AdviseNewBlock(call.Req.(*AdviseNewBlockReq), resp)
+	case MethodAdviseBinLog:
+		return s.AdviseBinLog(call.Req.(*AdviseBinLogReq), call.Resp.(*AdviseBinLogResp))
+	case MethodAdviseAckedQuery:
+		return s.AdviseAckedQuery(
+			call.Req.(*AdviseAckedQueryReq), call.Resp.(*AdviseAckedQueryResp))
+	case MethodFetchBlock:
+		var resp = call.Resp.(*FetchBlockResp)
+		resp.Timestamp = call.Received
+		return s.FetchBlock(call.Req.(*FetchBlockReq), resp)
+	case MethodFetchBlockRange:
+		var resp = call.Resp.(*FetchBlockRangeResp)
+		resp.Timestamp = call.Received
+		return s.FetchBlockRange(call.Req.(*FetchBlockRangeReq), resp)
+	case MethodFetchBlockHeader:
+		var resp = call.Resp.(*FetchBlockHeaderResp)
+		resp.Timestamp = call.Received
+		return s.FetchBlockHeader(call.Req.(*FetchBlockHeaderReq), resp)
+	}
+	return ErrUnknownMuxRequest
 }
 
 // AdviseNewBlockReq defines a request of the AdviseNewBlock RPC method.
@@ -33,6 +122,9 @@ type AdviseNewBlockReq struct {
 
 // AdviseNewBlockResp defines a response of the AdviseNewBlock RPC method.
 type AdviseNewBlockResp struct {
+	// Timestamp is the local clock reading of the server when the call is received, for clock
+	// skew estimation.
+	Timestamp time.Time
 }
 
 // AdviseBinLogReq defines a request of the AdviseBinLog RPC method.
@@ -61,6 +153,36 @@ type FetchBlockReq struct {
 type FetchBlockResp struct {
 	Height int32
 	Block  *types.Block
+	// Timestamp is the local clock reading of the server when the call is received, for clock
+	// skew estimation.
+	Timestamp time.Time
+}
+
+// FetchBlockRangeReq defines a request of the FetchBlockRange RPC method.
+type FetchBlockRangeReq struct {
+	From, To int32
+}
+
+// FetchBlockRangeResp defines a response of the FetchBlockRange RPC method.
+type FetchBlockRangeResp struct {
+	Blocks []*types.Block
+	// Timestamp is the local clock reading of the server when the call is received, for clock
+	// skew estimation.
+	Timestamp time.Time
+}
+
+// FetchBlockHeaderReq defines a request of the FetchBlockHeader RPC method.
+type FetchBlockHeaderReq struct {
+	Height int32
+}
+
+// FetchBlockHeaderResp defines a response of the FetchBlockHeader RPC method.
+type FetchBlockHeaderResp struct {
+	Height int32
+	Header *types.SignedHeader
+	// Timestamp is the local clock reading of the server when the call is received, for clock
+	// skew estimation.
+	Timestamp time.Time
 }
 
 // AdviseNewBlock is the RPC method to advise a new produced block to the target server.
@@ -88,3 +210,20 @@ func (s *ChainRPCService) FetchBlock(req *FetchBlockReq, resp *FetchBlockResp) (
 	resp.Block, err = s.chain.FetchBlock(req.Height)
 	return
 }
+
+// FetchBlockRange is the RPC method to fetch the known blocks in a height range from the target
+// server.
+func (s *ChainRPCService) FetchBlockRange(
+	req *FetchBlockRangeReq, resp *FetchBlockRangeResp) (err error) {
+	resp.Blocks, err = s.chain.FetchBlockRange(req.From, req.To)
+	return
+}
+
+// FetchBlockHeader is the RPC method to fetch the signed header of a known block from the target
+// server.
+func (s *ChainRPCService) FetchBlockHeader(
+	req *FetchBlockHeaderReq, resp *FetchBlockHeaderResp) (err error) {
+	resp.Height = req.Height
+	resp.Header, err = s.chain.FetchBlockHeader(req.Height)
+	return
+}
@@ -15,3 +15,65 @@
  */
 
 package sqlchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddleware(t *testing.T) {
+	Convey("Given a chain RPC service with middlewares", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		var (
+			trace     []string
+			errDenied = errors.New("denied")
+			denied    bool
+			newTracer = func(name string) Middleware {
+				return func(next Handler) Handler {
+					return func(call *RPCCall) (err error) {
+						trace = append(trace, name+">"+call.Method)
+						err = next(call)
+						trace = append(trace, name+"<")
+						return
+					}
+				}
+			}
+			denier = func(next Handler) Handler {
+				return func(call *RPCCall) error {
+					if denied {
+						return errDenied
+					}
+					return next(call)
+				}
+			}
+			mux = &MuxService{}
+			req = &MuxFetchBlockReq{
+				DatabaseID:    chain.databaseID,
+				FetchBlockReq: FetchBlockReq{Height: 0},
+			}
+			resp = &MuxFetchBlockResp{}
+		)
+		mux.register(chain.databaseID,
+			newChainRPCService(chain, []Middleware{newTracer("m0"), denier, newTracer("m1")}))
+		Convey("The middlewares should be applied in order", func() {
+			err = mux.FetchBlock(req, resp)
+			So(err, ShouldBeNil)
+			So(resp.Block, ShouldNotBeNil)
+			So(resp.Block.BlockHash(), ShouldResemble, &chain.rt.genesisHash)
+			So(trace, ShouldResemble, []string{
+				"m0>" + MethodFetchBlock, "m1>" + MethodFetchBlock, "m1<", "m0<"})
+		})
+		Convey("The call should be rejected by middleware", func() {
+			denied = true
+			err = mux.FetchBlock(req, resp)
+			So(err, ShouldEqual, errDenied)
+			So(resp.Block, ShouldBeNil)
+			So(trace, ShouldResemble, []string{"m0>" + MethodFetchBlock, "m0<"})
+		})
+	})
+}
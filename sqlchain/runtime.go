@@ -18,10 +18,14 @@ package sqlchain
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/types"
@@ -45,10 +49,28 @@ type runtime struct {
 	period time.Duration
 	// tick defines the maximum duration between each cycle.
 	tick time.Duration
+	// maxTickJitter bounds the random delay added to each tick, 0 to disable.
+	maxTickJitter time.Duration
 	// queryTTL sets the unacknowledged query TTL in block periods.
 	queryTTL int32
-	// blockCacheTTL sets the cached block numbers.
-	blockCacheTTL int32
+	// minPeersToProduce sets the minimum peer number required to produce blocks.
+	minPeersToProduce int32
+	// adviseRetries sets the maximum retry times of advising a new block to each peer.
+	adviseRetries int32
+	// fetchRetries sets the maximum retry times of fetching a block from each peer.
+	fetchRetries int32
+	// retryBackoff sets the initial backoff between the RPC retries.
+	retryBackoff time.Duration
+	// verboseAdvise logs each advising failure instead of a summary of the block.
+	verboseAdvise bool
+	// observer disables block producing and advising.
+	observer bool
+	// localSendTimeout bounds the wait to send a produced block to the local processing.
+	localSendTimeout time.Duration
+	// drainTimeout bounds the wait to persist the in-flight produced block on stop.
+	drainTimeout time.Duration
+	// schemes is the accepted signature scheme set of acks and blocks.
+	schemes schemeSet
 	// muxServer is the multiplexing service of sql-chain PRC.
 	muxService *MuxService
 
@@ -62,6 +84,8 @@ type runtime struct {
 	index int32
 	// total is the total peer number of the sql-chain.
 	total int32
+	// badBlocks counts the blocks served by each peer which fail the verification.
+	badBlocks map[proto.NodeID]int64
 
 	// stateMutex protects following turn-relative fields.
 	stateMutex sync.Mutex
@@ -74,10 +98,86 @@ type runtime struct {
 
 	// timeMutex protects following time-relative fields.
 	timeMutex sync.Mutex
-	// offset is the time difference calculated by: coodinatedChainTime - time.Now().
-	//
-	// TODO(leventeliu): update offset in ping cycle.
+	// offset is the time difference calculated by: coodinatedChainTime - time.Now(), excluding
+	// the clock skew correction.
 	offset time.Duration
+	// skewCorrection is the bounded correction of the local clock skew, which is applied to the
+	// chain time in addition to offset.
+	skewCorrection time.Duration
+	// skewWarned indicates that the estimated clock skew has exceeded skewWarning.
+	skewWarned bool
+	// skews estimates the local clock skew from the timestamps reported by peers.
+	skews *skewEstimator
+	// maxSkewCorrection bounds the absolute value of offset estimated from clock skew.
+	maxSkewCorrection time.Duration
+	// skewWarning sets the estimated clock skew threshold to log warnings.
+	skewWarning time.Duration
+	// separateReadPath dispatches read queries to the read-only path of the state.
+	separateReadPath bool
+	// ackRetention sets the number of block periods to retain acks in tdb, 0 for forever.
+	ackRetention int32
+	// archive retains all the blocks in memory and all the acks in tdb.
+	archive bool
+	// persistResponses persists the added responses in tdb.
+	persistResponses bool
+	// writeOptions is the options of the chain database writes, nil for the default.
+	writeOptions *opt.WriteOptions
+	// storeOptions is the options of the chain databases.
+	storeOptions *opt.Options
+	// responseAccounts is the set of the delegated response accounts, nil to skip validating the
+	// response accounts of blocks.
+	responseAccounts map[proto.AccountAddress]struct{}
+	// middlewares wraps the chain RPC endpoints.
+	middlewares []Middleware
+	// poolTransientBlocks enables reusing the block structures of transient decodes.
+	poolTransientBlocks bool
+	// strictSequenceID fails the chain loading on inconsistent sequence ids.
+	strictSequenceID bool
+	// queries schedules the concurrently running queries by priority, nil for unlimited.
+	queries *queryScheduler
+	// newHeightScheme creates heights from the genesis block.
+	newHeightScheme HeightSchemeFactory
+	// heights converts between the chain time and the block heights.
+	heights HeightScheme
+	// schedulingMode sets how the turns begin.
+	schedulingMode SchedulingMode
+	// maxStashedHeights sets the number of turns ahead of the current turn to stash the future
+	// blocks.
+	maxStashedHeights int32
+	// maxQueryDuration bounds the duration of a query in the state, 0 for unlimited.
+	maxQueryDuration time.Duration
+	// maxBlockTimeSkew sets the tolerance of block timestamps ahead of now, 0 to disable.
+	maxBlockTimeSkew time.Duration
+	// maxClockSkew sets the tolerance of block timestamps deviating from now, 0 to disable.
+	maxClockSkew time.Duration
+	// maxStashedBlocks sets the max number of the stashed future blocks.
+	maxStashedBlocks int
+	// maxSyncStalls sets the number of initial sync attempts without head progress to give up.
+	maxSyncStalls int32
+	// maxHealthyLag sets the max lag in turns of a synced head.
+	maxHealthyLag int32
+	// maxSkippedPeriods sets the max periods a new block with an unknown parent may run ahead of
+	// the head before catching up.
+	maxSkippedPeriods int32
+	// snapshotInterval sets the number of turns between block index snapshots, 0 to disable.
+	snapshotInterval int32
+	// maxOrphans sets the capacity of the orphan block store, 0 to disable it.
+	maxOrphans int
+	// confirmationDepth sets the number of subsequent blocks to finalize a block.
+	confirmationDepth int32
+	// producerVersion is the software version tag of the produced blocks.
+	producerVersion string
+	// stateChecksum sets the state checksum to the produced blocks.
+	stateChecksum bool
+	// maxBillingUsers caps the number of users aggregated in memory by billing, 0 for unlimited.
+	maxBillingUsers int
+	// maxBlockQueries and maxBlockBytes cap the produced blocks, 0 for unlimited.
+	maxBlockQueries int
+	maxBlockBytes   int
+	// checkpoints are the trusted block hashes indexed by block count.
+	checkpoints map[int32]hash.Hash
+	// isolationLevel is the isolation level of the chain state.
+	isolationLevel sql.IsolationLevel
 }
 
 func blockCacheTTLRequired(c *Config) (ttl int32) {
@@ -100,13 +200,50 @@ func newRunTime(ctx context.Context, c *Config) (r *runtime) {
 		ctx:    cld,
 		cancel: ccl,
 
-		period:        c.Period,
-		tick:          c.Tick,
-		queryTTL:      c.QueryTTL,
-		blockCacheTTL: blockCacheTTLRequired(c),
-		muxService:    c.MuxService,
-		peers:         c.Peers,
-		server:        c.Server,
+		period:              c.Period,
+		tick:                c.Tick,
+		maxTickJitter:       c.MaxTickJitter,
+		queryTTL:            c.QueryTTL,
+		minPeersToProduce:   c.MinPeersToProduce,
+		adviseRetries:       c.AdviseRetries,
+		fetchRetries:        c.FetchRetries,
+		retryBackoff:        c.RPCRetryBackoff,
+		verboseAdvise:       c.VerboseAdviseErrors,
+		observer:            c.ObserverMode,
+		localSendTimeout:    c.LocalBlockSendTimeout,
+		drainTimeout:        c.StopDrainTimeout,
+		schemes:             newSchemeSet(c.SignatureSchemes),
+		separateReadPath:    c.SeparateReadPath,
+		ackRetention:        c.MaxAckRetention,
+		archive:             c.ArchiveMode,
+		persistResponses:    !c.DisableResponsePersistence,
+		middlewares:         c.Middlewares,
+		poolTransientBlocks: c.PoolTransientBlocks,
+		strictSequenceID:    c.StrictSequenceID,
+		queries:             newQueryScheduler(c.MaxConcurrentQueries),
+		newHeightScheme:     c.HeightScheme,
+		schedulingMode:      c.SchedulingMode,
+		maxStashedHeights:   c.MaxStashedHeights,
+		maxBlockTimeSkew:    c.MaxBlockTimeSkew,
+		maxClockSkew:        c.MaxClockSkew,
+		maxQueryDuration:    c.MaxQueryDuration,
+		maxStashedBlocks:    c.MaxStashedBlocks,
+		maxSyncStalls:       c.MaxSyncStalls,
+		maxHealthyLag:       c.MaxHealthyLag,
+		maxSkippedPeriods:   c.MaxSkippedPeriods,
+		snapshotInterval:    c.IndexSnapshotInterval,
+		maxOrphans:          c.MaxOrphanBlocks,
+		confirmationDepth:   c.ConfirmationDepth,
+		producerVersion:     c.ProducerVersion,
+		stateChecksum:       c.StateChecksum,
+		maxBillingUsers:     c.MaxBillingUsers,
+		maxBlockQueries:     c.MaxQueriesPerBlock,
+		maxBlockBytes:       c.MaxBlockBytes,
+		checkpoints:         c.Checkpoints,
+		isolationLevel:      sql.IsolationLevel(c.IsolationLevel),
+		muxService:          c.MuxService,
+		peers:               c.Peers,
+		server:              c.Server,
 		index: func() int32 {
 			if index, found := c.Peers.Find(c.Server); found {
 				return index
@@ -119,10 +256,55 @@ func newRunTime(ctx context.Context, c *Config) (r *runtime) {
 
 			return -1
 		}(),
-		total:    int32(len(c.Peers.Servers)),
-		nextTurn: 1,
-		head:     &state{},
-		offset:   time.Duration(0),
+		total:     int32(len(c.Peers.Servers)),
+		badBlocks: make(map[proto.NodeID]int64),
+		nextTurn:  1,
+		head:      &state{},
+		offset:    time.Duration(0),
+
+		skews:             newSkewEstimator(),
+		maxSkewCorrection: c.MaxClockSkewCorrection,
+		skewWarning:       c.ClockSkewWarning,
+	}
+	if c.SyncWrites {
+		r.writeOptions = &opt.WriteOptions{Sync: true}
+	}
+	r.storeOptions = storeOptions(c)
+	if r.maxStashedHeights <= 0 {
+		r.maxStashedHeights = defaultMaxStashedHeights
+	}
+	if r.retryBackoff <= 0 {
+		r.retryBackoff = defaultRPCRetryBackoff
+	}
+	if r.maxStashedBlocks <= 0 {
+		r.maxStashedBlocks = defaultMaxStashedBlocks
+	}
+	if r.maxSyncStalls <= 0 {
+		r.maxSyncStalls = defaultMaxSyncStalls
+	}
+	if r.maxHealthyLag <= 0 {
+		r.maxHealthyLag = defaultMaxHealthyLag
+	}
+	if r.maxSkippedPeriods <= 0 {
+		r.maxSkippedPeriods = defaultMaxSkippedPeriods
+	}
+	if c.ValidateResponseAccounts {
+		r.responseAccounts = make(map[proto.AccountAddress]struct{})
+		for _, v := range c.DelegatedResponseAccounts {
+			r.responseAccounts[v] = struct{}{}
+		}
+	}
+	if r.skewWarning <= 0 {
+		r.skewWarning = r.period / 10
+	}
+	if r.drainTimeout <= 0 {
+		r.drainTimeout = r.period
+	}
+	if r.maxTickJitter > r.period/2 {
+		r.maxTickJitter = r.period / 2
+	}
+	if r.newHeightScheme == nil {
+		r.newHeightScheme = NewLinearHeightScheme
 	}
 
 	if c.Genesis != nil {
@@ -134,6 +316,7 @@ func newRunTime(ctx context.Context, c *Config) (r *runtime) {
 
 func (r *runtime) setGenesis(b *types.Block) {
 	r.chainInitTime = b.Timestamp()
+	r.heights = r.newHeightScheme(r.chainInitTime, r.period)
 	r.genesisHash = *b.BlockHash()
 	r.head = &state{
 		node:   nil,
@@ -172,18 +355,67 @@ func (r *runtime) updateTime(now time.Time) {
 	r.offset = time.Until(now)
 }
 
+// reportPeerTime reports the peer time of a roundtrip to peer id, which is sent and received at
+// the local clock readings. The estimated clock skew is applied to the chain time as a separate
+// correction within the maxSkewCorrection bound. A warning is logged once the estimated skew
+// exceeds skewWarning, and is not repeated until the skew falls back within it.
+func (r *runtime) reportPeerTime(id proto.NodeID, sent, received, peerTime time.Time) {
+	if peerTime.IsZero() {
+		return
+	}
+	r.skews.update(id, sent, received, peerTime)
+	var skew, ok = r.skews.estimate()
+	if !ok {
+		return
+	}
+	var (
+		exceeded   = r.skewWarning > 0 && (skew > r.skewWarning || skew < -r.skewWarning)
+		correction = skew
+	)
+	if correction > r.maxSkewCorrection {
+		correction = r.maxSkewCorrection
+	} else if correction < -r.maxSkewCorrection {
+		correction = -r.maxSkewCorrection
+	}
+	r.timeMutex.Lock()
+	r.skewCorrection = correction
+	var crossed = exceeded != r.skewWarned
+	r.skewWarned = exceeded
+	r.timeMutex.Unlock()
+	if crossed {
+		var le = log.WithFields(log.Fields{
+			"peer":           r.getPeerInfoString(),
+			"skew":           skew,
+			"max_correction": r.maxSkewCorrection,
+		})
+		if exceeded {
+			le.Warning("local clock is skewed from peers, please check NTP synchronization")
+		} else {
+			le.Info("local clock skew is back within the warning threshold")
+		}
+	}
+}
+
+// getOffset returns the current offset of the coodinated chain time from the local clock,
+// including the clock skew correction.
+func (r *runtime) getOffset() time.Duration {
+	r.timeMutex.Lock()
+	defer r.timeMutex.Unlock()
+	return r.offset + r.skewCorrection
+}
+
 // now returns the current coodinated chain time.
 func (r *runtime) now() time.Time {
 	r.timeMutex.Lock()
 	defer r.timeMutex.Unlock()
-	return time.Now().Add(r.offset)
+	return time.Now().Add(r.offset + r.skewCorrection)
 }
 
 func (r *runtime) getChainTimeString() string {
-	diff := r.now().Sub(r.chainInitTime)
-	height := diff / r.period
-	offset := diff % r.period
-	return fmt.Sprintf("[@%d+%.9f]", int32(height), offset.Seconds())
+	now := r.now()
+	height := r.getHeightFromTime(now)
+	offset := now.Sub(r.getTimeFromHeight(height))
+	return fmt.Sprintf("[@%d+%.9f]", height, offset.Seconds())
 }
 
 func (r *runtime) getNextTurn() int32 {
@@ -192,6 +424,11 @@ func (r *runtime) getNextTurn() int32 {
 	return r.nextTurn
 }
 
+// isTooFarAhead reports whether height h is too far ahead of the current turn to be stashed.
+func (r *runtime) isTooFarAhead(h int32) bool {
+	return h >= r.getNextTurn()+r.maxStashedHeights
+}
+
 // setNextTurn prepares the runtime state for the next turn.
 func (r *runtime) setNextTurn() {
 	r.stateMutex.Lock()
@@ -208,20 +445,60 @@ func (r *runtime) stop(dbID proto.DatabaseID) {
 
 // getHeightFromTime calculates the height with this sql-chain config of a given time reading.
 func (r *runtime) getHeightFromTime(t time.Time) int32 {
-	return int32(t.Sub(r.chainInitTime) / r.period)
+	return r.heights.HeightFromTime(t)
+}
+
+// isCountDriven reports whether the turns are driven by the processed blocks, see
+// CountDrivenScheduling.
+func (r *runtime) isCountDriven() bool {
+	return r.schedulingMode == CountDrivenScheduling
+}
+
+// getCurrentHeight returns the height of the latest begun turn: the height of the current chain
+// time in wall-clock scheduling, or the explicitly tracked turn in count-driven scheduling.
+func (r *runtime) getCurrentHeight() int32 {
+	if r.isCountDriven() {
+		return r.getNextTurn() - 1
+	}
+	return r.getHeightFromTime(r.now())
+}
+
+// getTimeFromHeight calculates the beginning time of a given height with this sql-chain config.
+func (r *runtime) getTimeFromHeight(h int32) time.Time {
+	return r.heights.TimeFromHeight(h)
 }
 
 // nextTick returns the current clock reading and the duration till the next turn. If duration
 // is less or equal to 0, use the clock reading to run the next cycle - this avoids some problem
 // caused by concurrently time synchronization.
+//
+// In count-driven scheduling, the next turn is due once the block of the previous turn is
+// processed, and the beginning time of the turn height is returned as the clock reading.
 func (r *runtime) nextTick() (t time.Time, d time.Duration) {
+	index, total := r.getIndexTotal()
 	r.stateMutex.Lock()
 	defer r.stateMutex.Unlock()
+	if r.isCountDriven() {
+		t = r.getTimeFromHeight(r.nextTurn)
+		if r.head.Height < r.nextTurn-1 {
+			d = r.tick
+		}
+		return
+	}
 	t = r.now()
-	d = r.chainInitTime.Add(time.Duration(r.nextTurn) * r.period).Sub(t)
-
-	if d > r.tick {
-		d = r.tick
+	d = r.getTimeFromHeight(r.nextTurn).Sub(t)
+
+	var tick = r.tick
+	if r.maxTickJitter > 0 {
+		var jitter = time.Duration(rand.Int63n(int64(r.maxTickJitter)))
+		tick += jitter
+		// Only the peers not producing the next turn may run it late
+		if d > 0 && !ownsTurn(index, total, r.nextTurn) {
+			d += jitter
+		}
+	}
+	if d > tick {
+		d = tick
 	}
 
 	return
@@ -283,25 +560,52 @@ func (r *runtime) getServer() proto.NodeID {
 }
 
 func (r *runtime) startService(chain *Chain) {
-	r.muxService.register(chain.databaseID, &ChainRPCService{chain: chain})
+	r.muxService.register(chain.databaseID, newChainRPCService(chain, r.middlewares))
 }
 
 func (r *runtime) stopService(dbID proto.DatabaseID) {
 	r.muxService.unregister(dbID)
 }
 
+// isMyTurn reports whether the local node should produce the block of the next turn.
+//
+// A node which is not in the peer set (including an empty peer set) never produces blocks. A
+// standalone chain, i.e. a peer set with the local node as its only member, produces blocks in
+// every turn. Otherwise, the peers produce blocks in a round-robin manner by their indexes.
 func (r *runtime) isMyTurn() (ret bool) {
 	index, total := r.getIndexTotal()
 	r.stateMutex.Lock()
 	defer r.stateMutex.Unlock()
+	return ownsTurn(index, total, r.nextTurn)
+}
 
-	if r.total <= 0 {
-		ret = false
-	} else {
-		ret = (r.nextTurn%total == index)
+// ownsTurn reports whether the peer at index of total peers produces the block of turn.
+func ownsTurn(index, total, turn int32) bool {
+	switch {
+	case total <= 0 || index < 0 || index >= total:
+		return false
+	case total == 1:
+		return true
+	default:
+		return turn%total == index
 	}
+}
 
-	return
+// hasEnoughPeers reports whether the peer set is large enough to start producing blocks.
+func (r *runtime) hasEnoughPeers() bool {
+	return r.getTotal() >= r.minPeersToProduce
+}
+
+// hasRemotePeers reports whether there is any peer other than the local server.
+func (r *runtime) hasRemotePeers() bool {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	for _, v := range r.peers.Servers {
+		if v != r.server {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *runtime) getPeers() *proto.Peers {
@@ -311,6 +615,24 @@ func (r *runtime) getPeers() *proto.Peers {
 	return &peers
 }
 
+// reportBadBlock records a block served by peer id which fails the verification.
+func (r *runtime) reportBadBlock(id proto.NodeID) {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	r.badBlocks[id]++
+}
+
+// getBadBlockCounts returns a copy of the bad block counts of the peers.
+func (r *runtime) getBadBlockCounts() (counts map[proto.NodeID]int64) {
+	r.peersMutex.Lock()
+	defer r.peersMutex.Unlock()
+	counts = make(map[proto.NodeID]int64, len(r.badBlocks))
+	for k, v := range r.badBlocks {
+		counts[k] = v
+	}
+	return
+}
+
 func (r *runtime) getHead() *state {
 	r.stateMutex.Lock()
 	defer r.stateMutex.Unlock()
@@ -323,6 +645,71 @@ func (r *runtime) setHead(head *state) {
 	r.head = head
 }
 
+// addFork records node as the tip of a side branch, which replaces its parent if the parent is
+// a tip.
+func (r *runtime) addFork(node *blockNode) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	var st = &state{node: node, Head: node.hash, Height: node.height}
+	for i, v := range r.forks {
+		if v.node == node.parent {
+			r.forks[i] = st
+			return
+		}
+	}
+	r.forks = append(r.forks, st)
+}
+
+// switchHead switches the head to the side branch ending at head, and records the previous head
+// as the tip of a side branch.
+func (r *runtime) switchHead(head *state) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	for i, v := range r.forks {
+		if v.node == head.node {
+			r.forks = append(r.forks[:i], r.forks[i+1:]...)
+			break
+		}
+	}
+	r.forks = append(r.forks, r.head)
+	r.head = head
+}
+
+// dropForks removes the side branches whose tip counts are lower than count, and returns their
+// tips.
+func (r *runtime) dropForks(count int32) (dropped []*blockNode) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	var kept = r.forks[:0]
+	for _, v := range r.forks {
+		if v.node.count < count {
+			dropped = append(dropped, v.node)
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	r.forks = kept
+	return
+}
+
+// isForkNode reports whether node is on any side branch.
+func (r *runtime) isForkNode(node *blockNode) bool {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	for _, v := range r.forks {
+		if v.node.ancestorByCount(node.count) == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runtime) getForkCount() int {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return len(r.forks)
+}
+
 func (r *runtime) goFunc(f func(context.Context)) {
 	r.wg.Add(1)
 	go func() {
@@ -17,9 +17,13 @@
 package sqlchain
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
 )
 
 func TestBlockCacheTTL(t *testing.T) {
@@ -55,3 +59,202 @@ func TestBlockCacheTTL(t *testing.T) {
 		}
 	})
 }
+
+func TestMinPeersToProduce(t *testing.T) {
+	Convey("Test minimum peer number to produce", t, func() {
+		var (
+			peers = &proto.Peers{
+				PeersHeader: proto.PeersHeader{
+					Servers: []proto.NodeID{"node0", "node1"},
+				},
+			}
+			cases = []struct {
+				min    int32
+				expect bool
+			}{
+				{min: 0, expect: true},
+				{min: 2, expect: true},
+				{min: 3, expect: false},
+			}
+		)
+		for _, v := range cases {
+			var rt = newRunTime(context.Background(), &Config{
+				Peers:             peers,
+				Server:            "node0",
+				MinPeersToProduce: v.min,
+			})
+			So(rt.hasEnoughPeers(), ShouldEqual, v.expect)
+		}
+	})
+}
+
+func TestIsMyTurn(t *testing.T) {
+	Convey("Test producing turn with different peer sets", t, func() {
+		var newPeers = func(servers ...proto.NodeID) *proto.Peers {
+			return &proto.Peers{PeersHeader: proto.PeersHeader{Servers: servers}}
+		}
+		Convey("The node should never produce with an empty peer set", func() {
+			var rt = newRunTime(context.Background(), &Config{
+				Peers:  newPeers(),
+				Server: "node0",
+			})
+			for i := 0; i < 3; i++ {
+				So(rt.isMyTurn(), ShouldBeFalse)
+				rt.setNextTurn()
+			}
+		})
+		Convey("The node should produce in every turn of a standalone chain", func() {
+			var rt = newRunTime(context.Background(), &Config{
+				Peers:  newPeers("node0"),
+				Server: "node0",
+			})
+			for i := 0; i < 3; i++ {
+				So(rt.isMyTurn(), ShouldBeTrue)
+				rt.setNextTurn()
+			}
+		})
+		Convey("The node should never produce if it is not in the peer set", func() {
+			var rt = newRunTime(context.Background(), &Config{
+				Peers:  newPeers("node1", "node2"),
+				Server: "node0",
+			})
+			for i := 0; i < 3; i++ {
+				So(rt.isMyTurn(), ShouldBeFalse)
+				rt.setNextTurn()
+			}
+		})
+		Convey("The nodes should produce in turn in a multi-member peer set", func() {
+			var (
+				peers = newPeers("node0", "node1", "node2")
+				rts   []*runtime
+			)
+			for _, v := range peers.Servers {
+				rts = append(rts, newRunTime(context.Background(), &Config{
+					Peers:  peers,
+					Server: v,
+				}))
+			}
+			for i := 0; i < 6; i++ {
+				var producers int
+				for j, rt := range rts {
+					if rt.isMyTurn() {
+						producers++
+						So(int32(j), ShouldEqual, rt.getNextTurn()%int32(len(rts)))
+					}
+					rt.setNextTurn()
+				}
+				So(producers, ShouldEqual, 1)
+			}
+		})
+	})
+}
+
+func TestMaxStashedHeights(t *testing.T) {
+	Convey("Test future block stashing limit", t, func() {
+		var (
+			peers = &proto.Peers{PeersHeader: proto.PeersHeader{Servers: []proto.NodeID{"node0"}}}
+			cases = []struct {
+				max    int32
+				height int32
+				expect bool
+			}{
+				{max: 0, height: 1, expect: false},
+				{max: 0, height: defaultMaxStashedHeights, expect: false},
+				{max: 0, height: defaultMaxStashedHeights + 1, expect: true},
+				{max: 1, height: 1, expect: false},
+				{max: 1, height: 2, expect: true},
+				{max: 5, height: 5, expect: false},
+				{max: 5, height: 6, expect: true},
+			}
+		)
+		for _, v := range cases {
+			var rt = newRunTime(context.Background(), &Config{
+				Peers:             peers,
+				Server:            "node0",
+				MaxStashedHeights: v.max,
+			})
+			So(rt.isTooFarAhead(v.height), ShouldEqual, v.expect)
+		}
+	})
+}
+
+func TestTickJitter(t *testing.T) {
+	Convey("Given the runtimes of two peers with tick jitter", t, func() {
+		genesis, err := createTestGenesis(time.Now())
+		So(err, ShouldBeNil)
+		var (
+			peers  = &proto.Peers{PeersHeader: proto.PeersHeader{Servers: []proto.NodeID{"node0", "node1"}}}
+			jitter = 10 * time.Minute
+			newRT  = func(server proto.NodeID, tick, jitter time.Duration) *runtime {
+				return newRunTime(context.Background(), &Config{
+					Genesis:       genesis,
+					Peers:         peers,
+					Server:        server,
+					Period:        time.Hour,
+					Tick:          tick,
+					MaxTickJitter: jitter,
+				})
+			}
+			fireTimes = func(rt *runtime) (min, max time.Time) {
+				for i := 0; i < 50; i++ {
+					var now, d = rt.nextTick()
+					var at = now.Add(d)
+					if i == 0 || at.Before(min) {
+						min = at
+					}
+					if i == 0 || at.After(max) {
+						max = at
+					}
+				}
+				return
+			}
+		)
+		Convey("The jitter should be clamped to half of the period", func() {
+			So(newRT("node0", time.Hour, 2*time.Hour).maxTickJitter, ShouldEqual, 30*time.Minute)
+		})
+		Convey("The turn ownership should be unchanged", func() {
+			var (
+				plain    = []*runtime{newRT("node0", time.Hour, 0), newRT("node1", time.Hour, 0)}
+				jittered = []*runtime{newRT("node0", time.Hour, jitter), newRT("node1", time.Hour, jitter)}
+			)
+			for i := 0; i < 4; i++ {
+				for j := range plain {
+					So(jittered[j].isMyTurn(), ShouldEqual, plain[j].isMyTurn())
+					plain[j].setNextTurn()
+					jittered[j].setNextTurn()
+				}
+			}
+		})
+		Convey("The producer should never fire after its turn", func() {
+			var rt = newRT("node0", time.Hour, jitter)
+			for !rt.isMyTurn() {
+				rt.setNextTurn()
+			}
+			var turn = rt.getTimeFromHeight(rt.getNextTurn())
+			_, max := fireTimes(rt)
+			So(max, ShouldHappenOnOrBefore, turn)
+		})
+		Convey("The other peer should fire the turn spread after its beginning", func() {
+			var rt = newRT("node0", time.Hour, jitter)
+			for rt.isMyTurn() {
+				rt.setNextTurn()
+			}
+			var turn = rt.getTimeFromHeight(rt.getNextTurn())
+			min, max := fireTimes(rt)
+			So(min, ShouldHappenOnOrAfter, turn)
+			So(max, ShouldHappenBefore, turn.Add(jitter))
+			So(max.Sub(min), ShouldBeGreaterThan, jitter/10)
+		})
+		Convey("The intermediate ticks should be spread for every peer", func() {
+			var rt = newRT("node0", time.Minute, jitter)
+			for !rt.isMyTurn() {
+				rt.setNextTurn()
+			}
+			var now = time.Now()
+			min, max := fireTimes(rt)
+			So(min, ShouldHappenOnOrAfter, now.Add(time.Minute))
+			So(max, ShouldHappenBefore, time.Now().Add(time.Minute+jitter))
+			So(max.Sub(min), ShouldBeGreaterThan, jitter/10)
+		})
+	})
+}
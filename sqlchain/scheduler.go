@@ -0,0 +1,132 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"sync"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// queryScheduler limits the number of concurrently running queries, and serves the waiting
+// queries by priority when saturated: high priority queries first, then normal and low ones.
+// Queries of the same priority are served in FIFO order.
+//
+// The scheduler only decides when a query may enter the state engine. Writes are still
+// serialized by the state engine in their arrival order, so the committing order of writes in
+// blocks is not affected by priority.
+type queryScheduler struct {
+	sync.Mutex
+	capacity int
+	running  int
+	waiting  [types.NumberOfQueryPriority][]chan struct{}
+}
+
+// newQueryScheduler returns a new query scheduler with capacity, or nil for an unlimited one.
+func newQueryScheduler(capacity int) *queryScheduler {
+	if capacity <= 0 {
+		return nil
+	}
+	return &queryScheduler{capacity: capacity}
+}
+
+// schedulingOrder is the serving order of waiting queries.
+var schedulingOrder = [...]types.QueryPriority{
+	types.HighPriority, types.NormalPriority, types.LowPriority,
+}
+
+func normalizePriority(p types.QueryPriority) types.QueryPriority {
+	if p < 0 || p >= types.NumberOfQueryPriority {
+		return types.NormalPriority
+	}
+	return p
+}
+
+// acquire blocks until a running slot is acquired for a query of priority p, or ctx is done.
+func (s *queryScheduler) acquire(ctx context.Context, p types.QueryPriority) (err error) {
+	if s == nil {
+		return
+	}
+	p = normalizePriority(p)
+	s.Lock()
+	if s.running < s.capacity {
+		s.running++
+		s.Unlock()
+		return
+	}
+	var ch = make(chan struct{})
+	s.waiting[p] = append(s.waiting[p], ch)
+	s.Unlock()
+
+	select {
+	case <-ch:
+		return
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for i, v := range s.waiting[p] {
+		if v == ch {
+			s.waiting[p] = append(s.waiting[p][:i], s.waiting[p][i+1:]...)
+			return
+		}
+	}
+	// The slot has been handed over before cancelling, pass it on
+	s.handOver()
+	return
+}
+
+// release releases a running slot to the next waiting query.
+func (s *queryScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.handOver()
+}
+
+// handOver hands over a running slot to the next waiting query by priority, or frees it if there
+// is no waiting query. The caller must hold the lock.
+func (s *queryScheduler) handOver() {
+	for _, p := range schedulingOrder {
+		if len(s.waiting[p]) > 0 {
+			var ch = s.waiting[p][0]
+			s.waiting[p] = s.waiting[p][1:]
+			close(ch)
+			return
+		}
+	}
+	s.running--
+}
+
+// depths returns the numbers of waiting queries of each priority.
+func (s *queryScheduler) depths() (depths map[types.QueryPriority]int) {
+	depths = make(map[types.QueryPriority]int)
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, p := range schedulingOrder {
+		depths[p] = len(s.waiting[p])
+	}
+	return
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestQueryScheduler(t *testing.T) {
+	Convey("Given a saturated query scheduler", t, func() {
+		var s = newQueryScheduler(1)
+		So(s.acquire(context.Background(), types.NormalPriority), ShouldBeNil)
+		var (
+			served = make(chan types.QueryPriority, 3)
+			wait   = func(expect map[types.QueryPriority]int) {
+				for i := 0; i < 100; i++ {
+					var depths = s.depths()
+					if depths[types.HighPriority] == expect[types.HighPriority] &&
+						depths[types.NormalPriority] == expect[types.NormalPriority] &&
+						depths[types.LowPriority] == expect[types.LowPriority] {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				So(s.depths(), ShouldResemble, expect)
+			}
+			enqueue = func(p types.QueryPriority) {
+				go func() {
+					if err := s.acquire(context.Background(), p); err == nil {
+						served <- p
+					}
+				}()
+			}
+		)
+		Convey("The waiting queries should be served by priority", func() {
+			enqueue(types.LowPriority)
+			wait(map[types.QueryPriority]int{types.LowPriority: 1})
+			enqueue(types.NormalPriority)
+			wait(map[types.QueryPriority]int{types.LowPriority: 1, types.NormalPriority: 1})
+			enqueue(types.HighPriority)
+			wait(map[types.QueryPriority]int{
+				types.LowPriority: 1, types.NormalPriority: 1, types.HighPriority: 1})
+			for _, p := range []types.QueryPriority{
+				types.HighPriority, types.NormalPriority, types.LowPriority,
+			} {
+				s.release()
+				So(<-served, ShouldEqual, p)
+			}
+			s.release()
+			So(s.running, ShouldEqual, 0)
+		})
+		Convey("A cancelled query should leave the queue", func() {
+			var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			So(s.acquire(ctx, types.HighPriority), ShouldResemble, context.DeadlineExceeded)
+			So(s.depths()[types.HighPriority], ShouldEqual, 0)
+			s.release()
+			So(s.running, ShouldEqual, 0)
+		})
+		Convey("Unknown priority should be treated as normal", func() {
+			enqueue(types.QueryPriority(100))
+			wait(map[types.QueryPriority]int{types.NormalPriority: 1})
+			s.release()
+			So(<-served, ShouldEqual, types.QueryPriority(100))
+		})
+	})
+	Convey("An unlimited query scheduler should never block", t, func() {
+		var s = newQueryScheduler(0)
+		for i := 0; i < 10; i++ {
+			So(s.acquire(context.Background(), types.LowPriority), ShouldBeNil)
+		}
+		s.release()
+		So(s.depths(), ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	ec "github.com/btcsuite/btcd/btcec"
+	"github.com/pkg/errors"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+// SignatureScheme defines the signature algorithm of a signed object.
+type SignatureScheme string
+
+const (
+	// SchemeUnknown indicates an unknown signature scheme.
+	SchemeUnknown SignatureScheme = "unknown"
+	// SchemeSecp256k1 indicates the ECDSA signature scheme over the secp256k1 curve.
+	SchemeSecp256k1 SignatureScheme = "secp256k1"
+)
+
+// DefaultSignatureSchemes is the default accepted signature scheme set.
+var DefaultSignatureSchemes = []SignatureScheme{SchemeSecp256k1}
+
+// schemeOf returns the signature scheme of signatures signed by the signee public key.
+func schemeOf(signee *asymmetric.PublicKey) SignatureScheme {
+	if signee != nil && signee.Curve == ec.S256() {
+		return SchemeSecp256k1
+	}
+	return SchemeUnknown
+}
+
+// schemeSet defines a set of accepted signature schemes.
+type schemeSet map[SignatureScheme]struct{}
+
+func newSchemeSet(schemes []SignatureScheme) (set schemeSet) {
+	if schemes == nil {
+		schemes = DefaultSignatureSchemes
+	}
+	set = make(schemeSet)
+	for _, v := range schemes {
+		set[v] = struct{}{}
+	}
+	return
+}
+
+// check returns an ErrDisallowedSignatureScheme error if the signature scheme of signee is not
+// in the set.
+func (s schemeSet) check(signee *asymmetric.PublicKey) (err error) {
+	var scheme = schemeOf(signee)
+	if _, ok := s[scheme]; !ok {
+		err = errors.Wrapf(ErrDisallowedSignatureScheme, "signature scheme %s", scheme)
+	}
+	return
+}
+
+// checkBlock checks the signature scheme of block and all the signed objects packed in it, i.e.,
+// the failed requests, the requests of the query txs and the acks. The responses of the query txs
+// carry no signatures, and they're attributed by the block signature instead.
+func (s schemeSet) checkBlock(block *types.Block) (err error) {
+	if err = s.check(block.Signee()); err != nil {
+		return
+	}
+	for _, v := range block.FailedReqs {
+		if err = s.check(v.Header.Signee); err != nil {
+			return errors.Wrapf(err, "failed request %s", v.Header.Hash().String())
+		}
+	}
+	for _, v := range block.QueryTxs {
+		if err = s.check(v.Request.Header.Signee); err != nil {
+			return errors.Wrapf(err, "request of response %s", v.Response.Hash().String())
+		}
+	}
+	for _, v := range block.Acks {
+		if err = s.checkAck(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkAck checks the signature scheme of ack.
+func (s schemeSet) checkAck(ack *types.SignedAckHeader) (err error) {
+	if err = s.check(ack.Signee); err != nil {
+		return errors.Wrapf(err, "ack %s", ack.Hash().String())
+	}
+	return
+}
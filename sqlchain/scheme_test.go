@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestSignatureScheme(t *testing.T) {
+	Convey("Given some public keys of different signature schemes", t, func() {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		var p256 = (*asymmetric.PublicKey)(&priv.PublicKey)
+		So(schemeOf(testPubKey), ShouldEqual, SchemeSecp256k1)
+		So(schemeOf(p256), ShouldEqual, SchemeUnknown)
+		So(schemeOf(nil), ShouldEqual, SchemeUnknown)
+		Convey("The default scheme set should only accept the supported schemes", func() {
+			var set = newSchemeSet(nil)
+			So(set.check(testPubKey), ShouldBeNil)
+			So(errors.Cause(set.check(p256)), ShouldEqual, ErrDisallowedSignatureScheme)
+		})
+		Convey("The restricted scheme set should reject the disallowed schemes", func() {
+			var set = newSchemeSet([]SignatureScheme{})
+			So(errors.Cause(set.check(testPubKey)), ShouldEqual, ErrDisallowedSignatureScheme)
+		})
+		Convey("The signed objects packed in a block should be checked as well", func() {
+			cli, err := newRandomNode()
+			So(err, ShouldBeNil)
+			tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+			So(err, ShouldBeNil)
+			block, err := createTestBlock(
+				&hash.Hash{}, cli.NodeID, time.Now(), []*types.QueryAsTx{tx})
+			So(err, ShouldBeNil)
+			var set = newSchemeSet(nil)
+			So(set.checkBlock(block), ShouldBeNil)
+			tx.Request.Header.Signee = p256
+			So(errors.Cause(set.checkBlock(block)), ShouldEqual, ErrDisallowedSignatureScheme)
+		})
+	})
+	Convey("Given a chain which accepts no signature scheme", t, func() {
+		chain, _, err := createTestChain(t.Name(), time.Now())
+		So(err, ShouldBeNil)
+		defer chain.Stop()
+		chain.rt.schemes = newSchemeSet([]SignatureScheme{})
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		resp, err := createRandomQueryResponse(cli, cli)
+		So(err, ShouldBeNil)
+		ack, err := createRandomQueryAckWithResponse(resp, cli)
+		So(err, ShouldBeNil)
+		Convey("The otherwise valid ack should be rejected", func() {
+			err = chain.VerifyAndPushAckedQuery(ack)
+			So(errors.Cause(err), ShouldEqual, ErrDisallowedSignatureScheme)
+		})
+	})
+}
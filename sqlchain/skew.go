@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+// skewEstimator estimates the local clock skew relative to the peers from the timestamps
+// reported in RPC responses.
+//
+// NOTE: the estimation is only a safety net for a slightly skewed clock, and is not a
+// replacement for NTP.
+type skewEstimator struct {
+	sync.Mutex
+	// samples keeps the latest clock skew sample of each peer, i.e., peerTime - localTime.
+	samples map[proto.NodeID]time.Duration
+}
+
+func newSkewEstimator() *skewEstimator {
+	return &skewEstimator{
+		samples: make(map[proto.NodeID]time.Duration),
+	}
+}
+
+// update records a skew sample of peer id from a roundtrip, which is sent and received at the
+// local clock readings and handled at peerTime by the peer.
+func (e *skewEstimator) update(id proto.NodeID, sent, received, peerTime time.Time) {
+	var local = sent.Add(received.Sub(sent) / 2)
+	e.Lock()
+	defer e.Unlock()
+	e.samples[id] = peerTime.Sub(local)
+}
+
+// estimate returns the median of the peer skew samples.
+func (e *skewEstimator) estimate() (skew time.Duration, ok bool) {
+	e.Lock()
+	defer e.Unlock()
+	if len(e.samples) == 0 {
+		return
+	}
+	var samples = make([]time.Duration, 0, len(e.samples))
+	for _, v := range e.samples {
+		samples = append(samples, v)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	if l := len(samples); l%2 == 0 {
+		skew = (samples[l/2-1] + samples[l/2]) / 2
+	} else {
+		skew = samples[l/2]
+	}
+	return skew, true
+}
+
+// reset removes all the skew samples.
+func (e *skewEstimator) reset() {
+	e.Lock()
+	defer e.Unlock()
+	e.samples = make(map[proto.NodeID]time.Duration)
+}
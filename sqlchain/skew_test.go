@@ -0,0 +1,89 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/proto"
+)
+
+func TestSkewEstimator(t *testing.T) {
+	Convey("Given a clock skew estimator", t, func() {
+		var (
+			e    = newSkewEstimator()
+			sent = time.Now()
+			recv = sent.Add(20 * time.Millisecond)
+		)
+		_, ok := e.estimate()
+		So(ok, ShouldBeFalse)
+		Convey("The skew should be estimated as the median of peer samples", func() {
+			e.update("node0", sent, recv, sent.Add(10*time.Millisecond+1*time.Second))
+			e.update("node1", sent, recv, sent.Add(10*time.Millisecond+3*time.Second))
+			e.update("node2", sent, recv, sent.Add(10*time.Millisecond-5*time.Second))
+			skew, ok := e.estimate()
+			So(ok, ShouldBeTrue)
+			So(skew, ShouldEqual, 1*time.Second)
+			e.update("node2", sent, recv, sent.Add(10*time.Millisecond+2*time.Second))
+			skew, ok = e.estimate()
+			So(ok, ShouldBeTrue)
+			So(skew, ShouldEqual, 2*time.Second)
+			e.update("node3", sent, recv, sent.Add(10*time.Millisecond+3*time.Second))
+			skew, ok = e.estimate()
+			So(ok, ShouldBeTrue)
+			So(skew, ShouldEqual, 2500*time.Millisecond)
+			e.reset()
+			_, ok = e.estimate()
+			So(ok, ShouldBeFalse)
+		})
+	})
+	Convey("Given a runtime with bounded clock skew correction", t, func() {
+		var (
+			rt = newRunTime(context.Background(), &Config{
+				Peers:                  &proto.Peers{},
+				Period:                 testPeriod,
+				MaxClockSkewCorrection: 500 * time.Millisecond,
+			})
+			sent = time.Now()
+		)
+		So(rt.skewWarning, ShouldEqual, testPeriod/10)
+		Convey("The correction should be applied within the bound", func() {
+			rt.offset = time.Second
+			rt.reportPeerTime("node0", sent, sent, sent.Add(50*time.Millisecond))
+			So(rt.skewCorrection, ShouldEqual, 50*time.Millisecond)
+			So(rt.skewWarned, ShouldBeFalse)
+			rt.reportPeerTime("node0", sent, sent, sent.Add(-2*time.Second))
+			So(rt.skewCorrection, ShouldEqual, -500*time.Millisecond)
+			So(rt.skewWarned, ShouldBeTrue)
+			rt.reportPeerTime("node0", sent, sent, time.Time{})
+			So(rt.skewCorrection, ShouldEqual, -500*time.Millisecond)
+			So(rt.offset, ShouldEqual, time.Second)
+			So(rt.getOffset(), ShouldEqual, 500*time.Millisecond)
+			rt.reportPeerTime("node0", sent, sent, sent)
+			So(rt.skewWarned, ShouldBeFalse)
+		})
+		Convey("The correction should be disabled by a zero bound", func() {
+			rt.maxSkewCorrection = 0
+			rt.reportPeerTime("node0", sent, sent, sent.Add(2*time.Second))
+			So(rt.skewCorrection, ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlchain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
+	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestStateChecksum(t *testing.T) {
+	Convey("Given a chain setting the state checksum to the produced blocks", t, func() {
+		cli, err := newRandomNode()
+		So(err, ShouldBeNil)
+		chain, _, err := createTestChain(t.Name(), time.Now().Add(-10*testPeriod))
+		So(err, ShouldBeNil)
+		defer func() { So(chain.Stop(), ShouldBeNil) }()
+		chain.rt.stateChecksum = true
+		var (
+			producer = chain.rt.getServer()
+			newBlock = func(pattern string, sum hash.Hash) *types.Block {
+				tx, err := createTestQueryTx(cli, cli, types.WriteQuery, 0)
+				So(err, ShouldBeNil)
+				tx.Request.Payload.Queries = []types.Query{{Pattern: pattern}}
+				So(tx.Request.Sign(cli.PrivateKey), ShouldBeNil)
+				tx.Response.RequestHash = tx.Request.Header.Hash()
+				So(tx.Response.BuildHash(), ShouldBeNil)
+				var head = chain.rt.getHead()
+				block, err := createTestBlock(&head.Head, producer,
+					chain.rt.getTimeFromHeight(head.Height+1), []*types.QueryAsTx{tx})
+				So(err, ShouldBeNil)
+				block.StateChecksum = sum
+				So(block.PackAndSignBlock(testPrivKey), ShouldBeNil)
+				return block
+			}
+		)
+		Convey("The produced block should carry the checksum of the local state", func() {
+			var req = &types.Request{
+				Header: types.SignedRequestHeader{
+					RequestHeader: types.RequestHeader{
+						QueryType:  types.WriteQuery,
+						NodeID:     cli.NodeID,
+						DatabaseID: testDatabaseID,
+						Timestamp:  time.Now().UTC(),
+					},
+				},
+				Payload: types.RequestPayload{Queries: []types.Query{
+					{Pattern: `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`},
+				}},
+			}
+			So(req.Sign(cli.PrivateKey), ShouldBeNil)
+			tracker, resp, err := chain.Query(req, true)
+			So(err, ShouldBeNil)
+			tracker.UpdateResp(resp)
+			var errCh = make(chan error, 1)
+			go func() {
+				errCh <- chain.produceBlock(chain.rt.getTimeFromHeight(chain.rt.getHead().Height + 1))
+			}()
+			var block = <-chain.blocks
+			So(<-errCh, ShouldBeNil)
+			So(block.Verify(), ShouldBeNil)
+			sum, err := chain.st.Checksum(chain.rt.ctx)
+			So(err, ShouldBeNil)
+			So(block.StateChecksum, ShouldResemble, sum)
+			So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+			chain.endProduced(block)
+		})
+		Convey("The block replayed from a peer should be verified by its checksum", func() {
+			// Take the blocks as produced by a peer, so that they're replayed
+			chain.rt.peersMutex.Lock()
+			chain.rt.server = proto.NodeID("0000000000000000000000000000000000000000000000000000000000000001")
+			chain.rt.peersMutex.Unlock()
+			// Compute the expected checksum with another chain
+			other, _, err := createTestChain(t.Name()+"-other", time.Now().Add(-10*testPeriod))
+			So(err, ShouldBeNil)
+			defer func() { So(other.Stop(), ShouldBeNil) }()
+			const pattern = `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`
+			var probe = newBlock(pattern, hash.Hash{})
+			So(replayBlock(other.rt.ctx, other.st, probe), ShouldBeNil)
+			expected, err := other.st.Checksum(other.rt.ctx)
+			So(err, ShouldBeNil)
+			Convey("The block matching the local state should be pushed", func() {
+				var block = newBlock(pattern, expected)
+				So(chain.CheckAndPushNewBlock(block), ShouldBeNil)
+				So(chain.rt.getHead().Head, ShouldResemble, *block.BlockHash())
+			})
+			Convey("The block diverging from the local state should be rejected", func() {
+				var (
+					head  = chain.rt.getHead()
+					block = newBlock(pattern, hash.HashH([]byte("diverged state")))
+				)
+				err = chain.CheckAndPushNewBlock(block)
+				So(errors.Cause(err), ShouldEqual, ErrStateDivergence)
+				So(chain.rt.getHead().Head, ShouldResemble, head.Head)
+			})
+			Convey("The state rebuilt for a branch should be verified by the checksums", func() {
+				chain.rt.confirmationDepth = 5
+				var block = newBlock(pattern, hash.HashH([]byte("diverged state")))
+				So(chain.pushBlock(block), ShouldBeNil)
+				_, _, err = chain.rebuildState(chain.rt.getHead().node)
+				So(errors.Cause(err), ShouldEqual, ErrStateDivergence)
+			})
+		})
+	})
+}
@@ -17,6 +17,8 @@
 package sqlchain
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -25,12 +27,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto"
 	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/kms"
 	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
 	"github.com/CovenantSQL/CovenantSQL/pow/cpuminer"
 	"github.com/CovenantSQL/CovenantSQL/proto"
+	"github.com/CovenantSQL/CovenantSQL/route"
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
 )
@@ -369,3 +373,156 @@ func TestMain(m *testing.M) {
 		return m.Run()
 	}())
 }
+
+func createTestGenesis(begin time.Time) (b *types.Block, err error) {
+	var emptyNode = &proto.RawNodeID{}
+	b = &types.Block{
+		SignedHeader: types.SignedHeader{
+			Header: types.Header{
+				Version:   0x01000000,
+				Producer:  emptyNode.ToNodeID(),
+				Timestamp: begin,
+			},
+		},
+	}
+	err = b.PackAsGenesis()
+	return
+}
+
+func createTestQueryTx(cli, worker *nodeProfile, qt types.QueryType, offset uint64) (
+	tx *types.QueryAsTx, err error,
+) {
+	var req = &types.Request{
+		Header: types.SignedRequestHeader{
+			RequestHeader: types.RequestHeader{
+				QueryType:    qt,
+				NodeID:       cli.NodeID,
+				DatabaseID:   testDatabaseID,
+				ConnectionID: uint64(rand.Int63()),
+				SeqNo:        uint64(rand.Int63()),
+				Timestamp:    time.Now().UTC(),
+			},
+		},
+		Payload: types.RequestPayload{
+			Queries: createRandomStorageQueries(1, 3, 10, 10),
+		},
+	}
+	if err = req.Sign(cli.PrivateKey); err != nil {
+		return
+	}
+	var resp = &types.SignedResponseHeader{
+		ResponseHeader: types.ResponseHeader{
+			Request:     req.Header.RequestHeader,
+			RequestHash: req.Header.Hash(),
+			NodeID:      worker.NodeID,
+			Timestamp:   createRandomTimeAfter(req.Header.Timestamp, 100),
+			LogOffset:   offset,
+		},
+	}
+	if resp.ResponseAccount, err = crypto.PubKeyHash(worker.PublicKey); err != nil {
+		return
+	}
+	if qt == types.ReadQuery {
+		resp.RowCount = uint64(rand.Intn(10) + 1)
+	} else {
+		resp.AffectedRows = int64(rand.Intn(10) + 1)
+	}
+	if err = resp.BuildHash(); err != nil {
+		return
+	}
+	tx = &types.QueryAsTx{
+		Request:  req,
+		Response: resp,
+	}
+	return
+}
+
+func createTestBlock(
+	parent *hash.Hash, producer proto.NodeID, ts time.Time, txs []*types.QueryAsTx,
+) (
+	b *types.Block, err error,
+) {
+	b = &types.Block{
+		SignedHeader: types.SignedHeader{
+			Header: types.Header{
+				Version:    0x01000000,
+				Producer:   producer,
+				ParentHash: *parent,
+				Timestamp:  ts,
+			},
+		},
+		QueryTxs: txs,
+	}
+	err = b.PackAndSignBlock(testPrivKey)
+	return
+}
+
+// createTestChain creates a single node sql-chain whose genesis block is produced at begin.
+func createTestChain(name string, begin time.Time) (chain *Chain, config *Config, err error) {
+	var (
+		genesis *types.Block
+		peers   *proto.Peers
+		dbfile  = path.Join(testDataDir, fmt.Sprintf("%s-%d", name, rand.Int63()))
+	)
+	if genesis, err = createTestGenesis(begin); err != nil {
+		return
+	}
+	if _, peers, err = createTestPeers(1); err != nil {
+		return
+	}
+	config = &Config{
+		DatabaseID:      testDatabaseID,
+		ChainFilePrefix: dbfile,
+		DataFile:        dbfile,
+		Genesis:         genesis,
+		Period:          testPeriod,
+		Tick:            testTick,
+		MuxService:      &MuxService{ServiceName: route.SQLChainRPCName},
+		Server:          peers.Servers[0],
+		Peers:           peers,
+		QueryTTL:        testQueryTTL,
+		UpdatePeriod:    testUpdatePeriod,
+	}
+	chain, err = NewChain(config)
+	return
+}
+
+// pushTestBlocks pushes n blocks with the given query transactions to the chain, one block per
+// period after the current head.
+func pushTestBlocks(chain *Chain, n int, txsFn func(i int) []*types.QueryAsTx) (err error) {
+	for i := 0; i < n; i++ {
+		var (
+			head = chain.rt.getHead()
+			ts   = chain.rt.getTimeFromHeight(head.Height + 1)
+			txs  []*types.QueryAsTx
+			b    *types.Block
+		)
+		if txsFn != nil {
+			txs = txsFn(i)
+		}
+		if b, err = createTestBlock(&head.Head, chain.rt.getServer(), ts, txs); err != nil {
+			return
+		}
+		if err = chain.pushBlock(b); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// mockCaller implements Caller with a customized call function.
+type mockCaller struct {
+	call func(
+		ctx context.Context, node proto.NodeID, method string, args, reply interface{}) error
+}
+
+func (c *mockCaller) CallNode(
+	node proto.NodeID, method string, args interface{}, reply interface{}) error {
+	return c.CallNodeWithContext(context.Background(), node, method, args, reply)
+}
+
+func (c *mockCaller) CallNodeWithContext(
+	ctx context.Context, node proto.NodeID, method string, args interface{}, reply interface{},
+) error {
+	return c.call(ctx, node, method, args, reply)
+}
@@ -79,6 +79,12 @@ type Block struct {
 	FailedReqs   []*Request
 	QueryTxs     []*QueryAsTx
 	Acks         []*SignedAckHeader
+	// ProducerVersion is the optional software version tag of the block producer. It's covered
+	// by the merkle root if set, so that the blocks without version tags keep their hashes.
+	ProducerVersion string
+	// StateChecksum is the optional checksum of the producer state after the block is applied.
+	// It's covered by the merkle root if set, as ProducerVersion is.
+	StateChecksum hash.Hash
 }
 
 // CalcNextID calculates the next query id by examinating every query in block, and adds write
@@ -185,6 +191,14 @@ func (b *Block) computeMerkleRoot() hash.Hash {
 		h := b.Acks[i].Hash()
 		hs = append(hs, &h)
 	}
+	if b.ProducerVersion != "" {
+		h := hash.THashH([]byte(b.ProducerVersion))
+		hs = append(hs, &h)
+	}
+	if !b.StateChecksum.IsEqual(&hash.Hash{}) {
+		h := b.StateChecksum
+		hs = append(hs, &h)
+	}
 	return *merkle.NewMerkle(hs).GetRoot()
 }
 
@@ -10,8 +10,8 @@ import (
 func (z *Block) MarshalHash() (o []byte, err error) {
 	var b []byte
 	o = hsp.Require(b, z.Msgsize())
-	// map header, size 4
-	o = append(o, 0x84)
+	// map header, size 6
+	o = append(o, 0x86)
 	o = hsp.AppendArrayHeader(o, uint32(len(z.Acks)))
 	for za0003 := range z.Acks {
 		if z.Acks[za0003] == nil {
@@ -36,6 +36,7 @@ func (z *Block) MarshalHash() (o []byte, err error) {
 			}
 		}
 	}
+	o = hsp.AppendString(o, z.ProducerVersion)
 	o = hsp.AppendArrayHeader(o, uint32(len(z.QueryTxs)))
 	for za0002 := range z.QueryTxs {
 		if z.QueryTxs[za0002] == nil {
@@ -60,6 +61,11 @@ func (z *Block) MarshalHash() (o []byte, err error) {
 	} else {
 		o = hsp.AppendBytes(o, oTemp)
 	}
+	if oTemp, err := z.StateChecksum.MarshalHash(); err != nil {
+		return nil, err
+	} else {
+		o = hsp.AppendBytes(o, oTemp)
+	}
 	return
 }
 
@@ -81,7 +87,7 @@ func (z *Block) Msgsize() (s int) {
 			s += z.FailedReqs[za0001].Msgsize()
 		}
 	}
-	s += 9 + hsp.ArrayHeaderSize
+	s += 16 + hsp.StringPrefixSize + len(z.ProducerVersion) + 9 + hsp.ArrayHeaderSize
 	for za0002 := range z.QueryTxs {
 		if z.QueryTxs[za0002] == nil {
 			s += hsp.NilSize
@@ -89,7 +95,7 @@ func (z *Block) Msgsize() (s int) {
 			s += z.QueryTxs[za0002].Msgsize()
 		}
 	}
-	s += 13 + 1 + 7 + z.SignedHeader.Header.Msgsize() + 4 + z.SignedHeader.HSV.Msgsize()
+	s += 13 + 1 + 7 + z.SignedHeader.Header.Msgsize() + 4 + z.SignedHeader.HSV.Msgsize() + 14 + z.StateChecksum.Msgsize()
 	return
 }
 
@@ -25,6 +25,7 @@ import (
 	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/asymmetric"
 	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/crypto/verifier"
 	"github.com/CovenantSQL/CovenantSQL/utils"
@@ -58,6 +59,88 @@ func TestSignAndVerify(t *testing.T) {
 	}
 }
 
+func TestProducerVersion(t *testing.T) {
+	block, err := CreateRandomBlock(genesisHash, false)
+
+	if err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	root := block.SignedHeader.MerkleRoot
+	priv, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	block.ProducerVersion = "v0.1.0"
+
+	if err = block.PackAndSignBlock(priv); err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	if root.IsEqual(&block.SignedHeader.MerkleRoot) {
+		t.Fatal("producer version should be covered by merkle root")
+	}
+
+	if err = block.Verify(); err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	block.ProducerVersion = "v0.1.1"
+
+	if err = block.Verify(); err != ErrMerkleRootVerification {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	block.ProducerVersion = ""
+
+	if merkleRoot := block.computeMerkleRoot(); !merkleRoot.IsEqual(&root) {
+		t.Fatal("merkle root should not change without producer version")
+	}
+}
+
+func TestStateChecksum(t *testing.T) {
+	block, err := CreateRandomBlock(genesisHash, false)
+
+	if err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	root := block.SignedHeader.MerkleRoot
+	priv, _, err := asymmetric.GenSecp256k1KeyPair()
+
+	if err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	block.StateChecksum = hash.HashH([]byte("state"))
+
+	if err = block.PackAndSignBlock(priv); err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	if root.IsEqual(&block.SignedHeader.MerkleRoot) {
+		t.Fatal("state checksum should be covered by merkle root")
+	}
+
+	if err = block.Verify(); err != nil {
+		t.Fatalf("error occurred: %v", err)
+	}
+
+	block.StateChecksum = hash.HashH([]byte("diverged state"))
+
+	if err = block.Verify(); err != ErrMerkleRootVerification {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	block.StateChecksum = hash.Hash{}
+
+	if merkleRoot := block.computeMerkleRoot(); !merkleRoot.IsEqual(&root) {
+		t.Fatal("merkle root should not change without state checksum")
+	}
+}
+
 func TestHeaderMarshalUnmarshaler(t *testing.T) {
 	block, err := CreateRandomBlock(genesisHash, false)
 
@@ -40,6 +40,20 @@ const (
 	NumberOfQueryType
 )
 
+// QueryPriority enumerates available query scheduling priority.
+type QueryPriority int32
+
+const (
+	// NormalPriority defines the default query priority.
+	NormalPriority QueryPriority = iota
+	// HighPriority defines a query priority served before the others, e.g., interactive reads.
+	HighPriority
+	// LowPriority defines a query priority served after the others, e.g., batch writes.
+	LowPriority
+	// NumberOfQueryPriority defines the number of query priority.
+	NumberOfQueryPriority
+)
+
 // NamedArg defines the named argument structure for database.
 type NamedArg struct {
 	Name  string
@@ -116,6 +130,20 @@ func (t QueryType) String() string {
 	}
 }
 
+// String implements fmt.Stringer for logging purpose.
+func (p QueryPriority) String() string {
+	switch p {
+	case NormalPriority:
+		return "normal"
+	case HighPriority:
+		return "high"
+	case LowPriority:
+		return "low"
+	default:
+		return "unknown"
+	}
+}
+
 // Verify checks hash and signature in request header.
 func (sh *SignedRequestHeader) Verify() (err error) {
 	return sh.DefaultHashSignVerifierImpl.Verify(&sh.RequestHeader)
@@ -78,6 +78,20 @@ func (z *QueryKey) Msgsize() (s int) {
 	return
 }
 
+// MarshalHash marshals for hash
+func (z QueryPriority) MarshalHash() (o []byte, err error) {
+	var b []byte
+	o = hsp.Require(b, z.Msgsize())
+	o = hsp.AppendInt32(o, int32(z))
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z QueryPriority) Msgsize() (s int) {
+	s = hsp.Int32Size
+	return
+}
+
 // MarshalHash marshals for hash
 func (z QueryType) MarshalHash() (o []byte, err error) {
 	var b []byte
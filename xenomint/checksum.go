@@ -0,0 +1,166 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	chash "github.com/CovenantSQL/CovenantSQL/crypto/hash"
+)
+
+// Checksum computes a deterministic checksum of the state, which covers the schema and the rows
+// of all the user tables, including the current uncommitted writes. The states applying the same
+// writes always have the same checksum regardless of their sequences and storage layouts.
+//
+// The whole storage is read, so it's expensive for a large state.
+func (s *State) Checksum(ctx context.Context) (sum chash.Hash, err error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.checksum(ctx)
+}
+
+func (s *State) checksum(ctx context.Context) (sum chash.Hash, err error) {
+	var (
+		rows   *sql.Rows
+		tables []*schemaObject
+		d      = sha256.New()
+	)
+	if rows, err = s.executer.QueryContext(ctx, `SELECT "type", "name", "sql" `+
+		`FROM "sqlite_master" WHERE "sql" IS NOT NULL AND "name" NOT LIKE 'sqlite_%' `+
+		`AND "name"<>'`+appliedSeqTable+`' ORDER BY "type", "name"`); err != nil {
+		err = errors.Wrap(err, "list schema objects")
+		return
+	}
+	for rows.Next() {
+		var obj = &schemaObject{}
+		if err = rows.Scan(&obj.typ, &obj.name, &obj.sql); err != nil {
+			rows.Close()
+			err = errors.Wrap(err, "scan schema object")
+			return
+		}
+		writeChecksumValue(d, obj.typ)
+		writeChecksumValue(d, obj.name)
+		writeChecksumValue(d, obj.sql)
+		if obj.typ == "table" {
+			tables = append(tables, obj)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, v := range tables {
+		if err = s.checksumTable(ctx, d, v.name); err != nil {
+			err = errors.Wrapf(err, "checksum table %s", v.name)
+			return
+		}
+	}
+	copy(sum[:], d.Sum(nil))
+	return
+}
+
+// checksumTable writes the rows of table name to d in the order of all the columns.
+func (s *State) checksumTable(ctx context.Context, d hash.Hash, name string) (err error) {
+	var (
+		rows *sql.Rows
+		cols []string
+	)
+	if rows, err = s.executer.QueryContext(
+		ctx, `SELECT * FROM `+quoteIdentifier(name)+` LIMIT 0`); err != nil {
+		return
+	}
+	cols, err = rows.Columns()
+	rows.Close()
+	if err != nil {
+		return
+	}
+	var order = make([]string, len(cols))
+	for i := range cols {
+		order[i] = fmt.Sprint(i + 1)
+	}
+	if rows, err = s.executer.QueryContext(ctx, `SELECT * FROM `+quoteIdentifier(name)+
+		` ORDER BY `+strings.Join(order, ",")); err != nil {
+		return
+	}
+	defer rows.Close()
+	var (
+		vals = make([]interface{}, len(cols))
+		ptrs = make([]interface{}, len(cols))
+	)
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		for _, v := range vals {
+			writeChecksumValue(d, v)
+		}
+	}
+	return rows.Err()
+}
+
+// writeChecksumValue writes v to d with its type tag, so that the values of different types
+// never collide.
+func writeChecksumValue(d hash.Hash, v interface{}) {
+	var buf [9]byte
+	switch v := v.(type) {
+	case nil:
+		d.Write([]byte{0})
+	case int64:
+		buf[0] = 1
+		binary.BigEndian.PutUint64(buf[1:], uint64(v))
+		d.Write(buf[:])
+	case float64:
+		buf[0] = 2
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+		d.Write(buf[:])
+	case []byte:
+		buf[0] = 3
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(v)))
+		d.Write(buf[:])
+		d.Write(v)
+	case string:
+		buf[0] = 4
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(v)))
+		d.Write(buf[:])
+		d.Write([]byte(v))
+	case bool:
+		if v {
+			d.Write([]byte{5, 1})
+		} else {
+			d.Write([]byte{5, 0})
+		}
+	case time.Time:
+		buf[0] = 6
+		binary.BigEndian.PutUint64(buf[1:], uint64(v.UnixNano()))
+		d.Write(buf[:])
+	default:
+		writeChecksumValue(d, fmt.Sprint(v))
+	}
+}
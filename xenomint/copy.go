@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 The CovenantSQL Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xenomint
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	xi "github.com/CovenantSQL/CovenantSQL/xenomint/interfaces"
+)
+
+// schemaObject is a schema object of the sqlite master table.
+type schemaObject struct {
+	typ, name, sql string
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// listSchemaObjects returns the schema objects of strg, in which the tables are listed before
+// the others, e.g., the indexes and triggers, which depend on them.
+func listSchemaObjects(ctx context.Context, strg xi.Storage) (objs []*schemaObject, err error) {
+	var rows *sql.Rows
+	if rows, err = strg.Writer().QueryContext(ctx, `SELECT "type", "name", "sql" `+
+		`FROM "sqlite_master" WHERE "sql" IS NOT NULL AND "name" NOT LIKE 'sqlite_%' `+
+		`ORDER BY CASE "type" WHEN 'table' THEN 0 ELSE 1 END`); err != nil {
+		err = errors.Wrap(err, "list schema objects")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var obj = &schemaObject{}
+		if err = rows.Scan(&obj.typ, &obj.name, &obj.sql); err != nil {
+			err = errors.Wrap(err, "scan schema object")
+			return
+		}
+		objs = append(objs, obj)
+	}
+	err = rows.Err()
+	return
+}
+
+// copyStorage copies the schema and data of src to the empty storage dst in a transaction.
+func copyStorage(ctx context.Context, dst, src xi.Storage) (err error) {
+	var objs []*schemaObject
+	if objs, err = listSchemaObjects(ctx, src); err != nil {
+		return
+	}
+	var tx *sql.Tx
+	if tx, err = dst.Writer().BeginTx(ctx, nil); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, v := range objs {
+		if _, err = tx.ExecContext(ctx, v.sql); err != nil {
+			err = errors.Wrapf(err, "create %s %s", v.typ, v.name)
+			return
+		}
+		if v.typ == "table" {
+			if err = copyTable(ctx, tx, src, v.name); err != nil {
+				err = errors.Wrapf(err, "copy table %s", v.name)
+				return
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// copyTable copies the rows of table name from src with tx.
+func copyTable(ctx context.Context, tx *sql.Tx, src xi.Storage, name string) (err error) {
+	var rows *sql.Rows
+	if rows, err = src.Writer().QueryContext(
+		ctx, `SELECT * FROM `+quoteIdentifier(name)); err != nil {
+		return
+	}
+	defer rows.Close()
+	var cols []string
+	if cols, err = rows.Columns(); err != nil {
+		return
+	}
+	var (
+		stmt *sql.Stmt
+		vals = make([]interface{}, len(cols))
+		ptrs = make([]interface{}, len(cols))
+	)
+	if stmt, err = tx.PrepareContext(ctx, `INSERT INTO `+quoteIdentifier(name)+` VALUES (`+
+		strings.TrimSuffix(strings.Repeat("?,", len(cols)), ",")+`)`); err != nil {
+		return
+	}
+	defer stmt.Close()
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		if _, err = stmt.ExecContext(ctx, vals...); err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+// readAppliedSeq reads the applied seq recorded in strg, ok is false if it's not recorded.
+func readAppliedSeq(ctx context.Context, strg xi.Storage) (seq uint64, ok bool, err error) {
+	var v int64
+	if err = strg.Writer().QueryRowContext(ctx, `SELECT "v" FROM "`+appliedSeqTable+
+		`" WHERE "k"=?`, appliedSeqKey).Scan(&v); err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			err = nil
+		}
+		return
+	}
+	return uint64(v), true, nil
+}
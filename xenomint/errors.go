@@ -33,4 +33,7 @@ var (
 	ErrStatefulQueryParts = errors.New("query contains stateful query parts")
 	// ErrInvalidTableName indicates query contains invalid table name in ddl statement.
 	ErrInvalidTableName = errors.New("invalid table name in ddl")
+	// ErrStorageNotCaughtUp indicates that the storage to swap in is neither empty nor caught up
+	// with the current one.
+	ErrStorageNotCaughtUp = errors.New("storage not caught up")
 )
@@ -29,6 +29,8 @@ type QueryTracker struct {
 	sync.RWMutex
 	Req  *types.Request
 	Resp *types.Response
+	// done is closed once Resp is set, it's created on demand.
+	done chan struct{}
 }
 
 // UpdateResp updates response of the QueryTracker within locking scope.
@@ -36,6 +38,31 @@ func (q *QueryTracker) UpdateResp(resp *types.Response) {
 	q.Lock()
 	defer q.Unlock()
 	q.Resp = resp
+	q.notify()
+}
+
+// Done returns a channel which is closed once the query is ready, see Ready. The query is
+// never considered as unready again.
+func (q *QueryTracker) Done() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+	if q.done == nil {
+		q.done = make(chan struct{})
+	}
+	q.notify()
+	return q.done
+}
+
+// notify closes the done channel if the query is ready, it must be called with the lock held.
+func (q *QueryTracker) notify() {
+	if q.Resp == nil || q.done == nil {
+		return
+	}
+	select {
+	case <-q.done:
+	default:
+		close(q.done)
+	}
 }
 
 // Ready reports whether the query is ready for block producing. It is assumed that all objects
@@ -73,6 +100,24 @@ func (p *pool) enqueue(sp uint64, q *QueryTracker) {
 	return
 }
 
+// prepend puts the ready queries qs before the pooled ones.
+func (p *pool) prepend(qs []*QueryTracker) {
+	if len(qs) == 0 {
+		return
+	}
+	var ni = make(map[uint64]int, len(p.index)+len(qs))
+	for k, v := range p.index {
+		ni[k] = v + len(qs)
+	}
+	for i, q := range qs {
+		ni[q.Resp.Header.LogOffset] = i
+	}
+	p.queries = append(append(make([]*QueryTracker, 0, len(qs)+len(p.queries)), qs...),
+		p.queries...)
+	p.index = ni
+	atomic.StoreInt32(&p.trackerCount, int32(len(p.queries)))
+}
+
 func (p *pool) setFailed(req *types.Request) {
 	p.failed[req.Header.Hash()] = req
 	atomic.StoreInt32(&p.failedRequestCount, int32(len(p.failed)))
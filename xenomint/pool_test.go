@@ -15,3 +15,82 @@
  */
 
 package xenomint
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/CovenantSQL/CovenantSQL/types"
+)
+
+func TestQueryTrackerDone(t *testing.T) {
+	Convey("Given an unready query tracker", t, func() {
+		var q = &QueryTracker{}
+		So(q.Ready(), ShouldBeFalse)
+		var done = q.Done()
+		select {
+		case <-done:
+			So("done channel is closed before the response is set", ShouldBeEmpty)
+		default:
+		}
+		Convey("The done channel should be closed once the response is set", func() {
+			q.UpdateResp(&types.Response{})
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				So("done channel is not closed", ShouldBeEmpty)
+			}
+			So(q.Ready(), ShouldBeTrue)
+			q.UpdateResp(&types.Response{})
+			<-q.Done()
+		})
+	})
+	Convey("Given a ready query tracker", t, func() {
+		var q = &QueryTracker{Resp: &types.Response{}}
+		Convey("The done channel should be closed", func() {
+			select {
+			case <-q.Done():
+			default:
+				So("done channel is not closed", ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+// benchmarkTrackerWait benchmarks waiting for a set of trackers, which become ready one by one
+// shortly after the wait starts, as the pending queries do at the beginning of block producing.
+func benchmarkTrackerWait(b *testing.B, wait func(q *QueryTracker)) {
+	const trackers = 100
+	for i := 0; i < b.N; i++ {
+		var qs = make([]*QueryTracker, trackers)
+		for j := range qs {
+			qs[j] = &QueryTracker{}
+		}
+		go func() {
+			for _, q := range qs {
+				time.Sleep(10 * time.Microsecond)
+				q.UpdateResp(&types.Response{})
+			}
+		}()
+		for _, q := range qs {
+			wait(q)
+		}
+	}
+}
+
+func BenchmarkTrackerWait(b *testing.B) {
+	b.Run("Poll", func(b *testing.B) {
+		benchmarkTrackerWait(b, func(q *QueryTracker) {
+			for !q.Ready() {
+				time.Sleep(time.Millisecond)
+			}
+		})
+	})
+	b.Run("Done", func(b *testing.B) {
+		benchmarkTrackerWait(b, func(q *QueryTracker) {
+			<-q.Done()
+		})
+	})
+}
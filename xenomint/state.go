@@ -25,6 +25,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/CovenantSQL/CovenantSQL/crypto/hash"
 	"github.com/CovenantSQL/CovenantSQL/proto"
 	"github.com/CovenantSQL/CovenantSQL/types"
 	"github.com/CovenantSQL/CovenantSQL/utils/log"
@@ -71,8 +72,15 @@ type State struct {
 	lastCommitPoint uint64
 	current         uint64 // current is the current lastSeq of the current transaction
 	hasSchemaChange uint32 // indicates schema change happens in this uncommitted transaction
+	trackApplied    bool   // indicates the applied seq is recorded at commit points
 }
 
+const (
+	// appliedSeqTable is the metadata table recording the applied seq of the state.
+	appliedSeqTable = "__cql_state"
+	appliedSeqKey   = "applied_seq"
+)
+
 // NewState returns a new State bound to strg.
 func NewState(level sql.IsolationLevel, nodeID proto.NodeID, strg xi.Storage) (s *State) {
 	s = &State{
@@ -121,6 +129,41 @@ func (s *State) getLastCommitPoint() uint64 {
 	return atomic.LoadUint64(&s.lastCommitPoint)
 }
 
+// TrackAppliedSeq enables recording the applied seq of the state in the underlying storage at
+// each commit point, and returns the last recorded one if exists. The record is written in the
+// same transaction as the committed writes if the state runs with sql.LevelReadUncommitted, so
+// that it always matches the persisted writes after a crash. Otherwise it's written right after
+// the autocommitted writes.
+func (s *State) TrackAppliedSeq() (seq uint64, ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, err = s.executer.Exec(`CREATE TABLE IF NOT EXISTS "` + appliedSeqTable +
+		`" ("k" TEXT PRIMARY KEY, "v" INTEGER)`); err != nil {
+		err = errors.Wrap(err, "create applied seq table")
+		return
+	}
+	var rows *sql.Rows
+	if rows, err = s.executer.Query(`SELECT "v" FROM "`+appliedSeqTable+`" WHERE "k"=?`,
+		appliedSeqKey); err != nil {
+		err = errors.Wrap(err, "query applied seq")
+		return
+	}
+	defer rows.Close()
+	if ok = rows.Next(); ok {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			err = errors.Wrap(err, "scan applied seq")
+			return
+		}
+		seq = uint64(v)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	s.trackApplied = true
+	return
+}
+
 // Close commits any ongoing transaction if needed and closes the underlying storage.
 func (s *State) Close(commit bool) (err error) {
 	s.Lock()
@@ -142,6 +185,86 @@ func (s *State) Close(commit bool) (err error) {
 	return
 }
 
+// SwapStorage replaces the underlying storage of the state with strg, and returns the replaced
+// one to be closed by the caller. The ongoing transaction is committed before the swap, and then
+// the data is copied to strg if it's empty. Otherwise strg must be caught up with the current
+// storage, i.e., it records the same applied seq, see TrackAppliedSeq. The pooled queries are
+// kept, and the state is locked during the swap, so that no write or block replaying is
+// interleaved.
+func (s *State) SwapStorage(ctx context.Context, strg xi.Storage) (old xi.Storage, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		err = errors.New("state is closed")
+		return
+	}
+	s.commitSQLExecuter()
+	defer s.openSQLExecuter()
+
+	var objs []*schemaObject
+	if objs, err = listSchemaObjects(ctx, strg); err != nil {
+		return
+	}
+	if len(objs) == 0 {
+		if err = copyStorage(ctx, strg, s.strg); err != nil {
+			err = errors.Wrap(err, "copy storage")
+			return
+		}
+	} else {
+		var (
+			seq uint64
+			ok  bool
+		)
+		if seq, ok, err = readAppliedSeq(ctx, strg); err != nil {
+			return
+		}
+		if !s.trackApplied || !ok || seq != s.getSeq() {
+			err = errors.Wrapf(ErrStorageNotCaughtUp, "applied seq %d, current seq %d", seq,
+				s.getSeq())
+			return
+		}
+	}
+	old, s.strg = s.strg, strg
+	return
+}
+
+// ReplaceStorage replaces the underlying storage of the state with the one returned by replace,
+// which may diverge from the current one, e.g., rebuilt from another branch of a chain. The state
+// is then reset to seq with the pooled queries dropped, and the previous seq is returned. The
+// replace function is called with the current storage while the state is locked, so that no
+// write or block replaying is interleaved. It takes over the current storage, and must return
+// the storage to keep using if it fails, e.g., the reopened current one, in which case the state
+// is left unchanged. The state is closed if no storage is returned.
+func (s *State) ReplaceStorage(
+	replace func(old xi.Storage) (xi.Storage, error), seq uint64) (prev uint64, err error,
+) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		err = errors.New("state is closed")
+		return
+	}
+	s.commitSQLExecuter()
+
+	var strg xi.Storage
+	if strg, err = replace(s.strg); strg == nil {
+		s.closed = true
+		if err == nil {
+			err = errors.New("no storage replaced")
+		}
+		return
+	}
+	s.strg = strg
+	if err == nil {
+		prev = s.getSeq()
+		s.pool = newPool()
+		s.SetSeq(seq)
+		atomic.StoreUint64(&s.lastCommitPoint, seq)
+	}
+	s.openSQLExecuter()
+	return
+}
+
 func buildTypeNamesFromSQLColumnTypes(types []*sql.ColumnType) (names []string) {
 	names = make([]string, len(types))
 	for i, v := range types {
@@ -192,6 +315,10 @@ func readSingle(
 		}
 		data = append(data, row)
 	}
+	// The iteration stops silently if the query is interrupted by ctx, and the data is incomplete
+	if rows.Err() != nil {
+		err = ctx.Err()
+	}
 	return
 }
 
@@ -395,6 +522,10 @@ func (s *State) write(
 			s.Unlock()
 			lockReleased = time.Since(start)
 		}()
+		// Refuse the expired query before touching the ongoing transaction
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		lastSeq = s.getSeq()
 		if qcnt > 1 && s.level == sql.LevelReadUncommitted {
 			// Set savepoint
@@ -596,6 +727,22 @@ func (s *State) CommitEx() (failed []*types.Request, queries []*QueryTracker, er
 // with context.
 func (s *State) CommitExWithContext(
 	ctx context.Context) (failed []*types.Request, queries []*QueryTracker, err error,
+) {
+	failed, queries, _, err = s.commitEx(ctx, false)
+	return
+}
+
+// CommitExWithChecksum commits the current transaction and returns all the pooled queries with
+// the checksum of the committed state, see Checksum. No write is applied between the commit and
+// the checksum.
+func (s *State) CommitExWithChecksum(ctx context.Context) (
+	failed []*types.Request, queries []*QueryTracker, sum hash.Hash, err error,
+) {
+	return s.commitEx(ctx, true)
+}
+
+func (s *State) commitEx(ctx context.Context, withChecksum bool) (
+	failed []*types.Request, queries []*QueryTracker, sum hash.Hash, err error,
 ) {
 	var (
 		start = time.Now()
@@ -627,6 +774,11 @@ func (s *State) CommitExWithContext(
 	// Always try to commit before the block is produced
 	s.flushSQLExecuter()
 	committed = time.Since(start)
+	if withChecksum {
+		if sum, err = s.checksum(ctx); err != nil {
+			return
+		}
+	}
 	// Return pooled items and reset
 	failed = s.pool.failedList()
 	queries = s.pool.queries
@@ -635,12 +787,27 @@ func (s *State) CommitExWithContext(
 	return
 }
 
+// Requeue puts the ready queries returned by CommitEx back to the pool, so that they're returned
+// again by the next CommitEx, followed by the queries pooled since then. Note that the writes of
+// the queries stay committed.
+func (s *State) Requeue(queries []*QueryTracker) {
+	s.Lock()
+	defer s.Unlock()
+	s.pool.prepend(queries)
+}
+
 func (s *State) flushSQLExecuter() {
 	s.commitSQLExecuter()
 	s.openSQLExecuter()
 }
 
 func (s *State) commitSQLExecuter() {
+	if s.trackApplied {
+		if _, err := s.executer.Exec(`INSERT OR REPLACE INTO "`+appliedSeqTable+
+			`" ("k", "v") VALUES (?, ?)`, appliedSeqKey, int64(s.getSeq())); err != nil {
+			log.WithError(err).Fatal("failed to record applied seq")
+		}
+	}
 	if err := s.executer.Commit(); err != nil {
 		log.WithError(err).Fatal("failed to commit")
 	}
@@ -683,6 +850,118 @@ func (s *State) QueryWithContext(
 	return
 }
 
+// ReadOnlyQueryWithContext does the read query(ies) in req through the reader pool of the
+// underlying storage. Unlike QueryWithContext, it neither opens a transaction nor acquires the
+// state lock, so it never blocks on the write path. Note that the read may fail if there is an
+// uncommitted schema change in the current block.
+func (s *State) ReadOnlyQueryWithContext(
+	ctx context.Context, req *types.Request) (ref *QueryTracker, resp *types.Response, err error,
+) {
+	if req.Header.QueryType != types.ReadQuery {
+		err = ErrInvalidRequest
+		return
+	}
+	return s.readWithContext(ctx, req)
+}
+
+// RowIterator iterates the result rows of a streaming read query incrementally. It must be
+// closed after use to release the underlying reader connection.
+type RowIterator struct {
+	ctx       context.Context
+	rows      *sql.Rows
+	columns   []string
+	declTypes []string
+	values    []interface{}
+	err       error
+}
+
+// Columns returns the column names of the result rows.
+func (i *RowIterator) Columns() []string {
+	return i.columns
+}
+
+// DeclTypes returns the declared column types of the result rows.
+func (i *RowIterator) DeclTypes() []string {
+	return i.declTypes
+}
+
+// Next prepares the next result row for reading with Values. It returns false if there is no
+// more row or an error occurs, including the cancellation of the query context, which can be
+// checked by Err.
+func (i *RowIterator) Next() bool {
+	if i.err != nil || !i.rows.Next() {
+		return false
+	}
+	var (
+		values = make([]interface{}, len(i.columns))
+		dest   = make([]interface{}, len(i.columns))
+	)
+	for j := range values {
+		dest[j] = &values[j]
+	}
+	if i.err = i.rows.Scan(dest...); i.err != nil {
+		return false
+	}
+	i.values = values
+	return true
+}
+
+// Values returns the current row. The returned slice is not reused by the later Next calls.
+func (i *RowIterator) Values() []interface{} {
+	return i.values
+}
+
+// Err returns the error encountered during the iteration, if any. The context error is returned
+// if the iteration is interrupted by the query context.
+func (i *RowIterator) Err() (err error) {
+	if err = i.err; err == nil {
+		err = i.rows.Err()
+	}
+	if err != nil && i.ctx.Err() != nil {
+		err = i.ctx.Err()
+	}
+	return
+}
+
+// Close closes the iterator.
+func (i *RowIterator) Close() error {
+	return i.rows.Close()
+}
+
+// QueryStream executes a single-query read request through the read-only path, and returns an
+// iterator which yields the result rows incrementally without materializing the full set.
+// Writes and multiple-query requests are rejected with ErrInvalidRequest.
+func (s *State) QueryStream(ctx context.Context, req *types.Request) (iter *RowIterator, err error) {
+	if req.Header.QueryType != types.ReadQuery || len(req.Payload.Queries) != 1 {
+		err = ErrInvalidRequest
+		return
+	}
+	var (
+		q       = &req.Payload.Queries[0]
+		rows    *sql.Rows
+		cols    []*sql.ColumnType
+		pattern string
+		args    []interface{}
+	)
+	if _, pattern, args, err = convertQueryAndBuildArgs(q.Pattern, q.Args); err != nil {
+		return
+	}
+	if rows, err = s.reader().QueryContext(ctx, pattern, args...); err != nil {
+		return
+	}
+	iter = &RowIterator{ctx: ctx, rows: rows}
+	if iter.columns, err = rows.Columns(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	if cols, err = rows.ColumnTypes(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	iter.declTypes = buildTypeNamesFromSQLColumnTypes(cols)
+	return
+}
+
 // Replay replays a write log from other peer to replicate storage state.
 func (s *State) Replay(req *types.Request, resp *types.Response) (err error) {
 	return s.ReplayWithContext(context.Background(), req, resp)
@@ -709,17 +988,20 @@ func (s *State) ReplayWithContext(
 	return
 }
 
+// PoolStats returns the numbers of the failed requests and the query trackers in the pool, which
+// are waiting to be packed into the next block.
+func (s *State) PoolStats() (failedRequests, queryTrackers int32) {
+	var p = func() *pool {
+		s.RLock()
+		defer s.RUnlock()
+		return s.pool
+	}()
+	return atomic.LoadInt32(&p.failedRequestCount), atomic.LoadInt32(&p.trackerCount)
+}
+
 // Stat prints the statistic message of the State object.
 func (s *State) Stat(id proto.DatabaseID) {
-	var (
-		p = func() *pool {
-			s.RLock()
-			defer s.RUnlock()
-			return s.pool
-		}()
-		fc = atomic.LoadInt32(&p.failedRequestCount)
-		tc = atomic.LoadInt32(&p.trackerCount)
-	)
+	var fc, tc = s.PoolStats()
 	log.WithFields(log.Fields{
 		"database_id":               id,
 		"pooled_fail_request_count": fc,
@@ -25,6 +25,7 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	. "github.com/smartystreets/goconvey/convey"
@@ -145,6 +146,93 @@ func TestState(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(resp.Header.RowCount, ShouldEqual, 0)
 			})
+			Convey("The state should read through the read-only path", func() {
+				_, resp, err = st1.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[0]...),
+				}), true)
+				So(err, ShouldBeNil)
+				err = st1.commit()
+				So(err, ShouldBeNil)
+				_, resp, err = st1.ReadOnlyQueryWithContext(
+					context.Background(), buildRequest(types.ReadQuery, []types.Query{
+						buildQuery(`SELECT v FROM t1 WHERE k=?`, values[0][0]),
+					}),
+				)
+				So(err, ShouldBeNil)
+				So(resp.Header.RowCount, ShouldEqual, 1)
+				So(resp.Payload.Rows[0].Values[0], ShouldResemble, values[0][1])
+				_, resp, err = st1.ReadOnlyQueryWithContext(
+					context.Background(), buildRequest(types.WriteQuery, []types.Query{
+						buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[1]...),
+					}),
+				)
+				So(err, ShouldEqual, ErrInvalidRequest)
+				So(resp, ShouldBeNil)
+			})
+			Convey("The state should stream the rows of read query", func() {
+				for i := range values {
+					_, _, err = st1.Query(buildRequest(types.WriteQuery, []types.Query{
+						buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[i]...),
+					}), true)
+					So(err, ShouldBeNil)
+				}
+				err = st1.commit()
+				So(err, ShouldBeNil)
+				iter, err := st1.QueryStream(
+					context.Background(), buildRequest(types.ReadQuery, []types.Query{
+						buildQuery(`SELECT k, v FROM t1 ORDER BY k`),
+					}),
+				)
+				So(err, ShouldBeNil)
+				So(iter.Columns(), ShouldResemble, []string{"k", "v"})
+				var count int
+				for ; iter.Next(); count++ {
+					So(iter.Values(), ShouldResemble, values[count])
+				}
+				So(iter.Err(), ShouldBeNil)
+				So(count, ShouldEqual, len(values))
+				So(iter.Close(), ShouldBeNil)
+			})
+			Convey("The streaming read should honor the context cancellation", func() {
+				for i := range values {
+					_, _, err = st1.Query(buildRequest(types.WriteQuery, []types.Query{
+						buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[i]...),
+					}), true)
+					So(err, ShouldBeNil)
+				}
+				err = st1.commit()
+				So(err, ShouldBeNil)
+				// Cross join to produce 4^8 rows
+				var ctx, cancel = context.WithCancel(context.Background())
+				iter, err := st1.QueryStream(ctx, buildRequest(types.ReadQuery, []types.Query{
+					buildQuery(`SELECT a.k FROM t1 a, t1 b, t1 c, t1 d, t1 e, t1 f, t1 g, t1 h`),
+				}))
+				So(err, ShouldBeNil)
+				defer iter.Close()
+				So(iter.Next(), ShouldBeTrue)
+				cancel()
+				// Wait for the cancellation to be propagated to the rows
+				time.Sleep(50 * time.Millisecond)
+				var count int
+				for ; iter.Next(); count++ {
+				}
+				So(count, ShouldBeLessThan, 65536-1)
+				So(iter.Err(), ShouldEqual, context.Canceled)
+			})
+			Convey("The streaming read should reject write or multiple-query request", func() {
+				_, err := st1.QueryStream(
+					context.Background(), buildRequest(types.WriteQuery, []types.Query{
+						buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[0]...),
+					}),
+				)
+				So(err, ShouldEqual, ErrInvalidRequest)
+				_, err = st1.QueryStream(
+					context.Background(), buildRequest(types.ReadQuery, []types.Query{
+						buildQuery(`SELECT 1`), buildQuery(`SELECT 2`),
+					}),
+				)
+				So(err, ShouldEqual, ErrInvalidRequest)
+			})
 			Convey("The state should report invalid request with unknown query type", func() {
 				req = buildRequest(types.QueryType(0xff), []types.Query{
 					buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, values[0]...),
@@ -897,3 +985,114 @@ func TestSerializableState(t *testing.T) {
 		})
 	})
 }
+
+func TestTrackAppliedSeq(t *testing.T) {
+	Convey("Given a state tracking its applied seq", t, func() {
+		var (
+			filePath = path.Join(testingDataDir, t.Name())
+			open     = func() (state *State, seq uint64, ok bool) {
+				storage, err := xs.NewSqlite(fmt.Sprint("file:", filePath))
+				So(err, ShouldBeNil)
+				state = NewState(sql.LevelReadUncommitted, nodeID, storage)
+				seq, ok, err = state.TrackAppliedSeq()
+				So(err, ShouldBeNil)
+				return
+			}
+			state, seq, ok = open()
+		)
+		So(ok, ShouldBeFalse)
+		So(seq, ShouldEqual, 0)
+		Reset(func() {
+			So(state.Close(false), ShouldBeNil)
+			So(os.Remove(filePath), ShouldBeNil)
+			for _, v := range []string{"-shm", "-wal"} {
+				var err = os.Remove(fmt.Sprint(filePath, v))
+				So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+			}
+		})
+		_, _, err := state.Query(buildRequest(types.WriteQuery, []types.Query{
+			buildQuery(`CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`),
+		}), true)
+		So(err, ShouldBeNil)
+		_, _, err = state.Query(buildRequest(types.WriteQuery, []types.Query{
+			buildQuery(`INSERT INTO t1 (k, v) VALUES (?, ?)`, 1, "v1"),
+		}), true)
+		So(err, ShouldBeNil)
+		Convey("The recorded seq should match the writes persisted at the last commit point", func() {
+			So(state.Close(false), ShouldBeNil)
+			state, seq, ok = open()
+			So(ok, ShouldBeTrue)
+			So(seq, ShouldEqual, 1)
+			_, resp, err := state.Query(buildRequest(types.ReadQuery, []types.Query{
+				buildQuery(`SELECT COUNT(1) FROM t1`),
+			}), true)
+			So(err, ShouldBeNil)
+			So(resp.Payload.Rows[0].Values[0], ShouldEqual, 0)
+		})
+		Convey("The recorded seq should be updated by committing", func() {
+			_, _, err = state.CommitEx()
+			So(err, ShouldBeNil)
+			So(state.Close(false), ShouldBeNil)
+			state, seq, ok = open()
+			So(ok, ShouldBeTrue)
+			So(seq, ShouldEqual, 2)
+		})
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	Convey("Given two states applying the same writes in different orders", t, func() {
+		var (
+			open = func(name string) *State {
+				var filePath = path.Join(testingDataDir, t.Name()+name)
+				storage, err := xs.NewSqlite(fmt.Sprint("file:", filePath))
+				So(err, ShouldBeNil)
+				Reset(func() {
+					for _, v := range []string{"", "-shm", "-wal"} {
+						var err = os.Remove(fmt.Sprint(filePath, v))
+						So(err == nil || os.IsNotExist(err), ShouldBeTrue)
+					}
+				})
+				return NewState(sql.LevelReadUncommitted, nodeID, storage)
+			}
+			write = func(st *State, pattern string, args ...interface{}) {
+				_, _, err := st.Query(buildRequest(types.WriteQuery, []types.Query{
+					buildQuery(pattern, args...),
+				}), true)
+				So(err, ShouldBeNil)
+			}
+			st1 = open("-1")
+			st2 = open("-2")
+		)
+		Reset(func() {
+			So(st1.Close(false), ShouldBeNil)
+			So(st2.Close(false), ShouldBeNil)
+		})
+		// Only st2 records its applied seq, which is never covered by the checksum
+		_, _, err := st2.TrackAppliedSeq()
+		So(err, ShouldBeNil)
+		for _, st := range []*State{st1, st2} {
+			write(st, `CREATE TABLE t1 (k INT, v TEXT, PRIMARY KEY(k))`)
+		}
+		write(st1, `INSERT INTO t1 (k, v) VALUES (?, ?)`, 1, "v1")
+		write(st1, `INSERT INTO t1 (k, v) VALUES (?, ?)`, 2, 2.5)
+		write(st2, `INSERT INTO t1 (k, v) VALUES (?, ?)`, 2, 2.5)
+		write(st2, `INSERT INTO t1 (k, v) VALUES (?, ?)`, 1, "v1")
+		sum1, err := st1.Checksum(context.Background())
+		So(err, ShouldBeNil)
+		Convey("The checksums should be equal", func() {
+			_, _, sum2, err := st2.CommitExWithChecksum(context.Background())
+			So(err, ShouldBeNil)
+			So(sum2, ShouldResemble, sum1)
+			sum, err := st2.Checksum(context.Background())
+			So(err, ShouldBeNil)
+			So(sum, ShouldResemble, sum2)
+		})
+		Convey("The checksums should differ once the states diverge", func() {
+			write(st2, `UPDATE t1 SET v=? WHERE k=?`, "v2", 1)
+			sum2, err := st2.Checksum(context.Background())
+			So(err, ShouldBeNil)
+			So(sum2, ShouldNotResemble, sum1)
+		})
+	})
+}